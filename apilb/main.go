@@ -28,19 +28,16 @@ SOFTWARE.
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	oa "github.com/ossrs/go-oryx-lib/asprocess"
 	oh "github.com/ossrs/go-oryx-lib/http"
-	oj "github.com/ossrs/go-oryx-lib/json"
 	ol "github.com/ossrs/go-oryx-lib/logger"
 	oo "github.com/ossrs/go-oryx-lib/options"
 	"github.com/ossrs/go-oryx/kernel"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"os"
 	"strconv"
 	"strings"
 	"syscall"
@@ -64,15 +61,7 @@ func (v *ApiLbConfig) String() string {
 }
 
 func (v *ApiLbConfig) Loads(c string) (err error) {
-	var f *os.File
-	if f, err = os.Open(c); err != nil {
-		ol.E(nil, "Open config failed, err is", err)
-		return
-	}
-	defer f.Close()
-
-	r := json.NewDecoder(oj.NewJsonPlusReader(f))
-	if err = r.Decode(v); err != nil {
+	if err = kernel.DecodeConfig(c, v); err != nil {
 		ol.E(nil, "Decode config failed, err is", err)
 		return
 	}
@@ -90,6 +79,10 @@ func (v *ApiLbConfig) Loads(c string) (err error) {
 		return fmt.Errorf("Empty backend api")
 	}
 
+	if err = v.Config.CheckProfile(); err != nil {
+		return
+	}
+
 	return
 }
 
@@ -195,7 +188,7 @@ func main() {
 	if conf.Backend.Enabled {
 		addrs := strings.Split(conf.Backend.Api, "://")
 		backendNetwork, backendAddr = addrs[0], addrs[1]
-		if backendListener, err = net.Listen(backendNetwork, backendAddr); err != nil {
+		if backendListener, err = kernel.SdListen(conf.Backend.Api); err != nil {
 			ol.E(ctx, "backend api listen failed, err is", err)
 			return
 		}
@@ -204,13 +197,19 @@ func main() {
 
 	var apiListener net.Listener
 	addrs := strings.Split(conf.Api, "://")
-	apiNetwork, apiAddr := addrs[0], addrs[1]
-	if apiListener, err = net.Listen(apiNetwork, apiAddr); err != nil {
+	apiAddr := addrs[1]
+	if apiListener, err = kernel.SdListen(conf.Api); err != nil {
 		ol.E(ctx, "api listen failed, err is", err)
 		return
 	}
 	defer apiListener.Close()
 
+	// drop root after listen, before serve.
+	if err = conf.DropPrivileges(kernel.DefaultPrivilegeDropper); err != nil {
+		ol.E(ctx, "drop privileges failed, err is", err)
+		return
+	}
+
 	proxy := NewProxy(conf)
 	oh.Server = signature
 
@@ -266,6 +265,8 @@ func main() {
 			oh.WriteData(ctx, w, r, nil)
 		})
 
+		kernel.HandleProfile(ctx, handler, &conf.Profile)
+
 		server := &http.Server{Addr: apiAddr, Handler: handler}
 		if err = server.Serve(apiListener); err != nil {
 			ol.E(ctx, "api serve failed, err is", err)
@@ -275,6 +276,10 @@ func main() {
 		apiListener.Close()
 	})
 
+	// notify systemd when serving, and ping the watchdog.
+	kernel.SdNotifyReady(ctx, wg)
+
 	wg.Wait()
+	kernel.SdNotifyStopping(ctx)
 	return
 }
@@ -0,0 +1,262 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the access log of httplb, a line for each proxied request for analytics.
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx/kernel"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The access log of httplb, written to its own file.
+type HttpAccess struct {
+	// The file to write access log, empty to disable.
+	File string `json:"file"`
+	// The format of line, combined or json, empty to use combined.
+	Format string `json:"format"`
+	// The rotate of file, disabled when size and interval are 0.
+	Rotate kernel.LogRotate `json:"rotate"`
+}
+
+const (
+	// the apache combined format, with the duration, backend and session appended.
+	AccessFormatCombined = "combined"
+	// a json object each line.
+	AccessFormatJson = "json"
+)
+
+func (v *HttpAccess) format() string {
+	if len(v.Format) == 0 {
+		return AccessFormatCombined
+	}
+	return v.Format
+}
+
+func (v *HttpAccess) String() string {
+	return fmt.Sprintf("file=%v,format=%v,rotate=(%v)", v.File, v.format(), &v.Rotate)
+}
+
+func (v *HttpAccess) Check() error {
+	if f := v.format(); f != AccessFormatCombined && f != AccessFormatJson {
+		return fmt.Errorf("format=%v should be combined or json", f)
+	}
+	if c := &v.Rotate; c.Size < 0 || c.Interval < 0 || c.Keep < 0 {
+		return fmt.Errorf("rotate size=%v, interval=%v, keep=%v should not be negative", c.Size, c.Interval, c.Keep)
+	}
+	return nil
+}
+
+// The access of a proxied request, the fields of json format.
+type AccessEntry struct {
+	Time   string `json:"time"`
+	Client string `json:"client"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Query  string `json:"query,omitempty"`
+	Proto  string `json:"proto"`
+	Status int    `json:"status"`
+	Bytes  int64  `json:"bytes"`
+	// the duration in ms.
+	Duration float64 `json:"duration"`
+	// the backend host:port, empty when served by httplb.
+	Backend string `json:"backend"`
+	// the hls+ session id, the uuid or xpsid.
+	Session   string `json:"session"`
+	Referer   string `json:"referer"`
+	UserAgent string `json:"user_agent"`
+}
+
+// The key of access entry in the context of request.
+type accessKey struct{}
+
+// Set the backend of request, ignored when access log disabled.
+func setAccessBackend(r *http.Request, backend string) {
+	if e, ok := r.Context().Value(accessKey{}).(*accessWriter); ok {
+		e.lock.Lock()
+		e.backend = backend
+		e.lock.Unlock()
+	}
+}
+
+// Set the hls+ session of request, ignored when access log disabled.
+func setAccessSession(r *http.Request, session string) {
+	if e, ok := r.Context().Value(accessKey{}).(*accessWriter); ok {
+		e.lock.Lock()
+		e.session = session
+		e.lock.Unlock()
+	}
+}
+
+// The access log, nil when disabled.
+type accessLog struct {
+	format string
+	lock   *sync.Mutex
+	w      io.WriteCloser
+}
+
+// Open the access log, nil when disabled.
+func NewAccessLog(c *HttpAccess) (v *accessLog, err error) {
+	if len(c.File) == 0 {
+		return nil, nil
+	}
+
+	v = &accessLog{format: c.format(), lock: &sync.Mutex{}}
+	if v.w, err = kernel.NewRotateWriter(c.File, c.Rotate); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (v *accessLog) Close() error {
+	if v == nil {
+		return nil
+	}
+	return v.w.Close()
+}
+
+// Wrap the writer to account the status and bytes, and the request to carry the backend.
+// @remark user should call done when request served.
+func (v *accessLog) wrap(w http.ResponseWriter, r *http.Request) (*accessWriter, *http.Request) {
+	aw := &accessWriter{ResponseWriter: w, start: time.Now(), lock: &sync.Mutex{}}
+	return aw, r.WithContext(context.WithValue(r.Context(), accessKey{}, aw))
+}
+
+// Write the access of request when served.
+func (v *accessLog) done(aw *accessWriter, r *http.Request) {
+	e := aw.entry(r)
+
+	var line []byte
+	if v.format == AccessFormatJson {
+		line, _ = json.Marshal(e)
+	} else {
+		line = []byte(e.combined())
+	}
+	line = append(line, '\n')
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.w.Write(line)
+}
+
+// The combined format, for example,
+//
+//	127.0.0.1 - - [10/Oct/2016:13:55:36 +0800] "GET /live/livestream.m3u8 HTTP/1.1" 200 2326 "-" "Safari" 1.024 127.0.0.1:8081 7cc7e6e8
+func (v *AccessEntry) combined() string {
+	uri := v.Path
+	if len(v.Query) > 0 {
+		uri = fmt.Sprintf("%v?%v", uri, v.Query)
+	}
+	dash := func(s string) string {
+		if len(s) == 0 {
+			return "-"
+		}
+		return s
+	}
+	return fmt.Sprintf("%v - - [%v] %q %v %v %q %q %.3f %v %v",
+		v.Client, v.Time, fmt.Sprintf("%v %v %v", v.Method, uri, v.Proto), v.Status, v.Bytes,
+		dash(v.Referer), dash(v.UserAgent), v.Duration, dash(v.Backend), dash(v.Session))
+}
+
+// The writer to account the status and bytes of response.
+type accessWriter struct {
+	http.ResponseWriter
+	start time.Time
+	// the status and bytes written.
+	status int
+	bytes  int64
+	// the backend and session, set by proxy, protected by lock.
+	lock    *sync.Mutex
+	backend string
+	session string
+}
+
+func (v *accessWriter) WriteHeader(code int) {
+	if v.status == 0 {
+		v.status = code
+	}
+	v.ResponseWriter.WriteHeader(code)
+}
+
+func (v *accessWriter) Write(p []byte) (n int, err error) {
+	if v.status == 0 {
+		v.status = http.StatusOK
+	}
+	n, err = v.ResponseWriter.Write(p)
+	v.bytes += int64(n)
+	return
+}
+
+// For the http stream, flush each packet.
+func (v *accessWriter) Flush() {
+	if f, ok := v.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// For the websocket, the bytes after hijack are not accounted.
+func (v *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := v.ResponseWriter.(http.Hijacker); ok {
+		if v.status == 0 {
+			v.status = http.StatusSwitchingProtocols
+		}
+		return hj.Hijack()
+	}
+	return nil, nil, fmt.Errorf("hijack not supported")
+}
+
+// The access entry of request, when served.
+func (v *accessWriter) entry(r *http.Request) *AccessEntry {
+	client := r.RemoteAddr
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		client = ip
+	}
+
+	e := &AccessEntry{
+		Time: v.start.Format("02/Jan/2006:15:04:05 -0700"), Client: client,
+		Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Proto: r.Proto,
+		Status: v.status, Bytes: v.bytes,
+		Duration: float64(time.Now().Sub(v.start)) / float64(time.Millisecond),
+		Referer:  r.Referer(), UserAgent: r.UserAgent(),
+	}
+	// the client closed before any response.
+	if e.Status == 0 {
+		e.Status = http.StatusOK
+	}
+
+	v.lock.Lock()
+	e.Backend, e.Session = v.backend, v.session
+	v.lock.Unlock()
+	return e
+}
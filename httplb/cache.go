@@ -0,0 +1,199 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the LRU cache for hls+, serve the hot m3u8 and ts from memory.
+*/
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The cached response of backend.
+type cacheEntry struct {
+	key    string
+	header http.Header
+	body   []byte
+	expire time.Time
+	elem   *list.Element
+}
+
+// The LRU cache with ttl for each entry, and max size in bytes for all bodies.
+type hlsCache struct {
+	maxSize int64
+	size    int64
+	// the front is the most recently used.
+	lru     *list.List
+	entries map[string]*cacheEntry
+	// the requests to backend in flight, the others wait for it.
+	flights map[string]chan bool
+	lock    *sync.Mutex
+}
+
+func NewHlsCache(maxSize int64) *hlsCache {
+	return &hlsCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*cacheEntry),
+		flights: make(map[string]chan bool),
+		lock:    &sync.Mutex{},
+	}
+}
+
+// Get the entry not expired, nil if not found.
+// @remark user must hold the lock.
+func (v *hlsCache) get(key string, now time.Time) *cacheEntry {
+	e, ok := v.entries[key]
+	if !ok {
+		return nil
+	}
+
+	if now.After(e.expire) {
+		v.remove(e)
+		return nil
+	}
+
+	v.lru.MoveToFront(e.elem)
+	return e
+}
+
+// Put the entry, evict the least recently used when exceed max size.
+// @remark user must hold the lock.
+func (v *hlsCache) put(key string, header http.Header, body []byte, expire time.Time) {
+	if int64(len(body)) > v.maxSize {
+		return
+	}
+
+	if e, ok := v.entries[key]; ok {
+		v.remove(e)
+	}
+	for v.size+int64(len(body)) > v.maxSize {
+		v.remove(v.lru.Back().Value.(*cacheEntry))
+	}
+
+	e := &cacheEntry{key: key, header: header, body: body, expire: expire}
+	e.elem = v.lru.PushFront(e)
+	v.entries[key] = e
+	v.size += int64(len(body))
+}
+
+// @remark user must hold the lock.
+func (v *hlsCache) remove(e *cacheEntry) {
+	v.lru.Remove(e.elem)
+	delete(v.entries, e.key)
+	v.size -= int64(len(e.body))
+}
+
+// Serve from cache, or fetch from backend and cache the ok response for ttl.
+// @remark the concurrent requests for the same key wait for the first one.
+func (v *hlsCache) serve(w http.ResponseWriter, r *http.Request, key string, ttl time.Duration, fetch http.HandlerFunc) {
+	for waited := false; ; waited = true {
+		v.lock.Lock()
+		if e := v.get(key, time.Now()); e != nil {
+			v.lock.Unlock()
+
+			for k, vs := range e.header {
+				w.Header()[k] = vs
+			}
+			w.Header().Set("X-Cache", "HIT")
+			w.Write(e.body)
+			return
+		}
+
+		// the previous request failed, fetch without cache.
+		if waited {
+			v.lock.Unlock()
+			fetch(w, r)
+			return
+		}
+
+		if flight, ok := v.flights[key]; ok {
+			v.lock.Unlock()
+			<-flight
+			continue
+		}
+
+		flight := make(chan bool)
+		v.flights[key] = flight
+		v.lock.Unlock()
+
+		w.Header().Set("X-Cache", "MISS")
+		rec := &cacheRecorder{ResponseWriter: w, status: http.StatusOK, max: v.maxSize}
+		fetch(rec, r)
+
+		v.lock.Lock()
+		if rec.status == http.StatusOK && !rec.overflow {
+			// the CORS headers depend on the origin of request, never cache them.
+			header := make(http.Header)
+			for k, vs := range w.Header() {
+				if k != "Vary" && !strings.HasPrefix(k, "Access-Control-") {
+					header[k] = vs
+				}
+			}
+			header.Del("X-Cache")
+			v.put(key, header, rec.body, time.Now().Add(ttl))
+		}
+		delete(v.flights, key)
+		close(flight)
+		v.lock.Unlock()
+		return
+	}
+}
+
+// The writer to record the response to cache.
+type cacheRecorder struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+	// the body exceed max is never cached.
+	max      int64
+	overflow bool
+}
+
+func (v *cacheRecorder) WriteHeader(status int) {
+	v.status = status
+	v.ResponseWriter.WriteHeader(status)
+}
+
+func (v *cacheRecorder) Write(p []byte) (n int, err error) {
+	if !v.overflow {
+		if int64(len(v.body)+len(p)) > v.max {
+			v.overflow, v.body = true, nil
+		} else {
+			v.body = append(v.body, p...)
+		}
+	}
+	return v.ResponseWriter.Write(p)
+}
+
+func (v *cacheRecorder) Flush() {
+	if f, ok := v.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,195 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the CORS of httplb, for the players in browser of other origins.
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/ossrs/go-oryx/kernel"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The CORS policy for all proxied responses.
+type HttpCors struct {
+	// The allowed origins, for example, https://player.example.com, * for any, empty to disable.
+	Origins []string `json:"origins"`
+	// The allowed methods for preflight, empty to use default.
+	Methods []string `json:"methods"`
+	// The allowed request headers for preflight, empty to allow the requested headers.
+	Headers []string `json:"headers"`
+	// The max age in ms to cache the preflight, 0 to not set it.
+	MaxAge kernel.Duration `json:"max_age"`
+}
+
+func (v *HttpCors) String() string {
+	return fmt.Sprintf("origins=%v,methods=%v,headers=%v,max_age=%v", v.Origins, v.Methods, v.Headers, v.MaxAge)
+}
+
+func (v *HttpCors) Check() error {
+	for _, o := range v.Origins {
+		if o != "*" && !strings.HasPrefix(o, "http://") && !strings.HasPrefix(o, "https://") {
+			return fmt.Errorf("origin %v should be * or start with http:// or https://", o)
+		}
+	}
+	if v.MaxAge < 0 {
+		return fmt.Errorf("max_age=%v should not be negative", v.MaxAge)
+	}
+	return nil
+}
+
+// The default methods allowed for preflight.
+var defaultCorsMethods = []string{"GET", "HEAD", "OPTIONS"}
+
+// The CORS policy to set the headers of response, and response the preflight.
+type corsPolicy struct {
+	any     bool
+	origins map[string]bool
+	methods string
+	headers string
+	// the max age in seconds, empty to not set.
+	maxAge string
+}
+
+// Create the policy, nil when disabled.
+func NewCorsPolicy(c *HttpCors) *corsPolicy {
+	if len(c.Origins) == 0 {
+		return nil
+	}
+
+	v := &corsPolicy{origins: make(map[string]bool)}
+	for _, o := range c.Origins {
+		if o == "*" {
+			v.any = true
+		}
+		v.origins[strings.TrimSuffix(o, "/")] = true
+	}
+
+	methods := c.Methods
+	if len(methods) == 0 {
+		methods = defaultCorsMethods
+	}
+	v.methods = strings.Join(methods, ", ")
+	v.headers = strings.Join(c.Headers, ", ")
+	if c.MaxAge > 0 {
+		v.maxAge = strconv.Itoa(int(c.MaxAge+999) / 1000)
+	}
+	return v
+}
+
+// Whether allow the origin, the request without origin is not CORS.
+func (v *corsPolicy) allowed(origin string) bool {
+	return len(origin) > 0 && (v.any || v.origins[origin])
+}
+
+// Set the headers for the allowed origin, override the headers of backend.
+func (v *corsPolicy) setHeader(h http.Header, origin string) {
+	if v.any {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+	}
+}
+
+// Response the preflight, never forward it to backend.
+// @return true when the request is preflight.
+func (v *corsPolicy) preflight(w http.ResponseWriter, r *http.Request) bool {
+	origin, method := r.Header.Get("Origin"), r.Header.Get("Access-Control-Request-Method")
+	if r.Method != "OPTIONS" || len(origin) == 0 || len(method) == 0 {
+		return false
+	}
+
+	if !v.allowed(origin) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return true
+	}
+
+	h := w.Header()
+	v.setHeader(h, origin)
+	h.Set("Access-Control-Allow-Methods", v.methods)
+	if headers := v.headers; len(headers) > 0 {
+		h.Set("Access-Control-Allow-Headers", headers)
+	} else if headers = r.Header.Get("Access-Control-Request-Headers"); len(headers) > 0 {
+		h.Set("Access-Control-Allow-Headers", headers)
+	}
+	if len(v.maxAge) > 0 {
+		h.Set("Access-Control-Max-Age", v.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// The writer to set the CORS headers for the allowed origin, or w when not allowed.
+func (v *corsPolicy) wrap(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if origin := r.Header.Get("Origin"); v.allowed(origin) {
+		return &corsWriter{ResponseWriter: w, policy: v, origin: origin}
+	}
+	return w
+}
+
+// The writer to set the CORS headers before the response header is written.
+type corsWriter struct {
+	http.ResponseWriter
+	policy *corsPolicy
+	origin string
+	// whether the header is written.
+	written bool
+}
+
+func (v *corsWriter) WriteHeader(code int) {
+	if !v.written {
+		v.written = true
+		v.policy.setHeader(v.Header(), v.origin)
+	}
+	v.ResponseWriter.WriteHeader(code)
+}
+
+func (v *corsWriter) Write(p []byte) (int, error) {
+	if !v.written {
+		v.WriteHeader(http.StatusOK)
+	}
+	return v.ResponseWriter.Write(p)
+}
+
+// For the http stream, flush each packet.
+func (v *corsWriter) Flush() {
+	if f, ok := v.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// For the websocket, the CORS is checked by backend.
+func (v *corsWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := v.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, fmt.Errorf("hijack not supported")
+}
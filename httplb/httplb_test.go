@@ -25,9 +25,24 @@ SOFTWARE.
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx/kernel"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestHlsPlusProxy(t *testing.T) {
@@ -86,3 +101,754 @@ func TestHlsPlusProxy(t *testing.T) {
 		t.Error("invalid conn")
 	}
 }
+
+func TestHlsPlusProxy_Sessions(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#EXTM3U"))
+	}))
+	defer backend.Close()
+
+	proxy := NewProxy(nil)
+	u, _ := url.Parse(backend.URL)
+	r, _ := http.NewRequest("GET", "/api/v1/proxy?http="+u.Port(), nil)
+	if msg, err := proxy.serveChangeBackendApi(&kernel.Context{}, r); err != Success {
+		t.Fatal("failed, err is", err, msg)
+	}
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		proxy.serveHttp(w, httptest.NewRequest("GET", "/live/livestream.m3u8?shp_uuid=abc", nil))
+	}
+
+	ss := proxy.hlsPlus.Sessions()
+	if len(ss) != 1 || ss[0].Uuid != "abc" || ss[0].Bytes != 14 || ss[0].Port != proxy.pickBackend("abc") {
+		t.Fatalf("invalid sessions %v", ss)
+	}
+
+	r, _ = http.NewRequest("DELETE", "/api/v1/sessions?uuid=abc", nil)
+	if msg, err := proxy.serveKickSessionApi(&kernel.Context{}, r); err != Success {
+		t.Error("kick failed, err is", err, msg)
+	}
+	if ss = proxy.hlsPlus.Sessions(); len(ss) != 0 {
+		t.Errorf("invalid sessions %v", ss)
+	}
+	if _, err := proxy.serveKickSessionApi(&kernel.Context{}, r); err != ApiSessionQuery {
+		t.Error("should fail for session not found")
+	}
+}
+
+func TestProxy_PickBackend(t *testing.T) {
+	ctx := &kernel.Context{}
+	proxy := NewProxy(nil)
+	if port := proxy.pickBackend("/live/livestream"); port != 0 {
+		t.Errorf("invalid port=%v", port)
+	}
+
+	r, _ := http.NewRequest("GET", "/api/v1/proxy?http=8081,8082", nil)
+	if msg, err := proxy.serveChangeBackendApi(ctx, r); err != Success {
+		t.Error("failed, err is", err, msg)
+	}
+	port := proxy.pickBackend("/live/livestream")
+	if port != 8081 && port != 8082 {
+		t.Errorf("invalid port=%v", port)
+	}
+	for i := 0; i < 3; i++ {
+		if p := proxy.pickBackend("/live/livestream"); p != port {
+			t.Errorf("%v: invalid port=%v, expect %v", i, p, port)
+		}
+	}
+
+	r, _ = http.NewRequest("GET", "/api/v1/proxy?http=8083", nil)
+	if msg, err := proxy.serveChangeBackendApi(ctx, r); err != Success {
+		t.Error("failed, err is", err, msg)
+	}
+	if port := proxy.pickBackend("/live/livestream"); port != 8083 {
+		t.Errorf("invalid port=%v", port)
+	}
+	if len(proxy.ports) != 3 {
+		t.Errorf("invalid ports=%v", proxy.ports)
+	}
+
+	r, _ = http.NewRequest("GET", "/api/v1/proxy?http=8084,x", nil)
+	if _, err := proxy.serveChangeBackendApi(ctx, r); err != ApiProxyQuery {
+		t.Errorf("should failed, err is %v", err)
+	}
+}
+
+func TestProxy_Https(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-Proto")))
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	proxy := NewProxy(nil)
+	r, _ := http.NewRequest("GET", "/api/v1/proxy?http="+u.Port(), nil)
+	if msg, err := proxy.serveChangeBackendApi(&kernel.Context{}, r); err != Success {
+		t.Fatal("failed, err is", err, msg)
+	}
+
+	frontend := httptest.NewUnstartedServer(http.HandlerFunc(proxy.serveHttp))
+	frontend.EnableHTTP2 = true
+	frontend.StartTLS()
+	defer frontend.Close()
+
+	res, err := frontend.Client().Get(frontend.URL + "/live/livestream.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ProtoMajor != 2 || string(b) != "https" {
+		t.Errorf("invalid proto=%v, body=%v", res.Proto, string(b))
+	}
+}
+
+func TestProxy_WebSocket(t *testing.T) {
+	// the backend upgrade to websocket then echo.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocket(r) || r.Header.Get("X-Real-IP") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		c, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		c.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+		io.Copy(c, brw)
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	proxy := NewProxy(nil)
+	r, _ := http.NewRequest("GET", "/api/v1/proxy?http="+u.Port(), nil)
+	if msg, err := proxy.serveChangeBackendApi(&kernel.Context{}, r); err != Success {
+		t.Fatal("failed, err is", err, msg)
+	}
+
+	frontend := httptest.NewServer(http.HandlerFunc(proxy.serveHttp))
+	defer frontend.Close()
+
+	u, _ = url.Parse(frontend.URL)
+	c, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+
+	c.Write([]byte("GET /live/livestream.flv HTTP/1.1\r\nHost: " + u.Host +
+		"\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n\r\nhello"))
+
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("invalid status %v", res.Status)
+	}
+
+	b := make([]byte, 5)
+	if _, err = io.ReadFull(br, b); err != nil || string(b) != "hello" {
+		t.Errorf("invalid echo %v, err is %v", string(b), err)
+	}
+}
+
+func TestHashRing(t *testing.T) {
+	if port := NewHashRing(nil).get("/live/livestream"); port != 0 {
+		t.Errorf("invalid port=%v", port)
+	}
+
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, fmt.Sprintf("/live/livestream%v", i))
+	}
+
+	// the keys are balanced to all backends.
+	ring := NewHashRing([]int{8081, 8082, 8083})
+	counts := make(map[int]int)
+	for _, key := range keys {
+		counts[ring.get(key)]++
+	}
+	for _, port := range []int{8081, 8082, 8083} {
+		if counts[port] < 200 {
+			t.Errorf("unbalanced port=%v, counts=%v", port, counts)
+		}
+	}
+
+	var total float64
+	for _, share := range ring.shares() {
+		total += share
+	}
+	if total < 99.99 || total > 100.01 {
+		t.Errorf("invalid shares=%v", ring.shares())
+	}
+
+	// only the keys of removed backend are remapped.
+	removed := NewHashRing([]int{8081, 8083})
+	for _, key := range keys {
+		if prev, port := ring.get(key), removed.get(key); prev != 8082 && prev != port {
+			t.Errorf("key=%v remapped from %v to %v", key, prev, port)
+		}
+	}
+
+	// only the keys to added backend are remapped.
+	added := NewHashRing([]int{8081, 8082, 8083, 8084})
+	for _, key := range keys {
+		if prev, port := ring.get(key), added.get(key); port != 8084 && prev != port {
+			t.Errorf("key=%v remapped from %v to %v", key, prev, port)
+		}
+	}
+}
+
+func TestHlsCache(t *testing.T) {
+	var fetches int32
+	fetch := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Write([]byte(r.URL.Path))
+	}
+	get := func(c *hlsCache, p string, ttl time.Duration) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", p, nil)
+		c.serve(w, r, p, ttl, fetch)
+		return w
+	}
+
+	// the concurrent requests fetch once.
+	c := NewHlsCache(16)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := get(c, "/a-0.ts", time.Minute); w.Body.String() != "/a-0.ts" || w.Header().Get("Content-Type") != "video/mp2t" {
+				t.Errorf("invalid response %v, header %v", w.Body.String(), w.Header())
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("invalid fetches=%v", n)
+	}
+	if w := get(c, "/a-0.ts", time.Minute); w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("should hit, header %v", w.Header())
+	}
+
+	// evict the least recently used when exceed max size.
+	get(c, "/b-0.ts", time.Minute)
+	get(c, "/a-0.ts", time.Minute)
+	get(c, "/c-0.ts", time.Minute)
+	if _, ok := c.entries["/b-0.ts"]; ok || c.size != 14 || len(c.entries) != 2 {
+		t.Errorf("invalid entries=%v, size=%v", c.entries, c.size)
+	}
+
+	// the body exceed max size is never cached.
+	if w := get(c, "/too-large-stream-0.ts", time.Minute); w.Body.String() != "/too-large-stream-0.ts" || len(c.entries) != 2 {
+		t.Errorf("invalid response %v, entries=%v", w.Body.String(), c.entries)
+	}
+
+	// the expired entry is fetched again.
+	atomic.StoreInt32(&fetches, 0)
+	get(c, "/a.m3u8", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if w := get(c, "/a.m3u8", time.Millisecond); w.Header().Get("X-Cache") != "MISS" || atomic.LoadInt32(&fetches) != 2 {
+		t.Errorf("should miss, header %v, fetches=%v", w.Header(), fetches)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(2, 100)
+	for i := 0; i < 2; i++ {
+		if !l.allowRequest("a") {
+			t.Errorf("request %v should be allowed", i)
+		}
+	}
+	if l.allowRequest("a") {
+		t.Error("should limit the third request")
+	}
+	if !l.allowRequest("b") {
+		t.Error("should allow other key")
+	}
+
+	if !l.allowBytes("a") {
+		t.Error("should allow bytes")
+	}
+	l.consume("a", 200)
+	if l.allowBytes("a") {
+		t.Error("should limit bytes")
+	}
+
+	// refill the tokens after a while.
+	l.buckets["a"].bytes.last = time.Now().Add(-2 * time.Second)
+	if !l.allowBytes("a") {
+		t.Error("should allow bytes after refill")
+	}
+
+	l.buckets["b"].last = time.Now().Add(-2 * limitIdleTimeout)
+	if l.cleanup(limitIdleTimeout); len(l.buckets) != 1 {
+		t.Errorf("invalid buckets %v", len(l.buckets))
+	}
+
+	if l = NewRateLimiter(0, 0); !l.allowRequest("a") || !l.allowBytes("a") {
+		t.Error("should allow all when disabled")
+	}
+}
+
+func TestProxy_Limit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 4096))
+	}))
+	defer backend.Close()
+
+	conf := &HttpLbConfig{}
+	conf.Http.Limit.Client.Requests, conf.Http.Limit.Stream.Bytes = 1, 1024
+	proxy := NewProxy(conf)
+
+	u, _ := url.Parse(backend.URL)
+	r, _ := http.NewRequest("GET", "/api/v1/proxy?http="+u.Port(), nil)
+	if msg, err := proxy.serveChangeBackendApi(&kernel.Context{}, r); err != Success {
+		t.Fatal("failed, err is", err, msg)
+	}
+
+	get := func(p string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", p, nil)
+		proxy.serveHttp(w, r)
+		return w.Code
+	}
+
+	if code := get("/live/livestream.m3u8"); code != http.StatusOK {
+		t.Errorf("invalid code %v", code)
+	}
+	if code := get("/live/livestream.m3u8"); code != http.StatusTooManyRequests {
+		t.Errorf("should limit m3u8, code is %v", code)
+	}
+
+	// the segments of the same stream share the bytes limit.
+	if code := get("/live/livestream-1.ts"); code != http.StatusOK {
+		t.Errorf("invalid code %v", code)
+	}
+	if code := get("/live/livestream-2.ts"); code != http.StatusTooManyRequests {
+		t.Errorf("should limit ts, code is %v", code)
+	}
+	if code := get("/live/other-1.ts"); code != http.StatusOK {
+		t.Errorf("invalid code %v", code)
+	}
+}
+
+func TestProxy_Cors(t *testing.T) {
+	var options int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			atomic.AddInt32(&options, 1)
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write([]byte("#EXTM3U"))
+	}))
+	defer backend.Close()
+
+	conf := &HttpLbConfig{}
+	conf.Http.Cors = HttpCors{Origins: []string{"https://a.com"}, MaxAge: 1500}
+	conf.Http.Cache.MaxSize = 1
+	proxy := NewProxy(conf)
+
+	u, _ := url.Parse(backend.URL)
+	r, _ := http.NewRequest("GET", "/api/v1/proxy?http="+u.Port(), nil)
+	if msg, err := proxy.serveChangeBackendApi(&kernel.Context{}, r); err != Success {
+		t.Fatal("failed, err is", err, msg)
+	}
+
+	do := func(method, origin string, h http.Header) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/live/livestream.m3u8", nil)
+		for k, vs := range h {
+			r.Header[k] = vs
+		}
+		r.Header.Set("Origin", origin)
+		proxy.serveHttp(w, r)
+		return w
+	}
+
+	// the preflight is responsed by httplb.
+	w := do("OPTIONS", "https://a.com", http.Header{
+		"Access-Control-Request-Method": []string{"GET"}, "Access-Control-Request-Headers": []string{"Range"},
+	})
+	if h := w.Header(); w.Code != http.StatusNoContent || h.Get("Access-Control-Allow-Origin") != "https://a.com" ||
+		h.Get("Access-Control-Allow-Methods") != "GET, HEAD, OPTIONS" || h.Get("Access-Control-Allow-Headers") != "Range" ||
+		h.Get("Access-Control-Max-Age") != "2" {
+		t.Errorf("invalid preflight %v %v", w.Code, h)
+	}
+	if w = do("OPTIONS", "https://b.com", http.Header{"Access-Control-Request-Method": []string{"GET"}}); w.Code != http.StatusForbidden {
+		t.Errorf("should reject preflight, code is %v", w.Code)
+	}
+	if n := atomic.LoadInt32(&options); n != 0 {
+		t.Errorf("should not forward preflight, n=%v", n)
+	}
+
+	// the headers of backend is override.
+	w = do("GET", "https://a.com", nil)
+	if vs := w.Header()["Access-Control-Allow-Origin"]; w.Code != http.StatusOK || len(vs) != 1 || vs[0] != "https://a.com" {
+		t.Errorf("invalid response %v %v", w.Code, w.Header())
+	}
+
+	// the cached response never replay the CORS headers of other origin.
+	if w = do("GET", "", nil); w.Header().Get("X-Cache") != "HIT" || len(w.Header()["Access-Control-Allow-Origin"]) != 0 {
+		t.Errorf("invalid response %v %v", w.Code, w.Header())
+	}
+	w = do("GET", "https://a.com", nil)
+	if h := w.Header(); h.Get("X-Cache") != "HIT" || h.Get("Access-Control-Allow-Origin") != "https://a.com" || len(h["Vary"]) != 1 {
+		t.Errorf("invalid response %v %v", w.Code, w.Header())
+	}
+
+	c := &HttpCors{Origins: []string{"a.com"}}
+	if err := c.Check(); err == nil {
+		t.Error("should fail for origin without scheme")
+	}
+}
+
+func TestProxy_Access(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#EXTM3U"))
+	}))
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "httplb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, format := range []string{"combined", "json"} {
+		f := path.Join(dir, format+".log")
+		access, err := NewAccessLog(&HttpAccess{File: f, Format: format})
+		if err != nil {
+			t.Fatal("open access failed, err is", err)
+		}
+
+		proxy := NewProxy(&HttpLbConfig{})
+		proxy.access = access
+
+		u, _ := url.Parse(backend.URL)
+		r, _ := http.NewRequest("GET", "/api/v1/proxy?http="+u.Port(), nil)
+		if msg, err := proxy.serveChangeBackendApi(&kernel.Context{}, r); err != Success {
+			t.Fatal("failed, err is", err, msg)
+		}
+
+		for _, p := range []string{"/live/livestream.m3u8?shp_uuid=7cc7e6e8", "/live/livestream.mp4"} {
+			r := httptest.NewRequest("GET", p, nil)
+			r.RemoteAddr = "10.0.0.1:1935"
+			proxy.serveHttp(httptest.NewRecorder(), r)
+		}
+		access.Close()
+
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("invalid %v lines %v", format, lines)
+		}
+
+		if format == "combined" {
+			if l := lines[0]; !strings.HasPrefix(l, "10.0.0.1 - - [") || !strings.Contains(l, `"GET /live/livestream.m3u8?shp_uuid=7cc7e6e8 HTTP/1.1" 200 7 "-" "-"`) ||
+				!strings.HasSuffix(l, fmt.Sprintf(" 127.0.0.1:%v 7cc7e6e8", u.Port())) {
+				t.Errorf("invalid line %v", l)
+			}
+			if l := lines[1]; !strings.Contains(l, `"GET /live/livestream.mp4 HTTP/1.1" 404 `) || !strings.HasSuffix(l, " - -") {
+				t.Errorf("invalid line %v", l)
+			}
+			continue
+		}
+
+		var e AccessEntry
+		if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+			t.Fatal("invalid json, err is", err)
+		}
+		if e.Client != "10.0.0.1" || e.Method != "GET" || e.Path != "/live/livestream.m3u8" || e.Status != 200 ||
+			e.Bytes != 7 || e.Backend != "127.0.0.1:"+u.Port() || e.Session != "7cc7e6e8" || e.Duration < 0 {
+			t.Errorf("invalid entry %+v", e)
+		}
+	}
+
+	if err := (&HttpAccess{Format: "csv"}).Check(); err == nil {
+		t.Error("should fail for format csv")
+	}
+}
+
+func TestStreamKey(t *testing.T) {
+	for _, p := range []string{"/live/livestream.flv", "/live/livestream.ts", "/live/livestream"} {
+		if key := streamKey(p); key != "/live/livestream" {
+			t.Errorf("invalid key=%v of %v", key, p)
+		}
+	}
+}
+
+func TestTestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httplb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := path.Join(dir, "httplb.json")
+	test := func(conf string) (int, string) {
+		if err := ioutil.WriteFile(c, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		code := testConfig(c, "", "", "text", &b)
+		return code, b.String()
+	}
+
+	conf := `{"logger": {"tank": "file", "file": "%v"}, "http": {"listen": "%v"}, "api": "%v"}`
+	if code, out := test(fmt.Sprintf(conf, path.Join(dir, "httplb.log"), "tcp://:8080", "tcp://127.0.0.1:2038")); code != 0 {
+		t.Errorf("invalid code=%v, output=%v", code, out)
+	}
+
+	// all errors are reported.
+	code, out := test(fmt.Sprintf(conf, path.Join(dir, "none", "httplb.log"), "tcp://8080", ""))
+	if code != 1 || strings.Count(out, "\n") != 4 {
+		t.Errorf("invalid code=%v, output=%v", code, out)
+	}
+	for _, msg := range []string{"not writable", "Empty api", "tcp://8080 invalid"} {
+		if !strings.Contains(out, msg) {
+			t.Errorf("no %v in output=%v", msg, out)
+		}
+	}
+
+	if code, out := test(`{"logger"`); code != 1 {
+		t.Errorf("invalid code=%v, output=%v", code, out)
+	}
+
+	// the errors with field in json.
+	test(fmt.Sprintf(conf, path.Join(dir, "httplb.log"), "tcp://8080", ""))
+	var b bytes.Buffer
+	if code := testConfig(c, "", "", "json", &b); code != 1 {
+		t.Errorf("invalid code=%v, output=%v", code, b.String())
+	}
+	for _, field := range []string{`"field":"api"`, `"field":"http.listen"`} {
+		if !strings.Contains(b.String(), field) {
+			t.Errorf("no %v in output=%v", field, b.String())
+		}
+	}
+}
+
+func TestHttpLbConfig_CheckUpstreams(t *testing.T) {
+	conf := &HttpLbConfig{}
+	conf.Api, conf.Http.Listen = "tcp://127.0.0.1:2038", "tcp://:8080"
+	conf.Http.Upstreams = map[string]*HttpUpstream{
+		"vod": &HttpUpstream{Backends: []string{"10.0.0.2:8080"}},
+	}
+	conf.Http.Rules = []*HttpRule{&HttpRule{Prefix: "/vod/", Upstream: "vod"}}
+	if errs := conf.Check(); len(errs) > 0 {
+		t.Error("check failed, errs is", errs)
+	}
+
+	conf.Http.Upstreams["bad"] = &HttpUpstream{Backends: []string{"10.0.0.2"}}
+	conf.Http.Rules = append(conf.Http.Rules, &HttpRule{Upstream: "vod"}, &HttpRule{Suffix: ".flv", Upstream: "none"})
+	if errs := conf.Check(); len(errs) != 3 {
+		t.Error("should fail, errs is", errs)
+	}
+}
+
+func TestProxy_Upstream(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("vod" + r.URL.Path))
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	conf := &HttpLbConfig{}
+	conf.Http.Upstreams = map[string]*HttpUpstream{
+		"vod": &HttpUpstream{Backends: []string{u.Host}, DialTimeout: 1000},
+	}
+	conf.Http.Rules = []*HttpRule{&HttpRule{Prefix: "/vod/", Suffix: ".m3u8", Upstream: "vod"}}
+	proxy := NewProxy(conf)
+
+	// the matched request is proxy to upstream, without local backends.
+	w := httptest.NewRecorder()
+	proxy.serveHttp(w, httptest.NewRequest("GET", "/vod/movie.m3u8", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "vod/vod/movie.m3u8" {
+		t.Errorf("invalid response %v %v", w.Code, w.Body.String())
+	}
+
+	// the not matched request is proxy to local backends, which is not ready.
+	for _, p := range []string{"/vod/movie.flv", "/live/movie.m3u8"} {
+		w = httptest.NewRecorder()
+		proxy.serveHttp(w, httptest.NewRequest("GET", p, nil))
+		if w.Code == http.StatusOK {
+			t.Errorf("%v should not proxy to upstream", p)
+		}
+	}
+}
+
+func TestProxy_Retry(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok" + r.URL.Path))
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+
+	// the backend is restarting, the connection is refused.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	conf := &HttpLbConfig{}
+	conf.Http.Retry = HttpRetry{Retries: 1, Backoff: 1, Failures: 2}
+	proxy := NewProxy(conf)
+
+	r := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/proxy?http=%v,%v", dead, u.Port()), nil)
+	if msg, err := proxy.serveChangeBackendApi(&kernel.Context{}, r); err != Success {
+		t.Fatal("failed, err is", err, msg)
+	}
+
+	// the m3u8 and ts are retried to the healthy backend.
+	for i := 0; i < 10; i++ {
+		for _, p := range []string{"/live/s%v.m3u8?shp_uuid=%v", "/live/s%v-1.ts?v=%v"} {
+			r := httptest.NewRequest("GET", fmt.Sprintf(p, i, i), nil)
+			w := httptest.NewRecorder()
+			proxy.serveHttp(w, r)
+			if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "ok/live/") {
+				t.Errorf("invalid response %v %v of %v", w.Code, w.Body.String(), r.URL)
+			}
+		}
+	}
+
+	for _, b := range proxy.Backends().Backends {
+		if b.Port == dead && (b.Healthy || b.Failures < 2) {
+			t.Errorf("should unhealthy %+v", b)
+		} else if b.Port != dead && (!b.Healthy || b.Failures != 0) {
+			t.Errorf("should healthy %+v", b)
+		}
+	}
+
+	// the flv is not idempotent to retry.
+	if retryable(httptest.NewRequest("GET", "/live/s.flv", nil)) || retryable(httptest.NewRequest("POST", "/live/s.m3u8", nil)) {
+		t.Error("should not retry")
+	}
+}
+
+func TestProxy_Stale(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:10\n#EXTINF:10,\ns-10.ts\n#EXTINF:10,\ns-11.ts\n#EXTINF:10,\ns-12.ts\n"))
+	}))
+	u, _ := url.Parse(backend.URL)
+
+	conf := &HttpLbConfig{}
+	conf.Http.Stale = HttpStale{Duration: 1000, Window: 2}
+	proxy := NewProxy(conf)
+
+	r := httptest.NewRequest("GET", "/api/v1/proxy?http="+u.Port(), nil)
+	if msg, err := proxy.serveChangeBackendApi(&kernel.Context{}, r); err != Success {
+		t.Fatal("failed, err is", err, msg)
+	}
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		proxy.serveHttp(w, httptest.NewRequest("GET", "/live/s.m3u8?shp_uuid=abc", nil))
+		return w
+	}
+
+	if w := get(); w.Code != http.StatusOK || w.Header().Get("X-Cache") == "STALE" || strings.Count(w.Body.String(), ".ts") != 3 {
+		t.Fatalf("invalid response %v %v", w.Code, w.Body.String())
+	}
+
+	// the backend is down, serve the stale m3u8 with the last 2 segments.
+	backend.Close()
+	w := get()
+	if w.Code != http.StatusOK || w.Header().Get("X-Cache") != "STALE" || w.Header().Get("Warning") == "" {
+		t.Fatalf("invalid response %v %v %v", w.Code, w.Header(), w.Body.String())
+	}
+	if b := w.Body.String(); strings.Contains(b, "s-10.ts") || !strings.Contains(b, "s-12.ts") || !strings.Contains(b, "#EXT-X-MEDIA-SEQUENCE:11\n") {
+		t.Errorf("invalid stale m3u8 %v", b)
+	}
+
+	// the stale m3u8 is expired.
+	proxy.stale.lock.Lock()
+	for _, e := range proxy.stale.entries {
+		e.update = e.update.Add(-2 * time.Second)
+	}
+	proxy.stale.lock.Unlock()
+	if w := get(); w.Code == http.StatusOK {
+		t.Errorf("should fail for expired, %v %v", w.Code, w.Body.String())
+	}
+
+	if err := (&HttpStale{Window: -1}).Check(); err == nil {
+		t.Error("should fail for negative window")
+	}
+}
+
+func TestHlsPlusProxy_Checkpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httplb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "sessions.json")
+
+	p := NewHlsPlusProxy(nil)
+	if n, err := p.load(file); err != nil || n != 0 {
+		t.Errorf("load no checkpoint failed, n=%v, err is %v", n, err)
+	}
+
+	q := url.Values{"shp_uuid": []string{"abc"}, "shp_pid": []string{"100"}}
+	if _, err = p.identify(q, http.Header{}, "127.0.0.1:1234", 8081); err != nil {
+		t.Fatal(err)
+	}
+	q = url.Values{}
+	if _, err = p.identify(q, http.Header{"X-Playback-Session-Id": []string{"xyz"}}, "127.0.0.1:1235", 8082); err != nil {
+		t.Fatal(err)
+	}
+	// the jwplayer without uuid or xpsid is not restored.
+	if _, err = p.identify(q, http.Header{}, "127.0.0.1:1236", 8083); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := p.save(file); err != nil || n != 3 {
+		t.Fatalf("save failed, n=%v, err is %v", n, err)
+	}
+
+	// restart, the sessions stick to the same backends.
+	p = NewHlsPlusProxy(nil)
+	if n, err := p.load(file); err != nil || n != 2 {
+		t.Fatalf("load failed, n=%v, err is %v", n, err)
+	}
+
+	// the restored sessions are counted before the players reconnect.
+	proxy := NewProxy(&HttpLbConfig{})
+	proxy.hlsPlus = p
+	r := httptest.NewRequest("GET", "/api/v1/proxy?http=8081,8082", nil)
+	if msg, err := proxy.serveChangeBackendApi(&kernel.Context{}, r); err != Success {
+		t.Fatal("failed, err is", err, msg)
+	}
+	for _, b := range proxy.Backends().Backends {
+		if b.Sessions != 1 {
+			t.Errorf("invalid sessions %+v", b)
+		}
+	}
+	if conn, err := p.identify(url.Values{"shp_uuid": []string{"abc"}}, http.Header{}, "127.0.0.1:2234", 9091); err != nil || conn.port != 8081 || conn.pid != "100" {
+		t.Errorf("invalid conn %v, err is %v", conn, err)
+	}
+	if conn, err := p.identify(url.Values{}, http.Header{"X-Playback-Session-Id": []string{"xyz"}}, "127.0.0.1:2235", 9091); err != nil || conn.port != 8082 {
+		t.Errorf("invalid conn %v, err is %v", conn, err)
+	}
+	if ss := p.Sessions(); len(ss) != 2 {
+		t.Errorf("invalid sessions %v", ss)
+	}
+}
@@ -0,0 +1,202 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the token bucket rate limiter, protect backends from the retry storms.
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The rate limit in config, 0 to disable.
+type RateLimit struct {
+	// The requests per second, for m3u8.
+	Requests int `json:"requests"`
+	// The bytes per second, for ts and flv.
+	Bytes int `json:"bytes"`
+}
+
+// The token bucket, refill rate tokens per second, burst to rate tokens.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: now}
+}
+
+func (v *tokenBucket) refill(now time.Time) {
+	if d := now.Sub(v.last); d > 0 {
+		if v.tokens += v.rate * d.Seconds(); v.tokens > v.rate {
+			v.tokens = v.rate
+		}
+	}
+	v.last = now
+}
+
+// Take n tokens when there are enough tokens.
+func (v *tokenBucket) take(now time.Time, n float64) bool {
+	v.refill(now)
+	if v.tokens < n {
+		return false
+	}
+	v.tokens -= n
+	return true
+}
+
+// Consume n tokens, the tokens maybe negative for the data already sent.
+func (v *tokenBucket) consume(now time.Time, n float64) {
+	v.refill(now)
+	v.tokens -= n
+}
+
+// The buckets of a key, nil when the limit is disabled.
+type limitBuckets struct {
+	requests *tokenBucket
+	bytes    *tokenBucket
+	last     time.Time
+}
+
+// The rate limiter by key, for example, client ip or stream path.
+type rateLimiter struct {
+	// the requests and bytes per second, 0 to disable.
+	requests, bytes int
+	buckets         map[string]*limitBuckets
+	lock            *sync.Mutex
+}
+
+func NewRateLimiter(requests, bytes int) *rateLimiter {
+	return &rateLimiter{
+		requests: requests, bytes: bytes,
+		buckets: make(map[string]*limitBuckets),
+		lock:    &sync.Mutex{},
+	}
+}
+
+// @remark user must hold the lock.
+func (v *rateLimiter) get(key string, now time.Time) *limitBuckets {
+	b, ok := v.buckets[key]
+	if !ok {
+		b = &limitBuckets{}
+		if v.requests > 0 {
+			b.requests = NewTokenBucket(float64(v.requests), now)
+		}
+		if v.bytes > 0 {
+			b.bytes = NewTokenBucket(float64(v.bytes), now)
+		}
+		v.buckets[key] = b
+	}
+	b.last = now
+	return b
+}
+
+// Whether allow the request of key, for m3u8.
+func (v *rateLimiter) allowRequest(key string) bool {
+	if v.requests <= 0 {
+		return true
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	return v.get(key, now).requests.take(now, 1)
+}
+
+// Whether allow the stream of key, for ts and flv, deny when the bytes sent exceed the rate.
+func (v *rateLimiter) allowBytes(key string) bool {
+	if v.bytes <= 0 {
+		return true
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	b := v.get(key, now).bytes
+	b.refill(now)
+	return b.tokens > 0
+}
+
+// Account the bytes sent of key.
+func (v *rateLimiter) consume(key string, n int) {
+	if v.bytes <= 0 {
+		return
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	v.get(key, now).bytes.consume(now, float64(n))
+}
+
+// Remove the buckets not used for idle.
+func (v *rateLimiter) cleanup(idle time.Duration) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	die := time.Now().Add(-1 * idle)
+	for key, b := range v.buckets {
+		if b.last.Before(die) {
+			delete(v.buckets, key)
+		}
+	}
+}
+
+// The writer to account the bytes sent, for the rate limiters and sessions.
+type countWriter struct {
+	http.ResponseWriter
+	consume func(n int)
+}
+
+func (v *countWriter) Write(p []byte) (n int, err error) {
+	n, err = v.ResponseWriter.Write(p)
+	v.consume(n)
+	return
+}
+
+// For the http stream, flush each packet.
+func (v *countWriter) Flush() {
+	if f, ok := v.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// For the websocket, the bytes after hijack are not accounted.
+func (v *countWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := v.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, fmt.Errorf("hijack not supported")
+}
@@ -28,24 +28,28 @@ SOFTWARE.
 package main
 
 import (
-	"encoding/json"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	oa "github.com/ossrs/go-oryx-lib/asprocess"
 	oh "github.com/ossrs/go-oryx-lib/http"
-	oj "github.com/ossrs/go-oryx-lib/json"
 	ol "github.com/ossrs/go-oryx-lib/logger"
 	oo "github.com/ossrs/go-oryx-lib/options"
 	"github.com/ossrs/go-oryx/kernel"
+	"hash/crc32"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -58,48 +62,187 @@ type HttpLbConfig struct {
 	Api  string `json:"api"`
 	Http struct {
 		Listen string `json:"listen"`
+		// The https and h2 to terminate tls and proxy http to backend.
+		Tls kernel.Tls `json:"tls"`
+		// The socket options for each client of http and https.
+		Tcp kernel.TcpOptions `json:"tcp"`
+		// The LRU cache for hls+ m3u8 and ts.
+		Cache struct {
+			// The max size in MB of all cached responses, 0 to disable.
+			MaxSize kernel.SizeMB `json:"max_size"`
+			// The ttl in ms for m3u8, 0 to use default.
+			M3u8Ttl kernel.Duration `json:"m3u8_ttl"`
+			// The ttl in ms for ts, 0 to use default.
+			TsTtl kernel.Duration `json:"ts_ttl"`
+		} `json:"cache"`
+		// The stale m3u8 to serve when backend is unreachable.
+		Stale HttpStale `json:"stale"`
+		// The token bucket rate limit, response 429 when exceeded.
+		Limit struct {
+			// The limit for each client ip.
+			Client RateLimit `json:"client"`
+			// The limit for each stream of all clients.
+			Stream RateLimit `json:"stream"`
+		} `json:"limit"`
+		// The CORS for the players in browser, applied to all proxied responses.
+		Cors HttpCors `json:"cors"`
+		// The retry of the GET of m3u8 and ts to other backends, when backend is restarting.
+		Retry HttpRetry `json:"retry"`
+		// The access log of proxied requests, in its own file.
+		Access HttpAccess `json:"access"`
+		// The upstream pools of remote backends, key is the name.
+		Upstreams map[string]*HttpUpstream `json:"upstreams"`
+		// The checkpoint of hls+ sessions, loaded when start, so a restart does not reshuffle sessions.
+		Sessions struct {
+			// The file to save sessions, empty to disable.
+			File string `json:"file"`
+			// The interval in ms to save, 0 to use default.
+			Interval kernel.Duration `json:"interval"`
+		} `json:"sessions"`
+		// The rules to proxy the matched path to upstream, the first matched wins,
+		// the request not matched is proxy to the local backends.
+		Rules []*HttpRule `json:"rules"`
 	} `json:"http"`
 }
 
 func (v *HttpLbConfig) String() string {
-	return fmt.Sprintf("%v, api=%v, http(listen=%v)", &v.Config, v.Api, v.Http.Listen)
+	c, l := &v.Http.Cache, &v.Http.Limit
+	return fmt.Sprintf("%v, api=%v, http(listen=%v,tls(%v),tcp(%v),cache(size=%vMB,m3u8=%vms,ts=%vms),stale(%v),limit(client=%v/%v,stream=%v/%v),cors(%v),retry(%v),access(%v),sessions(file=%v,interval=%v),upstreams=%v,rules=%v)",
+		&v.Config, v.Api, v.Http.Listen, &v.Http.Tls, &v.Http.Tcp, c.MaxSize, c.M3u8Ttl, c.TsTtl, &v.Http.Stale,
+		l.Client.Requests, l.Client.Bytes, l.Stream.Requests, l.Stream.Bytes, &v.Http.Cors, &v.Http.Retry, &v.Http.Access,
+		v.Http.Sessions.File, v.Http.Sessions.Interval, len(v.Http.Upstreams), len(v.Http.Rules))
 }
 
 func (v *HttpLbConfig) Loads(c string) (err error) {
-	var f *os.File
-	if f, err = os.Open(c); err != nil {
-		ol.E(nil, "Open config failed, err is", err)
+	if err = v.decode(c); err != nil {
 		return
 	}
-	defer f.Close()
 
-	r := json.NewDecoder(oj.NewJsonPlusReader(f))
-	if err = r.Decode(v); err != nil {
-		ol.E(nil, "Decode config failed, err is", err)
+	if err = v.Config.OpenLogger(); err != nil {
+		ol.E(nil, "Open logger failed, err is", err)
 		return
 	}
 
-	if err = v.Config.OpenLogger(); err != nil {
-		ol.E(nil, "Open logger failed, err is", err)
+	if errs := v.Check(); len(errs) > 0 {
+		return errs[0]
+	}
+
+	return
+}
+
+func (v *HttpLbConfig) decode(c string) (err error) {
+	if err = kernel.DecodeConfig(c, v); err != nil {
+		ol.E(nil, "Decode config failed, err is", err)
 		return
 	}
 
+	return
+}
+
+// Check the config, return all errors.
+func (v *HttpLbConfig) Check() (errs []error) {
 	if len(v.Api) == 0 {
-		return fmt.Errorf("Empty api")
-	} else if nn := strings.Count(v.Api, "://"); nn != 1 {
-		return fmt.Errorf("Api contains %v network", nn)
+		errs = append(errs, kernel.NewConfigError("api", "Empty api"))
+	} else if err := kernel.CheckListen(v.Api); err != nil {
+		errs = append(errs, kernel.NewConfigError("api", "Api %v", err))
 	}
 
 	if len(v.Http.Listen) == 0 {
-		return fmt.Errorf("Empty http listens")
+		errs = append(errs, kernel.NewConfigError("http.listen", "Empty http listens"))
+	} else if err := kernel.CheckListen(v.Http.Listen); err != nil {
+		errs = append(errs, kernel.NewConfigError("http.listen", "Listen %v", err))
 	}
-	if nn := strings.Count(v.Http.Listen, "://"); nn != 1 {
-		return fmt.Errorf("Listen %v contains %v network", v.Http.Listen, nn)
+
+	for _, err := range v.Http.Tls.Check() {
+		errs = append(errs, kernel.ConfigField("http.tls", err))
+	}
+
+	if err := v.Http.Tcp.Check(); err != nil {
+		errs = append(errs, kernel.NewConfigError("http.tcp", "Tcp %v", err))
+	}
+
+	if c := &v.Http.Cache; c.MaxSize < 0 || c.M3u8Ttl < 0 || c.TsTtl < 0 {
+		errs = append(errs, kernel.NewConfigError("http.cache", "Cache size=%v, m3u8=%v, ts=%v should not be negative", c.MaxSize, c.M3u8Ttl, c.TsTtl))
+	}
+
+	if err := v.Http.Stale.Check(); err != nil {
+		errs = append(errs, kernel.NewConfigError("http.stale", "Stale %v", err))
+	}
+
+	for _, name := range []string{"client", "stream"} {
+		l := &v.Http.Limit.Client
+		if name == "stream" {
+			l = &v.Http.Limit.Stream
+		}
+		if l.Requests < 0 || l.Bytes < 0 {
+			errs = append(errs, kernel.NewConfigError("http.limit."+name, "Limit %v requests=%v, bytes=%v should not be negative", name, l.Requests, l.Bytes))
+		}
+	}
+
+	if err := v.Config.CheckProfile(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := v.Http.Cors.Check(); err != nil {
+		errs = append(errs, kernel.NewConfigError("http.cors", "Cors %v", err))
+	}
+
+	if err := v.Http.Retry.Check(); err != nil {
+		errs = append(errs, kernel.NewConfigError("http.retry", "Retry %v", err))
+	}
+
+	if err := v.Http.Access.Check(); err != nil {
+		errs = append(errs, kernel.NewConfigError("http.access", "Access %v", err))
+	}
+
+	if v.Http.Sessions.Interval < 0 {
+		errs = append(errs, kernel.NewConfigError("http.sessions.interval", "Sessions interval=%v should not be negative", v.Http.Sessions.Interval))
+	}
+
+	for name, u := range v.Http.Upstreams {
+		if u == nil {
+			errs = append(errs, kernel.NewConfigError("http.upstreams."+name, "Empty upstream %v", name))
+		} else if err := u.Check(); err != nil {
+			errs = append(errs, kernel.NewConfigError("http.upstreams."+name, "Upstream %v %v", name, err))
+		}
+	}
+
+	for i, rule := range v.Http.Rules {
+		field := fmt.Sprintf("http.rules[%v]", i)
+		if rule == nil || len(rule.Prefix) == 0 && len(rule.Suffix) == 0 {
+			errs = append(errs, kernel.NewConfigError(field, "Rule %v requires prefix or suffix", i))
+		} else if _, ok := v.Http.Upstreams[rule.Upstream]; !ok {
+			errs = append(errs, kernel.NewConfigError(field+".upstream", "Rule %v upstream %v not found", i, rule.Upstream))
+		}
 	}
 
 	return
 }
 
+// Test the config c without listen, print the result to w.
+// @param api and listen override the config when not empty.
+// @return the exit code, 0 when ok.
+func testConfig(c, api, listen, format string, w io.Writer) int {
+	conf := &HttpLbConfig{}
+	if err := conf.decode(c); err != nil {
+		return kernel.ConfigTestFormat(w, c, format, []error{err})
+	}
+
+	if len(api) > 0 {
+		conf.Api = api
+	}
+	if len(listen) > 0 {
+		conf.Http.Listen = listen
+	}
+
+	var errs []error
+	if err := conf.Config.CheckLogger(); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, conf.Check()...)
+	return kernel.ConfigTestFormat(w, c, format, errs)
+}
+
 // Create isolate transport for http stream and hls+.
 func createHttpTransport() http.RoundTripper {
 	return &http.Transport{
@@ -132,6 +275,8 @@ type hlsPlusVirtualConnection struct {
 	// each connection use one proxy
 	rp   *httputil.ReverseProxy
 	lock *sync.Mutex
+	// the bytes proxied to client.
+	bytes int64
 }
 
 func NewHlsPlusVirtualConnection(uuid, xpsid string, port int) *hlsPlusVirtualConnection {
@@ -162,6 +307,10 @@ func (v *hlsPlusVirtualConnection) serve(w http.ResponseWriter, r *http.Request)
 		if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
 			r.Header.Set("X-Real-IP", ip)
 		}
+		if r.TLS != nil {
+			r.Header.Set("X-Forwarded-Proto", "https")
+		}
+		setAccessBackend(r, r.URL.Host)
 
 		if v.doPrint {
 			ol.T(ctx, fmt.Sprintf("proxy hls+ %v to %v", v, r.URL.String()))
@@ -169,7 +318,9 @@ func (v *hlsPlusVirtualConnection) serve(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	v.rp.ServeHTTP(w, r)
+	v.rp.ServeHTTP(&countWriter{ResponseWriter: w, consume: func(n int) {
+		atomic.AddInt64(&v.bytes, int64(n))
+	}}, r)
 }
 
 func (v *hlsPlusVirtualConnection) String() string {
@@ -226,6 +377,7 @@ func (v *hlsPlusProxy) identify(q url.Values, h http.Header, addr string, active
 	}
 	if vconn == nil {
 		vconn = NewHlsPlusVirtualConnection(uuid, xpsid, activePort)
+		vconn.transport = v.proxy.createTransport()
 		vconn.doPrint = true
 	}
 	vconn.lastUpdate = time.Now()
@@ -262,15 +414,51 @@ func (v *hlsPlusProxy) identify(q url.Values, h http.Header, addr string, active
 func (v *hlsPlusProxy) serve(w http.ResponseWriter, r *http.Request) {
 	ctx := &kernel.Context{}
 
-	vconn, err := v.identify(r.URL.Query(), r.Header, r.RemoteAddr, v.proxy.activePort)
+	// the new connection is sticky to the picked backend.
+	q := r.URL.Query()
+	vconn, err := v.identify(q, r.Header, r.RemoteAddr, v.proxy.pickBackend(sessionKey(r)))
 	if err != nil {
 		oh.WriteError(ctx, w, r, err)
 		return
 	}
 
-	vconn.serve(w, r)
+	// the cached response is from the backend of session.
+	if len(vconn.uuid) > 0 {
+		setAccessSession(r, vconn.uuid)
+	} else {
+		setAccessSession(r, vconn.xpsid)
+	}
+	setAccessBackend(r, fmt.Sprintf("127.0.0.1:%v", vconn.port))
+
+	// serve the last good m3u8 when backend is unreachable.
+	fetch := vconn.serve
+	if s := v.proxy.stale; s != nil && r.Method == "GET" && strings.HasSuffix(r.URL.Path, ".m3u8") {
+		key := fmt.Sprintf("%v?%v", r.URL.Path, r.URL.RawQuery)
+		fetch = func(w http.ResponseWriter, r *http.Request) {
+			s.serve(w, r, key, vconn.serve)
+		}
+	}
+
+	// serve the hot m3u8 and ts from cache.
+	if c := v.proxy.cache; c != nil && r.Method == "GET" {
+		// the m3u8 is for the session, while the ts is the same for all sessions.
+		ttl, key := v.proxy.tsTtl, fmt.Sprintf("%v%v", vconn.port, r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, ".m3u8") {
+			ttl, key = v.proxy.m3u8Ttl, fmt.Sprintf("%v?%v", key, r.URL.RawQuery)
+		}
+		c.serve(w, r, key, ttl, fetch)
+		return
+	}
+
+	fetch(w, r)
 }
 
+const (
+	// the default ttl of cached m3u8 and ts.
+	defaultM3u8Ttl = time.Duration(1) * time.Second
+	defaultTsTtl   = time.Duration(30) * time.Second
+)
+
 const (
 	proxyCleanupInterval  = time.Duration(10) * time.Second
 	hlsPlusSessionTimeout = time.Duration(120) * time.Second
@@ -284,48 +472,397 @@ func (v *hlsPlusProxy) cleanup(ctx ol.Context) {
 
 	die := time.Now().Add(-1 * hlsPlusSessionTimeout)
 
-	for _, conn := range v.tcpConns {
+	for conn := range v.conns() {
 		if conn.lastUpdate.After(die) {
 			continue
 		}
 
-		for _, addr := range conn.addrs {
-			delete(v.tcpConns, addr)
+		v.remove(ctx, conn)
+	}
+}
+
+// All virtual connections, each conn maybe in all caches, for example,
+// the conn loaded from checkpoint without tcp connection.
+// @remark user must hold the lock.
+func (v *hlsPlusProxy) conns() map[*hlsPlusVirtualConnection]bool {
+	conns := make(map[*hlsPlusVirtualConnection]bool)
+	for _, cache := range []map[string]*hlsPlusVirtualConnection{v.virtualConns, v.appConns, v.tcpConns} {
+		for _, conn := range cache {
+			conns[conn] = true
 		}
-		if len(conn.xpsid) > 0 {
-			delete(v.appConns, conn.xpsid)
+	}
+	return conns
+}
+
+// Remove the virtual connection from all caches.
+// @remark user must hold the lock.
+func (v *hlsPlusProxy) remove(ctx ol.Context, conn *hlsPlusVirtualConnection) {
+	for _, addr := range conn.addrs {
+		delete(v.tcpConns, addr)
+	}
+	if len(conn.xpsid) > 0 {
+		delete(v.appConns, conn.xpsid)
+	}
+	if len(conn.uuid) > 0 {
+		delete(v.virtualConns, conn.uuid)
+	}
+
+	ol.W(ctx, fmt.Sprintf("remove %v from total=%v/%v/%v",
+		conn, len(v.virtualConns), len(v.tcpConns), len(v.appConns)))
+}
+
+// The hls+ session, for api.
+type HlsPlusSession struct {
+	Uuid  string   `json:"uuid"`
+	Xpsid string   `json:"xpsid"`
+	Addrs []string `json:"addrs"`
+	Pid   string   `json:"pid"`
+	Port  int      `json:"port"`
+	// the unix time in ms of last request.
+	LastUpdate int64 `json:"last_update"`
+	// the bytes proxied to client.
+	Bytes int64 `json:"bytes"`
+}
+
+// The snapshot of sessions, the recent updated first.
+func (v *hlsPlusProxy) Sessions() []*HlsPlusSession {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	r := make([]*HlsPlusSession, 0)
+	for conn := range v.conns() {
+		r = append(r, &HlsPlusSession{
+			Uuid: conn.uuid, Xpsid: conn.xpsid, Addrs: append([]string{}, conn.addrs...),
+			Pid: conn.pid, Port: conn.port,
+			LastUpdate: conn.lastUpdate.UnixNano() / int64(time.Millisecond),
+			Bytes:      atomic.LoadInt64(&conn.bytes),
+		})
+	}
+
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].LastUpdate > r[j].LastUpdate
+	})
+	return r
+}
+
+// Kick the sessions identified by uuid, xpsid or addr, the player is
+// identified as a new session and picks backend again for next request.
+// @return the number of sessions kicked.
+func (v *hlsPlusProxy) kick(ctx ol.Context, uuid, xpsid, addr string) int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	conns := make(map[*hlsPlusVirtualConnection]bool)
+	if conn, ok := v.virtualConns[uuid]; ok && len(uuid) > 0 {
+		conns[conn] = true
+	}
+	if conn, ok := v.appConns[xpsid]; ok && len(xpsid) > 0 {
+		conns[conn] = true
+	}
+	if conn, ok := v.tcpConns[addr]; ok && len(addr) > 0 {
+		conns[conn] = true
+	}
+
+	for conn := range conns {
+		v.remove(ctx, conn)
+	}
+	return len(conns)
+}
+
+// The replicas of each backend in hash ring, more replicas more balanced.
+const hashRingReplicas = 160
+
+// The consistent hash ring of backends, the same key always map to the same backend,
+// and only the keys of the added or removed backend are remapped.
+type hashRing struct {
+	// the sorted hashes of replicas.
+	hashes []uint32
+	// the backend port of replica.
+	ports map[uint32]int
+}
+
+func NewHashRing(ports []int) *hashRing {
+	v := &hashRing{ports: make(map[uint32]int)}
+	for _, port := range ports {
+		for i := 0; i < hashRingReplicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%v#%v", port, i)))
+			if _, ok := v.ports[h]; ok {
+				continue
+			}
+			v.hashes = append(v.hashes, h)
+			v.ports[h] = port
 		}
-		if len(conn.uuid) > 0 {
-			delete(v.virtualConns, conn.uuid)
+	}
+	sort.Slice(v.hashes, func(i, j int) bool {
+		return v.hashes[i] < v.hashes[j]
+	})
+	return v
+}
+
+// The backend port of key, the first replica clockwise, 0 if no backend.
+func (v *hashRing) get(key string) int {
+	if len(v.hashes) == 0 {
+		return 0
+	}
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(v.hashes), func(i int) bool {
+		return v.hashes[i] >= h
+	})
+	if i == len(v.hashes) {
+		i = 0
+	}
+	return v.ports[v.hashes[i]]
+}
+
+// The share of hash space of each backend, in percent.
+func (v *hashRing) shares() map[int]float64 {
+	r := make(map[int]float64)
+	for i, h := range v.hashes {
+		// the replica owns the hashes from previous one.
+		prev := v.hashes[len(v.hashes)-1]
+		if i > 0 {
+			prev = v.hashes[i-1]
 		}
+		r[v.ports[h]] += float64(h-prev) * 100 / (1 << 32)
+	}
+	// the only replica owns all.
+	if len(v.hashes) == 1 {
+		r[v.ports[v.hashes[0]]] = 100
+	}
+	return r
+}
+
+// The key of stream to hash, the path without extension, for example, /live/livestream.
+func streamKey(p string) string {
+	return strings.TrimSuffix(p, path.Ext(p))
+}
 
-		ol.W(ctx, fmt.Sprintf("remove %v from total=%v/%v/%v",
-			conn, len(v.virtualConns), len(v.tcpConns), len(v.appConns)))
+// The key to hash the request, the session id for hls+, or the stream when no session.
+func sessionKey(r *http.Request) string {
+	q := r.URL.Query()
+	key := q.Get("shp_uuid")
+	if len(key) == 0 {
+		key = q.Get("shp_xpsid")
 	}
+	if len(key) == 0 {
+		key = r.Header.Get("X-Playback-Session-Id")
+	}
+	if len(key) == 0 {
+		key = streamKey(r.URL.Path)
+	}
+	return key
 }
 
 // The proxy object, serve http stream and hls+.
 type proxy struct {
-	conf       *HttpLbConfig
-	ports      []int
-	activePort int
-	hlsPlus    *hlsPlusProxy
+	conf  *HttpLbConfig
+	ports []int
+	// the active backends, pick one by consistent hash for each stream.
+	activePorts []int
+	ring        *hashRing
+	lock        *sync.Mutex
+	hlsPlus     *hlsPlusProxy
+	// the cache for hls+, nil when disabled.
+	cache          *hlsCache
+	m3u8Ttl, tsTtl time.Duration
+	// the rate limit by client ip and by stream.
+	clientLimit, streamLimit *rateLimiter
+	// the upstreams of remote backends, and the rules to match them.
+	upstreams map[string]*upstream
+	rules     []*HttpRule
+	// the retry to other backends, nil when disabled.
+	retry *retryPolicy
+	// the CORS policy, nil when disabled.
+	cors *corsPolicy
+	// the access log, nil when disabled.
+	access *accessLog
+	// the stale m3u8, nil when disabled.
+	stale *staleCache
 }
 
 func NewProxy(conf *HttpLbConfig) *proxy {
 	v := &proxy{
 		conf: conf,
+		ring: NewHashRing(nil),
+		lock: &sync.Mutex{},
+
+		upstreams: make(map[string]*upstream),
 	}
 	v.hlsPlus = NewHlsPlusProxy(v)
+
+	if conf != nil {
+		for name, u := range conf.Http.Upstreams {
+			v.upstreams[name] = NewUpstream(name, u)
+		}
+		v.rules = conf.Http.Rules
+	}
+
+	if conf != nil {
+		v.cors = NewCorsPolicy(&conf.Http.Cors)
+		v.stale = NewStaleCache(&conf.Http.Stale)
+	}
+
+	if conf != nil && conf.Http.Retry.Retries > 0 {
+		v.retry = NewRetryPolicy(&conf.Http.Retry)
+	}
+
+	v.clientLimit, v.streamLimit = NewRateLimiter(0, 0), NewRateLimiter(0, 0)
+	if conf != nil {
+		l := &conf.Http.Limit
+		v.clientLimit = NewRateLimiter(l.Client.Requests, l.Client.Bytes)
+		v.streamLimit = NewRateLimiter(l.Stream.Requests, l.Stream.Bytes)
+	}
+
+	if conf != nil && conf.Http.Cache.MaxSize > 0 {
+		c := &conf.Http.Cache
+		v.cache = NewHlsCache(int64(c.MaxSize) * 1024 * 1024)
+		v.m3u8Ttl, v.tsTtl = defaultM3u8Ttl, defaultTsTtl
+		if c.M3u8Ttl > 0 {
+			v.m3u8Ttl = time.Duration(c.M3u8Ttl) * time.Millisecond
+		}
+		if c.TsTtl > 0 {
+			v.tsTtl = time.Duration(c.TsTtl) * time.Millisecond
+		}
+	}
 	return v
 }
 
+// Pick a active backend by consistent hash of key, 0 if no backend.
+func (v *proxy) pickBackend(key string) int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.ring.get(key)
+}
+
+// The next healthy backend after port which not tried, 0 if no backend.
+func (v *proxy) nextBackend(port int, tried map[int]bool) int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	start := 0
+	for i, p := range v.activePorts {
+		if p == port {
+			start = i + 1
+			break
+		}
+	}
+
+	for i := 0; i < len(v.activePorts); i++ {
+		p := v.activePorts[(start+i)%len(v.activePorts)]
+		if !tried[p] && (v.retry == nil || v.retry.healthy(p)) {
+			return p
+		}
+	}
+	return 0
+}
+
+// Create isolate transport to backends, retry the m3u8 and ts when enabled.
+func (v *proxy) createTransport() http.RoundTripper {
+	if v == nil || v.retry == nil {
+		return createHttpTransport()
+	}
+	return &retryTransport{proxy: v, policy: v.retry, rt: createHttpTransport()}
+}
+
+// The backend of httplb, for api.
+type HttpBackend struct {
+	Port int `json:"port"`
+	// the share of hash space in percent.
+	Share float64 `json:"share"`
+	// the hls+ sessions on backend.
+	Sessions int `json:"sessions"`
+	// the consecutive failures, and whether healthy when retry enabled.
+	Failures int  `json:"failures"`
+	Healthy  bool `json:"healthy"`
+}
+
+// The mapping of backends, for api.
+type HttpBackends struct {
+	Replicas int            `json:"replicas"`
+	Backends []*HttpBackend `json:"backends"`
+}
+
+// The snapshot of backends and the hls+ sessions on them.
+func (v *proxy) Backends() *HttpBackends {
+	sessions := make(map[int]int)
+	func() {
+		v.hlsPlus.lock.Lock()
+		defer v.hlsPlus.lock.Unlock()
+
+		// count each conn once, including the restored ones without tcp conns.
+		for conn := range v.hlsPlus.conns() {
+			sessions[conn.port]++
+		}
+	}()
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	r := &HttpBackends{Replicas: hashRingReplicas, Backends: make([]*HttpBackend, 0)}
+	shares := v.ring.shares()
+	for _, port := range v.activePorts {
+		b := &HttpBackend{Port: port, Share: shares[port], Sessions: sessions[port], Healthy: true}
+		if v.retry != nil {
+			b.Failures, b.Healthy = v.retry.status(port)
+		}
+		r.Backends = append(r.Backends, b)
+	}
+	return r
+}
+
 func (v *proxy) serveHlsPlus(w http.ResponseWriter, r *http.Request) {
 	v.hlsPlus.serve(w, r)
 }
 
+// The idle timeout to remove the rate limit buckets.
+const limitIdleTimeout = time.Duration(60) * time.Second
+
 func (v *proxy) cleanup(ctx ol.Context) {
 	v.hlsPlus.cleanup(ctx)
+	v.clientLimit.cleanup(limitIdleTimeout)
+	v.streamLimit.cleanup(limitIdleTimeout)
+	if v.stale != nil {
+		v.stale.cleanup(time.Now())
+	}
+}
+
+// The stream of ts segment, for example, /live/livestream-12.ts is /live/livestream.
+var tsSegmentPattern = regexp.MustCompile(`-[0-9]+\.ts$`)
+
+// Apply the rate limit for m3u8 and ts/flv, response 429 when exceeded.
+// @return the writer to account the bytes, nil when exceeded.
+func (v *proxy) limit(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	p := r.URL.Path
+
+	client := r.RemoteAddr
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		client = ip
+	}
+	stream := streamKey(tsSegmentPattern.ReplaceAllString(p, ".ts"))
+
+	switch {
+	case strings.HasSuffix(p, ".m3u8"):
+		if v.clientLimit.allowRequest(client) && v.streamLimit.allowRequest(stream) {
+			return w
+		}
+	case strings.HasSuffix(p, ".ts") || strings.HasSuffix(p, ".flv"):
+		if v.clientLimit.allowBytes(client) && v.streamLimit.allowBytes(stream) {
+			return &countWriter{ResponseWriter: w, consume: func(n int) {
+				v.clientLimit.consume(client, n)
+				v.streamLimit.consume(stream, n)
+			}}
+		}
+	default:
+		return w
+	}
+
+	ol.W(&kernel.Context{}, fmt.Sprintf("limit client %v of stream %v, path=%v", client, stream, p))
+	oh.SetHeader(w)
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	return nil
 }
 
 func (v *proxy) serveHttpStream(w http.ResponseWriter, r *http.Request) {
@@ -334,26 +871,134 @@ func (v *proxy) serveHttpStream(w http.ResponseWriter, r *http.Request) {
 	rp := &httputil.ReverseProxy{}
 
 	// each http stream use isolate transport.
-	rp.Transport = createHttpTransport()
+	rp.Transport = v.createTransport()
 
-	// proxy to the latest backend.
+	// proxy the same stream to the same backend.
+	port := v.pickBackend(streamKey(r.URL.Path))
 	rp.Director = func(r *http.Request) {
 		r.URL.Scheme = "http"
 
-		r.URL.Host = fmt.Sprintf("127.0.0.1:%v", v.activePort)
+		r.URL.Host = fmt.Sprintf("127.0.0.1:%v", port)
 		if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
 			r.Header.Set("X-Real-IP", ip)
 		}
+		if r.TLS != nil {
+			r.Header.Set("X-Forwarded-Proto", "https")
+		}
+		setAccessBackend(r, r.URL.Host)
 		ol.W(ctx, fmt.Sprintf("proxy http %v to %v", r.RemoteAddr, r.URL.String()))
 	}
 
 	rp.ServeHTTP(w, r)
 }
 
+// The timeout to connect to backend for websocket.
+const webSocketDialTimeout = time.Duration(30) * time.Second
+
+// Whether the request is to upgrade to websocket.
+func isWebSocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+
+	// the connection maybe "keep-alive, Upgrade".
+	for _, v := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// Proxy the websocket to backend, each stream use isolate tcp connection.
+func (v *proxy) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	ctx := &kernel.Context{}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		oh.WriteError(ctx, w, r, fmt.Errorf("websocket not supported by %v", r.Proto))
+		return
+	}
+
+	// proxy the same stream to the same backend.
+	port := v.pickBackend(streamKey(r.URL.Path))
+	backend, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%v", port), webSocketDialTimeout)
+	if err != nil {
+		oh.WriteError(ctx, w, r, err)
+		return
+	}
+	defer backend.Close()
+	setAccessBackend(r, backend.RemoteAddr().String())
+
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		r.Header.Set("X-Real-IP", ip)
+	}
+	if r.TLS != nil {
+		r.Header.Set("X-Forwarded-Proto", "https")
+	}
+	if err = r.Write(backend); err != nil {
+		oh.WriteError(ctx, w, r, err)
+		return
+	}
+
+	client, brw, err := hj.Hijack()
+	if err != nil {
+		ol.E(ctx, "hijack websocket failed, err is", err)
+		return
+	}
+	defer client.Close()
+	ol.W(ctx, fmt.Sprintf("proxy websocket %v to %v%v", r.RemoteAddr, backend.RemoteAddr(), r.URL.Path))
+
+	// quit when any side closed, the defer close the other side.
+	errs := make(chan error, 2)
+	go func() {
+		// the buffered data of client is read first.
+		_, err := io.Copy(backend, brw.Reader)
+		errs <- err
+	}()
+	go func() {
+		_, err := io.Copy(client, backend)
+		errs <- err
+	}()
+	if err = <-errs; err != nil {
+		ol.W(ctx, "proxy websocket quit, err is", err)
+	}
+}
+
 func (v *proxy) serveHttp(w http.ResponseWriter, r *http.Request) {
 	ctx := &kernel.Context{}
 
-	if v.activePort <= 0 {
+	// log all requests, including the preflight and limited ones.
+	if v.access != nil {
+		var aw *accessWriter
+		aw, r = v.access.wrap(w, r)
+		defer v.access.done(aw, r)
+		w = aw
+	}
+
+	// response the preflight, which is not limited.
+	if v.cors != nil {
+		if v.cors.preflight(w, r) {
+			return
+		}
+		w = v.cors.wrap(w, r)
+	}
+
+	if w = v.limit(w, r); w == nil {
+		return
+	}
+
+	// the matched request to the upstream of remote backends.
+	if u := matchUpstream(v.rules, v.upstreams, r.URL.Path); u != nil {
+		u.serve(w, r)
+		return
+	}
+
+	v.lock.Lock()
+	ready := len(v.activePorts) > 0
+	v.lock.Unlock()
+
+	if !ready {
 		oh.WriteError(ctx, w, r, fmt.Errorf("Backend not ready"))
 		return
 	}
@@ -371,6 +1016,12 @@ func (v *proxy) serveHttp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the flv over websocket.
+	if strings.HasSuffix(p, ".flv") && isWebSocket(r) {
+		v.serveWebSocket(w, r)
+		return
+	}
+
 	hasAnySuffixes := func(s string, suffixes ...string) bool {
 		for _, suffix := range suffixes {
 			if strings.HasSuffix(s, suffix) {
@@ -412,8 +1063,26 @@ func (v *proxy) serveHttp(w http.ResponseWriter, r *http.Request) {
 const (
 	Success       oh.SystemError = 0
 	ApiProxyQuery oh.SystemError = 100 + iota
+	// error when api sessions parse parameters.
+	ApiSessionQuery
 )
 
+// Kick the hls+ session, for example,
+// DELETE /api/v1/sessions?uuid=xxx, or by xpsid or addr.
+func (v *proxy) serveKickSessionApi(ctx ol.Context, r *http.Request) (string, oh.SystemError) {
+	q := r.URL.Query()
+
+	uuid, xpsid, addr := q.Get("uuid"), q.Get("xpsid"), q.Get("addr")
+	if len(uuid) == 0 && len(xpsid) == 0 && len(addr) == 0 {
+		return fmt.Sprintf("require query uuid, xpsid or addr"), ApiSessionQuery
+	}
+
+	if n := v.hlsPlus.kick(ctx, uuid, xpsid, addr); n == 0 {
+		return fmt.Sprintf("session uuid=%v, xpsid=%v, addr=%v not found", uuid, xpsid, addr), ApiSessionQuery
+	}
+	return "", Success
+}
+
 func (v *proxy) serveChangeBackendApi(ctx ol.Context, r *http.Request) (string, oh.SystemError) {
 	var err error
 	q := r.URL.Query()
@@ -423,9 +1092,14 @@ func (v *proxy) serveChangeBackendApi(ctx ol.Context, r *http.Request) (string,
 		return fmt.Sprintf("require query http port"), ApiProxyQuery
 	}
 
-	var port int
-	if port, err = strconv.Atoi(httpPort); err != nil {
-		return fmt.Sprintf("http port is not int, err is %v", err), ApiProxyQuery
+	// the ports seperated by comma, for example, 8081,8082
+	var ports []int
+	for _, s := range strings.Split(httpPort, ",") {
+		var port int
+		if port, err = strconv.Atoi(s); err != nil {
+			return fmt.Sprintf("http port is not int, err is %v", err), ApiProxyQuery
+		}
+		ports = append(ports, port)
 	}
 
 	hasProxyed := func(port int) bool {
@@ -437,11 +1111,17 @@ func (v *proxy) serveChangeBackendApi(ctx ol.Context, r *http.Request) (string,
 		return false
 	}
 
-	ol.T(ctx, fmt.Sprintf("proxy http to %v, previous=%v, ports=%v", port, v.activePort, v.ports))
-	if !hasProxyed(port) {
-		v.ports = append(v.ports, port)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	ol.T(ctx, fmt.Sprintf("proxy http to %v, previous=%v, ports=%v", ports, v.activePorts, v.ports))
+	for _, port := range ports {
+		if !hasProxyed(port) {
+			v.ports = append(v.ports, port)
+		}
 	}
-	v.activePort = port
+	v.activePorts = ports
+	v.ring = NewHashRing(ports)
 
 	return "", Success
 }
@@ -453,8 +1133,16 @@ func main() {
 	var api, port string
 	flag.StringVar(&api, "a", "", "The api tcp://host:port, optional.")
 	flag.StringVar(&port, "l", "", "The listen tcp://host:port, optional.")
+	// test the config and quit.
+	var test bool
+	flag.BoolVar(&test, "t", false, "Test the config and quit.")
+	var format string
+	flag.StringVar(&format, "f", "text", "The format to print the config test, text or json.")
 
 	confFile := oo.ParseArgv("../conf/httplb.json", kernel.Version(), signature)
+	if test {
+		os.Exit(testConfig(confFile, api, port, format, os.Stdout))
+	}
 	fmt.Println("HTTPLB is the load-balance for http flv/hls+ streaming, config is", confFile)
 
 	conf := &HttpLbConfig{}
@@ -482,22 +1170,55 @@ func main() {
 	var httpListener net.Listener
 	addrs := strings.Split(conf.Http.Listen, "://")
 	httpNetwork, httpAddr := addrs[0], addrs[1]
-	if httpListener, err = net.Listen(httpNetwork, httpAddr); err != nil {
+	if httpListener, err = kernel.SdListen(conf.Http.Listen); err != nil {
 		ol.E(ctx, "http listen failed, err is", err)
 		return
 	}
 	defer httpListener.Close()
+	httpListener = kernel.TuneListener(httpListener, conf.Http.Tcp)
+
+	// the https listener, serve h2 and http/1.1 over tls.
+	var httpsListener net.Listener
+	var tlsConfig *tls.Config
+	if conf.Http.Tls.Enabled() {
+		if tlsConfig, err = conf.Http.Tls.Load(); err != nil {
+			ol.E(ctx, "load tls failed, err is", err)
+			return
+		}
+
+		if httpsListener, err = kernel.SdListen(conf.Http.Tls.Listen); err != nil {
+			ol.E(ctx, "https listen failed, err is", err)
+			return
+		}
+		defer httpsListener.Close()
+		httpsListener = kernel.TuneListener(httpsListener, conf.Http.Tcp)
+	}
 
 	var apiListener net.Listener
 	addrs = strings.Split(conf.Api, "://")
-	apiNetwork, apiAddr := addrs[0], addrs[1]
-	if apiListener, err = net.Listen(apiNetwork, apiAddr); err != nil {
+	apiAddr := addrs[1]
+	if apiListener, err = kernel.SdListen(conf.Api); err != nil {
 		ol.E(ctx, "http listen failed, err is", err)
 		return
 	}
 	defer apiListener.Close()
 
+	// open the access log before drop root, the dir maybe owned by root.
+	var access *accessLog
+	if access, err = NewAccessLog(&conf.Http.Access); err != nil {
+		ol.E(ctx, "open access log failed, err is", err)
+		return
+	}
+	defer access.Close()
+
+	// drop root after listen, before serve.
+	if err = conf.DropPrivileges(kernel.DefaultPrivilegeDropper); err != nil {
+		ol.E(ctx, "drop privileges failed, err is", err)
+		return
+	}
+
 	proxy := NewProxy(conf)
+	proxy.access = access
 	oh.Server = signature
 
 	// cleanup the proxy.
@@ -515,18 +1236,44 @@ func main() {
 	wg.QuitForChan(asq)
 	wg.QuitForSignals(ctx, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 
+	// load the hls+ sessions, checkpoint by interval and save when quit.
+	if c := &conf.Http.Sessions; len(c.File) > 0 {
+		if n, err := proxy.hlsPlus.load(c.File); err != nil {
+			ol.W(ctx, "load sessions failed, err is", err)
+		} else {
+			ol.T(ctx, fmt.Sprintf("load %v sessions from %v", n, c.File))
+		}
+
+		interval := defaultCheckpointInterval
+		if c.Interval > 0 {
+			interval = time.Duration(c.Interval) * time.Millisecond
+		}
+
+		closing := make(chan bool)
+		wg.ForkGoroutine(func() {
+			proxy.hlsPlus.checkpoint(ctx, c.File, interval, closing)
+		}, func() {
+			close(closing)
+			if n, err := proxy.hlsPlus.save(c.File); err != nil {
+				ol.W(ctx, "save sessions failed, err is", err)
+			} else {
+				ol.T(ctx, fmt.Sprintf("save %v sessions to %v", n, c.File))
+			}
+		})
+	}
+
+	// the http and https share the handler.
+	handler := http.NewServeMux()
+	handler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		proxy.serveHttp(w, r)
+	})
+
 	// http proxy.
 	wg.ForkGoroutine(func() {
 		ol.E(ctx, "http proxy ready")
 		defer ol.E(ctx, "http proxy ok")
 
-		handler := http.NewServeMux()
-
 		ol.T(ctx, fmt.Sprintf("handle http://%v/", httpAddr))
-		handler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			proxy.serveHttp(w, r)
-		})
-
 		server := &http.Server{Addr: httpNetwork, Handler: handler}
 		if err = server.Serve(httpListener); err != nil {
 			ol.E(ctx, "http serve failed, err is", err)
@@ -536,6 +1283,24 @@ func main() {
 		httpListener.Close()
 	})
 
+	// https proxy.
+	if httpsListener != nil {
+		wg.ForkGoroutine(func() {
+			ol.E(ctx, "https proxy ready")
+			defer ol.E(ctx, "https proxy ok")
+
+			// the certs are loaded to tls config, h2 is enabled by ServeTLS.
+			ol.T(ctx, fmt.Sprintf("handle https://%v/", httpsListener.Addr()))
+			server := &http.Server{Handler: handler, TLSConfig: tlsConfig}
+			if err = server.ServeTLS(httpsListener, "", ""); err != nil {
+				ol.E(ctx, "https serve failed, err is", err)
+				return
+			}
+		}, func() {
+			httpsListener.Close()
+		})
+	}
+
 	// control messages
 	wg.ForkGoroutine(func() {
 		ol.E(ctx, "http handler ready")
@@ -548,7 +1313,7 @@ func main() {
 			oh.WriteVersion(w, r, kernel.Version())
 		})
 
-		ol.T(ctx, fmt.Sprintf("handle http://%v/api/v1/proxy?http=8081", apiAddr))
+		ol.T(ctx, fmt.Sprintf("handle http://%v/api/v1/proxy?http=8081,8082", apiAddr))
 		handler.HandleFunc("/api/v1/proxy", func(w http.ResponseWriter, r *http.Request) {
 			ctx := &kernel.Context{}
 			if msg, err := proxy.serveChangeBackendApi(ctx, r); err != Success {
@@ -558,6 +1323,27 @@ func main() {
 			oh.WriteData(ctx, w, r, nil)
 		})
 
+		ol.T(ctx, fmt.Sprintf("handle http://%v/api/v1/backends", apiAddr))
+		handler.HandleFunc("/api/v1/backends", func(w http.ResponseWriter, r *http.Request) {
+			oh.WriteData(&kernel.Context{}, w, r, proxy.Backends())
+		})
+
+		ol.T(ctx, fmt.Sprintf("handle http://%v/api/v1/sessions", apiAddr))
+		handler.HandleFunc("/api/v1/sessions", func(w http.ResponseWriter, r *http.Request) {
+			ctx := &kernel.Context{}
+			if r.Method != "DELETE" {
+				oh.WriteData(ctx, w, r, proxy.hlsPlus.Sessions())
+				return
+			}
+			if msg, err := proxy.serveKickSessionApi(ctx, r); err != Success {
+				oh.WriteCplxError(ctx, w, r, err, msg)
+				return
+			}
+			oh.WriteData(ctx, w, r, nil)
+		})
+
+		kernel.HandleProfile(ctx, handler, &conf.Profile)
+
 		server := &http.Server{Addr: apiAddr, Handler: handler}
 		if err = server.Serve(apiListener); err != nil {
 			ol.E(ctx, "http serve failed, err is", err)
@@ -567,7 +1353,11 @@ func main() {
 		apiListener.Close()
 	})
 
+	// notify systemd when serving, and ping the watchdog.
+	kernel.SdNotifyReady(ctx, wg)
+
 	// wait util quit event.
 	wg.Wait()
+	kernel.SdNotifyStopping(ctx)
 	return
 }
@@ -0,0 +1,238 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the retry of httplb, failover the idempotent requests to other backends.
+*/
+package main
+
+import (
+	"fmt"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"github.com/ossrs/go-oryx/kernel"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The retry for the GET of m3u8 and ts, when backend is restarting.
+type HttpRetry struct {
+	// The max retries to other backends, 0 to disable.
+	Retries int `json:"retries"`
+	// The backoff in ms before retry, 0 to use default.
+	Backoff kernel.Duration `json:"backoff"`
+	// The consecutive failures to mark backend unhealthy, 0 to use default.
+	Failures int `json:"failures"`
+	// The time in ms to try the unhealthy backend again, 0 to use default.
+	Recover kernel.Duration `json:"recover"`
+}
+
+func (v *HttpRetry) String() string {
+	return fmt.Sprintf("retries=%v,backoff=%v,failures=%v,recover=%v", v.Retries, v.Backoff, v.Failures, v.Recover)
+}
+
+func (v *HttpRetry) Check() error {
+	if v.Retries < 0 || v.Backoff < 0 || v.Failures < 0 || v.Recover < 0 {
+		return fmt.Errorf("retries=%v, backoff=%v, failures=%v, recover=%v should not be negative",
+			v.Retries, v.Backoff, v.Failures, v.Recover)
+	}
+	return nil
+}
+
+const (
+	defaultRetryBackoff  = time.Duration(100) * time.Millisecond
+	defaultRetryFailures = 3
+	defaultRetryRecover  = time.Duration(10) * time.Second
+)
+
+// The health of backend, unhealthy when consecutive failures exceed.
+type backendHealth struct {
+	failures int
+	// when marked unhealthy, zero for healthy.
+	unhealthy time.Time
+}
+
+// The policy to retry and the health of backends.
+type retryPolicy struct {
+	retries  int
+	backoff  time.Duration
+	failures int
+	recover  time.Duration
+	lock     *sync.Mutex
+	// key is the port of backend.
+	health map[int]*backendHealth
+}
+
+func NewRetryPolicy(c *HttpRetry) *retryPolicy {
+	v := &retryPolicy{
+		retries: c.Retries, backoff: defaultRetryBackoff,
+		failures: defaultRetryFailures, recover: defaultRetryRecover,
+		lock: &sync.Mutex{}, health: make(map[int]*backendHealth),
+	}
+	if c.Backoff > 0 {
+		v.backoff = time.Duration(c.Backoff) * time.Millisecond
+	}
+	if c.Failures > 0 {
+		v.failures = c.Failures
+	}
+	if c.Recover > 0 {
+		v.recover = time.Duration(c.Recover) * time.Millisecond
+	}
+	return v
+}
+
+// Whether the backend is healthy, the unhealthy one is tried again after recover.
+func (v *retryPolicy) healthy(port int) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	h, ok := v.health[port]
+	return !ok || h.unhealthy.IsZero() || time.Now().Sub(h.unhealthy) >= v.recover
+}
+
+// The backend failed, mark unhealthy when consecutive failures exceed.
+func (v *retryPolicy) fail(ctx ol.Context, port int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	h, ok := v.health[port]
+	if !ok {
+		h = &backendHealth{}
+		v.health[port] = h
+	}
+
+	if h.failures++; h.failures >= v.failures {
+		if h.unhealthy.IsZero() {
+			ol.W(ctx, fmt.Sprintf("backend %v unhealthy, failures=%v", port, h.failures))
+		}
+		h.unhealthy = time.Now()
+	}
+}
+
+// The backend is ok, reset the failures.
+func (v *retryPolicy) succeed(ctx ol.Context, port int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if h, ok := v.health[port]; ok {
+		if !h.unhealthy.IsZero() {
+			ol.T(ctx, fmt.Sprintf("backend %v recovered, failures=%v", port, h.failures))
+		}
+		delete(v.health, port)
+	}
+}
+
+// The consecutive failures and whether healthy of backend, for api.
+func (v *retryPolicy) status(port int) (failures int, healthy bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if h, ok := v.health[port]; ok {
+		return h.failures, h.unhealthy.IsZero()
+	}
+	return 0, true
+}
+
+// Only the GET of m3u8 and ts is idempotent to retry.
+func retryable(r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	return strings.HasSuffix(r.URL.Path, ".m3u8") || strings.HasSuffix(r.URL.Path, ".ts")
+}
+
+// Whether the backend failed, the connection refused or the backend not ready.
+func backendFailed(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return res.StatusCode == http.StatusBadGateway || res.StatusCode == http.StatusServiceUnavailable
+}
+
+// The transport to retry the request to other backends.
+type retryTransport struct {
+	proxy  *proxy
+	policy *retryPolicy
+	rt     http.RoundTripper
+}
+
+func (v *retryTransport) RoundTrip(r *http.Request) (res *http.Response, err error) {
+	ctx := &kernel.Context{}
+
+	_, p, _ := net.SplitHostPort(r.URL.Host)
+	port, _ := strconv.Atoi(p)
+
+	if !retryable(r) || port == 0 {
+		return v.rt.RoundTrip(r)
+	}
+
+	// skip the unhealthy backend.
+	tried := map[int]bool{port: true}
+	if !v.policy.healthy(port) {
+		if next := v.proxy.nextBackend(port, tried); next > 0 {
+			port = next
+			tried[port] = true
+		}
+	}
+
+	for i := 0; ; i++ {
+		// never modify the request, the url is copied for each retry.
+		req, u := &http.Request{}, *r.URL
+		*req = *r
+		req.URL, u.Host = &u, fmt.Sprintf("127.0.0.1:%v", port)
+
+		// the access log records the last backend tried.
+		res, err = v.rt.RoundTrip(req)
+		setAccessBackend(r, u.Host)
+		if !backendFailed(res, err) {
+			v.policy.succeed(ctx, port)
+			return
+		}
+		v.policy.fail(ctx, port)
+
+		// response the last failure when no more backend.
+		next := v.proxy.nextBackend(port, tried)
+		if i >= v.policy.retries || next == 0 {
+			return
+		}
+		var status int
+		if res != nil {
+			status = res.StatusCode
+			res.Body.Close()
+		}
+
+		ol.W(ctx, fmt.Sprintf("retry %v from %v to %v, retry=%v, status=%v, err=%v",
+			r.URL.Path, port, next, i+1, status, err))
+		select {
+		case <-time.After(v.policy.backoff):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+		port = next
+		tried[port] = true
+	}
+}
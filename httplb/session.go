@@ -0,0 +1,119 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the checkpoint of hls+ sessions, the sessions stick to the same backend after restart.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// The default interval to checkpoint the sessions.
+const defaultCheckpointInterval = time.Duration(10) * time.Second
+
+// Save the sessions to file, write to a temporary file then rename it,
+// so the file is never corrupted when crash.
+func (v *hlsPlusProxy) save(file string) (n int, err error) {
+	ss := v.Sessions()
+
+	var b []byte
+	if b, err = json.Marshal(ss); err != nil {
+		return
+	}
+
+	tmp := file + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return
+	}
+	if err = os.Rename(tmp, file); err != nil {
+		return
+	}
+	return len(ss), nil
+}
+
+// Load the sessions from file, ignore the expired ones and the ones without uuid or xpsid,
+// the tcp connections are lost when restart, so never load the addrs.
+func (v *hlsPlusProxy) load(file string) (n int, err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile(file); err != nil {
+		// no checkpoint for the first start.
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	var ss []*HlsPlusSession
+	if err = json.Unmarshal(b, &ss); err != nil {
+		return 0, fmt.Errorf("parse %v failed, err is %v", file, err)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	die := time.Now().Add(-1 * hlsPlusSessionTimeout)
+	for _, s := range ss {
+		lastUpdate := time.Unix(0, s.LastUpdate*int64(time.Millisecond))
+		if lastUpdate.Before(die) || len(s.Uuid) == 0 && len(s.Xpsid) == 0 || s.Port <= 0 {
+			continue
+		}
+
+		conn := NewHlsPlusVirtualConnection(s.Uuid, s.Xpsid, s.Port)
+		conn.transport = v.proxy.createTransport()
+		conn.pid, conn.lastUpdate, conn.doPrint = s.Pid, lastUpdate, true
+		atomic.StoreInt64(&conn.bytes, s.Bytes)
+
+		if len(s.Uuid) > 0 {
+			v.virtualConns[s.Uuid] = conn
+		}
+		if len(s.Xpsid) > 0 {
+			v.appConns[s.Xpsid] = conn
+		}
+		n++
+	}
+	return
+}
+
+// Checkpoint the sessions to file by interval, util closing.
+func (v *hlsPlusProxy) checkpoint(ctx ol.Context, file string, interval time.Duration, closing chan bool) {
+	for {
+		select {
+		case <-closing:
+			return
+		case <-time.After(interval):
+		}
+
+		if _, err := v.save(file); err != nil {
+			ol.W(ctx, "checkpoint sessions failed, err is", err)
+		}
+	}
+}
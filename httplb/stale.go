@@ -0,0 +1,211 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the stale m3u8 of httplb, serve the last good m3u8 when backend is down.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"github.com/ossrs/go-oryx/kernel"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The stale m3u8 to serve when backend is unreachable, so the restart of backend
+// is invisible to players.
+type HttpStale struct {
+	// The max time in ms to serve the stale m3u8 since the last good one, 0 to disable.
+	Duration kernel.Duration `json:"duration"`
+	// The max segments in the stale m3u8, the latest ones are kept, 0 to keep all.
+	Window int `json:"window"`
+}
+
+func (v *HttpStale) String() string {
+	return fmt.Sprintf("duration=%v,window=%v", v.Duration, v.Window)
+}
+
+func (v *HttpStale) Check() error {
+	if v.Duration < 0 || v.Window < 0 {
+		return fmt.Errorf("duration=%v, window=%v should not be negative", v.Duration, v.Window)
+	}
+	return nil
+}
+
+// The last good m3u8 of backend.
+type staleEntry struct {
+	header http.Header
+	body   []byte
+	update time.Time
+	// whether the stale one is served, to log once.
+	stale bool
+}
+
+// The stale m3u8 of each stream and session.
+type staleCache struct {
+	duration time.Duration
+	window   int
+	entries  map[string]*staleEntry
+	lock     *sync.Mutex
+}
+
+// Create the stale cache, nil when disabled.
+func NewStaleCache(c *HttpStale) *staleCache {
+	if c.Duration <= 0 {
+		return nil
+	}
+	return &staleCache{
+		duration: time.Duration(c.Duration) * time.Millisecond, window: c.Window,
+		entries: make(map[string]*staleEntry), lock: &sync.Mutex{},
+	}
+}
+
+// Whether the backend is unreachable, the reverse proxy response 502 when dial failed.
+func staleFailed(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// Fetch the m3u8 from backend and keep the good one, or serve the stale one when backend failed.
+func (v *staleCache) serve(w http.ResponseWriter, r *http.Request, key string, fetch http.HandlerFunc) {
+	rec := &staleRecorder{header: make(http.Header), status: http.StatusOK}
+	fetch(rec, r)
+
+	now := time.Now()
+	v.lock.Lock()
+	e, ok := v.entries[key]
+	if rec.status == http.StatusOK {
+		e = &staleEntry{header: rec.header, body: rec.body.Bytes(), update: now}
+		v.entries[key] = e
+	} else if ok && staleFailed(rec.status) && now.Sub(e.update) <= v.duration {
+		if !e.stale {
+			e.stale = true
+			ol.W(&kernel.Context{}, fmt.Sprintf("serve stale m3u8 %v, status=%v, update=%v", key, rec.status, e.update))
+		}
+	} else {
+		ok = false
+	}
+	v.lock.Unlock()
+
+	// the backend response, or the backend failed without stale one.
+	if rec.status == http.StatusOK || !ok {
+		rec.writeTo(w)
+		return
+	}
+
+	for k, vs := range e.header {
+		w.Header()[k] = vs
+	}
+	w.Header().Set("X-Cache", "STALE")
+	w.Header().Set("Warning", `110 - "Response is Stale"`)
+	w.Write(shortenM3u8(e.body, v.window))
+}
+
+// Remove the entries expired.
+func (v *staleCache) cleanup(now time.Time) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for key, e := range v.entries {
+		if now.Sub(e.update) > v.duration {
+			delete(v.entries, key)
+		}
+	}
+}
+
+// Keep the latest window segments of m3u8, and increase the media sequence for the removed ones.
+// @remark keep all segments when window is 0.
+func shortenM3u8(body []byte, window int) []byte {
+	// the head before segments, the segments each ends with uri, and the tail after.
+	var head, seg, tail []string
+	var segs [][]string
+	for _, line := range strings.Split(string(body), "\n") {
+		if line = strings.TrimSpace(line); len(line) == 0 {
+			continue
+		}
+
+		if len(segs) == 0 && len(seg) == 0 && !strings.HasPrefix(line, "#EXTINF") {
+			head = append(head, line)
+		} else if seg = append(seg, line); !strings.HasPrefix(line, "#") {
+			segs, seg = append(segs, seg), nil
+		}
+	}
+	tail = seg
+
+	drop := 0
+	if window > 0 && len(segs) > window {
+		drop = len(segs) - window
+	}
+	if drop == 0 {
+		return body
+	}
+
+	lines := make([]string, 0, len(head))
+	for _, line := range head {
+		if s := strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"); s != line {
+			if n, err := strconv.Atoi(s); err == nil {
+				line = fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%v", n+drop)
+			}
+		}
+		lines = append(lines, line)
+	}
+	for _, seg := range segs[drop:] {
+		lines = append(lines, seg...)
+	}
+	lines = append(lines, tail...)
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// The writer to buffer the m3u8 of backend, write to client when not failed.
+type staleRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (v *staleRecorder) Header() http.Header {
+	return v.header
+}
+
+func (v *staleRecorder) WriteHeader(status int) {
+	v.status = status
+}
+
+func (v *staleRecorder) Write(p []byte) (int, error) {
+	return v.body.Write(p)
+}
+
+// Write the buffered response to w.
+func (v *staleRecorder) writeTo(w http.ResponseWriter) {
+	for k, vs := range v.header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(v.status)
+	w.Write(v.body.Bytes())
+}
@@ -0,0 +1,149 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the upstreams of httplb, proxy the matched requests to the remote backends.
+*/
+package main
+
+import (
+	"fmt"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"github.com/ossrs/go-oryx/kernel"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+)
+
+// The upstream pool of remote backends.
+type HttpUpstream struct {
+	// The backends host:port, pick one by consistent hash of session or stream.
+	Backends []string `json:"backends"`
+	// The timeout in ms to dial backend, 0 to use default.
+	DialTimeout kernel.Duration `json:"dial_timeout"`
+	// The timeout in ms to wait for the response header, 0 to wait forever.
+	ResponseTimeout kernel.Duration `json:"response_timeout"`
+}
+
+func (v *HttpUpstream) Check() error {
+	if len(v.Backends) == 0 {
+		return fmt.Errorf("no backends")
+	}
+	for _, addr := range v.Backends {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("backend %v", err)
+		}
+	}
+	if v.DialTimeout < 0 || v.ResponseTimeout < 0 {
+		return fmt.Errorf("dial_timeout=%v, response_timeout=%v should not be negative", v.DialTimeout, v.ResponseTimeout)
+	}
+	return nil
+}
+
+// The rule to proxy the request to upstream, the path must match both the prefix and
+// suffix, for example, prefix /vod/ and suffix .m3u8 for /vod/*.m3u8
+type HttpRule struct {
+	Prefix   string `json:"prefix"`
+	Suffix   string `json:"suffix"`
+	Upstream string `json:"upstream"`
+}
+
+func (v *HttpRule) match(p string) bool {
+	return strings.HasPrefix(p, v.Prefix) && strings.HasSuffix(p, v.Suffix)
+}
+
+// The default timeout to dial the upstream backend.
+const defaultUpstreamDialTimeout = time.Duration(30) * time.Second
+
+// The upstream to proxy to, each upstream use its own transport.
+type upstream struct {
+	name string
+	// the backends and the consistent hash ring of their index.
+	backends []string
+	ring     *hashRing
+	rp       *httputil.ReverseProxy
+}
+
+func NewUpstream(name string, c *HttpUpstream) *upstream {
+	v := &upstream{name: name, backends: c.Backends}
+
+	var indexes []int
+	for i := range c.Backends {
+		indexes = append(indexes, i)
+	}
+	v.ring = NewHashRing(indexes)
+
+	dial := defaultUpstreamDialTimeout
+	if c.DialTimeout > 0 {
+		dial = time.Duration(c.DialTimeout) * time.Millisecond
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   dial,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Duration(c.ResponseTimeout) * time.Millisecond,
+	}
+
+	v.rp = &httputil.ReverseProxy{Transport: transport, Director: v.direct}
+	return v
+}
+
+// Pick the backend by the key, the same session or stream to the same backend.
+func (v *upstream) pick(key string) string {
+	return v.backends[v.ring.get(key)]
+}
+
+func (v *upstream) direct(r *http.Request) {
+	ctx := &kernel.Context{}
+
+	r.URL.Scheme = "http"
+	r.URL.Host = v.pick(sessionKey(r))
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		r.Header.Set("X-Real-IP", ip)
+	}
+	if r.TLS != nil {
+		r.Header.Set("X-Forwarded-Proto", "https")
+	}
+	setAccessBackend(r, r.URL.Host)
+	ol.T(ctx, fmt.Sprintf("proxy upstream %v %v to %v", v.name, r.RemoteAddr, r.URL.String()))
+}
+
+func (v *upstream) serve(w http.ResponseWriter, r *http.Request) {
+	v.rp.ServeHTTP(w, r)
+}
+
+// Match the rules in order, nil if no rule matched.
+func matchUpstream(rules []*HttpRule, upstreams map[string]*upstream, p string) *upstream {
+	for _, rule := range rules {
+		if rule.match(p) {
+			return upstreams[rule.Upstream]
+		}
+	}
+	return nil
+}
@@ -28,28 +28,59 @@ SOFTWARE.
 package kernel
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	oj "github.com/ossrs/go-oryx-lib/json"
 	ol "github.com/ossrs/go-oryx-lib/logger"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
 )
 
 // The basic config, for all modules which will provides these config.
 type Config struct {
 	Logger struct {
+		// The tank for logger, console, file, json, syslog or remote.
 		Tank     string `json:"tank"`
 		FilePath string `json:"file"`
+		// The rotation for tank file and json.
+		Rotate LogRotate `json:"rotate"`
+		// The addr for tank syslog or remote, for example, udp://127.0.0.1:514,
+		// empty for the local syslog.
+		Addr string `json:"addr"`
+		// The tag for tank syslog, or the module for tank json, empty to use the name of binary.
+		Tag string `json:"tag"`
 	} `json:"logger"`
+	// The user and group to run as after listen, empty to keep current.
+	RunAs struct {
+		User  string `json:"user"`
+		Group string `json:"group"`
+	} `json:"runAs"`
+	// The profile to diagnose the performance issues, served by api.
+	Profile Profile `json:"profile"`
 }
 
 // The interface fmt.Stringer
 func (v *Config) String() string {
 	var logger string
-	if v.Logger.Tank == "console" {
-		logger = v.Logger.Tank
-	} else {
-		logger = fmt.Sprintf("tank=%v,file=%v", v.Logger.Tank, v.Logger.FilePath)
+	switch r := &v.Logger; r.Tank {
+	case "file", "json":
+		logger = fmt.Sprintf("tank=%v,file=%v", r.Tank, r.FilePath)
+		if r.Rotate.Enabled() {
+			logger = fmt.Sprintf("%v,rotate(%v)", logger, &r.Rotate)
+		}
+	case "syslog", "remote":
+		logger = fmt.Sprintf("tank=%v,addr=%v,tag=%v", r.Tank, r.Addr, r.Tag)
+	default:
+		logger = r.Tank
 	}
 
+	if r := &v.RunAs; len(r.User) > 0 {
+		return fmt.Sprintf("logger(tank=%v), runAs(user=%v,group=%v)", logger, r.User, r.Group)
+	}
 	return fmt.Sprintf("logger(tank=%v)", logger)
 }
 
@@ -59,23 +90,316 @@ func (v *Config) Close() error {
 	return ol.Close()
 }
 
-// Open the logger, when tank is file, switch logger to file.
+// Open the logger, switch logger to the tank except console.
 func (v *Config) OpenLogger() (err error) {
-	if tank := v.Logger.Tank; tank != "file" && tank != "console" {
-		return fmt.Errorf("Invalid logger tank, must be console/file, actual is %v", tank)
+	r := &v.Logger
+	if !validLogTank(r.Tank) {
+		return fmt.Errorf("Invalid logger tank, must be console/file/json/syslog/remote, actual is %v", r.Tank)
 	}
 
-	if v.Logger.Tank != "file" {
+	var w io.Writer
+	switch r.Tank {
+	case "console":
+		return
+	case "file", "json":
+		if r.Rotate.Enabled() {
+			w, err = NewRotateWriter(r.FilePath, r.Rotate)
+		} else {
+			w, err = os.OpenFile(r.FilePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		}
+		if err != nil {
+			return fmt.Errorf("Open logger %v failed, err is %v", r.FilePath, err)
+		}
+		if r.Tank == "json" {
+			w = NewJsonWriter(w, r.Tag)
+		}
+	case "syslog":
+		if w, err = openSyslog(r.Addr, r.Tag); err != nil {
+			return fmt.Errorf("Open syslog %v failed, err is %v", r.Addr, err)
+		}
+	case "remote":
+		w = NewRemoteWriter(r.Addr)
+	}
+
+	_ = ol.Close()
+	ol.Switch(w)
+
+	return
+}
+
+func validLogTank(tank string) bool {
+	return tank == "console" || tank == "file" || tank == "json" || tank == "syslog" || tank == "remote"
+}
+
+// Whether the logger writes to file, the tank file or json.
+func (v *Config) LogToFile() bool {
+	return v.Logger.Tank == "file" || v.Logger.Tank == "json"
+}
+
+// Check the logger without switch to it, the log file should be writable.
+func (v *Config) CheckLogger() (err error) {
+	r := &v.Logger
+	if !validLogTank(r.Tank) {
+		return NewConfigError("logger.tank", "Invalid logger tank, must be console/file/json/syslog/remote, actual is %v", r.Tank)
+	}
+
+	if r.Tank == "syslog" && len(r.Addr) > 0 || r.Tank == "remote" {
+		if CheckListen(r.Addr) != nil && CheckListenUdp(r.Addr) != nil {
+			return NewConfigError("logger.addr", "Logger addr=%v should be tcp://host:port or udp://host:port", r.Addr)
+		}
+	}
+
+	if c := &r.Rotate; c.Size < 0 || c.Interval < 0 || c.Keep < 0 {
+		return NewConfigError("logger.rotate", "Logger rotate %v should not be negative", c)
+	}
+
+	if !v.LogToFile() {
 		return
 	}
 
 	var f *os.File
 	if f, err = os.OpenFile(v.Logger.FilePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
-		return fmt.Errorf("Open logger %v failed, err is", v.Logger.FilePath, err)
+		return NewConfigError("logger.file", "Logger %v not writable, err is %v", v.Logger.FilePath, err)
 	}
+	return f.Close()
+}
 
-	_ = ol.Close()
-	ol.Switch(f)
+// The error of config, with the path of field, for example, rtmp.listen.
+type ConfigError struct {
+	// The path of field, empty for the whole config.
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func NewConfigError(field, format string, a ...interface{}) error {
+	return &ConfigError{Field: field, Message: fmt.Sprintf(format, a...)}
+}
+
+func (v *ConfigError) Error() string {
+	return v.Message
+}
+
+// Prefix the field of err with prefix, for example, the tls.listen of rtmp
+// is rtmp.tls.listen, the err which is not ConfigError is the error of prefix.
+func ConfigField(prefix string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if r, ok := err.(*ConfigError); ok {
+		field := prefix
+		if len(r.Field) > 0 {
+			field = fmt.Sprintf("%v.%v", prefix, r.Field)
+		}
+		return &ConfigError{Field: field, Message: r.Message}
+	}
+	return &ConfigError{Field: prefix, Message: err.Error()}
+}
+
+// Print the result of config test, like nginx -t.
+// @return the exit code, 0 when ok, 1 when any error.
+func ConfigTest(w io.Writer, c string, errs []error) int {
+	if len(errs) == 0 {
+		fmt.Fprintln(w, "config OK, file is", c)
+		return 0
+	}
+
+	fmt.Fprintln(w, fmt.Sprintf("config failed, file is %v, %v errors:", c, len(errs)))
+	for _, err := range errs {
+		fmt.Fprintln(w, "   ", err)
+	}
+	return 1
+}
+
+// The result of config test in json.
+type ConfigTestResult struct {
+	File   string         `json:"file"`
+	Ok     bool           `json:"ok"`
+	Errors []*ConfigError `json:"errors"`
+}
+
+// Print the result of config test in json, for CI to verify the config.
+// @return the exit code, 0 when ok, 1 when any error.
+func ConfigTestJson(w io.Writer, c string, errs []error) int {
+	r := &ConfigTestResult{File: c, Ok: len(errs) == 0, Errors: make([]*ConfigError, 0)}
+	for _, err := range errs {
+		if e, ok := err.(*ConfigError); ok {
+			r.Errors = append(r.Errors, e)
+		} else {
+			r.Errors = append(r.Errors, &ConfigError{Message: err.Error()})
+		}
+	}
+
+	if b, err := json.Marshal(r); err == nil {
+		fmt.Fprintln(w, string(b))
+	}
+
+	if r.Ok {
+		return 0
+	}
+	return 1
+}
 
+// Print the result of config test in format, text or json.
+// @return the exit code, 0 when ok, 1 when any error.
+func ConfigTestFormat(w io.Writer, c, format string, errs []error) int {
+	if format == "json" {
+		return ConfigTestJson(w, c, errs)
+	}
+	return ConfigTest(w, c, errs)
+}
+
+// The env in config, the name must be upper case, to distinguish from
+// the template variables of worker, for example, ${rtmp}.
+var configEnvPattern = regexp.MustCompile(`^\$\{([A-Z_][A-Z0-9_]*)\}`)
+
+// Decode the json+ config file c to v, which expand the env, for example,
+// "listen": "tcp://:${RTMP_PORT}", and merge the include files before it,
+// for example, "include": ["base.json"], the path is relative to the dir of c.
+// @remark the objects are merged by key, while the other values are replaced.
+func DecodeConfig(c string, v interface{}) (err error) {
+	var m map[string]interface{}
+	if m, err = loadConfig(c, make(map[string]bool)); err != nil {
+		return
+	}
+
+	var b []byte
+	if b, err = json.Marshal(m); err != nil {
+		return
+	}
+
+	// the error of typed field, for example, the duration "30x" of rtmp.drain.grace.
+	if err = json.Unmarshal(b, v); err != nil {
+		if r, ok := err.(*unitError); ok {
+			return NewConfigError(findConfigField(m, r.raw), "%v", err)
+		}
+		if r, ok := err.(*json.UnmarshalTypeError); ok && len(r.Field) > 0 {
+			return NewConfigError(r.Field, "%v", err)
+		}
+	}
 	return
 }
+
+// Load the config c and its includes, the visited is the include path to detect cycle.
+func loadConfig(c string, visited map[string]bool) (m map[string]interface{}, err error) {
+	var p string
+	if p, err = filepath.Abs(c); err != nil {
+		return
+	}
+	if visited[p] {
+		return nil, fmt.Errorf("Include %v cycle", c)
+	}
+	visited[p] = true
+	defer delete(visited, p)
+
+	var b []byte
+	if b, err = readConfig(c); err != nil {
+		return
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err = d.Decode(&m); err != nil {
+		return nil, fmt.Errorf("Decode %v failed, err is %v", c, err)
+	}
+
+	var includes []string
+	switch r := m["include"].(type) {
+	case nil:
+	case string:
+		includes = append(includes, r)
+	case []interface{}:
+		for _, i := range r {
+			if s, ok := i.(string); ok {
+				includes = append(includes, s)
+			} else {
+				return nil, fmt.Errorf("Include %v of %v should be string", i, c)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Include %v of %v should be string or array", r, c)
+	}
+	delete(m, "include")
+
+	merged := make(map[string]interface{})
+	for _, i := range includes {
+		if !filepath.IsAbs(i) {
+			i = filepath.Join(filepath.Dir(c), i)
+		}
+
+		var im map[string]interface{}
+		if im, err = loadConfig(i, visited); err != nil {
+			return
+		}
+		mergeConfig(merged, im)
+	}
+	mergeConfig(merged, m)
+
+	return merged, nil
+}
+
+// Read the json+ config c and expand the env.
+func readConfig(c string) (b []byte, err error) {
+	var f *os.File
+	if f, err = os.Open(c); err != nil {
+		return
+	}
+	defer f.Close()
+
+	if b, err = ioutil.ReadAll(oj.NewJsonPlusReader(f)); err != nil {
+		return
+	}
+
+	var r bytes.Buffer
+	var inString, escaped bool
+	for i := 0; i < len(b); i++ {
+		ch := b[i]
+
+		if ch == '$' {
+			if vs := configEnvPattern.FindSubmatch(b[i:]); vs != nil {
+				value, ok := os.LookupEnv(string(vs[1]))
+				if !ok {
+					return nil, fmt.Errorf("Config %v env %v not set", c, string(vs[1]))
+				}
+
+				// escape the value in string, for example, the quote in password.
+				if inString {
+					e, _ := json.Marshal(value)
+					value = string(e[1 : len(e)-1])
+				}
+
+				r.WriteString(value)
+				i += len(vs[0]) - 1
+				continue
+			}
+		}
+
+		if inString {
+			if escaped {
+				escaped = false
+			} else if ch == '\\' {
+				escaped = true
+			} else if ch == '"' {
+				inString = false
+			}
+		} else if ch == '"' {
+			inString = true
+		}
+		r.WriteByte(ch)
+	}
+
+	return r.Bytes(), nil
+}
+
+// Merge the src to dst, the objects are merged by key, the others are replaced.
+func mergeConfig(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if sv, ok := v.(map[string]interface{}); ok {
+			if dv, ok := dst[k].(map[string]interface{}); ok {
+				mergeConfig(dv, sv)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
@@ -0,0 +1,198 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package kernel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCheckListen(t *testing.T) {
+	for _, addr := range []string{"tcp://:1935", "tcp4://127.0.0.1:1935", "tcp6://[::1]:1935"} {
+		if err := CheckListen(addr); err != nil {
+			t.Errorf("check %v failed, err is %v", addr, err)
+		}
+	}
+
+	for _, addr := range []string{"", ":1935", "udp://:1935", "tcp://tcp://:1935", "tcp://1935", "tcp://:port", "tcp://:65536"} {
+		if err := CheckListen(addr); err == nil {
+			t.Errorf("check %v should fail", addr)
+		}
+	}
+}
+
+func TestCheckListenUdp(t *testing.T) {
+	for _, addr := range []string{"udp://:1935", "udp4://127.0.0.1:1935", "udp6://[::1]:1935"} {
+		if err := CheckListenUdp(addr); err != nil {
+			t.Errorf("check %v failed, err is %v", addr, err)
+		}
+	}
+
+	for _, addr := range []string{"", ":1935", "tcp://:1935", "udp://udp://:1935", "udp://1935", "udp://:65536"} {
+		if err := CheckListenUdp(addr); err == nil {
+			t.Errorf("check %v should fail", addr)
+		}
+	}
+}
+
+func TestConfig_CheckLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &Config{}
+	if err = c.CheckLogger(); err == nil {
+		t.Error("should fail for empty tank")
+	}
+
+	c.Logger.Tank = "console"
+	if err = c.CheckLogger(); err != nil {
+		t.Error("check failed, err is", err)
+	}
+
+	c.Logger.Tank, c.Logger.FilePath = "file", path.Join(dir, "oryx.log")
+	if err = c.CheckLogger(); err != nil {
+		t.Error("check failed, err is", err)
+	}
+
+	c.Logger.FilePath = path.Join(dir, "none", "oryx.log")
+	if err = c.CheckLogger(); err == nil {
+		t.Error("should fail for not writable")
+	}
+}
+
+func TestConfigTest(t *testing.T) {
+	var b bytes.Buffer
+	if code := ConfigTest(&b, "oryx.json", nil); code != 0 || !strings.Contains(b.String(), "config OK") {
+		t.Errorf("invalid code=%v, output=%v", code, b.String())
+	}
+
+	b.Reset()
+	errs := []error{fmt.Errorf("mock error0"), fmt.Errorf("mock error1")}
+	if code := ConfigTest(&b, "oryx.json", errs); code != 1 {
+		t.Errorf("invalid code=%v", code)
+	}
+	if s := b.String(); !strings.Contains(s, "2 errors") || !strings.Contains(s, "mock error0") || !strings.Contains(s, "mock error1") {
+		t.Errorf("invalid output=%v", s)
+	}
+}
+
+func TestConfigTestJson(t *testing.T) {
+	var b bytes.Buffer
+	if code := ConfigTestFormat(&b, "oryx.json", "json", nil); code != 0 || strings.TrimSpace(b.String()) != `{"file":"oryx.json","ok":true,"errors":[]}` {
+		t.Errorf("invalid code=%v, output=%v", code, b.String())
+	}
+
+	b.Reset()
+	errs := []error{
+		ConfigField("rtmp.tls", NewConfigError("listen", "invalid %v", "tcp://443")),
+		ConfigField("worker", fmt.Errorf("mock error")),
+		fmt.Errorf("decode failed"),
+	}
+	if code := ConfigTestFormat(&b, "oryx.json", "json", errs); code != 1 {
+		t.Errorf("invalid code=%v", code)
+	}
+
+	r := &ConfigTestResult{}
+	if err := json.Unmarshal(b.Bytes(), r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Ok || len(r.Errors) != 3 {
+		t.Fatalf("invalid result %v", b.String())
+	}
+	for i, e := range []ConfigError{{"rtmp.tls.listen", "invalid tcp://443"}, {"worker", "mock error"}, {"", "decode failed"}} {
+		if *r.Errors[i] != e {
+			t.Errorf("invalid error %v, expect %v", r.Errors[i], e)
+		}
+	}
+}
+
+func TestDecodeConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		f := path.Join(dir, name)
+		if err := ioutil.WriteFile(f, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	defer os.Unsetenv("ORYX_TEST_PORT")
+	defer os.Unsetenv("ORYX_TEST_SECRET")
+	os.Setenv("ORYX_TEST_PORT", "1935")
+	os.Setenv("ORYX_TEST_SECRET", `p"w\d`)
+
+	write("base.json", `{"logger": {"tank": "file", "file": "base.log"}, "runAs": {"user": "nobody"}, "listen": "tcp://:80"}`)
+	c := write("oryx.json", `{"include": "base.json", "logger": {"file": "${ORYX_TEST_SECRET}.log"},
+		"port": ${ORYX_TEST_PORT}, "listen": "tcp://:${ORYX_TEST_PORT}", "template": "${rtmp}"}`)
+
+	v := &struct {
+		Config
+		Port     int    `json:"port"`
+		Listen   string `json:"listen"`
+		Template string `json:"template"`
+	}{}
+	if err = DecodeConfig(c, v); err != nil {
+		t.Fatal("decode failed, err is", err)
+	}
+
+	// the include is merged by key, and overrided by the config.
+	if v.Logger.Tank != "file" || v.Logger.FilePath != `p"w\d.log` || v.RunAs.User != "nobody" {
+		t.Errorf("invalid config %v", &v.Config)
+	}
+	// the env is expanded in number and string, the template variables are kept.
+	if v.Port != 1935 || v.Listen != "tcp://:1935" || v.Template != "${rtmp}" {
+		t.Errorf("invalid port=%v, listen=%v, template=%v", v.Port, v.Listen, v.Template)
+	}
+
+	c = write("noenv.json", `{"listen": "tcp://:${ORYX_TEST_NOT_SET}"}`)
+	if err = DecodeConfig(c, v); err == nil || !strings.Contains(err.Error(), "ORYX_TEST_NOT_SET") {
+		t.Errorf("should fail for env not set, err is %v", err)
+	}
+
+	write("a.json", `{"include": ["b.json"]}`)
+	c = write("b.json", `{"include": ["a.json"]}`)
+	if err = DecodeConfig(c, v); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("should fail for cycle, err is %v", err)
+	}
+
+	c = write("invalid.json", `{"include": [1]}`)
+	if err = DecodeConfig(c, v); err == nil {
+		t.Error("should fail for invalid include")
+	}
+}
@@ -138,6 +138,31 @@ func ExampleTcpListeners() {
 	}
 }
 
+func ExampleUdpListeners() {
+	// create listener by addresses
+	ls, err := kernel.NewUdpListeners([]string{"udp://:1935", "udp://:8000"})
+	if err != nil {
+		return
+	}
+	defer ls.Close()
+
+	// listen all addresses
+	if err = ls.ListenUDP(); err != nil {
+		return
+	}
+
+	// read packet from any listeners
+	for {
+		p, err := ls.ReadFromUDP()
+		if err != nil {
+			return
+		}
+
+		// response by the listener which got the packet.
+		p.Conn.WriteToUDP(p.Data, p.Addr)
+	}
+}
+
 func ExampleContext() {
 	ctx := &kernel.Context{}
 	ol.T(ctx, "create context ok")
@@ -28,21 +28,189 @@ SOFTWARE.
 package kernel
 
 import (
+	"context"
 	"fmt"
 	ol "github.com/ossrs/go-oryx-lib/logger"
 	"net"
+	"os"
+	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 	"io"
+	"time"
 )
 
+// The connection accepted from tcp listeners.
+type TcpConn struct {
+	*net.TCPConn
+	// The listen addr the connection arrived on, for example, tcp://:1935
+	Listen string
+	// Release the slot of max conns when closed.
+	release *sync.Once
+	limiter *tcpLimiter
+}
+
+// Close the connection, release the slot for the max conns of listener.
+func (v *TcpConn) Close() error {
+	if v.limiter != nil {
+		v.release.Do(v.limiter.release)
+	}
+	return v.TCPConn.Close()
+}
+
+// The limits for each listener, the overflow connections are closed immediately,
+// so the connect flood cannot exhaust the file descriptors.
+type TcpLimits struct {
+	// The max concurrent connections, 0 to disable.
+	// @remark only the TcpConn from AcceptTCP2 release the slot when closed.
+	MaxConns int `json:"max_conns"`
+	// The max connections accepted per second, 0 to disable.
+	MaxAccepts int `json:"max_accepts"`
+}
+
+func (v *TcpLimits) String() string {
+	return fmt.Sprintf("max_conns=%v, max_accepts=%v", v.MaxConns, v.MaxAccepts)
+}
+
+func (v *TcpLimits) Check() error {
+	if v.MaxConns < 0 || v.MaxAccepts < 0 {
+		return fmt.Errorf("max_conns=%v, max_accepts=%v should not be negative", v.MaxConns, v.MaxAccepts)
+	}
+	return nil
+}
+
+// The options applied to each accepted connection, for example, the larger buffers
+// for the high bitrate rtmp ingest over high latency links.
+type TcpOptions struct {
+	// The size in KB of SO_RCVBUF, 0 to use the default of system.
+	RecvBuffer SizeKB `json:"recv_buffer"`
+	// The size in KB of SO_SNDBUF, 0 to use the default of system.
+	SendBuffer SizeKB `json:"send_buffer"`
+	// Whether enable the nagle algorithm, which disables the TCP_NODELAY.
+	Nagle bool `json:"nagle"`
+	// The period in ms of tcp keepalive, 0 to use default.
+	Keepalive Duration `json:"keepalive"`
+}
+
+func (v *TcpOptions) String() string {
+	return fmt.Sprintf("recv_buffer=%vKB, send_buffer=%vKB, nagle=%v, keepalive=%vms", v.RecvBuffer, v.SendBuffer, v.Nagle, v.Keepalive)
+}
+
+func (v *TcpOptions) Check() error {
+	if v.RecvBuffer < 0 || v.SendBuffer < 0 || v.Keepalive < 0 {
+		return fmt.Errorf("recv_buffer=%v, send_buffer=%v, keepalive=%v should not be negative", v.RecvBuffer, v.SendBuffer, v.Keepalive)
+	}
+	return nil
+}
+
+// Apply the options to the connection.
+func (v *TcpOptions) Apply(c *net.TCPConn) (err error) {
+	if v.RecvBuffer > 0 {
+		if err = c.SetReadBuffer(int(v.RecvBuffer) * 1024); err != nil {
+			return
+		}
+	}
+	if v.SendBuffer > 0 {
+		if err = c.SetWriteBuffer(int(v.SendBuffer) * 1024); err != nil {
+			return
+		}
+	}
+	if v.Nagle {
+		if err = c.SetNoDelay(false); err != nil {
+			return
+		}
+	}
+	if v.Keepalive > 0 {
+		if err = c.SetKeepAlive(true); err != nil {
+			return
+		}
+		if err = c.SetKeepAlivePeriod(time.Duration(v.Keepalive) * time.Millisecond); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// The listener to apply the options to each accepted tcp connection,
+// for the listener not TcpListeners, for example, the http server.
+type tunedListener struct {
+	net.Listener
+	options TcpOptions
+}
+
+// Apply the options to the connections accepted from l.
+func TuneListener(l net.Listener, options TcpOptions) net.Listener {
+	return &tunedListener{Listener: l, options: options}
+}
+
+func (v *tunedListener) Accept() (c net.Conn, err error) {
+	if c, err = v.Listener.Accept(); err != nil {
+		return
+	}
+
+	if tc, ok := c.(*net.TCPConn); ok {
+		if err := v.options.Apply(tc); err != nil {
+			ol.W(nil, "listener: tune", c.RemoteAddr(), "failed, err is", err)
+		}
+	}
+	return
+}
+
+// The limiter for a listener, count the concurrent connections and accepts in current second.
+type tcpLimiter struct {
+	limits TcpLimits
+	lock   *sync.Mutex
+	conns  int
+	// the second and number of accepts in it.
+	second  int64
+	accepts int
+}
+
+func newTcpLimiter(limits TcpLimits) *tcpLimiter {
+	return &tcpLimiter{limits: limits, lock: &sync.Mutex{}}
+}
+
+// Acquire a slot for the new connection, false if exceed the limits.
+func (v *tcpLimiter) acquire(now time.Time) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if s := now.Unix(); s != v.second {
+		v.second, v.accepts = s, 0
+	}
+
+	if v.limits.MaxAccepts > 0 && v.accepts >= v.limits.MaxAccepts {
+		return false
+	}
+	if v.limits.MaxConns > 0 && v.conns >= v.limits.MaxConns {
+		return false
+	}
+
+	v.accepts++
+	if v.limits.MaxConns > 0 {
+		v.conns++
+	}
+	return true
+}
+
+func (v *tcpLimiter) release() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.conns--
+}
+
 // The tcp listeners which support reload.
 type TcpListeners struct {
 	// The config and listener objects.
 	addrs     []string
 	listeners []*net.TCPListener
+	// The limits for each listener.
+	limits TcpLimits
+	// The options for each accepted connection.
+	options TcpOptions
 	// Used to get the connection or error for accept.
-	conns  chan *net.TCPConn
+	conns  chan *TcpConn
 	errors chan error
 	// Used to ensure all gorutine quit.
 	wait *sync.WaitGroup
@@ -69,7 +237,7 @@ func NewTcpListeners(addrs []string) (v *TcpListeners, err error) {
 
 	v = &TcpListeners{
 		addrs:       addrs,
-		conns:       make(chan *net.TCPConn),
+		conns:       make(chan *TcpConn),
 		errors:      make(chan error),
 		wait:        &sync.WaitGroup{},
 		closing:     make(chan bool, 1),
@@ -78,7 +246,86 @@ func NewTcpListeners(addrs []string) (v *TcpListeners, err error) {
 	return
 }
 
+// Set the limits for each listener, must be called before ListenTCP.
+func (v *TcpListeners) Limit(limits TcpLimits) {
+	v.limits = limits
+}
+
+// Set the options for each accepted connection, must be called before ListenTCP.
+func (v *TcpListeners) Tune(options TcpOptions) {
+	v.options = options
+}
+
+// Check the listen addr format as network://laddr without listen,
+// for example, tcp://:1935, tcp4://127.0.0.1:1935
+func CheckListen(addr string) (err error) {
+	return checkListen(addr, "tcp")
+}
+
+// Check the udp listen addr format as network://laddr without listen,
+// for example, udp://:1935, udp4://127.0.0.1:1935
+func CheckListenUdp(addr string) (err error) {
+	return checkListen(addr, "udp")
+}
+
+// Check the addr of network, which also can be network4 or network6.
+func checkListen(addr, network string) (err error) {
+	if !strings.HasPrefix(addr, network+"://") && !strings.HasPrefix(addr, network+"4://") && !strings.HasPrefix(addr, network+"6://") {
+		return fmt.Errorf("%v should prefix with %v://, %v4:// or %v6://", addr, network, network, network)
+	}
+	if n := strings.Count(addr, "://"); n != 1 {
+		return fmt.Errorf("%v contains %d network identify", addr, n)
+	}
+
+	var port string
+	if _, port, err = net.SplitHostPort(strings.Split(addr, "://")[1]); err != nil {
+		return fmt.Errorf("%v invalid, err is %v", addr, err)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+		return fmt.Errorf("%v port %v invalid", addr, port)
+	}
+	return
+}
+
+// The env to pass the listeners to child process, the addr and fd seperated by comma,
+// for example, ORYX_LISTEN_FDS=tcp://:1935=3,tcp://:1985=4
+const ListenFdsEnv = "ORYX_LISTEN_FDS"
+
+// Parse the fds inherited from parent, the key is the listen addr.
+func inheritedFds() map[string]uintptr {
+	fds := make(map[string]uintptr)
+	for _, v := range strings.Split(os.Getenv(ListenFdsEnv), ",") {
+		if i := strings.LastIndex(v, "="); i > 0 {
+			if fd, err := strconv.Atoi(v[i+1:]); err == nil && fd > 2 {
+				fds[v[:i]] = uintptr(fd)
+			}
+		}
+	}
+	return fds
+}
+
+// Create the listener of addr from the fd inherited from parent.
+func inheritListener(addr string, fd uintptr) (l net.Listener, err error) {
+	f := os.NewFile(fd, addr)
+	l, err = net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("inherit %v fd %v failed, err is %v", addr, fd, err)
+	}
+	return
+}
+
+// Listen at all addrs, use the listener passed by systemd socket activation, or the fd
+// inherited from parent when the addr in ListenFdsEnv, so the new process can take over
+// the listening sockets of the old one.
 func (v *TcpListeners) ListenTCP() (err error) {
+	return v.ListenTCPContext(context.Background())
+}
+
+// Listen at all addrs, the accept goroutines quit when ctx done,
+// while the listening sockets are kept util Close.
+func (v *TcpListeners) ListenTCPContext(ctx context.Context) (err error) {
+	fds := inheritedFds()
 	for _, addr := range v.addrs {
 		var network, laddr string
 		if vs := strings.Split(addr, "://"); true {
@@ -86,9 +333,17 @@ func (v *TcpListeners) ListenTCP() (err error) {
 		}
 
 		var l net.Listener
-		if l, err = net.Listen(network, laddr); err != nil {
+		if sl := SdListener(addr); sl != nil {
+			l = sl
+		} else if fd, ok := fds[addr]; ok {
+			if l, err = inheritListener(addr, fd); err != nil {
+				return
+			}
+		} else if l, err = net.Listen(network, laddr); err != nil {
 			return
-		} else if l, ok := l.(*net.TCPListener); !ok {
+		}
+
+		if l, ok := l.(*net.TCPListener); !ok {
 			panic("listener: must be *net.TCPListener")
 		} else {
 			v.listeners = append(v.listeners, l)
@@ -96,20 +351,85 @@ func (v *TcpListeners) ListenTCP() (err error) {
 	}
 
 	for i, l := range v.listeners {
-		go v.acceptFrom(l, v.addrs[i])
+		go v.acceptFrom(ctx, l, v.addrs[i], newTcpLimiter(v.limits))
+	}
+
+	return
+}
+
+// The local addrs of listeners, for example, to get the port when listen at port 0.
+func (v *TcpListeners) Addrs() (addrs []net.Addr) {
+	for _, l := range v.listeners {
+		addrs = append(addrs, l.Addr())
 	}
+	return
+}
 
+// Pass the listeners to the child process by ExtraFiles and ListenFdsEnv.
+// @remark the cmd use the env of current process when env is nil.
+func (v *TcpListeners) Inherit(cmd *exec.Cmd) (err error) {
+	for i, l := range v.listeners {
+		if err = InheritListener(cmd, v.addrs[i], l); err != nil {
+			return
+		}
+	}
 	return
 }
 
-func (v *TcpListeners) acceptFrom(l *net.TCPListener, addr string) {
+// Pass the listener of addr to the child process by ExtraFiles and ListenFdsEnv,
+// the child takes over it by ListenTCP or SdListen of the same addr.
+// @remark the user should close the ExtraFiles after the child started.
+func InheritListener(cmd *exec.Cmd, addr string, l *net.TCPListener) (err error) {
+	var f *os.File
+	if f, err = dupListener(l); err != nil {
+		return fmt.Errorf("dup %v failed, err is %v", addr, err)
+	}
+
+	// the fd of ExtraFiles in child start from 3.
+	fds := []string{fmt.Sprintf("%v=%v", addr, 3+len(cmd.ExtraFiles))}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+
+	// ignore the fds inherited by current process.
+	prefix := ListenFdsEnv + "="
+	if cmd.Env == nil {
+		for _, e := range os.Environ() {
+			if !strings.HasPrefix(e, prefix) {
+				cmd.Env = append(cmd.Env, e)
+			}
+		}
+	}
+
+	// append to the fds of previous listeners.
+	for i, e := range cmd.Env {
+		if strings.HasPrefix(e, prefix) {
+			fds = append([]string{strings.TrimPrefix(e, prefix)}, fds...)
+			cmd.Env = append(cmd.Env[:i], cmd.Env[i+1:]...)
+			break
+		}
+	}
+	cmd.Env = append(cmd.Env, prefix+strings.Join(fds, ","))
+	return
+}
+
+func (v *TcpListeners) acceptFrom(cctx context.Context, l *net.TCPListener, addr string, limiter *tcpLimiter) {
 	v.wait.Add(1)
 	defer v.wait.Done()
 
 	ctx := &Context{}
 
+	// interrupt the accept by deadline when canceled, without close the listener.
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-cctx.Done():
+			l.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
 	for {
-		if err := v.doAcceptFrom(ctx, l); err != nil {
+		if err := v.doAcceptFrom(ctx, cctx.Done(), l, addr, limiter); err != nil {
 			if err != io.EOF {
 				ol.W(ctx, "listener:", addr, "quit, err is", err)
 			}
@@ -120,7 +440,7 @@ func (v *TcpListeners) acceptFrom(l *net.TCPListener, addr string) {
 	return
 }
 
-func (v *TcpListeners) doAcceptFrom(ctx ol.Context, l *net.TCPListener) (err error) {
+func (v *TcpListeners) doAcceptFrom(ctx ol.Context, canceled <-chan struct{}, l *net.TCPListener, addr string, limiter *tcpLimiter) (err error) {
 	defer func() {
 		if err != nil && err != io.EOF {
 			select {
@@ -153,20 +473,43 @@ func (v *TcpListeners) doAcceptFrom(ctx ol.Context, l *net.TCPListener) (err err
 		case c := <- v.closing:
 			err = io.EOF
 			v.closing <- c
+		case <-canceled:
+			err = io.EOF
 		default:
 			ol.E(ctx, "listener: accept failed, err is", err)
 		}
 		return
 	}
 
+	// reject the overflow connection immediately, reset without time_wait.
+	if !limiter.acquire(time.Now()) {
+		conn.SetLinger(0)
+		conn.Close()
+		ol.W(ctx, "listener: reject connection", conn.RemoteAddr(), "of", addr, "by limits", &v.limits)
+		return
+	}
+
+	// the connection is ok even the options failed, for example, the buffer is limited by system.
+	if err := v.options.Apply(conn); err != nil {
+		ol.W(ctx, "listener: tune", conn.RemoteAddr(), "of", addr, "failed, err is", err)
+	}
+
+	tc := &TcpConn{TCPConn: conn, Listen: addr, release: &sync.Once{}}
+	if v.limits.MaxConns > 0 {
+		tc.limiter = limiter
+	}
+
 	select {
-	case v.conns <- conn:
+	case v.conns <- tc:
+	case <-canceled:
+		tc.Close()
+		ol.W(ctx, "listener: drop connection", conn.RemoteAddr(), "for canceled")
 	case c := <-v.closing:
 		v.closing <- c
 
 		// we got a connection but not accept by user and listener is closed,
 		// we must close this connection for user never get it.
-		conn.Close()
+		tc.Close()
 		ol.W(ctx, "listener: drop connection", conn.RemoteAddr())
 	}
 
@@ -175,10 +518,30 @@ func (v *TcpListeners) doAcceptFrom(ctx ol.Context, l *net.TCPListener) (err err
 
 // @remark when user closed the listener, err is io.EOF.
 func (v *TcpListeners) AcceptTCP() (c *net.TCPConn, err error) {
+	var conn *TcpConn
+	if conn, err = v.AcceptTCP2(); err != nil {
+		return
+	}
+	return conn.TCPConn, nil
+}
+
+// Accept the connection with the listen addr it arrived on, user can apply
+// different policies for each listen, for example, the internal or public port.
+// @remark when user closed the listener, err is io.EOF.
+func (v *TcpListeners) AcceptTCP2() (c *TcpConn, err error) {
+	return v.AcceptTCPContext(context.Background())
+}
+
+// Accept the connection util ctx done, the pending accept is canceled without close
+// the listeners, so user can quit the component gracefully.
+// @remark when ctx done, err is ctx.Err(), and when listener closed, err is io.EOF.
+func (v *TcpListeners) AcceptTCPContext(ctx context.Context) (c *TcpConn, err error) {
 	var ok bool
 	select {
 	case c, ok = <-v.conns:
 	case err, ok = <-v.errors:
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	case c := <-v.closing:
 		v.closing <- c
 		return nil, io.EOF
@@ -221,3 +584,209 @@ func (v *TcpListeners) Close() (err error) {
 
 	return
 }
+
+// The packet received from udp listener.
+type UdpPacket struct {
+	// The payload of packet.
+	Data []byte
+	// The remote addr of packet.
+	Addr *net.UDPAddr
+	// The listener received the packet, user can response by it.
+	Conn *net.UDPConn
+}
+
+// The max size of udp packet.
+const maxUdpPacket = 65536
+
+// The udp listeners, with the same closing and dispose behavior as TcpListeners.
+type UdpListeners struct {
+	// The config and listener objects.
+	addrs     []string
+	listeners []*net.UDPConn
+	// Used to get the packet or error for read.
+	packets chan *UdpPacket
+	errors  chan error
+	// Used to ensure all gorutine quit.
+	wait *sync.WaitGroup
+	// Used to notify all goroutines to quit.
+	closing chan bool
+	closed  bool
+}
+
+// Listen at addrs format as netowrk://laddr, for example,
+// udp://:1935, udp4://:1935, udp6://1935, udp://0.0.0.0:1935
+func NewUdpListeners(addrs []string) (v *UdpListeners, err error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no listens")
+	}
+
+	for _, addr := range addrs {
+		if err = CheckListenUdp(addr); err != nil {
+			return nil, err
+		}
+	}
+
+	v = &UdpListeners{
+		addrs:   addrs,
+		packets: make(chan *UdpPacket),
+		errors:  make(chan error),
+		wait:    &sync.WaitGroup{},
+		closing: make(chan bool, 1),
+	}
+
+	return
+}
+
+func (v *UdpListeners) ListenUDP() (err error) {
+	for _, addr := range v.addrs {
+		var network, laddr string
+		if vs := strings.Split(addr, "://"); true {
+			network, laddr = vs[0], vs[1]
+		}
+
+		var ua *net.UDPAddr
+		if ua, err = net.ResolveUDPAddr(network, laddr); err != nil {
+			return
+		}
+
+		var l *net.UDPConn
+		if l, err = net.ListenUDP(network, ua); err != nil {
+			return
+		}
+		v.listeners = append(v.listeners, l)
+	}
+
+	for i, l := range v.listeners {
+		v.wait.Add(1)
+		go v.readFrom(l, v.addrs[i])
+	}
+
+	return
+}
+
+// The local addrs of listeners, for example, to get the port when listen at port 0.
+func (v *UdpListeners) Addrs() (addrs []net.Addr) {
+	for _, l := range v.listeners {
+		addrs = append(addrs, l.LocalAddr())
+	}
+	return
+}
+
+func (v *UdpListeners) readFrom(l *net.UDPConn, addr string) {
+	defer v.wait.Done()
+
+	ctx := &Context{}
+
+	for {
+		if err := v.doReadFrom(ctx, l); err != nil {
+			if err != io.EOF {
+				ol.W(ctx, "listener:", addr, "quit, err is", err)
+			}
+			return
+		}
+	}
+}
+
+func (v *UdpListeners) doReadFrom(ctx ol.Context, l *net.UDPConn) (err error) {
+	defer func() {
+		if err != nil && err != io.EOF {
+			select {
+			case v.errors <- err:
+			case c := <-v.closing:
+				v.closing <- c
+			}
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			if err != nil {
+				ol.E(ctx, "listener: recover from", r, "and err is", err)
+				return
+			}
+
+			if r, ok := r.(error); ok {
+				err = r
+			} else {
+				err = fmt.Errorf("system error %v", r)
+			}
+			ol.E(ctx, "listener: recover from", err)
+		}
+	}()
+
+	b := make([]byte, maxUdpPacket)
+
+	var n int
+	var addr *net.UDPAddr
+	if n, addr, err = l.ReadFromUDP(b); err != nil {
+		// when disposed, ignore any error for it's user closed listener.
+		select {
+		case c := <-v.closing:
+			err = io.EOF
+			v.closing <- c
+		default:
+			ol.E(ctx, "listener: read failed, err is", err)
+		}
+		return
+	}
+
+	select {
+	case v.packets <- &UdpPacket{Data: b[:n], Addr: addr, Conn: l}:
+	case c := <-v.closing:
+		v.closing <- c
+
+		// the packet is dropped for listener is closed.
+		ol.W(ctx, "listener: drop packet from", addr)
+	}
+
+	return
+}
+
+// Read packet from any listener.
+// @remark when user closed the listener, err is io.EOF.
+func (v *UdpListeners) ReadFromUDP() (p *UdpPacket, err error) {
+	var ok bool
+	select {
+	case p, ok = <-v.packets:
+	case err, ok = <-v.errors:
+	case c := <-v.closing:
+		v.closing <- c
+		return nil, io.EOF
+	}
+
+	// when chan closed, the listener is disposed.
+	if !ok {
+		return nil, io.EOF
+	}
+	return
+}
+
+// io.Closer
+// User should never reuse the closed instance.
+func (v *UdpListeners) Close() (err error) {
+	if v.closed {
+		return
+	}
+	v.closed = true
+
+	// unblock all listener and user goroutines
+	select {
+	case v.closing <- true:
+	default:
+	}
+
+	// interrupt all listeners.
+	for _, v := range v.listeners {
+		if r := v.Close(); r != nil {
+			err = r
+		}
+	}
+
+	// wait for all listener internal goroutines to quit.
+	v.wait.Wait()
+
+	// close channels to unblock the user goroutine to ReadFromUDP()
+	close(v.packets)
+	close(v.errors)
+
+	return
+}
@@ -0,0 +1,459 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package kernel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUdpListeners(t *testing.T) {
+	if _, err := NewUdpListeners(nil); err == nil {
+		t.Error("should fail for no listens")
+	}
+	if _, err := NewUdpListeners([]string{"tcp://:1935"}); err == nil {
+		t.Error("should fail for tcp")
+	}
+
+	ls, err := NewUdpListeners([]string{"udp4://127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ls.ListenUDP(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.DialUDP("udp4", nil, ls.Addrs()[0].(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err = c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := ls.ReadFromUDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Data) != "hello" {
+		t.Errorf("invalid data %v", string(p.Data))
+	}
+
+	// response by the listener.
+	if _, err = p.Conn.WriteToUDP([]byte("world"), p.Addr); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 16)
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if n, err := c.Read(b); err != nil || string(b[:n]) != "world" {
+		t.Errorf("invalid response %v, err is %v", string(b[:n]), err)
+	}
+
+	// the reader is unblocked when closed.
+	if err = ls.Close(); err != nil {
+		t.Error("close failed, err is", err)
+	}
+	if _, err = ls.ReadFromUDP(); err != io.EOF {
+		t.Errorf("should be EOF, err is %v", err)
+	}
+	if err = ls.Close(); err != nil {
+		t.Error("close twice failed, err is", err)
+	}
+}
+
+// When set, the test is the child process to serve the inherited listener.
+func TestTcpListeners_AcceptTCP2(t *testing.T) {
+	addrs := []string{"tcp://127.0.0.1:0", "tcp4://127.0.0.1:0"}
+	ls, err := NewTcpListeners(addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	if err = ls.ListenTCP(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, laddr := range ls.Addrs() {
+		c, err := net.Dial("tcp", laddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		conn, err := ls.AcceptTCP2()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if conn.Listen != addrs[i] || conn.RemoteAddr().String() != c.LocalAddr().String() {
+			t.Errorf("invalid conn %v from %v, listen %v", conn.RemoteAddr(), conn.Listen, addrs[i])
+		}
+	}
+}
+
+const inheritChildEnv = "KERNEL_TEST_INHERIT_CHILD"
+
+// When set, the child listen by SdListen.
+const inheritSdEnv = "KERNEL_TEST_INHERIT_SD"
+
+func TestTcpListeners_InheritChild(t *testing.T) {
+	addr := os.Getenv(inheritChildEnv)
+	if addr == "" {
+		t.Skip("not child")
+	}
+
+	var c net.Conn
+	if os.Getenv(inheritSdEnv) == "1" {
+		l, err := SdListen(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		if c, err = l.Accept(); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		ls, err := NewTcpListeners([]string{addr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ls.Close()
+
+		if err = ls.ListenTCP(); err != nil {
+			t.Fatal(err)
+		}
+		if c, err = ls.AcceptTCP(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer c.Close()
+	c.Write([]byte("child"))
+}
+
+func TestTcpListeners_Inherit(t *testing.T) {
+	testInherit(t, false)
+}
+
+func TestSdListen_Inherit(t *testing.T) {
+	testInherit(t, true)
+}
+
+// Start the child which takes over the listener, by SdListen when sd.
+func testInherit(t *testing.T, sd bool) {
+	addr := "tcp://127.0.0.1:0"
+	ls, err := NewTcpListeners([]string{addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	if err = ls.ListenTCP(); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestTcpListeners_InheritChild$")
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%v=%v", inheritChildEnv, addr))
+	if sd {
+		cmd.Env = append(cmd.Env, inheritSdEnv+"=1")
+	}
+	if err = ls.Inherit(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if env := cmd.Env[len(cmd.Env)-1]; env != ListenFdsEnv+"="+addr+"=3" || len(cmd.ExtraFiles) != 1 {
+		t.Errorf("invalid env %v, files %v", env, cmd.ExtraFiles)
+	}
+
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+
+	// the old process close the listener, the child serve the same socket.
+	laddr := ls.Addrs()[0].String()
+	ls.Close()
+	for _, f := range cmd.ExtraFiles {
+		f.Close()
+	}
+
+	c, err := net.Dial("tcp", laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if b, err := ioutil.ReadAll(c); err != nil || string(b) != "child" {
+		t.Errorf("invalid response %v, err is %v", string(b), err)
+	}
+}
+
+func TestInheritListener(t *testing.T) {
+	defer os.Unsetenv(ListenFdsEnv)
+	os.Setenv(ListenFdsEnv, "tcp://:1935=3")
+
+	var ls []*net.TCPListener
+	for i := 0; i < 2; i++ {
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		ls = append(ls, l)
+	}
+
+	cmd := exec.Command(os.Args[0])
+	for i, l := range ls {
+		if err := InheritListener(cmd, fmt.Sprintf("tcp://:%v", i), l); err != nil {
+			t.Skip("inherit not supported, err is", err)
+		}
+	}
+	for _, f := range cmd.ExtraFiles {
+		f.Close()
+	}
+
+	// the fds inherited by current process are ignored.
+	var envs []string
+	for _, env := range cmd.Env {
+		if strings.HasPrefix(env, ListenFdsEnv+"=") {
+			envs = append(envs, env)
+		}
+	}
+	if len(envs) != 1 || envs[0] != ListenFdsEnv+"=tcp://:0=3,tcp://:1=4" || len(cmd.ExtraFiles) != 2 {
+		t.Errorf("invalid envs %v, files %v", envs, cmd.ExtraFiles)
+	}
+}
+
+func TestInheritedFds(t *testing.T) {
+	defer os.Unsetenv(ListenFdsEnv)
+
+	os.Setenv(ListenFdsEnv, "tcp://:1935=3,tcp://[::1]:1985=4,tcp://:8080=x,tcp://:8081=1,invalid")
+	fds := inheritedFds()
+	if len(fds) != 2 || fds["tcp://:1935"] != 3 || fds["tcp://[::1]:1985"] != 4 {
+		t.Errorf("invalid fds %v", fds)
+	}
+
+	os.Setenv(ListenFdsEnv, "")
+	if fds = inheritedFds(); len(fds) != 0 {
+		t.Errorf("invalid fds %v", fds)
+	}
+}
+
+func TestTcpListeners_Limit(t *testing.T) {
+	ls, err := NewTcpListeners([]string{"tcp://127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	ls.Limit(TcpLimits{MaxConns: 1})
+	if err = ls.ListenTCP(); err != nil {
+		t.Fatal(err)
+	}
+	laddr := ls.Addrs()[0].String()
+
+	c0, err := net.Dial("tcp", laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c0.Close()
+
+	conn, err := ls.AcceptTCP2()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the overflow connection is reset by listener, maybe even when dial.
+	if c1, err := net.Dial("tcp", laddr); err == nil {
+		defer c1.Close()
+		c1.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if _, err = c1.Read(make([]byte, 1)); err == nil {
+			t.Error("should reject overflow connection")
+		}
+	}
+
+	// accept again when the slot released.
+	conn.Close()
+	c2, err := net.Dial("tcp", laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if conn, err = ls.AcceptTCP2(); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestTcpListeners_Tune(t *testing.T) {
+	ls, err := NewTcpListeners([]string{"tcp://127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	options := TcpOptions{RecvBuffer: 256, SendBuffer: 256, Nagle: true, Keepalive: 3000}
+	ls.Tune(options)
+	if err = ls.ListenTCP(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.Dial("tcp", ls.Addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	conn, err := ls.AcceptTCP2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = options.Apply(conn.TCPConn); err != nil {
+		t.Error("apply failed, err is", err)
+	}
+
+	// the listener of http server.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := TuneListener(l, options)
+	defer tl.Close()
+
+	if c, err = net.Dial("tcp", l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c, err := tl.Accept(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := c.(*net.TCPConn); !ok {
+		t.Errorf("invalid conn %v", c)
+	} else {
+		c.Close()
+	}
+
+	if err = (&TcpOptions{RecvBuffer: -1}).Check(); err == nil {
+		t.Error("should fail for negative buffer")
+	}
+}
+
+func TestTcpLimiter(t *testing.T) {
+	now := time.Now()
+	l := newTcpLimiter(TcpLimits{MaxAccepts: 2})
+	if !l.acquire(now) || !l.acquire(now) {
+		t.Error("should accept")
+	}
+	if l.acquire(now) {
+		t.Error("should reject by max accepts")
+	}
+	if !l.acquire(now.Add(time.Second)) {
+		t.Error("should accept in next second")
+	}
+
+	l = newTcpLimiter(TcpLimits{MaxConns: 1})
+	if !l.acquire(now) || l.acquire(now) {
+		t.Error("should reject by max conns")
+	}
+	if l.release(); !l.acquire(now) {
+		t.Error("should accept when released")
+	}
+}
+
+func TestTcpListeners_AcceptTCPContext(t *testing.T) {
+	ls, err := NewTcpListeners([]string{"tcp://127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	if err = ls.ListenTCP(); err != nil {
+		t.Fatal(err)
+	}
+
+	// cancel the pending accept, the listener is still ok.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = ls.AcceptTCPContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("should canceled, err is %v", err)
+	}
+
+	c, err := net.Dial("tcp", ls.Addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	conn, err := ls.AcceptTCPContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestTcpListeners_ListenTCPContext(t *testing.T) {
+	ls, err := NewTcpListeners([]string{"tcp://127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err = ls.ListenTCPContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the accept goroutines quit when canceled, never got the connection.
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+
+	c, err := net.Dial("tcp", ls.Addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	actx, acancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer acancel()
+	if _, err = ls.AcceptTCPContext(actx); err != context.DeadlineExceeded {
+		t.Errorf("should not accept, err is %v", err)
+	}
+
+	if err = ls.Close(); err != nil {
+		t.Error("close failed, err is", err)
+	}
+}
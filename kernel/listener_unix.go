@@ -0,0 +1,63 @@
+//go:build !windows
+// +build !windows
+
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the listener utilities for unix.
+*/
+package kernel
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// Dup the fd of listener for child process, which keep in non-blocking mode.
+// @remark the l.File() is a socket file, whose Fd() set the fd to blocking when
+// exec the child, so the accept of parent blocks in syscall and never closed.
+func dupListener(l *net.TCPListener) (f *os.File, err error) {
+	var rc syscall.RawConn
+	if rc, err = l.SyscallConn(); err != nil {
+		return
+	}
+
+	var fd int
+	if cerr := rc.Control(func(s uintptr) {
+		syscall.ForkLock.RLock()
+		defer syscall.ForkLock.RUnlock()
+		if fd, err = syscall.Dup(int(s)); err == nil {
+			syscall.CloseOnExec(fd)
+		}
+	}); cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return
+	}
+
+	return os.NewFile(uintptr(fd), "listener"), nil
+}
@@ -0,0 +1,300 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the log tanks for oryx, the file with rotation, the json, the syslog and the remote.
+*/
+package kernel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The rotation of log file, rotate when exceed the size or interval.
+type LogRotate struct {
+	// The max size in MB of log file, 0 to disable.
+	Size SizeMB `json:"size"`
+	// The interval in ms to rotate, 0 to disable.
+	Interval Duration `json:"interval"`
+	// The number of rotated files to keep, 0 to keep all.
+	Keep int `json:"keep"`
+}
+
+func (v *LogRotate) String() string {
+	return fmt.Sprintf("size=%vMB,interval=%vms,keep=%v", v.Size, v.Interval, v.Keep)
+}
+
+func (v *LogRotate) Enabled() bool {
+	return v.Size > 0 || v.Interval > 0
+}
+
+// The layout of time appended to the rotated file, sorted by time.
+const logRotateLayout = "20060102-150405.000"
+
+// The writer of log file, rename the file with time when rotate.
+type rotateWriter struct {
+	conf LogRotate
+	path string
+	lock *sync.Mutex
+	f    *os.File
+	size int64
+	// the time to rotate by interval.
+	next time.Time
+}
+
+func NewRotateWriter(p string, conf LogRotate) (v *rotateWriter, err error) {
+	v = &rotateWriter{conf: conf, path: p, lock: &sync.Mutex{}}
+	if err = v.open(time.Now()); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Open the log file, the current file is kept when failed.
+func (v *rotateWriter) open(now time.Time) (err error) {
+	var f *os.File
+	if f, err = os.OpenFile(v.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+		return
+	}
+
+	var fi os.FileInfo
+	if fi, err = f.Stat(); err != nil {
+		f.Close()
+		return
+	}
+
+	if v.f != nil {
+		v.f.Close()
+	}
+	v.f, v.size = f, fi.Size()
+	v.next = now.Add(v.conf.Interval.Duration())
+	return
+}
+
+func (v *rotateWriter) Write(p []byte) (n int, err error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.f == nil {
+		return 0, fmt.Errorf("closed")
+	}
+
+	// keep writing to current file when rotate failed.
+	now := time.Now()
+	if v.exceed(now, len(p)) {
+		if err := v.rotate(now); err != nil {
+			fmt.Fprintln(os.Stderr, "rotate log", v.path, "failed, err is", err)
+		}
+	}
+
+	n, err = v.f.Write(p)
+	v.size += int64(n)
+	return
+}
+
+// Whether exceed the size or interval when write n bytes.
+func (v *rotateWriter) exceed(now time.Time, n int) bool {
+	if c := &v.conf; c.Size > 0 && v.size > 0 && v.size+int64(n) > int64(c.Size)*1024*1024 {
+		return true
+	}
+	return v.conf.Interval > 0 && !now.Before(v.next)
+}
+
+// Rotate to a new log file, keep writing to the current one when failed, for example,
+// the dir is not writable after the privileges dropped.
+func (v *rotateWriter) rotate(now time.Time) (err error) {
+	rotated := fmt.Sprintf("%v.%v", v.path, now.Format(logRotateLayout))
+	if err = os.Rename(v.path, rotated); err != nil {
+		return
+	}
+
+	if err = v.open(now); err != nil {
+		// restore the current file, and retry after next interval or size.
+		os.Rename(rotated, v.path)
+		v.size, v.next = 0, now.Add(v.conf.Interval.Duration())
+		return
+	}
+
+	return v.cleanup()
+}
+
+// Remove the oldest rotated files exceed the keep.
+func (v *rotateWriter) cleanup() (err error) {
+	if v.conf.Keep <= 0 {
+		return
+	}
+
+	var files []string
+	if files, err = filepath.Glob(v.path + ".*"); err != nil {
+		return
+	}
+	sort.Strings(files)
+
+	for i := 0; i < len(files)-v.conf.Keep; i++ {
+		if r := os.Remove(files[i]); r != nil {
+			err = r
+		}
+	}
+	return
+}
+
+func (v *rotateWriter) Close() (err error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.f != nil {
+		err = v.f.Close()
+		v.f = nil
+	}
+	return
+}
+
+const (
+	// the timeout to dial and write the remote log.
+	remoteLogTimeout = time.Duration(1) * time.Second
+	// the interval to reconnect the remote log, the logs are dropped before that.
+	remoteLogRetry = time.Duration(3) * time.Second
+)
+
+// The writer to remote tcp or udp, reconnect when failed.
+// @remark never block the logger, drop the logs when disconnected.
+type remoteWriter struct {
+	network string
+	addr    string
+	lock    *sync.Mutex
+	conn    net.Conn
+	// the time to reconnect.
+	retry time.Time
+}
+
+// Create the writer for addr, for example, tcp://127.0.0.1:1514
+func NewRemoteWriter(addr string) *remoteWriter {
+	vs := strings.SplitN(addr, "://", 2)
+	return &remoteWriter{network: vs[0], addr: vs[1], lock: &sync.Mutex{}}
+}
+
+func (v *remoteWriter) Write(p []byte) (n int, err error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	if v.conn == nil {
+		if now.Before(v.retry) {
+			return 0, fmt.Errorf("drop log for %v://%v disconnected", v.network, v.addr)
+		}
+		if v.conn, err = net.DialTimeout(v.network, v.addr, remoteLogTimeout); err != nil {
+			v.retry = now.Add(remoteLogRetry)
+			return
+		}
+	}
+
+	v.conn.SetWriteDeadline(now.Add(remoteLogTimeout))
+	if n, err = v.conn.Write(p); err != nil {
+		v.conn.Close()
+		v.conn, v.retry = nil, now.Add(remoteLogRetry)
+	}
+	return
+}
+
+func (v *remoteWriter) Close() (err error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.conn != nil {
+		err = v.conn.Close()
+		v.conn = nil
+	}
+	return
+}
+
+// The line of go-oryx-lib logger, for example, "[trace] 2016/01/02 15:04:05 [1234][5678] msg",
+// where the 1234 is the pid and the optional 5678 is the cid of context.
+var logLineRegexp = regexp.MustCompile(`^\[(\w+)\] (\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?) \[(\d+)\](?:\[(\d+)\])? ?`)
+
+// The json object of log line.
+type jsonLog struct {
+	Time   string `json:"time"`
+	Level  string `json:"level,omitempty"`
+	Pid    int    `json:"pid"`
+	Cid    int    `json:"cid,omitempty"`
+	Module string `json:"module"`
+	Msg    string `json:"msg"`
+}
+
+// The writer to format each line of logger as json, for ELK to ingest and correlate
+// the logs by the cid of context.
+// @remark the line not matched is written with the time, pid and module of writer.
+type jsonWriter struct {
+	w      io.Writer
+	module string
+}
+
+// Create the json writer to w, the module is the name of binary when empty.
+func NewJsonWriter(w io.Writer, module string) *jsonWriter {
+	if len(module) == 0 {
+		module = filepath.Base(os.Args[0])
+	}
+	return &jsonWriter{w: w, module: module}
+}
+
+func (v *jsonWriter) Write(p []byte) (n int, err error) {
+	line := strings.TrimRight(string(p), "\n")
+	l := &jsonLog{Time: time.Now().Format(time.RFC3339Nano), Pid: os.Getpid(), Module: v.module, Msg: line}
+
+	if m := logLineRegexp.FindStringSubmatch(line); m != nil {
+		l.Level, l.Msg = m[1], line[len(m[0]):]
+		if t, err := time.ParseInLocation("2006/01/02 15:04:05", m[2], time.Local); err == nil {
+			l.Time = t.Format(time.RFC3339Nano)
+		}
+		l.Pid, _ = strconv.Atoi(m[3])
+		l.Cid, _ = strconv.Atoi(m[4])
+	}
+
+	var b []byte
+	if b, err = json.Marshal(l); err != nil {
+		return
+	}
+	if _, err = v.w.Write(append(b, '\n')); err != nil {
+		return
+	}
+	return len(p), nil
+}
+
+func (v *jsonWriter) Close() (err error) {
+	if c, ok := v.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return
+}
@@ -0,0 +1,193 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package kernel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotateWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := path.Join(dir, "oryx.log")
+	w, err := NewRotateWriter(p, LogRotate{Size: 1, Keep: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// rotate when exceed the size, the time of rotated files are different.
+	b := make([]byte, 1024*1024)
+	for i := 0; i < 4; i++ {
+		if _, err = w.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	if files, _ := filepath.Glob(p + ".*"); len(files) != 2 {
+		t.Errorf("invalid rotated files %v", files)
+	}
+	if fi, err := os.Stat(p); err != nil || fi.Size() != int64(len(b)) {
+		t.Errorf("invalid log file %v, err is %v", fi, err)
+	}
+
+	// rotate when exceed the interval.
+	w.conf, w.next = LogRotate{Interval: 1000}, time.Now().Add(time.Second)
+	if w.exceed(time.Now(), 1) {
+		t.Error("should not rotate")
+	}
+	if !w.exceed(w.next, 1) {
+		t.Error("should rotate")
+	}
+
+	// keep writing to the current file when open failed.
+	w.path = dir
+	if err = w.open(time.Now()); err == nil {
+		t.Error("should fail")
+	}
+	if _, err = w.Write([]byte("ok")); err != nil {
+		t.Error("write failed, err is", err)
+	}
+	if fi, err := os.Stat(p); err != nil || fi.Size() != int64(len(b))+2 {
+		t.Errorf("invalid log file %v, err is %v", fi, err)
+	}
+}
+
+func TestRemoteWriter(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewRemoteWriter("tcp://" + l.Addr().String())
+	defer w.Close()
+
+	if _, err = w.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if line, err := bufio.NewReader(c).ReadString('\n'); err != nil || line != "hello\n" {
+		t.Errorf("invalid log %v, err is %v", line, err)
+	}
+
+	// drop the logs before reconnect.
+	l.Close()
+	w.Close()
+	if _, err = w.Write([]byte("world\n")); err == nil {
+		t.Error("should fail when remote closed")
+	}
+	if _, err = w.Write([]byte("world\n")); err == nil || w.retry.IsZero() {
+		t.Error("should drop before retry")
+	}
+}
+
+func TestConfig_CheckLoggerTanks(t *testing.T) {
+	c := &Config{}
+	for _, tank := range []string{"syslog", "remote"} {
+		c.Logger.Tank, c.Logger.Addr = tank, "udp://127.0.0.1:514"
+		if err := c.CheckLogger(); err != nil {
+			t.Errorf("check %v failed, err is %v", tank, err)
+		}
+	}
+
+	c.Logger.Addr = ""
+	if err := c.CheckLogger(); err == nil {
+		t.Error("should fail for remote without addr")
+	}
+
+	dir, err := ioutil.TempDir("", "logger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c.Logger.Tank, c.Logger.FilePath = "json", path.Join(dir, "oryx.log")
+	if err := c.CheckLogger(); err != nil {
+		t.Errorf("check json failed, err is %v", err)
+	}
+
+	c.Logger.Tank = "console"
+	c.Logger.Rotate.Keep = -1
+	if err := c.CheckLogger(); err == nil {
+		t.Error("should fail for negative rotate")
+	}
+}
+
+func TestJsonWriter(t *testing.T) {
+	var b bytes.Buffer
+	w := NewJsonWriter(&b, "shell")
+
+	if _, err := w.Write([]byte("[trace] 2016/01/02 15:04:05 [1234][5678] hello oryx\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("not a line of logger\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expect 2 lines, actual is %v", lines)
+	}
+
+	var l jsonLog
+	if err := json.Unmarshal([]byte(lines[0]), &l); err != nil {
+		t.Fatal(err)
+	}
+	if l.Level != "trace" || l.Pid != 1234 || l.Cid != 5678 || l.Module != "shell" || l.Msg != "hello oryx" {
+		t.Errorf("invalid log %+v", l)
+	}
+	if tm, err := time.Parse(time.RFC3339Nano, l.Time); err != nil || tm.Year() != 2016 || tm.Second() != 5 {
+		t.Errorf("invalid time %v, err is %v", l.Time, err)
+	}
+
+	l = jsonLog{}
+	if err := json.Unmarshal([]byte(lines[1]), &l); err != nil {
+		t.Fatal(err)
+	}
+	if l.Level != "" || l.Pid != os.Getpid() || l.Msg != "not a line of logger" {
+		t.Errorf("invalid log %+v", l)
+	}
+}
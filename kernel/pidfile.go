@@ -0,0 +1,148 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the pid file for oryx, to prevent to start twice.
+*/
+package kernel
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The pid file, which contains the pid of process.
+// @remark the stale file of dead process is taken over.
+type PidFile struct {
+	// The path of pid file.
+	Path string
+	// The pid written to file.
+	pid int
+}
+
+func NewPidFile(path string) *PidFile {
+	return &PidFile{Path: path}
+}
+
+// Create the pid file exclusively, or verify the exists one,
+// fail when the recorded process is alive and is our binary.
+// @remark the pid is written to a temp file then linked to path, so the file
+// is never empty for others to read, and the same pid as ours is stale, for
+// example, the pid 1 in container restarted after crash.
+func (v *PidFile) Acquire() (err error) {
+	pid := os.Getpid()
+
+	var tmp string
+	if tmp, err = writeTempPid(v.Path, pid); err != nil {
+		return
+	}
+	defer os.Remove(tmp)
+
+	// retry once after remove the stale file.
+	for i := 0; i < 2; i++ {
+		if err = os.Link(tmp, v.Path); err == nil {
+			v.pid = pid
+			return
+		}
+
+		if !os.IsExist(err) {
+			return
+		}
+
+		// the recorded process is alive, refuse to start.
+		if prev, err := readPidFile(v.Path); err == nil && prev != pid && processAlive(prev) && isOurBinary(prev) {
+			return fmt.Errorf("process %v is running, pid file %v", prev, v.Path)
+		}
+
+		// the file is stale, take over it.
+		if err = os.Remove(v.Path); err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+
+	return fmt.Errorf("acquire pid file %v failed, err is %v", v.Path, err)
+}
+
+// Write the pid to a temp file in the dir of path.
+func writeTempPid(path string, pid int) (tmp string, err error) {
+	var f *os.File
+	if f, err = ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+"."); err != nil {
+		return
+	}
+	tmp = f.Name()
+
+	_, err = f.WriteString(fmt.Sprintf("%v\n", pid))
+	if r := f.Close(); err == nil {
+		err = r
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return
+}
+
+// The interface io.Closer
+// Remove the pid file when it's ours.
+func (v *PidFile) Close() error {
+	if v.pid == 0 {
+		return nil
+	}
+
+	// ignore the file taken over by others.
+	if pid, err := readPidFile(v.Path); err != nil || pid != v.pid {
+		return nil
+	}
+
+	v.pid = 0
+	return os.Remove(v.Path)
+}
+
+// Read the pid in file.
+func readPidFile(path string) (pid int, err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// Whether the process is our binary, best effort by /proc cmdline on linux.
+// @remark assume it's ours when cmdline not available.
+func isOurBinary(pid int) bool {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%v/cmdline", pid))
+	if err != nil || len(b) == 0 {
+		return true
+	}
+
+	// the args seperated by 0, the first one is binary.
+	bin := strings.SplitN(string(b), "\x00", 2)[0]
+	return filepath.Base(bin) == filepath.Base(os.Args[0])
+}
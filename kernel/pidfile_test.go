@@ -0,0 +1,149 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package kernel
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+// The env to run the test as a live process, until stdin closed.
+const pidChildEnv = "ORYX_TEST_PID_CHILD"
+
+func TestPidFile_Child(t *testing.T) {
+	if os.Getenv(pidChildEnv) == "" {
+		t.Skip("not child")
+	}
+	ioutil.ReadAll(os.Stdin)
+}
+
+func TestPidFile_Acquire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := NewPidFile(path.Join(dir, "oryx.pid"))
+	if err = f.Acquire(); err != nil {
+		t.Fatal("acquire failed, err is", err)
+	}
+	if pid, err := readPidFile(f.Path); err != nil || pid != os.Getpid() {
+		t.Errorf("invalid pid=%v, err is %v", pid, err)
+	}
+
+	// the same pid as ours is stale, for example, restart in container.
+	if err = NewPidFile(f.Path).Acquire(); err != nil {
+		t.Error("should take over our pid, err is", err)
+	}
+	if fs, _ := ioutil.ReadDir(dir); len(fs) != 1 {
+		t.Errorf("the temp file should removed, %v", fs)
+	}
+
+	// the process of our binary is alive, refuse to start.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestPidFile_Child$")
+	cmd.Env = append(os.Environ(), pidChildEnv+"=1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+
+	if err = ioutil.WriteFile(f.Path, []byte(fmt.Sprint(cmd.Process.Pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = NewPidFile(f.Path).Acquire(); err == nil {
+		t.Error("should refuse for live process")
+	}
+	if err = ioutil.WriteFile(f.Path, []byte(fmt.Sprint(os.Getpid())), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// remove the file when closed.
+	if err = f.Close(); err != nil {
+		t.Error("close failed, err is", err)
+	}
+	if _, err = os.Stat(f.Path); !os.IsNotExist(err) {
+		t.Errorf("should removed, err is %v", err)
+	}
+}
+
+func TestPidFile_Stale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the pid of dead process.
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err = cmd.Run(); err != nil {
+		t.Fatal("run failed, err is", err)
+	}
+
+	contents := []string{fmt.Sprint(cmd.Process.Pid), "invalid", ""}
+	// the process is alive but not our binary, for example, the init.
+	if _, err := os.Stat("/proc/1/cmdline"); err == nil {
+		contents = append(contents, "1")
+	}
+
+	p := path.Join(dir, "oryx.pid")
+	for _, content := range contents {
+		if err = ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		f := NewPidFile(p)
+		if err = f.Acquire(); err != nil {
+			t.Errorf("take over %v failed, err is %v", content, err)
+		} else if pid, err := readPidFile(p); err != nil || pid != os.Getpid() {
+			t.Errorf("invalid pid=%v, err is %v", pid, err)
+		}
+		f.Close()
+	}
+
+	// the file taken over by others is not removed.
+	f := NewPidFile(p)
+	if err = f.Acquire(); err != nil {
+		t.Fatal("acquire failed, err is", err)
+	}
+	if err = ioutil.WriteFile(p, []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Error("close failed, err is", err)
+	}
+	if _, err = os.Stat(p); err != nil {
+		t.Errorf("should not removed, err is %v", err)
+	}
+}
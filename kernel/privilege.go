@@ -0,0 +1,90 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the privileges for oryx, to drop root after listen.
+*/
+package kernel
+
+import (
+	"fmt"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The dropper to switch the user and group of process.
+type PrivilegeDropper interface {
+	// Lookup the uid of user and gid of group,
+	// use the primary group of user when group is empty.
+	Lookup(user, group string) (uid, gid int, err error)
+	// Change the owner of file, for the process to write it after drop.
+	Chown(path string, uid, gid int) error
+	// Switch the process to uid and gid, clear the supplementary groups.
+	Drop(uid, gid int) error
+}
+
+// Drop the privileges of process to the run as user and group, ignore when no user.
+// @remark user must call it after listeners created, before serving.
+// @remark the log file and files are chowned before drop, for process to write them.
+// @remark the dir of log file must be writable by the user to rotate, which is not chowned.
+func (v *Config) DropPrivileges(d PrivilegeDropper, files ...string) (err error) {
+	r := &v.RunAs
+	if len(r.User) == 0 {
+		return
+	}
+
+	var uid, gid int
+	if uid, gid, err = d.Lookup(r.User, r.Group); err != nil {
+		return fmt.Errorf("Lookup user=%v group=%v failed, err is %v", r.User, r.Group, err)
+	}
+
+	if v.LogToFile() {
+		files = append([]string{v.Logger.FilePath}, files...)
+	}
+	for _, f := range files {
+		if err = d.Chown(f, uid, gid); err != nil {
+			return fmt.Errorf("Chown %v to uid=%v gid=%v failed, err is %v", f, uid, gid, err)
+		}
+	}
+
+	if err = d.Drop(uid, gid); err != nil {
+		return fmt.Errorf("Drop to uid=%v gid=%v failed, err is %v", uid, gid, err)
+	}
+
+	// the rotate creates new log file, which requires the dir to be writable.
+	if c := &v.Logger; v.LogToFile() && c.Rotate.Enabled() {
+		var f *os.File
+		dir := filepath.Dir(c.FilePath)
+		if f, err = ioutil.TempFile(dir, ".rotate"); err != nil {
+			return fmt.Errorf("Rotate log requires dir %v writable by user=%v, err is %v", dir, r.User, err)
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	ol.T(nil, fmt.Sprintf("Run as user=%v(%v) group=%v(%v)", r.User, uid, r.Group, gid))
+	return
+}
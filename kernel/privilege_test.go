@@ -0,0 +1,91 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package kernel
+
+import (
+	"fmt"
+	"testing"
+)
+
+// The fake dropper, record the calls.
+type fakePrivilegeDropper struct {
+	calls []string
+	err   error
+}
+
+func (v *fakePrivilegeDropper) Lookup(user, group string) (uid, gid int, err error) {
+	v.calls = append(v.calls, fmt.Sprintf("lookup %v %v", user, group))
+	return 1000, 100, nil
+}
+
+func (v *fakePrivilegeDropper) Chown(path string, uid, gid int) error {
+	v.calls = append(v.calls, fmt.Sprintf("chown %v %v %v", path, uid, gid))
+	return nil
+}
+
+func (v *fakePrivilegeDropper) Drop(uid, gid int) error {
+	v.calls = append(v.calls, fmt.Sprintf("drop %v %v", uid, gid))
+	return v.err
+}
+
+func TestConfig_DropPrivileges(t *testing.T) {
+	// ignore when no user.
+	c := &Config{}
+	d := &fakePrivilegeDropper{}
+	if err := c.DropPrivileges(d, "oryx.pid"); err != nil || len(d.calls) != 0 {
+		t.Errorf("should ignore, err is %v, calls=%v", err, d.calls)
+	}
+
+	// chown the log file and files before drop.
+	c.Logger.Tank, c.Logger.FilePath = "file", "oryx.log"
+	c.RunAs.User = "nobody"
+	if err := c.DropPrivileges(d, "oryx.pid"); err != nil {
+		t.Error("drop failed, err is", err)
+	}
+	expect := []string{"lookup nobody ", "chown oryx.log 1000 100", "chown oryx.pid 1000 100", "drop 1000 100"}
+	if fmt.Sprint(d.calls) != fmt.Sprint(expect) {
+		t.Errorf("invalid calls=%v, expect %v", d.calls, expect)
+	}
+
+	// fail when the dir of log is not writable to rotate.
+	d = &fakePrivilegeDropper{}
+	c.Logger.FilePath, c.Logger.Rotate.Size = "not-exists/oryx.log", 1
+	if err := c.DropPrivileges(d); err == nil {
+		t.Error("should fail")
+	}
+	c.Logger.Rotate.Size = 0
+
+	// fail hard when drop failed.
+	d = &fakePrivilegeDropper{err: fmt.Errorf("mock error")}
+	c.Logger.Tank = "console"
+	c.RunAs.Group = "nogroup"
+	if err := c.DropPrivileges(d); err == nil {
+		t.Error("should fail")
+	}
+	expect = []string{"lookup nobody nogroup", "drop 1000 100"}
+	if fmt.Sprint(d.calls) != fmt.Sprint(expect) {
+		t.Errorf("invalid calls=%v, expect %v", d.calls, expect)
+	}
+}
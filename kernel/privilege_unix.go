@@ -0,0 +1,82 @@
+//go:build !windows
+// +build !windows
+
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the privileges for unix, switch the uid and gid of process.
+*/
+package kernel
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// The dropper to switch the user and group of process.
+var DefaultPrivilegeDropper PrivilegeDropper = &unixPrivilegeDropper{}
+
+type unixPrivilegeDropper struct {
+}
+
+func (v *unixPrivilegeDropper) Lookup(name, group string) (uid, gid int, err error) {
+	var u *user.User
+	if u, err = user.Lookup(name); err != nil {
+		return
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return
+	}
+
+	// use the primary group of user.
+	gs := u.Gid
+	if len(group) > 0 {
+		var g *user.Group
+		if g, err = user.LookupGroup(group); err != nil {
+			return
+		}
+		gs = g.Gid
+	}
+
+	gid, err = strconv.Atoi(gs)
+	return
+}
+
+func (v *unixPrivilegeDropper) Chown(path string, uid, gid int) error {
+	return os.Chown(path, uid, gid)
+}
+
+// @remark the gid must be changed before uid, which requires root.
+func (v *unixPrivilegeDropper) Drop(uid, gid int) (err error) {
+	if err = syscall.Setgroups([]int{}); err != nil {
+		return
+	}
+	if err = syscall.Setgid(gid); err != nil {
+		return
+	}
+	return syscall.Setuid(uid)
+}
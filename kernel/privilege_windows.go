@@ -0,0 +1,52 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the privileges for windows, which not support to switch user.
+*/
+package kernel
+
+import (
+	ol "github.com/ossrs/go-oryx-lib/logger"
+)
+
+// The dropper to switch the user and group of process.
+var DefaultPrivilegeDropper PrivilegeDropper = &windowsPrivilegeDropper{}
+
+// Ignore the run as user, for windows not support setuid.
+type windowsPrivilegeDropper struct {
+}
+
+func (v *windowsPrivilegeDropper) Lookup(user, group string) (uid, gid int, err error) {
+	ol.W(nil, "ignore run as user", user, "group", group, "for windows")
+	return
+}
+
+func (v *windowsPrivilegeDropper) Chown(path string, uid, gid int) error {
+	return nil
+}
+
+func (v *windowsPrivilegeDropper) Drop(uid, gid int) error {
+	return nil
+}
@@ -73,10 +73,13 @@ func NewProcessPool() *ProcessPool {
 
 // Start new process, user can start many processes.
 func (v *ProcessPool) Start(ctx ol.Context, name string, arg ...string) (c *exec.Cmd, err error) {
-	v.ctx = ctx
+	return v.StartCmd(ctx, exec.Command(name, arg...))
+}
 
-	// create command and start process.
-	var cmd *exec.Cmd = exec.Command(name, arg...)
+// Start the process of cmd, user can setup the env and dir of cmd.
+func (v *ProcessPool) StartCmd(ctx ol.Context, cmd *exec.Cmd) (c *exec.Cmd, err error) {
+	v.ctx = ctx
+	name, arg := cmd.Path, cmd.Args[1:]
 
 	if err = cmd.Start(); err != nil {
 		ol.E(ctx, "start", name, arg, "failed, err is", err)
@@ -0,0 +1,255 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the profile of oryx, serve the pprof and capture the profile to file by api.
+*/
+package kernel
+
+import (
+	"crypto/subtle"
+	"fmt"
+	oh "github.com/ossrs/go-oryx-lib/http"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The profile to diagnose the performance issues in production, without rebuild.
+type Profile struct {
+	// Whether serve the pprof at /debug/pprof/ and the capture at /api/v1/profile of api.
+	Enabled bool `json:"enabled"`
+	// The token to access the profile, in query token or header "Authorization: Bearer token".
+	Token string `json:"token"`
+	// The dir to save the captured profiles, empty to use the temp dir.
+	Dir string `json:"dir"`
+}
+
+// Check the profile, the token is required when enabled.
+func (v *Config) CheckProfile() error {
+	r := &v.Profile
+	if !r.Enabled {
+		return nil
+	}
+
+	if len(r.Token) == 0 {
+		return NewConfigError("profile.token", "Profile requires token when enabled")
+	}
+	if len(r.Dir) > 0 {
+		if fi, err := os.Stat(r.Dir); err != nil || !fi.IsDir() {
+			return NewConfigError("profile.dir", "Profile dir=%v should be a dir, err is %v", r.Dir, err)
+		}
+	}
+	return nil
+}
+
+const (
+	// the default and max duration of cpu profile.
+	defaultProfileDuration = time.Duration(30) * time.Second
+	maxProfileDuration     = time.Duration(10) * time.Minute
+)
+
+// The profiler serve the pprof and capture.
+type profiler struct {
+	conf Profile
+}
+
+// Serve the profile on mux when enabled, use http.DefaultServeMux when mux is nil.
+// @remark never import net/http/pprof, which always serve on http.DefaultServeMux without token.
+func HandleProfile(ctx ol.Context, mux *http.ServeMux, c *Profile) {
+	if !c.Enabled {
+		return
+	}
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+
+	v := &profiler{conf: *c}
+	ol.T(ctx, "handle /debug/pprof/ and /api/v1/profile?type=cpu&duration=30000")
+	mux.HandleFunc("/debug/pprof/", v.auth(v.servePprof))
+	mux.HandleFunc("/api/v1/profile", v.auth(v.serveCapture))
+}
+
+// Reject the request without token.
+func (v *profiler) auth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if a := r.Header.Get("Authorization"); strings.HasPrefix(a, "Bearer ") {
+			token = strings.TrimPrefix(a, "Bearer ")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(v.conf.Token)) != 1 {
+			ol.W(&Context{}, fmt.Sprintf("reject profile %v from %v", r.URL.Path, r.RemoteAddr))
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Serve the pprof for go tool pprof, for example,
+//      go tool pprof http://127.0.0.1:1985/debug/pprof/heap?token=xxx
+func (v *profiler) servePprof(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+
+	// list the profiles.
+	if len(name) == 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "profile")
+		for _, p := range pprof.Profiles() {
+			fmt.Fprintln(w, p.Name(), p.Count())
+		}
+		return
+	}
+
+	// the cpu profile in seconds.
+	if name == "profile" {
+		d := defaultProfileDuration
+		if s, err := strconv.Atoi(q.Get("seconds")); err == nil && s > 0 {
+			d = time.Duration(s) * time.Second
+		}
+		if d > maxProfileDuration {
+			d = maxProfileDuration
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if err := pprof.StartCPUProfile(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		select {
+		case <-time.After(d):
+		case <-r.Context().Done():
+		}
+		pprof.StopCPUProfile()
+		return
+	}
+
+	p := pprof.Lookup(name)
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if name == "heap" && len(q.Get("gc")) > 0 {
+		runtime.GC()
+	}
+	debug, _ := strconv.Atoi(q.Get("debug"))
+	if debug > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	p.WriteTo(w, debug)
+}
+
+// The captured profile, for api.
+type ProfileCapture struct {
+	Type string `json:"type"`
+	File string `json:"file"`
+	// the duration in ms of cpu profile.
+	Duration int   `json:"duration"`
+	Size     int64 `json:"size"`
+}
+
+// Capture the cpu profile in duration ms or the heap to file, for example,
+//      /api/v1/profile?type=cpu&duration=30000&token=xxx
+//      /api/v1/profile?type=heap&token=xxx
+func (v *profiler) serveCapture(w http.ResponseWriter, r *http.Request) {
+	ctx := &Context{}
+	q := r.URL.Query()
+
+	c := &ProfileCapture{Type: q.Get("type")}
+	if c.Type != "cpu" && c.Type != "heap" {
+		oh.WriteError(ctx, w, r, fmt.Errorf("profile type=%v should be cpu or heap", c.Type))
+		return
+	}
+
+	dir := v.conf.Dir
+	if len(dir) == 0 {
+		dir = os.TempDir()
+	}
+	c.File = filepath.Join(dir, fmt.Sprintf("%v-%v-%v.pprof", c.Type, os.Getpid(), time.Now().Format("20060102-150405.000")))
+
+	var err error
+	if c.Type == "cpu" {
+		d := defaultProfileDuration
+		if ms, err := strconv.Atoi(q.Get("duration")); err == nil && ms > 0 {
+			d = time.Duration(ms) * time.Millisecond
+		}
+		if d > maxProfileDuration {
+			d = maxProfileDuration
+		}
+		c.Duration = int(d / time.Millisecond)
+		err = captureCpuProfile(c.File, d)
+	} else {
+		err = captureHeapProfile(c.File)
+	}
+	if err != nil {
+		ol.W(ctx, fmt.Sprintf("capture %v profile failed, err is %v", c.Type, err))
+		oh.WriteError(ctx, w, r, err)
+		return
+	}
+
+	if fi, err := os.Stat(c.File); err == nil {
+		c.Size = fi.Size()
+	}
+	ol.T(ctx, fmt.Sprintf("capture %v profile to %v, duration=%v, size=%v", c.Type, c.File, c.Duration, c.Size))
+	oh.WriteData(ctx, w, r, c)
+}
+
+// Capture the cpu profile in d to file, only one at the same time.
+func captureCpuProfile(file string, d time.Duration) (err error) {
+	var f *os.File
+	if f, err = os.Create(file); err != nil {
+		return
+	}
+	defer f.Close()
+
+	if err = pprof.StartCPUProfile(f); err != nil {
+		os.Remove(file)
+		return
+	}
+	time.Sleep(d)
+	pprof.StopCPUProfile()
+	return
+}
+
+func captureHeapProfile(file string) (err error) {
+	var f *os.File
+	if f, err = os.Create(file); err != nil {
+		return
+	}
+	defer f.Close()
+
+	runtime.GC()
+	return pprof.WriteHeapProfile(f)
+}
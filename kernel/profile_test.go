@@ -0,0 +1,111 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package kernel
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestConfig_CheckProfile(t *testing.T) {
+	c := &Config{}
+	if err := c.CheckProfile(); err != nil {
+		t.Error("disabled should ok, err is", err)
+	}
+
+	c.Profile.Enabled = true
+	if err := c.CheckProfile(); err == nil {
+		t.Error("should fail without token")
+	}
+
+	c.Profile.Token, c.Profile.Dir = "secret", "/not/exists/dir"
+	if err := c.CheckProfile(); err == nil {
+		t.Error("should fail for invalid dir")
+	}
+}
+
+func TestHandleProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mux := http.NewServeMux()
+	HandleProfile(&Context{}, mux, &Profile{Enabled: true, Token: "secret", Dir: dir})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(p string, h http.Header) (int, string) {
+		r, _ := http.NewRequest("GET", server.URL+p, nil)
+		for k, vs := range h {
+			r.Header[k] = vs
+		}
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+
+	// reject without token.
+	for _, p := range []string{"/debug/pprof/heap", "/api/v1/profile?type=heap", "/debug/pprof/heap?token=bad"} {
+		if code, _ := get(p, nil); code != http.StatusUnauthorized {
+			t.Errorf("%v should reject, code is %v", p, code)
+		}
+	}
+
+	if code, body := get("/debug/pprof/goroutine?debug=1", http.Header{"Authorization": []string{"Bearer secret"}}); code != http.StatusOK || !strings.Contains(body, "goroutine") {
+		t.Errorf("invalid goroutine %v %v", code, body)
+	}
+	if code, _ := get("/debug/pprof/none?token=secret", nil); code != http.StatusNotFound {
+		t.Errorf("invalid code %v", code)
+	}
+
+	// capture the profiles to file.
+	for _, p := range []string{"/api/v1/profile?type=heap&token=secret", "/api/v1/profile?type=cpu&duration=50&token=secret"} {
+		_, body := get(p, nil)
+		res := struct {
+			Code int            `json:"code"`
+			Data ProfileCapture `json:"data"`
+		}{}
+		if err := json.Unmarshal([]byte(body), &res); err != nil || res.Code != 0 {
+			t.Errorf("invalid response %v, err is %v", body, err)
+			continue
+		}
+		if c := &res.Data; !strings.HasPrefix(c.File, dir) || c.Size == 0 {
+			t.Errorf("invalid capture %+v", c)
+		} else if _, err := os.Stat(c.File); err != nil {
+			t.Errorf("no capture file, err is %v", err)
+		}
+	}
+}
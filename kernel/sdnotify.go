@@ -0,0 +1,231 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the notify for systemd, the sd_notify protocol, and the socket activation.
+*/
+package kernel
+
+import (
+	"fmt"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The states to notify systemd.
+const (
+	// The service is ready, for Type=notify.
+	SdReady = "READY=1"
+	// The service is stopping.
+	SdStopping = "STOPPING=1"
+	// Ping the watchdog, for WatchdogSec.
+	SdWatchdog = "WATCHDOG=1"
+)
+
+// Notify the state to systemd by the NOTIFY_SOCKET,
+// ignore when not started by systemd.
+// @return whether the state is sent.
+func SdNotify(state string) (sent bool, err error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if len(name) == 0 {
+		return
+	}
+
+	var c *net.UnixConn
+	if c, err = net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"}); err != nil {
+		return
+	}
+	defer c.Close()
+
+	if _, err = c.Write([]byte(state)); err != nil {
+		return
+	}
+	return true, nil
+}
+
+// The interval to ping watchdog, half of WATCHDOG_USEC, 0 when disabled.
+func SdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	// ignore the watchdog for other process.
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// Ping the watchdog of systemd in interval, util closing.
+func SdWatchdogPing(ctx ol.Context, interval time.Duration, closing chan bool) {
+	for {
+		if _, err := SdNotify(SdWatchdog); err != nil {
+			ol.W(ctx, fmt.Sprintf("ping watchdog failed, err is %v", err))
+		}
+
+		select {
+		case <-time.After(interval):
+		case c := <-closing:
+			closing <- c
+			return
+		}
+	}
+}
+
+// Notify systemd ready, and ping the watchdog in the worker group when enabled.
+// @remark user should notify SdStopping when quit, see SdNotifyStopping.
+func SdNotifyReady(ctx ol.Context, wg *WorkerGroup) {
+	// ping the watchdog of systemd, the process is restarted when wedged.
+	if interval := SdWatchdogInterval(); interval > 0 {
+		closing := make(chan bool, 1)
+		wg.ForkGoroutine(func() {
+			ol.T(ctx, fmt.Sprintf("Watchdog: ready, interval=%v", interval))
+			defer ol.T(ctx, "Watchdog: ping ok.")
+
+			SdWatchdogPing(ctx, interval, closing)
+		}, func() {
+			select {
+			case closing <- true:
+			default:
+			}
+		})
+	}
+
+	if ok, err := SdNotify(SdReady); err != nil {
+		ol.W(ctx, "Notify systemd ready failed, err is", err)
+	} else if ok {
+		ol.T(ctx, "Notify systemd ready ok.")
+	}
+}
+
+// Notify systemd stopping, when quit.
+func SdNotifyStopping(ctx ol.Context) {
+	if _, err := SdNotify(SdStopping); err != nil {
+		ol.W(ctx, "Notify systemd stopping failed, err is", err)
+	}
+}
+
+// The first fd passed by systemd socket activation, SD_LISTEN_FDS_START.
+const sdListenFdsStart = 3
+
+// The listeners passed by systemd, claimed by the listen addr.
+var sdListeners []*net.TCPListener
+var sdListenersLock = &sync.Mutex{}
+var sdListenersOnce = &sync.Once{}
+
+// Parse the fds passed by systemd socket activation, ignore the fds for other process.
+// @remark the env is unset, so the child processes never use the fds.
+func sdListenFds() (fds []uintptr) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	for i := 0; err == nil && i < n; i++ {
+		fds = append(fds, uintptr(sdListenFdsStart+i))
+	}
+
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(env)
+	}
+	return
+}
+
+// Load the listeners passed by systemd, ignore the fds not tcp listener.
+func sdLoadListeners() {
+	ctx := &Context{}
+	for _, fd := range sdListenFds() {
+		f := os.NewFile(fd, fmt.Sprintf("systemd-%v", fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			ol.W(ctx, fmt.Sprintf("ignore systemd fd %v, err is %v", fd, err))
+			continue
+		}
+
+		if l, ok := l.(*net.TCPListener); ok {
+			sdListeners = append(sdListeners, l)
+			ol.T(ctx, fmt.Sprintf("systemd fd %v listen at %v", fd, l.Addr()))
+		} else {
+			ol.W(ctx, fmt.Sprintf("ignore systemd fd %v, listen at %v", fd, l.Addr()))
+			l.Close()
+		}
+	}
+}
+
+// Claim the listener passed by systemd which is bound at addr, for example, tcp://:1935
+// matches the ListenStream=1935, so the process never bind it again.
+// @return nil when not found, the process should listen itself.
+func SdListener(addr string) *net.TCPListener {
+	sdListenersOnce.Do(sdLoadListeners)
+
+	vs := strings.Split(addr, "://")
+	if len(vs) != 2 {
+		return nil
+	}
+	want, err := net.ResolveTCPAddr(vs[0], vs[1])
+	if err != nil {
+		return nil
+	}
+
+	sdListenersLock.Lock()
+	defer sdListenersLock.Unlock()
+
+	for i, l := range sdListeners {
+		got, ok := l.Addr().(*net.TCPAddr)
+		if !ok || got.Port != want.Port {
+			continue
+		}
+		// the addr without host matches the socket bound at any address.
+		if want.IP == nil && got.IP.IsUnspecified() || want.IP.Equal(got.IP) {
+			sdListeners = append(sdListeners[:i], sdListeners[i+1:]...)
+			return l
+		}
+	}
+	return nil
+}
+
+// Listen at addr, for example, tcp://:1985, use the listener passed by systemd when matched,
+// or the one inherited from parent when the addr in ListenFdsEnv.
+func SdListen(addr string) (net.Listener, error) {
+	if l := SdListener(addr); l != nil {
+		return l, nil
+	}
+	if fd, ok := inheritedFds()[addr]; ok {
+		return inheritListener(addr, fd)
+	}
+
+	vs := strings.Split(addr, "://")
+	if len(vs) != 2 {
+		return nil, fmt.Errorf("invalid listen %v", addr)
+	}
+	return net.Listen(vs[0], vs[1])
+}
@@ -0,0 +1,204 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package kernel
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSdNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if sent, err := SdNotify(SdReady); sent || err != nil {
+		t.Errorf("should ignore, sent=%v, err is %v", sent, err)
+	}
+
+	dir, err := ioutil.TempDir("", "kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the fake notify socket of systemd.
+	addr := &net.UnixAddr{Name: path.Join(dir, "notify.sock"), Net: "unixgram"}
+	c, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		t.Fatal("listen failed, err is", err)
+	}
+	defer c.Close()
+
+	os.Setenv("NOTIFY_SOCKET", addr.Name)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	// simulate the start, watchdog and stop.
+	if sent, err := SdNotify(SdReady); !sent || err != nil {
+		t.Errorf("notify failed, sent=%v, err is %v", sent, err)
+	}
+	closing := make(chan bool, 1)
+	done := make(chan bool)
+	go func() {
+		SdWatchdogPing(nil, 10*time.Millisecond, closing)
+		done <- true
+	}()
+	time.Sleep(35 * time.Millisecond)
+	closing <- true
+	<-done
+	if sent, err := SdNotify(SdStopping); !sent || err != nil {
+		t.Errorf("notify failed, sent=%v, err is %v", sent, err)
+	}
+
+	var msgs []string
+	b := make([]byte, 64)
+	for {
+		c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := c.Read(b)
+		if err != nil {
+			break
+		}
+		msgs = append(msgs, string(b[:n]))
+	}
+
+	if len(msgs) < 4 || msgs[0] != SdReady || msgs[len(msgs)-1] != SdStopping {
+		t.Fatalf("invalid msgs %v", msgs)
+	}
+	for _, msg := range msgs[1 : len(msgs)-1] {
+		if msg != SdWatchdog {
+			t.Errorf("invalid msgs %v", msgs)
+		}
+	}
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Unsetenv("WATCHDOG_USEC")
+	if v := SdWatchdogInterval(); v != 0 {
+		t.Errorf("invalid interval %v", v)
+	}
+
+	os.Setenv("WATCHDOG_USEC", "2000000")
+	if v := SdWatchdogInterval(); v != time.Second {
+		t.Errorf("invalid interval %v", v)
+	}
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if v := SdWatchdogInterval(); v != time.Second {
+		t.Errorf("invalid interval %v", v)
+	}
+
+	// the watchdog for other process.
+	os.Setenv("WATCHDOG_PID", "1")
+	if v := SdWatchdogInterval(); v != 0 {
+		t.Errorf("invalid interval %v", v)
+	}
+}
+
+const sdChildEnv = "KERNEL_TEST_SD_CHILD"
+
+func TestSdListener_Child(t *testing.T) {
+	addr := os.Getenv(sdChildEnv)
+	if addr == "" {
+		t.Skip("not child")
+	}
+
+	// the systemd set the pid after fork.
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	l := SdListener(addr)
+	if l == nil {
+		t.Fatal("no listener of", addr)
+	}
+	defer l.Close()
+	if os.Getenv("LISTEN_FDS") != "" || os.Getenv("LISTEN_PID") != "" {
+		t.Error("should unset env")
+	}
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("systemd"))
+}
+
+func TestSdListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the systemd pass the socket as fd 3.
+	addr := l.Addr().String()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSdListener_Child$")
+	cmd.Env = append(os.Environ(), sdChildEnv+"=tcp://"+addr, "LISTEN_FDS=1")
+	cmd.ExtraFiles = []*os.File{f}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	l.Close()
+	f.Close()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if b, err := ioutil.ReadAll(c); err != nil || string(b) != "systemd" {
+		t.Errorf("invalid response %v, err is %v", string(b), err)
+	}
+}
+
+func TestSdListenFds(t *testing.T) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	// the fds for other process.
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "2")
+	if fds := sdListenFds(); len(fds) != 0 || os.Getenv("LISTEN_FDS") != "2" {
+		t.Errorf("invalid fds %v", fds)
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	if fds := sdListenFds(); len(fds) != 2 || fds[0] != 3 || fds[1] != 4 || os.Getenv("LISTEN_FDS") != "" {
+		t.Errorf("invalid fds %v", fds)
+	}
+}
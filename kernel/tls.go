@@ -0,0 +1,133 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the tls for oryx, to terminate rtmps and https.
+*/
+package kernel
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/https"
+)
+
+// The cert and key files for tls.
+type TlsCert struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// The letsencrypt to request and renew the certs of domains automatically.
+type TlsLets struct {
+	// The domains to request cert, empty to disable.
+	Domains []string `json:"domains"`
+	// The file to cache the certs, empty to use default.
+	Cache string `json:"cache"`
+}
+
+// The default file to cache the certs of letsencrypt.
+const defaultLetsCache = "./letsencrypt.cache"
+
+// Whether letsencrypt is enabled.
+func (v *TlsLets) Enabled() bool {
+	return len(v.Domains) > 0
+}
+
+// The tls listen and certs, the cert is selected by SNI of client,
+// and the first cert is used when no SNI or not matched.
+type Tls struct {
+	// The listen addr, empty to disable tls.
+	Listen string     `json:"listen"`
+	Certs  []*TlsCert `json:"certs"`
+	// The letsencrypt, the certs are ignored when enabled.
+	Lets TlsLets `json:"lets"`
+}
+
+func (v *Tls) String() string {
+	return fmt.Sprintf("listen=%v,certs=%v,lets=%v", v.Listen, len(v.Certs), len(v.Lets.Domains))
+}
+
+// Whether tls is enabled.
+func (v *Tls) Enabled() bool {
+	return len(v.Listen) > 0
+}
+
+// Check the listen and load the certs, return all errors.
+// @remark ignore when tls is disabled.
+func (v *Tls) Check() (errs []error) {
+	if !v.Enabled() {
+		return
+	}
+
+	if err := CheckListen(v.Listen); err != nil {
+		errs = append(errs, NewConfigError("listen", "Tls listen %v", err))
+	}
+	// the certs of letsencrypt are requested when serving.
+	if v.Lets.Enabled() {
+		for _, domain := range v.Lets.Domains {
+			if len(domain) == 0 {
+				errs = append(errs, NewConfigError("lets.domains", "Tls letsencrypt domain should not be empty"))
+			}
+		}
+		return
+	}
+
+	if _, err := v.Load(); err != nil {
+		errs = append(errs, ConfigField("certs", err))
+	}
+	return
+}
+
+// Load the certs to tls config, or get the certs from letsencrypt.
+func (v *Tls) Load() (c *tls.Config, err error) {
+	if v.Lets.Enabled() {
+		cache := v.Lets.Cache
+		if len(cache) == 0 {
+			cache = defaultLetsCache
+		}
+
+		var m https.Manager
+		if m, err = https.NewLetsencryptManager("", v.Lets.Domains, cache); err != nil {
+			return nil, fmt.Errorf("Tls letsencrypt %v, err is %v", v.Lets.Domains, err)
+		}
+		return &tls.Config{GetCertificate: m.GetCertificate}, nil
+	}
+
+	if len(v.Certs) == 0 {
+		return nil, fmt.Errorf("No tls certs")
+	}
+
+	c = &tls.Config{}
+	for _, cert := range v.Certs {
+		var kp tls.Certificate
+		if kp, err = tls.LoadX509KeyPair(cert.Cert, cert.Key); err != nil {
+			return nil, fmt.Errorf("Tls cert %v key %v, err is %v", cert.Cert, cert.Key, err)
+		}
+		c.Certificates = append(c.Certificates, kp)
+	}
+	c.BuildNameToCertificate()
+
+	return
+}
@@ -0,0 +1,137 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package kernel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// Write a self-signed cert for name to dir.
+func writeCert(t *testing.T, dir, name string) *TlsCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &TlsCert{Cert: path.Join(dir, name+".crt"), Key: path.Join(dir, name+".key")}
+	if err = ioutil.WriteFile(c.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(c.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v := &Tls{}
+	if errs := v.Check(); len(errs) != 0 {
+		t.Errorf("should ignore when disabled, errs is %v", errs)
+	}
+
+	v.Listen = "tcp://:443"
+	if errs := v.Check(); len(errs) != 1 {
+		t.Errorf("should fail for no certs, errs is %v", errs)
+	}
+
+	v.Certs = []*TlsCert{{Cert: path.Join(dir, "none.crt"), Key: path.Join(dir, "none.key")}}
+	if errs := v.Check(); len(errs) != 1 {
+		t.Errorf("should fail for no cert files, errs is %v", errs)
+	}
+
+	v.Listen = "udp://:443"
+	v.Certs = []*TlsCert{writeCert(t, dir, "a.com"), writeCert(t, dir, "b.com")}
+	if errs := v.Check(); len(errs) != 1 {
+		t.Errorf("should fail for udp, errs is %v", errs)
+	}
+
+	c, err := v.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the cert selected by SNI, the first one when not matched.
+	for sni, expect := range map[string]string{"a.com": "a.com", "b.com": "b.com", "c.com": "a.com", "": "a.com"} {
+		server, client := net.Pipe()
+		go tls.Server(server, c).Handshake()
+
+		tc := tls.Client(client, &tls.Config{ServerName: sni, InsecureSkipVerify: true})
+		if err = tc.Handshake(); err != nil {
+			t.Errorf("sni %v handshake failed, err is %v", sni, err)
+		} else if cn := tc.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != expect {
+			t.Errorf("sni %v got cert %v, expect %v", sni, cn, expect)
+		}
+
+		server.Close()
+		client.Close()
+	}
+}
+
+func TestTls_Lets(t *testing.T) {
+	v := &Tls{Listen: "tcp://:443", Lets: TlsLets{Domains: []string{"ossrs.net"}}}
+	if errs := v.Check(); len(errs) != 0 {
+		t.Errorf("should ignore certs for letsencrypt, errs is %v", errs)
+	}
+
+	v.Lets.Domains = append(v.Lets.Domains, "")
+	if errs := v.Check(); len(errs) != 1 {
+		t.Errorf("should fail for empty domain, errs is %v", errs)
+	}
+}
@@ -0,0 +1,232 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the typed duration and size of config, parse the human-friendly values.
+*/
+package kernel
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The invalid value of typed field, the raw is the json value to find the field.
+type unitError struct {
+	kind string
+	raw  string
+	t    reflect.Type
+	// the reason why invalid, empty when not parsed.
+	reason string
+}
+
+func (v *unitError) Error() string {
+	if len(v.reason) > 0 {
+		return fmt.Sprintf("invalid %v %v of %v, %v", v.kind, v.raw, v.t, v.reason)
+	}
+	return fmt.Sprintf("invalid %v %v of %v", v.kind, v.raw, v.t)
+}
+
+// Find the path of field in config m whose json value is raw, for example,
+// logger.rotate.interval, the first one in order of keys when duplicated.
+func findConfigField(m interface{}, raw string) string {
+	switch v := m.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if b, err := json.Marshal(v[k]); err == nil && string(b) == raw {
+				return k
+			}
+			if f := findConfigField(v[k], raw); len(f) > 0 {
+				return fmt.Sprintf("%v.%v", k, f)
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			if f := findConfigField(e, raw); len(f) > 0 {
+				return fmt.Sprintf("%v.%v", i, f)
+			}
+		}
+	}
+	return ""
+}
+
+// The max duration in ms, which never overflows the time.Duration.
+const maxDuration = int64(math.MaxInt64 / time.Millisecond)
+
+// The duration in ms of config, unmarshal from a number in ms, or a string
+// like "500ms", "30s" or "2h", for example, "timeout": "30s".
+// @remark the duration should not be negative, or less than 1ms except 0.
+type Duration int
+
+func (v *Duration) UnmarshalJSON(b []byte) error {
+	e := &unitError{kind: "duration", raw: string(b), t: reflect.TypeOf(*v)}
+
+	var n int64
+	if err := json.Unmarshal(b, &n); err != nil {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return e
+		}
+
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return e
+		}
+		if d > 0 && d < time.Millisecond {
+			e.reason = "should not be less than 1ms"
+			return e
+		}
+		n = int64(d / time.Millisecond)
+	}
+
+	if n < 0 {
+		e.reason = "should not be negative"
+		return e
+	}
+	if n > maxDuration || int64(int(n)) != n {
+		e.reason = "overflow"
+		return e
+	}
+	*v = Duration(n)
+	return nil
+}
+
+// The time.Duration of config.
+func (v Duration) Duration() time.Duration {
+	return time.Duration(v) * time.Millisecond
+}
+
+// The size in KB of config, unmarshal from a number in KB, or a string
+// like "512kb" or "1mb", for example, "recv_buffer": "256kb".
+type SizeKB int
+
+func (v *SizeKB) UnmarshalJSON(b []byte) error {
+	n, err := unmarshalSize(b, 1024, reflect.TypeOf(*v))
+	if err == nil {
+		*v = SizeKB(n)
+	}
+	return err
+}
+
+// The size in MB of config, unmarshal from a number in MB, or a string
+// like "512mb" or "1gb", for example, "max_size": "1gb".
+type SizeMB int
+
+func (v *SizeMB) UnmarshalJSON(b []byte) error {
+	n, err := unmarshalSize(b, 1024*1024, reflect.TypeOf(*v))
+	if err == nil {
+		*v = SizeMB(n)
+	}
+	return err
+}
+
+// Unmarshal the size b in unit bytes, the number is in unit, while the string
+// is parsed by ParseSize, which must be multiple of unit.
+func unmarshalSize(b []byte, unit int64, t reflect.Type) (int, error) {
+	e := &unitError{kind: "size", raw: string(b), t: t}
+
+	var n int64
+	if err := json.Unmarshal(b, &n); err != nil {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return 0, e
+		}
+
+		size, err := ParseSize(s)
+		if err != nil {
+			e.reason = err.Error()
+			return 0, e
+		}
+		if size%unit != 0 {
+			e.reason = fmt.Sprintf("should be multiple of %v", unit)
+			return 0, e
+		}
+		n = size / unit
+	}
+
+	if n < 0 {
+		e.reason = "should not be negative"
+		return 0, e
+	}
+	if n > math.MaxInt64/unit || int64(int(n)) != n {
+		e.reason = "overflow"
+		return 0, e
+	}
+	return int(n), nil
+}
+
+// The units of size, the longer suffix first.
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"tb", 1 << 40}, {"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+	{"t", 1 << 40}, {"g", 1 << 30}, {"m", 1 << 20}, {"k", 1 << 10}, {"b", 1},
+}
+
+// Parse the human-friendly size to bytes, the unit is case insensitive and
+// in 1024, for example, "1024", "512kb", "1.5gb" or "2M".
+func ParseSize(s string) (int64, error) {
+	v, unit := strings.ToLower(strings.TrimSpace(s)), int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(v, u.suffix) {
+			v, unit = strings.TrimSpace(strings.TrimSuffix(v, u.suffix)), u.bytes
+			break
+		}
+	}
+
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if n < 0 {
+			return 0, fmt.Errorf("size %v should not be negative", s)
+		}
+		if n > math.MaxInt64/unit {
+			return 0, fmt.Errorf("size %v overflow", s)
+		}
+		return n * unit, nil
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid size %v", s)
+	}
+	if f < 0 {
+		return 0, fmt.Errorf("size %v should not be negative", s)
+	}
+	// the float64 of MaxInt64 is 2^63, which overflows.
+	if f *= float64(unit); f >= math.MaxInt64 {
+		return 0, fmt.Errorf("size %v overflow", s)
+	}
+	return int64(f), nil
+}
@@ -0,0 +1,133 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package kernel
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestDuration(t *testing.T) {
+	for s, d := range map[string]time.Duration{
+		`30000`: 30 * time.Second, `"30s"`: 30 * time.Second, `"500ms"`: 500 * time.Millisecond,
+		`"2h"`: 2 * time.Hour, `"1m30s"`: 90 * time.Second, `0`: 0,
+	} {
+		var v Duration
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			t.Errorf("%v failed, err is %v", s, err)
+		} else if v.Duration() != d {
+			t.Errorf("%v should be %v, actual %v", s, d, v.Duration())
+		}
+	}
+
+	for _, s := range []string{
+		`"30x"`, `"s"`, `true`, `1.5`, `-1`, `"-1s"`, `"500us"`, `9223372036854775807`, `"9223372036854775807ms"`,
+	} {
+		var v Duration
+		if err := json.Unmarshal([]byte(s), &v); err == nil {
+			t.Errorf("%v should fail", s)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, n := range map[string]int64{
+		"1024": 1024, "512kb": 512 * 1024, "512KB": 512 * 1024, "2M": 2 * 1024 * 1024,
+		"1gb": 1 << 30, "1.5gb": 3 << 29, "1 tb": 1 << 40, "100b": 100,
+	} {
+		if v, err := ParseSize(s); err != nil || v != n {
+			t.Errorf("%v should be %v, actual %v, err is %v", s, n, v, err)
+		}
+	}
+
+	for _, s := range []string{"", "kb", "1xb", "one", "-1kb", "-0.5gb", "9999999tb", "inf", "nan", "1e30"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("%v should fail", s)
+		}
+	}
+
+	var v struct {
+		Kb SizeKB `json:"kb"`
+		Mb SizeMB `json:"mb"`
+	}
+	if err := json.Unmarshal([]byte(`{"kb": "1mb", "mb": "2gb"}`), &v); err != nil || v.Kb != 1024 || v.Mb != 2048 {
+		t.Errorf("invalid size %+v, err is %v", v, err)
+	}
+	if err := json.Unmarshal([]byte(`{"kb": 256, "mb": 64}`), &v); err != nil || v.Kb != 256 || v.Mb != 64 {
+		t.Errorf("invalid size %+v, err is %v", v, err)
+	}
+	// the size must be multiple of the unit of field, and never overflow.
+	for _, s := range []string{`{"mb": "512kb"}`, `{"mb": "8589934592gb"}`, `{"mb": 8796093022208}`, `{"kb": -1}`} {
+		if err := json.Unmarshal([]byte(s), &v); err == nil {
+			t.Errorf("%v should fail, %+v", s, v)
+		}
+	}
+}
+
+func TestDecodeConfig_Units(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := path.Join(dir, "oryx.json")
+	if err = ioutil.WriteFile(c, []byte(`{"logger": {"rotate": {"size": "1gb", "interval": "24h"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	v := &Config{}
+	if err = DecodeConfig(c, v); err != nil {
+		t.Fatal("decode failed, err is", err)
+	}
+	if r := &v.Logger.Rotate; r.Size != 1024 || r.Interval.Duration() != 24*time.Hour {
+		t.Errorf("invalid rotate %v", r)
+	}
+
+	// the error names the field.
+	if err = ioutil.WriteFile(c, []byte(`{"logger": {"rotate": {"interval": "1d"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = DecodeConfig(c, v); err == nil {
+		t.Fatal("should fail for 1d")
+	} else if r, ok := err.(*ConfigError); !ok || r.Field != "logger.rotate.interval" {
+		t.Errorf("invalid err %v", err)
+	} else if r.Message != `invalid duration "1d" of kernel.Duration` {
+		t.Errorf("invalid message %v", r.Message)
+	}
+
+	if err = ioutil.WriteFile(c, []byte(`{"logger": {"rotate": {"size": "-1gb"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = DecodeConfig(c, v); err == nil {
+		t.Fatal("should fail for -1gb")
+	} else if r, ok := err.(*ConfigError); !ok || r.Field != "logger.rotate.size" {
+		t.Errorf("invalid err %v", err)
+	}
+}
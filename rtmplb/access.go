@@ -0,0 +1,234 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the access control for rtmplb, allow or deny clients by CIDR.
+*/
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// The access rules in config, the CIDR or ip, for example, 10.0.0.0/8 or 192.168.1.10
+type AccessRules struct {
+	// The clients allowed, empty to allow all.
+	Allow []string `json:"allow"`
+	// The clients denied, checked before allow.
+	Deny []string `json:"deny"`
+}
+
+// Parse the CIDR, the ip without mask is a single host.
+func parseCidr(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %v", s)
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// The parsed access rules.
+type accessRules struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func NewAccessRules(r *AccessRules) (v *accessRules, err error) {
+	v = &accessRules{}
+	for _, s := range r.Allow {
+		var n *net.IPNet
+		if n, err = parseCidr(s); err != nil {
+			return nil, fmt.Errorf("allow %v", err)
+		}
+		v.allow = append(v.allow, n)
+	}
+	for _, s := range r.Deny {
+		var n *net.IPNet
+		if n, err = parseCidr(s); err != nil {
+			return nil, fmt.Errorf("deny %v", err)
+		}
+		v.deny = append(v.deny, n)
+	}
+	return
+}
+
+func (v *accessRules) rules() AccessRules {
+	r := AccessRules{Allow: []string{}, Deny: []string{}}
+	for _, n := range v.allow {
+		r.Allow = append(r.Allow, n.String())
+	}
+	for _, n := range v.deny {
+		r.Deny = append(r.Deny, n.String())
+	}
+	return r
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The access control for clients, the global rules apply to all listens,
+// while the listen can override the allow list, and append more deny.
+type accessControl struct {
+	global *accessRules
+	// the rules by listen, for example, tcp://:1935
+	listens map[string]*accessRules
+	lock    *sync.Mutex
+}
+
+func NewAccessControl(global *AccessRules, listens map[string]*AccessRules) (v *accessControl, err error) {
+	v = &accessControl{listens: make(map[string]*accessRules), lock: &sync.Mutex{}}
+
+	if v.global, err = NewAccessRules(global); err != nil {
+		return nil, err
+	}
+
+	for listen, r := range listens {
+		if v.listens[listen], err = NewAccessRules(r); err != nil {
+			return nil, fmt.Errorf("listen %v %v", listen, err)
+		}
+	}
+	return
+}
+
+// Whether the client ip is allowed to connect to the listen.
+// @remark the deny is checked before allow.
+func (v *accessControl) allowed(listen string, ip net.IP) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if contains(v.global.deny, ip) {
+		return false
+	}
+
+	allow := v.global.allow
+	if r, ok := v.listens[listen]; ok {
+		if contains(r.deny, ip) {
+			return false
+		}
+		if len(r.allow) > 0 {
+			allow = r.allow
+		}
+	}
+
+	return len(allow) == 0 || contains(allow, ip)
+}
+
+// Add the global rule at runtime, the action is allow or deny.
+func (v *accessControl) add(action, cidr string) error {
+	n, err := parseCidr(cidr)
+	if err != nil {
+		return err
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	switch action {
+	case "allow":
+		if !containsNet(v.global.allow, n) {
+			v.global.allow = append(v.global.allow, n)
+		}
+	case "deny":
+		if !containsNet(v.global.deny, n) {
+			v.global.deny = append(v.global.deny, n)
+		}
+	default:
+		return fmt.Errorf("invalid action %v, must be allow/deny", action)
+	}
+	return nil
+}
+
+// Remove the global rule at runtime, the action is allow or deny.
+func (v *accessControl) remove(action, cidr string) error {
+	n, err := parseCidr(cidr)
+	if err != nil {
+		return err
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	switch action {
+	case "allow":
+		v.global.allow = removeNet(v.global.allow, n)
+	case "deny":
+		v.global.deny = removeNet(v.global.deny, n)
+	default:
+		return fmt.Errorf("invalid action %v, must be allow/deny", action)
+	}
+	return nil
+}
+
+func containsNet(nets []*net.IPNet, n *net.IPNet) bool {
+	for _, e := range nets {
+		if e.String() == n.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func removeNet(nets []*net.IPNet, n *net.IPNet) []*net.IPNet {
+	r := nets[:0]
+	for _, e := range nets {
+		if e.String() != n.String() {
+			r = append(r, e)
+		}
+	}
+	return r
+}
+
+// The snapshot of rules, global and by listen.
+type AccessSnapshot struct {
+	AccessRules
+	Listens map[string]AccessRules `json:"listens"`
+}
+
+func (v *accessControl) Rules() *AccessSnapshot {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	r := &AccessSnapshot{AccessRules: v.global.rules(), Listens: make(map[string]AccessRules)}
+	for listen, rules := range v.listens {
+		r.Listens[listen] = rules.rules()
+	}
+	return r
+}
@@ -0,0 +1,157 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the http hooks of rtmplb, notify the external systems when client connect and close.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"github.com/ossrs/go-oryx/kernel"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// The http hooks, POST the event in json to each url.
+type RtmpHooks struct {
+	// The urls to notify when client is proxied to backend.
+	OnConnect []string `json:"on_tcp_connect"`
+	// The urls to notify when client closed, with the duration, bytes and backend.
+	OnClose []string `json:"on_tcp_close"`
+	// The timeout in ms for each request, 0 to use default.
+	Timeout kernel.Duration `json:"timeout"`
+}
+
+func (v *RtmpHooks) String() string {
+	return fmt.Sprintf("on_tcp_connect=%v,on_tcp_close=%v,timeout=%v", len(v.OnConnect), len(v.OnClose), v.Timeout)
+}
+
+func (v *RtmpHooks) Check() error {
+	for _, hook := range append(append([]string{}, v.OnConnect...), v.OnClose...) {
+		if u, err := url.Parse(hook); err != nil {
+			return err
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("hook %v should be http or https", hook)
+		}
+	}
+	if v.Timeout < 0 {
+		return fmt.Errorf("timeout=%v should not be negative", v.Timeout)
+	}
+	return nil
+}
+
+// The default timeout for each hook.
+const defaultHookTimeout = time.Duration(3) * time.Second
+
+// The event of connection, POST to hooks.
+type RtmpConnEvent struct {
+	Action string `json:"action"`
+	Id     uint64 `json:"id"`
+	Client string `json:"client"`
+	// the listen which accept the client.
+	Listen string `json:"listen"`
+	// the host and port of backend.
+	Host    string `json:"host"`
+	Backend int    `json:"backend"`
+	// the start time in ms, and the duration in ms when close.
+	Start    int64 `json:"start"`
+	Duration int64 `json:"duration"`
+	// the bytes read from client and write to client.
+	In  int64 `json:"in"`
+	Out int64 `json:"out"`
+}
+
+// The hooks to notify the events of connection.
+type rtmpHooks struct {
+	conf   RtmpHooks
+	client *http.Client
+}
+
+// Create the hooks, nil when no hook.
+func NewRtmpHooks(c *RtmpHooks) *rtmpHooks {
+	if len(c.OnConnect) == 0 && len(c.OnClose) == 0 {
+		return nil
+	}
+
+	timeout := defaultHookTimeout
+	if c.Timeout > 0 {
+		timeout = time.Duration(c.Timeout) * time.Millisecond
+	}
+	return &rtmpHooks{conf: *c, client: &http.Client{Timeout: timeout}}
+}
+
+// Notify the client is proxied to backend.
+func (v *rtmpHooks) onConnect(ctx ol.Context, listen string, c *rtmpConn) {
+	v.notify(ctx, v.conf.OnConnect, v.event("on_tcp_connect", listen, c))
+}
+
+// Notify the client is closed, with the duration and bytes.
+func (v *rtmpHooks) onClose(ctx ol.Context, listen string, c *rtmpConn) {
+	e := v.event("on_tcp_close", listen, c)
+	e.Duration = int64(time.Now().Sub(c.start) / time.Millisecond)
+	e.In, e.Out = atomic.LoadInt64(&c.in), atomic.LoadInt64(&c.out)
+	v.notify(ctx, v.conf.OnClose, e)
+}
+
+func (v *rtmpHooks) event(action, listen string, c *rtmpConn) *RtmpConnEvent {
+	return &RtmpConnEvent{
+		Action: action, Id: c.id, Client: c.client, Listen: listen,
+		Host: c.backend.Host, Backend: c.backend.Port,
+		Start: c.start.UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// POST the event to each url, never block the proxy.
+func (v *rtmpHooks) notify(ctx ol.Context, urls []string, e *RtmpConnEvent) {
+	if len(urls) == 0 {
+		return
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		ol.W(ctx, "marshal hook event failed, err is", err)
+		return
+	}
+
+	for _, u := range urls {
+		go func(u string) {
+			res, err := v.client.Post(u, "application/json", bytes.NewReader(b))
+			if err != nil {
+				ol.W(ctx, fmt.Sprintf("hook %v %v failed, err is %v", e.Action, u, err))
+				return
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode/100 != 2 {
+				ol.W(ctx, fmt.Sprintf("hook %v %v failed, status=%v", e.Action, u, res.StatusCode))
+			}
+		}(u)
+	}
+}
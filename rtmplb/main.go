@@ -29,13 +29,13 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
-	"encoding/json"
 	"flag"
 	"fmt"
 	oa "github.com/ossrs/go-oryx-lib/asprocess"
 	oh "github.com/ossrs/go-oryx-lib/http"
-	oj "github.com/ossrs/go-oryx-lib/json"
 	ol "github.com/ossrs/go-oryx-lib/logger"
 	oo "github.com/ossrs/go-oryx-lib/options"
 	"github.com/ossrs/go-oryx/kernel"
@@ -43,8 +43,12 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -58,58 +62,461 @@ type RtmpLbConfig struct {
 	Rtmp struct {
 		Listen       string `json:"listen"`
 		UseRtmpProxy bool   `json:"proxy"`
+		// The rtmps to terminate tls and proxy plaintext rtmp to backend.
+		Tls kernel.Tls `json:"tls"`
+		// The drain of previous backends with connections when switch backend.
+		Drain struct {
+			// The grace in ms for the connections to quit, 0 to use default.
+			Grace kernel.Duration `json:"grace"`
+			// Whether force to close the connections after grace.
+			Force bool `json:"force"`
+		} `json:"drain"`
+		// The limits for each listener, reject the overflow connections immediately.
+		Limit kernel.TcpLimits `json:"limit"`
+		// The socket options for each client, for example, the larger buffers for ingest,
+		// and the keepalive also applies to backend.
+		Tcp kernel.TcpOptions `json:"tcp"`
+		// Whether splice the bytes in kernel when both client and backend are tcp, for linux.
+		// @remark the bytes and idle are updated for each chunk of 64KB.
+		Splice bool `json:"splice"`
+		// The idle connections to close, for example, the dead clients behind NAT.
+		Idle struct {
+			// The timeout in ms without any bytes in both directions, 0 to disable.
+			Timeout kernel.Duration `json:"timeout"`
+		} `json:"idle"`
+		// The access control for clients, the deny is checked before allow.
+		Access struct {
+			AccessRules
+			// The rules by listen, override the allow list and append the deny list.
+			Listens map[string]*AccessRules `json:"listens"`
+		} `json:"access"`
+		// The http hooks to notify the external systems when client connect and close.
+		Hooks RtmpHooks `json:"hooks"`
+		// The graceful shutdown when SIGTERM, stop accepting and drain the connections.
+		Shutdown struct {
+			// Whether drain the connections when SIGTERM, or quit immediately.
+			Graceful bool `json:"graceful"`
+			// The deadline in ms to force close the left connections, 0 to use default.
+			Deadline kernel.Duration `json:"deadline"`
+		} `json:"shutdown"`
+		// The options to dial backends, the local workers or remote hosts.
+		Backend struct {
+			BackendOptions
+			// The options by backend host:port, override the default options.
+			Backends map[string]*BackendOptions `json:"backends"`
+		} `json:"backend"`
 	} `json:"rtmp"`
 }
 
 func (v *RtmpLbConfig) String() string {
-	return fmt.Sprintf("%v, api=%v, rtmp(listen=%v,proxy=%v)",
-		&v.Config, v.Api, v.Rtmp.Listen, v.Rtmp.UseRtmpProxy)
+	r := &v.Rtmp
+	return fmt.Sprintf("%v, api=%v, rtmp(listen=%v,proxy=%v,tls(%v),drain(grace=%v,force=%v),limit(%v),tcp(%v),splice=%v,idle(timeout=%v),access(allow=%v,deny=%v,listens=%v),hooks(%v),shutdown(graceful=%v,deadline=%v),backend(%v,backends=%v))",
+		&v.Config, v.Api, r.Listen, r.UseRtmpProxy, &r.Tls, r.Drain.Grace, r.Drain.Force, &r.Limit, &r.Tcp, r.Splice, r.Idle.Timeout,
+		len(r.Access.Allow), len(r.Access.Deny), len(r.Access.Listens), &r.Hooks, r.Shutdown.Graceful, r.Shutdown.Deadline, &r.Backend.BackendOptions, len(r.Backend.Backends))
 }
 
 func (v *RtmpLbConfig) Loads(c string) (err error) {
-	var f *os.File
-	if f, err = os.Open(c); err != nil {
-		ol.E(nil, "Open config failed, err is", err)
+	if err = v.decode(c); err != nil {
 		return
 	}
-	defer f.Close()
 
-	r := json.NewDecoder(oj.NewJsonPlusReader(f))
-	if err = r.Decode(v); err != nil {
-		ol.E(nil, "Decode config failed, err is", err)
+	if err = v.Config.OpenLogger(); err != nil {
+		ol.E(nil, "Open logger failed, err is", err)
 		return
 	}
 
-	if err = v.Config.OpenLogger(); err != nil {
-		ol.E(nil, "Open logger failed, err is", err)
+	if errs := v.Check(); len(errs) > 0 {
+		return errs[0]
+	}
+
+	return
+}
+
+func (v *RtmpLbConfig) decode(c string) (err error) {
+	if err = kernel.DecodeConfig(c, v); err != nil {
+		ol.E(nil, "Decode config failed, err is", err)
 		return
 	}
 
+	return
+}
+
+// Check the config, return all errors.
+func (v *RtmpLbConfig) Check() (errs []error) {
 	if len(v.Api) == 0 {
-		return fmt.Errorf("No api")
-	} else if nn := strings.Count(v.Api, "://"); nn != 1 {
-		return fmt.Errorf("Api contains %d network", nn)
+		errs = append(errs, kernel.NewConfigError("api", "No api"))
+	} else if err := kernel.CheckListen(v.Api); err != nil {
+		errs = append(errs, kernel.NewConfigError("api", "Api %v", err))
 	}
 
 	if len(v.Rtmp.Listen) == 0 {
-		return fmt.Errorf("No rtmp listens")
+		errs = append(errs, kernel.NewConfigError("rtmp.listen", "No rtmp listens"))
+	} else if err := kernel.CheckListen(v.Rtmp.Listen); err != nil {
+		errs = append(errs, kernel.NewConfigError("rtmp.listen", "Listen %v", err))
+	}
+
+	for _, err := range v.Rtmp.Tls.Check() {
+		errs = append(errs, kernel.ConfigField("rtmp.tls", err))
+	}
+
+	if err := v.Rtmp.Limit.Check(); err != nil {
+		errs = append(errs, kernel.NewConfigError("rtmp.limit", "Limit %v", err))
+	}
+
+	if err := v.Rtmp.Tcp.Check(); err != nil {
+		errs = append(errs, kernel.NewConfigError("rtmp.tcp", "Tcp %v", err))
+	}
+
+	if r := &v.Rtmp.Idle; r.Timeout < 0 {
+		errs = append(errs, kernel.NewConfigError("rtmp.idle", "Idle timeout=%v should not be negative", r.Timeout))
+	}
+
+	if v.Rtmp.Drain.Grace < 0 {
+		errs = append(errs, kernel.NewConfigError("rtmp.drain.grace", "Drain grace=%v should not be negative", v.Rtmp.Drain.Grace))
+	}
+
+	if v.Rtmp.Shutdown.Deadline < 0 {
+		errs = append(errs, kernel.NewConfigError("rtmp.shutdown.deadline", "Shutdown deadline=%v should not be negative", v.Rtmp.Shutdown.Deadline))
+	}
+
+	if _, err := NewAccessControl(&v.Rtmp.Access.AccessRules, v.Rtmp.Access.Listens); err != nil {
+		errs = append(errs, kernel.NewConfigError("rtmp.access", "Access %v", err))
+	}
+
+	if err := v.Config.CheckProfile(); err != nil {
+		errs = append(errs, err)
 	}
-	if nn := strings.Count(v.Rtmp.Listen, "://"); nn != 1 {
-		return fmt.Errorf("Listen %v contains %v network", v.Rtmp.Listen, nn)
+
+	if err := v.Rtmp.Hooks.Check(); err != nil {
+		errs = append(errs, kernel.NewConfigError("rtmp.hooks", "Hooks %v", err))
+	}
+
+	if err := v.Rtmp.Backend.Check(); err != nil {
+		errs = append(errs, kernel.NewConfigError("rtmp.backend", "Backend %v", err))
+	}
+	for addr, o := range v.Rtmp.Backend.Backends {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, kernel.NewConfigError("rtmp.backend.backends", "Backend %v", err))
+		} else if err := o.Check(); err != nil {
+			errs = append(errs, kernel.NewConfigError("rtmp.backend.backends", "Backend %v %v", addr, err))
+		}
+	}
+
+	return
+}
+
+// Test the config c without listen, print the result to w.
+// @param api and listen override the config when not empty.
+// @return the exit code, 0 when ok.
+func testConfig(c, api, listen, format string, w io.Writer) int {
+	conf := &RtmpLbConfig{}
+	if err := conf.decode(c); err != nil {
+		return kernel.ConfigTestFormat(w, c, format, []error{err})
+	}
+
+	if len(api) > 0 {
+		conf.Api = api
 	}
+	if len(listen) > 0 {
+		conf.Rtmp.Listen = listen
+	}
+
+	var errs []error
+	if err := conf.Config.CheckLogger(); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, conf.Check()...)
+	return kernel.ConfigTestFormat(w, c, format, errs)
+}
+
+// The backend of rtmp proxy, with weight and connections.
+type rtmpBackend struct {
+	Host   string `json:"host"`
+	Port   int    `json:"port"`
+	Weight int    `json:"weight"`
+	Active bool   `json:"active"`
+	// whether disabled, new clients never route to it, while the alive connections are kept.
+	Disabled bool `json:"disabled"`
+	// the alive connections.
+	Conns int `json:"conns"`
+	// the total connections proxied.
+	Total int64 `json:"total"`
+	// whether draining, the previous backend with connections.
+	Draining bool `json:"draining"`
+	// the ms left to force close the draining connections, 0 when not force.
+	Remain int64 `json:"remain"`
+	// the current weight for smooth weighted round-robin.
+	current int
+	// when start to drain, and the seq to ignore the previous drain.
+	drainAt  time.Time
+	drainSeq int
+}
+
+// The addr to dial, host:port.
+func (v *rtmpBackend) addr() string {
+	return net.JoinHostPort(v.Host, strconv.Itoa(v.Port))
+}
 
+// The proxied rtmp connection, with the bytes in and out.
+type rtmpConn struct {
+	id      uint64
+	client  string
+	backend *rtmpBackend
+	start   time.Time
+	// the bytes read from client and write to client, atomic.
+	in, out int64
+	// the last time in ns of bytes in any direction, atomic.
+	active int64
+	// to force close the client, nil to ignore.
+	closer io.Closer
+}
+
+// The writer to count the bytes written to w, and update the active time.
+type countWriter struct {
+	w      io.Writer
+	n      *int64
+	active *int64
+}
+
+func (v *countWriter) Write(p []byte) (n int, err error) {
+	n, err = v.w.Write(p)
+	atomic.AddInt64(v.n, int64(n))
+	atomic.StoreInt64(v.active, time.Now().UnixNano())
 	return
 }
 
+// The duration since the last bytes in any direction.
+func (v *rtmpConn) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&v.active)))
+}
+
+// The proxied connection, for api.
+type RtmpConnection struct {
+	Id      uint64 `json:"id"`
+	Client  string `json:"client"`
+	Backend int    `json:"backend"`
+	// the host of backend.
+	Host string `json:"host"`
+	// the uptime in ms.
+	Uptime int64 `json:"uptime"`
+	// the idle in ms without any bytes.
+	Idle int64 `json:"idle"`
+	// the bytes read from client and write to client.
+	In  int64 `json:"in"`
+	Out int64 `json:"out"`
+	// the average kbps since connected.
+	KbpsIn  int64 `json:"kbps_in"`
+	KbpsOut int64 `json:"kbps_out"`
+}
+
 // The tcp porxy for rtmp backend.
 type proxy struct {
-	conf       *RtmpLbConfig
-	ports      []int
-	activePort int
+	conf *RtmpLbConfig
+	// the addrs of backends, in the order proxyed.
+	addrs []string
+	// all backends ever proxyed, by host:port, keep the connections of previous ones.
+	backends map[string]*rtmpBackend
+	// the active backends, pick the one with the least connections for each client.
+	actives []*rtmpBackend
+	// the alive connections, by id.
+	conns  map[uint64]*rtmpConn
+	nextId uint64
+	// the grace to drain the previous backends, and whether force close after it.
+	drainGrace time.Duration
+	drainForce bool
+	// the timeout to close idle connection, 0 to disable.
+	idleTimeout time.Duration
+	// the period of tcp keepalive for backend, 0 to use default.
+	keepalive time.Duration
+	// the access control for clients.
+	access *accessControl
+	// the http hooks, nil when disabled.
+	hooks *rtmpHooks
+	// the graceful shutdown, nil when not shutting down.
+	shutdown *rtmpShutdown
+	lock     *sync.Mutex
 }
 
+// The default grace to drain the previous backends.
+const defaultDrainGrace = time.Duration(30) * time.Second
+
 func NewProxy(conf *RtmpLbConfig) *proxy {
-	return &proxy{conf: conf}
+	v := &proxy{
+		conf: conf, backends: make(map[string]*rtmpBackend),
+		conns: make(map[uint64]*rtmpConn), lock: &sync.Mutex{},
+		drainGrace: defaultDrainGrace,
+	}
+	// allow all clients, main will load the rules in config.
+	v.access, _ = NewAccessControl(&AccessRules{}, nil)
+	if conf != nil {
+		if r := &conf.Rtmp.Drain; r.Grace > 0 {
+			v.drainGrace = time.Duration(r.Grace) * time.Millisecond
+		}
+		v.drainForce = conf.Rtmp.Drain.Force
+		v.idleTimeout = time.Duration(conf.Rtmp.Idle.Timeout) * time.Millisecond
+		v.keepalive = conf.Rtmp.Tcp.Keepalive.Duration()
+		v.hooks = NewRtmpHooks(&conf.Rtmp.Hooks)
+	}
+	return v
+}
+
+// Pick a enabled backend with the least connections by weight, nil if no backend.
+// @remark the ties are picked by smooth weighted round-robin, for weights 5,1,1
+// without connections, the sequence is a,a,b,a,c,a,a.
+func (v *proxy) pickBackend() *rtmpBackend {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// the least conns/weight, compare by a.Conns*b.Weight to avoid float.
+	var least []*rtmpBackend
+	for _, b := range v.actives {
+		if b.Disabled {
+			continue
+		}
+		if len(least) > 0 {
+			if l := least[0]; b.Conns*l.Weight > l.Conns*b.Weight {
+				continue
+			} else if b.Conns*l.Weight < l.Conns*b.Weight {
+				least = least[:0]
+			}
+		}
+		least = append(least, b)
+	}
+
+	var best *rtmpBackend
+	var total int
+	for _, b := range least {
+		b.current += b.Weight
+		total += b.Weight
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+// When client connected to backend, return the connection to account bytes.
+// @param closer to force close the client when drain timeout, nil to ignore.
+func (v *proxy) onConnect(b *rtmpBackend, client string, closer io.Closer) *rtmpConn {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	b.Conns++
+	b.Total++
+
+	v.nextId++
+	c := &rtmpConn{id: v.nextId, client: client, backend: b, start: time.Now(), closer: closer}
+	c.active = c.start.UnixNano()
+	v.conns[c.id] = c
+	return c
+}
+
+// When client disconnected from backend.
+func (v *proxy) onClose(b *rtmpBackend, c *rtmpConn) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	b.Conns--
+	delete(v.conns, c.id)
+
+	// all connections quit, drain ok.
+	if b.Conns == 0 {
+		b.Draining = false
+	}
+}
+
+// Drain the previous backend, new connections never route to it.
+// @remark user must hold the lock.
+func (v *proxy) drain(ctx ol.Context, b *rtmpBackend) {
+	b.Draining, b.drainAt = true, time.Now()
+	b.drainSeq++
+	ol.T(ctx, fmt.Sprintf("drain backend %v, conns=%v, grace=%v, force=%v", b.addr(), b.Conns, v.drainGrace, v.drainForce))
+
+	if !v.drainForce {
+		return
+	}
+
+	seq := b.drainSeq
+	time.AfterFunc(v.drainGrace, func() {
+		v.closeDrained(b, seq)
+	})
+}
+
+// Force close the connections of backend, when drain timeout.
+func (v *proxy) closeDrained(b *rtmpBackend, seq int) {
+	var closers []io.Closer
+	v.lock.Lock()
+	// ignore when drain ok, the backend is active again or drain again.
+	if b.Draining && b.drainSeq == seq {
+		for _, c := range v.conns {
+			if c.backend == b && c.closer != nil {
+				closers = append(closers, c.closer)
+			}
+		}
+	}
+	v.lock.Unlock()
+
+	if len(closers) == 0 {
+		return
+	}
+
+	ctx := &kernel.Context{}
+	ol.W(ctx, fmt.Sprintf("drain backend %v timeout %v, close %v conns", b.addr(), v.drainGrace, len(closers)))
+	for _, c := range closers {
+		c.Close()
+	}
+}
+
+// The snapshot of alive connections, order by id.
+func (v *proxy) Connections() []*RtmpConnection {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	r := make([]*RtmpConnection, 0, len(v.conns))
+	for _, c := range v.conns {
+		in, out := atomic.LoadInt64(&c.in), atomic.LoadInt64(&c.out)
+		uptime := int64(now.Sub(c.start) / time.Millisecond)
+
+		conn := &RtmpConnection{
+			Id: c.id, Client: c.client, Backend: c.backend.Port, Host: c.backend.Host,
+			Uptime: uptime, In: in, Out: out, Idle: int64(c.idle(now) / time.Millisecond),
+		}
+		// the bits per ms is kbps.
+		if uptime > 0 {
+			conn.KbpsIn, conn.KbpsOut = in*8/uptime, out*8/uptime
+		}
+		r = append(r, conn)
+	}
+
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Id < r[j].Id
+	})
+	return r
+}
+
+// The snapshot of backends, the active ones and the previous ones with connections.
+func (v *proxy) Backends() []rtmpBackend {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	r := make([]rtmpBackend, 0, len(v.backends))
+	for _, addr := range v.addrs {
+		if b := v.backends[addr]; b.Active || b.Conns > 0 {
+			s := *b
+			if s.Draining && v.drainForce {
+				if s.Remain = int64((v.drainGrace - time.Since(s.drainAt)) / time.Millisecond); s.Remain < 0 {
+					s.Remain = 0
+				}
+			}
+			r = append(r, s)
+		}
+	}
+	return r
 }
 
 const (
@@ -119,7 +526,22 @@ const (
 	RetryMax = 3
 )
 
-func (v *proxy) serveRtmp(client *net.TCPConn) (err error) {
+// The options to dial the backend addr.
+func (v *proxy) backendOptions(addr string) *BackendOptions {
+	if v.conf == nil {
+		return &BackendOptions{}
+	}
+	if o, ok := v.conf.Rtmp.Backend.Backends[addr]; ok {
+		return o
+	}
+	return &v.conf.Rtmp.Backend.BackendOptions
+}
+
+// The timeout for rtmps client to handshake.
+const TlsHandshakeTimeout = time.Duration(10) * time.Second
+
+// Serve the rtmp client accepted from listen, which is used to match the access rules.
+func (v *proxy) serveRtmp(listen string, client net.Conn) (err error) {
 	ctx := &kernel.Context{}
 
 	defer func() {
@@ -134,8 +556,26 @@ func (v *proxy) serveRtmp(client *net.TCPConn) (err error) {
 	}()
 	defer client.Close()
 
+	// reject the client denied, even before tls handshake.
+	if addr, ok := client.RemoteAddr().(*net.TCPAddr); ok && !v.access.allowed(listen, addr.IP) {
+		ol.W(ctx, fmt.Sprintf("reject client %v of %v by access", client.RemoteAddr(), listen))
+		return
+	}
+
+	// terminate tls before connect to backend.
+	if c, ok := client.(*tls.Conn); ok {
+		c.SetDeadline(time.Now().Add(TlsHandshakeTimeout))
+		if err = c.Handshake(); err != nil {
+			ol.W(ctx, "tls handshake with", client.RemoteAddr(), "failed, err is", err)
+			return
+		}
+		c.SetDeadline(time.Time{})
+		ol.T(ctx, fmt.Sprintf("tls handshake ok, sni=%v", c.ConnectionState().ServerName))
+	}
+
 	// connect to backend.
-	var backend *net.TCPConn
+	var backend net.Conn
+	var picked *rtmpBackend
 	connectBackend := func() error {
 		defer func() {
 			if backend == nil {
@@ -143,16 +583,17 @@ func (v *proxy) serveRtmp(client *net.TCPConn) (err error) {
 			}
 		}()
 
-		if v.activePort <= 0 {
-			return fmt.Errorf("ignore no backend, port=%v, ports=%v", v.activePort, v.ports)
+		b := v.pickBackend()
+		if b == nil {
+			return fmt.Errorf("ignore no backend")
 		}
 
-		addr := fmt.Sprintf("127.0.0.1:%v", v.activePort)
-		if c, err := net.DialTimeout("tcp", addr, RetryBackend); err != nil {
+		addr := b.addr()
+		if c, err := dialBackend(addr, v.backendOptions(addr), RetryBackend, v.keepalive); err != nil {
 			ol.W(ctx, "connect backend", addr, "failed, err is", err)
 			return err
 		} else {
-			backend = c.(*net.TCPConn)
+			backend, picked = c, b
 		}
 
 		return nil
@@ -167,6 +608,15 @@ func (v *proxy) serveRtmp(client *net.TCPConn) (err error) {
 		return
 	}
 	defer backend.Close()
+
+	conn := v.onConnect(picked, client.RemoteAddr().String(), client)
+	defer v.onClose(picked, conn)
+
+	// notify hooks after the copy done, for the bytes of connection.
+	if v.hooks != nil {
+		v.hooks.onConnect(ctx, listen, conn)
+		defer v.hooks.onClose(ctx, listen, conn)
+	}
 	ol.T(ctx, fmt.Sprintf("proxy %v to %v, rpp=%v",
 		client.RemoteAddr(), backend.RemoteAddr(), v.conf.Rtmp.UseRtmpProxy))
 
@@ -179,7 +629,8 @@ func (v *proxy) serveRtmp(client *net.TCPConn) (err error) {
 	}()
 
 	wg.ForkGoroutine(func() {
-		if nw, err = io.Copy(client, backend); err != nil {
+		var err error
+		if nw, err = copyConn(client, backend, &conn.out, &conn.active, v.conf.Rtmp.Splice); err != nil {
 			ol.E(ctx, fmt.Sprintf("proxy rtmp<=backend failed, nn=%v, err is %v", nw, err))
 			return
 		}
@@ -187,6 +638,7 @@ func (v *proxy) serveRtmp(client *net.TCPConn) (err error) {
 		client.Close()
 	})
 	wg.ForkGoroutine(func() {
+		var err error
 		// write proxy header.
 		// @see https://github.com/ossrs/go-oryx/wiki/RtmpProxy
 		if v.conf.Rtmp.UseRtmpProxy {
@@ -208,24 +660,67 @@ func (v *proxy) serveRtmp(client *net.TCPConn) (err error) {
 			}
 		}
 
-		if nr, err = io.Copy(backend, client); err != nil {
+		if nr, err = copyConn(backend, client, &conn.in, &conn.active, v.conf.Rtmp.Splice); err != nil {
 			ol.E(ctx, fmt.Sprintf("proxy rtmp=>backend failed, nn=%v, err is %v", nr, err))
 			return
 		}
 	}, func(){
-		client.Close()
+		backend.Close()
 	})
 
+	// close the connection without bytes in both directions,
+	// @remark close the backend to unblock the copy from it.
+	if v.idleTimeout > 0 {
+		closing := make(chan bool)
+		wg.ForkGoroutine(func() {
+			v.watchIdle(ctx, conn, closing)
+		}, func() {
+			close(closing)
+			backend.Close()
+		})
+	}
+
 	wg.Wait()
 	return
 }
 
+// The interval to check the idle connection, at most.
+const idleCheckInterval = time.Duration(1) * time.Second
+
+// Return when the connection is idle for timeout, or closing.
+func (v *proxy) watchIdle(ctx ol.Context, conn *rtmpConn, closing chan bool) {
+	interval := v.idleTimeout / 4
+	if interval > idleCheckInterval {
+		interval = idleCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closing:
+			return
+		case now := <-ticker.C:
+			if idle := conn.idle(now); idle > v.idleTimeout {
+				ol.W(ctx, fmt.Sprintf("close idle client %v, idle=%v, timeout=%v, in=%v, out=%v",
+					conn.client, idle, v.idleTimeout, atomic.LoadInt64(&conn.in), atomic.LoadInt64(&conn.out)))
+				return
+			}
+		}
+	}
+}
+
 const (
 	Success oh.SystemError = 0
 	// error when api proxy parse parameters.
 	ApiProxyQuery oh.SystemError = 100 + iota
+	// error when api access parse parameters.
+	ApiAccessQuery
 )
 
+// Change the backends at runtime, the action is set to replace all backends,
+// or add/remove/enable/disable some backends, for example,
+// /api/v1/proxy?rtmp=19350,19351 or /api/v1/proxy?action=disable&rtmp=19350
 func (v *proxy) serveChangeBackendApi(ctx ol.Context, r *http.Request) (string, oh.SystemError) {
 	var err error
 	q := r.URL.Query()
@@ -235,29 +730,151 @@ func (v *proxy) serveChangeBackendApi(ctx ol.Context, r *http.Request) (string,
 		return fmt.Sprintf("require query rtmp port"), ApiProxyQuery
 	}
 
-	var port int
-	if port, err = strconv.Atoi(rtmp); err != nil {
-		return fmt.Sprintf("rtmp port is not int, err is %v", err), ApiProxyQuery
+	action := q.Get("action")
+	switch action {
+	case "", "set", "add", "remove", "enable", "disable":
+	default:
+		return fmt.Sprintf("action %v should be set/add/remove/enable/disable", action), ApiProxyQuery
 	}
 
-	hasProxyed := func(port int) bool {
-		for _, p := range v.ports {
-			if p == port {
-				return true
+	// the backends seperated by comma, [host:]port[:weight], the host is 127.0.0.1
+	// and weight is 1 by default, for example, 19350,19351 or 19350:2,10.0.0.2:1935:1
+	var backends []*rtmpBackend
+	for _, s := range strings.Split(rtmp, ",") {
+		var b rtmpBackend
+		if b.Host, b.Port, b.Weight, err = parseBackend(s); err != nil {
+			return fmt.Sprintf("rtmp %v", err), ApiProxyQuery
+		}
+		backends = append(backends, &b)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if action != "" && action != "set" {
+		return v.updateBackends(ctx, action, backends)
+	}
+
+	var previous []string
+	for _, b := range v.actives {
+		previous = append(previous, b.addr())
+		b.Active = false
+	}
+
+	// reset the current weight for the new backends.
+	var addrs, weights []string
+	v.actives = nil
+	for _, nb := range backends {
+		addr := nb.addr()
+		b, ok := v.backends[addr]
+		if !ok {
+			b = &rtmpBackend{Host: nb.Host, Port: nb.Port}
+			v.backends[addr] = b
+			v.addrs = append(v.addrs, addr)
+		}
+
+		b.Weight, b.Active, b.Disabled, b.Draining, b.current = nb.Weight, true, false, false, 0
+		v.actives = append(v.actives, b)
+		addrs, weights = append(addrs, addr), append(weights, strconv.Itoa(b.Weight))
+	}
+	ol.T(ctx, fmt.Sprintf("proxy rtmp to %v, weights=%v, previous=%v, addrs=%v", addrs, weights, previous, v.addrs))
+
+	// drain the previous backends with connections.
+	for _, addr := range previous {
+		if b := v.backends[addr]; !b.Active && b.Conns > 0 {
+			v.drain(ctx, b)
+		}
+	}
+
+	return "", Success
+}
+
+// Add, remove, enable or disable some of the active backends.
+// @remark user must hold the lock.
+func (v *proxy) updateBackends(ctx ol.Context, action string, backends []*rtmpBackend) (string, oh.SystemError) {
+	// all backends except add should be active.
+	if action != "add" {
+		for _, nb := range backends {
+			if b, ok := v.backends[nb.addr()]; !ok || !b.Active {
+				return fmt.Sprintf("backend %v is not active", nb.addr()), ApiProxyQuery
+			}
+		}
+	}
+
+	var addrs []string
+	for _, nb := range backends {
+		addr := nb.addr()
+		addrs = append(addrs, addr)
+
+		b, ok := v.backends[addr]
+		switch action {
+		case "add":
+			if !ok {
+				b = &rtmpBackend{Host: nb.Host, Port: nb.Port}
+				v.backends[addr] = b
+				v.addrs = append(v.addrs, addr)
+			}
+			if !b.Active {
+				v.actives = append(v.actives, b)
+			}
+			b.Weight, b.Active, b.Disabled, b.Draining = nb.Weight, true, false, false
+		case "remove":
+			for i, a := range v.actives {
+				if a == b {
+					v.actives = append(v.actives[:i], v.actives[i+1:]...)
+					break
+				}
 			}
+			b.Active, b.Disabled = false, false
+			if b.Conns > 0 {
+				v.drain(ctx, b)
+			}
+		case "enable", "disable":
+			b.Disabled = action == "disable"
 		}
-		return false
 	}
 
-	ol.T(ctx, fmt.Sprintf("proxy rtmp to %v, previous=%v, ports=%v", port, v.activePort, v.ports))
-	if !hasProxyed(port) {
-		v.ports = append(v.ports, port)
+	// reset the current weight when the backends changed.
+	for _, b := range v.actives {
+		b.current = 0
+	}
+
+	var actives []string
+	for _, b := range v.actives {
+		actives = append(actives, b.addr())
 	}
-	v.activePort = port
+	ol.T(ctx, fmt.Sprintf("proxy rtmp %v %v, actives=%v, addrs=%v", action, addrs, actives, v.addrs))
 
 	return "", Success
 }
 
+// Add or remove the access rule at runtime, for example, to deny 10.0.0.0/8 by
+// /api/v1/access?action=add&type=deny&cidr=10.0.0.0/8
+func (v *proxy) serveAccessApi(ctx ol.Context, r *http.Request) (string, oh.SystemError) {
+	q := r.URL.Query()
+
+	action, typ, cidr := q.Get("action"), q.Get("type"), q.Get("cidr")
+	if len(cidr) == 0 {
+		return fmt.Sprintf("require query cidr"), ApiAccessQuery
+	}
+
+	var err error
+	switch action {
+	case "add":
+		err = v.access.add(typ, cidr)
+	case "remove":
+		err = v.access.remove(typ, cidr)
+	default:
+		return fmt.Sprintf("action %v should be add/remove", action), ApiAccessQuery
+	}
+	if err != nil {
+		return fmt.Sprintf("%v %v %v failed, err is %v", action, typ, cidr, err), ApiAccessQuery
+	}
+
+	ol.T(ctx, fmt.Sprintf("access %v %v %v", action, typ, cidr))
+	return "", Success
+}
+
 func main() {
 	var err error
 
@@ -265,8 +882,16 @@ func main() {
 	var api, port string
 	flag.StringVar(&api, "a", "", "The api tcp://host:port, optional.")
 	flag.StringVar(&port, "l", "", "The listen tcp://host:port, optional.")
+	// test the config and quit.
+	var test bool
+	flag.BoolVar(&test, "t", false, "Test the config and quit.")
+	var format string
+	flag.StringVar(&format, "f", "text", "The format to print the config test, text or json.")
 
 	confFile := oo.ParseArgv("../conf/rtmplb.json", kernel.Version(), signature)
+	if test {
+		os.Exit(testConfig(confFile, api, port, format, os.Stdout))
+	}
 	fmt.Println("RTMPLB is the load-balance for rtmp streaming, config is", confFile)
 
 	conf := &RtmpLbConfig{}
@@ -298,21 +923,56 @@ func main() {
 	}
 	defer listener.Close()
 
+	listener.Limit(conf.Rtmp.Limit)
+	listener.Tune(conf.Rtmp.Tcp)
 	if err = listener.ListenTCP(); err != nil {
 		ol.E(ctx, "listen tcp failed, err is", err)
 		return
 	}
 
+	// the rtmps listener, terminate tls and proxy plaintext rtmp to backend.
+	var tlsListener *kernel.TcpListeners
+	var tlsConfig *tls.Config
+	if conf.Rtmp.Tls.Enabled() {
+		if tlsConfig, err = conf.Rtmp.Tls.Load(); err != nil {
+			ol.E(ctx, "load tls failed, err is", err)
+			return
+		}
+
+		if tlsListener, err = kernel.NewTcpListeners([]string{conf.Rtmp.Tls.Listen}); err != nil {
+			ol.E(ctx, "create tls listener failed, err is", err)
+			return
+		}
+		defer tlsListener.Close()
+
+		tlsListener.Limit(conf.Rtmp.Limit)
+		tlsListener.Tune(conf.Rtmp.Tcp)
+		if err = tlsListener.ListenTCP(); err != nil {
+			ol.E(ctx, "listen tls failed, err is", err)
+			return
+		}
+	}
+
 	var apiListener net.Listener
 	addrs := strings.Split(conf.Api, "://")
-	apiNetwork, apiAddr := addrs[0], addrs[1]
-	if apiListener, err = net.Listen(apiNetwork, apiAddr); err != nil {
+	apiAddr := addrs[1]
+	if apiListener, err = kernel.SdListen(conf.Api); err != nil {
 		ol.E(ctx, "http listen failed, err is", err)
 		return
 	}
 	defer apiListener.Close()
 
+	// drop root after listen, before serve.
+	if err = conf.DropPrivileges(kernel.DefaultPrivilegeDropper); err != nil {
+		ol.E(ctx, "drop privileges failed, err is", err)
+		return
+	}
+
 	proxy := NewProxy(conf)
+	if proxy.access, err = NewAccessControl(&conf.Rtmp.Access.AccessRules, conf.Rtmp.Access.Listens); err != nil {
+		ol.E(ctx, "load access failed, err is", err)
+		return
+	}
 	oh.Server = signature
 
 	wg := kernel.NewWorkerGroup()
@@ -320,7 +980,29 @@ func main() {
 	defer wg.Close()
 
 	wg.QuitForChan(asq)
-	wg.QuitForSignals(ctx, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
+
+	// when graceful, the SIGTERM stop accepting and drain the connections, then quit.
+	shutdownCtx, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
+	if r := &conf.Rtmp.Shutdown; r.Graceful {
+		wg.QuitForSignals(ctx, syscall.SIGINT, syscall.SIGKILL)
+
+		deadline := defaultShutdownDeadline
+		if r.Deadline > 0 {
+			deadline = time.Duration(r.Deadline) * time.Millisecond
+		}
+		go func() {
+			ss := make(chan os.Signal, 1)
+			signal.Notify(ss, syscall.SIGTERM)
+			for s := range ss {
+				ol.W(ctx, "shutdown for signal", s)
+				proxy.Shutdown(ctx, deadline)
+				shutdown()
+			}
+		}()
+	} else {
+		wg.QuitForSignals(ctx, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
+	}
 
 	// rtmp connections
 	wg.ForkGoroutine(func() {
@@ -332,8 +1014,13 @@ func main() {
 		}()
 
 		for {
-			var c *net.TCPConn
-			if c, err = listener.AcceptTCP(); err != nil {
+			var c *kernel.TcpConn
+			if c, err = listener.AcceptTCPContext(shutdownCtx); err == context.Canceled {
+				// stop accepting, quit when all connections drained.
+				listener.Close()
+				proxy.waitShutdown()
+				break
+			} else if err != nil {
 				if err != io.EOF {
 					ol.E(ctx, "accept failed, err is", err)
 				}
@@ -341,12 +1028,44 @@ func main() {
 			}
 
 			//ol.T(ctx, "got rtmp client", c.RemoteAddr())
-			go proxy.serveRtmp(c)
+			go proxy.serveRtmp(c.Listen, c)
 		}
 	}, func() {
 		listener.Close()
+		proxy.abortShutdown()
 	})
 
+	// rtmps connections
+	if tlsListener != nil {
+		wg.ForkGoroutine(func() {
+			ol.E(ctx, "rtmps accepter ready")
+			defer ol.E(ctx, "rtmps accepter ok")
+
+			defer func() {
+				tlsListener.Close()
+			}()
+
+			for {
+				var c *kernel.TcpConn
+				if c, err = tlsListener.AcceptTCPContext(shutdownCtx); err == context.Canceled {
+					tlsListener.Close()
+					proxy.waitShutdown()
+					break
+				} else if err != nil {
+					if err != io.EOF {
+						ol.E(ctx, "accept tls failed, err is", err)
+					}
+					break
+				}
+
+				go proxy.serveRtmp(c.Listen, tls.Server(c, tlsConfig))
+			}
+		}, func() {
+			tlsListener.Close()
+			proxy.abortShutdown()
+		})
+	}
+
 	// control messages
 	wg.ForkGoroutine(func() {
 		ol.E(ctx, "http handler ready")
@@ -357,7 +1076,8 @@ func main() {
 			oh.WriteVersion(w, r, kernel.Version())
 		})
 
-		ol.T(ctx, fmt.Sprintf("handle http://%v/api/v1/proxy?rtmp=19350", apiAddr))
+		ol.T(ctx, fmt.Sprintf("handle http://%v/api/v1/proxy?rtmp=19350:2,19351,10.0.0.2:1935", apiAddr))
+		ol.T(ctx, fmt.Sprintf("handle http://%v/api/v1/proxy?action=add|remove|enable|disable&rtmp=19352", apiAddr))
 		http.HandleFunc("/api/v1/proxy", func(w http.ResponseWriter, r *http.Request) {
 			ctx := &kernel.Context{}
 			if msg, err := proxy.serveChangeBackendApi(ctx, r); err != Success {
@@ -367,6 +1087,37 @@ func main() {
 			oh.WriteData(ctx, w, r, nil)
 		})
 
+		ol.T(ctx, fmt.Sprintf("handle http://%v/api/v1/backends", apiAddr))
+		http.HandleFunc("/api/v1/backends", func(w http.ResponseWriter, r *http.Request) {
+			oh.WriteData(&kernel.Context{}, w, r, proxy.Backends())
+		})
+
+		ol.T(ctx, fmt.Sprintf("handle http://%v/api/v1/connections", apiAddr))
+		http.HandleFunc("/api/v1/connections", func(w http.ResponseWriter, r *http.Request) {
+			oh.WriteData(&kernel.Context{}, w, r, proxy.Connections())
+		})
+
+		ol.T(ctx, fmt.Sprintf("handle http://%v/api/v1/access?action=add&type=deny&cidr=10.0.0.0/8", apiAddr))
+		http.HandleFunc("/api/v1/access", func(w http.ResponseWriter, r *http.Request) {
+			ctx := &kernel.Context{}
+			if len(r.URL.Query()) == 0 {
+				oh.WriteData(ctx, w, r, proxy.access.Rules())
+				return
+			}
+			if msg, err := proxy.serveAccessApi(ctx, r); err != Success {
+				oh.WriteCplxError(ctx, w, r, err, msg)
+				return
+			}
+			oh.WriteData(ctx, w, r, nil)
+		})
+
+		ol.T(ctx, fmt.Sprintf("handle http://%v/api/v1/shutdown", apiAddr))
+		http.HandleFunc("/api/v1/shutdown", func(w http.ResponseWriter, r *http.Request) {
+			oh.WriteData(&kernel.Context{}, w, r, proxy.ShutdownStatus())
+		})
+
+		kernel.HandleProfile(ctx, nil, &conf.Profile)
+
 		server := &http.Server{Addr: apiAddr, Handler: nil}
 		if err = server.Serve(apiListener); err != nil {
 			ol.E(ctx, "http serve failed, err is", err)
@@ -376,7 +1127,11 @@ func main() {
 		apiListener.Close()
 	})
 
+	// notify systemd when serving, and ping the watchdog.
+	kernel.SdNotifyReady(ctx, wg)
+
 	// wait util quit.
 	wg.Wait()
+	kernel.SdNotifyStopping(ctx)
 	return
 }
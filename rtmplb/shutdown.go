@@ -0,0 +1,197 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the graceful shutdown of rtmplb, stop accepting and drain the connections.
+*/
+package main
+
+import (
+	"fmt"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"io"
+	"sync"
+	"time"
+)
+
+// The default deadline to drain the connections when shutdown.
+const defaultShutdownDeadline = time.Duration(30) * time.Second
+
+// The interval to check the connections when shutdown.
+const shutdownCheckInterval = time.Duration(100) * time.Millisecond
+
+// The graceful shutdown, drain the connections util deadline.
+type rtmpShutdown struct {
+	start    time.Time
+	deadline time.Duration
+	// the connections when start.
+	conns int
+	// the connections force closed at deadline.
+	closed int
+	// closed when all connections quit, or force closed.
+	done chan bool
+	// closed to force close the connections immediately.
+	abort     chan bool
+	abortOnce *sync.Once
+}
+
+// The progress of shutdown, for api.
+type RtmpShutdown struct {
+	// Whether shutting down, the listeners are closed.
+	Shutdown bool `json:"shutdown"`
+	// The unix time in ms when start to shutdown.
+	Start int64 `json:"start,omitempty"`
+	// The deadline in ms, and the ms left to force close the connections.
+	Deadline int64 `json:"deadline,omitempty"`
+	Remain   int64 `json:"remain,omitempty"`
+	// The connections when start, and the alive ones.
+	Conns int `json:"conns"`
+	Alive int `json:"alive"`
+	// The connections force closed at deadline.
+	Closed int `json:"closed,omitempty"`
+	// Whether all connections quit or closed.
+	Done bool `json:"done"`
+}
+
+// Start to shutdown, drain the alive connections util deadline, then force close them.
+// @remark the user should close the listeners, and wait for done.
+// @return the chan closed when done, the same one when shutdown again.
+func (v *proxy) Shutdown(ctx ol.Context, deadline time.Duration) chan bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.shutdown != nil {
+		return v.shutdown.done
+	}
+
+	s := &rtmpShutdown{
+		start: time.Now(), deadline: deadline, conns: len(v.conns),
+		done: make(chan bool), abort: make(chan bool), abortOnce: &sync.Once{},
+	}
+	v.shutdown = s
+	ol.T(ctx, fmt.Sprintf("shutdown start, conns=%v, deadline=%v", s.conns, deadline))
+
+	go v.drainShutdown(ctx, s)
+	return s.done
+}
+
+// Force close the connections when shutting down, for example, quit by SIGINT.
+func (v *proxy) abortShutdown() {
+	v.lock.Lock()
+	s := v.shutdown
+	v.lock.Unlock()
+
+	if s != nil {
+		s.abortOnce.Do(func() {
+			close(s.abort)
+		})
+	}
+}
+
+// Wait for the connections to quit when shutting down, return immediately when not.
+func (v *proxy) waitShutdown() {
+	v.lock.Lock()
+	s := v.shutdown
+	v.lock.Unlock()
+
+	if s != nil {
+		<-s.done
+	}
+}
+
+func (v *proxy) drainShutdown(ctx ol.Context, s *rtmpShutdown) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(shutdownCheckInterval)
+	defer ticker.Stop()
+
+	timer := time.NewTimer(s.deadline)
+	defer timer.Stop()
+
+	alive := s.conns
+	for {
+		v.lock.Lock()
+		n := len(v.conns)
+		v.lock.Unlock()
+
+		if n == 0 {
+			ol.T(ctx, fmt.Sprintf("shutdown drain ok, conns=%v, elapsed=%v", s.conns, time.Since(s.start)))
+			return
+		}
+		if n != alive {
+			alive = n
+			ol.T(ctx, fmt.Sprintf("shutdown drain, alive=%v/%v, elapsed=%v", n, s.conns, time.Since(s.start)))
+		}
+
+		select {
+		case <-ticker.C:
+			continue
+		case <-timer.C:
+		case <-s.abort:
+		}
+		break
+	}
+
+	// force close the left connections.
+	var closers []io.Closer
+	v.lock.Lock()
+	for _, c := range v.conns {
+		if c.closer != nil {
+			closers = append(closers, c.closer)
+		}
+	}
+	s.closed = len(closers)
+	v.lock.Unlock()
+
+	ol.W(ctx, fmt.Sprintf("shutdown drain timeout, close %v conns, elapsed=%v", len(closers), time.Since(s.start)))
+	for _, c := range closers {
+		c.Close()
+	}
+}
+
+// The progress of shutdown.
+func (v *proxy) ShutdownStatus() *RtmpShutdown {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	r := &RtmpShutdown{Alive: len(v.conns)}
+	s := v.shutdown
+	if s == nil {
+		return r
+	}
+
+	r.Shutdown, r.Conns, r.Closed = true, s.conns, s.closed
+	r.Start = s.start.UnixNano() / int64(time.Millisecond)
+	r.Deadline = int64(s.deadline / time.Millisecond)
+	if r.Remain = int64((s.deadline - time.Since(s.start)) / time.Millisecond); r.Remain < 0 {
+		r.Remain = 0
+	}
+
+	select {
+	case <-s.done:
+		r.Done, r.Remain = true, 0
+	default:
+	}
+	return r
+}
@@ -0,0 +1,76 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ This is the copy of rtmplb, splice the bytes in kernel when both are tcp.
+*/
+package main
+
+import (
+	"github.com/ossrs/go-oryx/kernel"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// The max bytes to splice for each chunk, the bytes and active are updated for each chunk.
+const spliceChunk = 64 * 1024
+
+// Copy from src to dst util EOF, count the bytes in n and update the active.
+// @remark when splice and both are tcp, use TCPConn.ReadFrom which on linux moves
+// the bytes by splice(2) in kernel, while on other os it's the same as io.Copy.
+func copyConn(dst, src net.Conn, n, active *int64, splice bool) (written int64, err error) {
+	d, ok := tcpConn(dst)
+	s, ok2 := tcpConn(src)
+	if !splice || !ok || !ok2 {
+		return io.Copy(&countWriter{dst, n, active}, src)
+	}
+
+	for {
+		var nn int64
+		nn, err = d.ReadFrom(&io.LimitedReader{R: s, N: spliceChunk})
+		if nn > 0 {
+			written += nn
+			atomic.AddInt64(n, nn)
+			atomic.StoreInt64(active, time.Now().UnixNano())
+		}
+
+		// the src is EOF when chunk not full.
+		if err != nil || nn < spliceChunk {
+			return
+		}
+	}
+}
+
+// Get the tcp conn of c, which maybe accepted by kernel.TcpListeners.
+func tcpConn(c net.Conn) (*net.TCPConn, bool) {
+	switch c := c.(type) {
+	case *net.TCPConn:
+		return c, true
+	case *kernel.TcpConn:
+		return c.TCPConn, c.TCPConn != nil
+	}
+	return nil, false
+}
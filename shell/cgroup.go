@@ -0,0 +1,241 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ The cgroup of shell, limit the cpu and memory of each worker.
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/ossrs/go-oryx/kernel"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The cgroup for workers, each worker in its own group under the parent group.
+type CgroupConfig struct {
+	Enabled bool `json:"enabled"`
+	// The mount point of cgroup fs, v1 or v2, empty to use default.
+	Root string `json:"root"`
+	// The parent group of workers, empty to use default.
+	Group string `json:"group"`
+	// The cpu limit in percent of one core, for example, 150 for 1.5 cores, 0 to disable.
+	Cpu int `json:"cpu"`
+	// The memory limit in MB, 0 to disable.
+	Memory kernel.SizeMB `json:"memory"`
+}
+
+func (v *CgroupConfig) String() string {
+	return fmt.Sprintf("cgroup(%v,root=%v,group=%v,cpu=%v%%,memory=%vMB)", v.Enabled, v.Root, v.Group, v.Cpu, v.Memory)
+}
+
+func (v *CgroupConfig) Check() error {
+	if v.Cpu < 0 || v.Memory < 0 {
+		return fmt.Errorf("Cgroup cpu=%v, memory=%v should not be negative", v.Cpu, v.Memory)
+	}
+	if len(v.Group) > 0 && (path.IsAbs(v.Group) || strings.Contains(v.Group, "..")) {
+		return fmt.Errorf("Cgroup group=%v should be relative to root", v.Group)
+	}
+	return nil
+}
+
+const (
+	defaultCgroupRoot  = "/sys/fs/cgroup"
+	defaultCgroupGroup = "oryx"
+	// the period in us of cpu quota.
+	cgroupCpuPeriod = 100000
+)
+
+// The resource usage of worker in cgroup, for api.
+type CgroupUsage struct {
+	// The cpu time in us.
+	Cpu int64 `json:"cpu"`
+	// The memory in bytes.
+	Memory int64 `json:"memory"`
+}
+
+// The cgroup to place the workers in.
+type cgroup struct {
+	conf  CgroupConfig
+	root  string
+	group string
+	// whether the unified hierarchy, or v1 with a hierarchy for each controller.
+	v2 bool
+}
+
+// Detect the version of cgroup at root, then create the parent group.
+func NewCgroup(c *CgroupConfig) (v *cgroup, err error) {
+	v = &cgroup{conf: *c, root: c.Root, group: c.Group}
+	if len(v.root) == 0 {
+		v.root = defaultCgroupRoot
+	}
+	if len(v.group) == 0 {
+		v.group = defaultCgroupGroup
+	}
+
+	if _, err = os.Stat(path.Join(v.root, "cgroup.controllers")); err == nil {
+		v.v2 = true
+	} else if _, err = os.Stat(path.Join(v.root, "memory")); err != nil {
+		return nil, fmt.Errorf("no cgroup at %v, err is %v", v.root, err)
+	}
+
+	// for v2, the controllers must be enabled for the children of parent.
+	if v.v2 {
+		parent := path.Join(v.root, v.group)
+		if err = os.MkdirAll(parent, 0755); err != nil {
+			return nil, fmt.Errorf("create cgroup %v failed, err is %v", parent, err)
+		}
+		for _, dir := range []string{v.root, parent} {
+			if err = writeCgroup(dir, "cgroup.subtree_control", "+cpu +memory"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return
+}
+
+func (v *cgroup) String() string {
+	version := "v1"
+	if v.v2 {
+		version = "v2"
+	}
+	return fmt.Sprintf("%v %v/%v", version, v.root, v.group)
+}
+
+// The dirs of group name, key is the controller, empty for v2.
+func (v *cgroup) dirs(name string) map[string]string {
+	if v.v2 {
+		return map[string]string{"": path.Join(v.root, v.group, name)}
+	}
+	return map[string]string{
+		"cpu":    path.Join(v.root, "cpu", v.group, name),
+		"memory": path.Join(v.root, "memory", v.group, name),
+	}
+}
+
+// Create the group name with limits, then move the process pid into it.
+func (v *cgroup) Add(name string, pid int) (err error) {
+	quota := fmt.Sprintf("%v", v.conf.Cpu*cgroupCpuPeriod/100)
+	memory := fmt.Sprintf("%v", int64(v.conf.Memory)*1024*1024)
+
+	for controller, dir := range v.dirs(name) {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("create cgroup %v failed, err is %v", dir, err)
+		}
+
+		var files [][]string
+		switch controller {
+		case "":
+			if v.conf.Cpu > 0 {
+				files = append(files, []string{"cpu.max", fmt.Sprintf("%v %v", quota, cgroupCpuPeriod)})
+			}
+			if v.conf.Memory > 0 {
+				files = append(files, []string{"memory.max", memory})
+			}
+		case "cpu":
+			if v.conf.Cpu > 0 {
+				files = append(files, []string{"cpu.cfs_period_us", strconv.Itoa(cgroupCpuPeriod)}, []string{"cpu.cfs_quota_us", quota})
+			}
+		case "memory":
+			if v.conf.Memory > 0 {
+				files = append(files, []string{"memory.limit_in_bytes", memory})
+			}
+		}
+		files = append(files, []string{"cgroup.procs", strconv.Itoa(pid)})
+
+		for _, f := range files {
+			if err = writeCgroup(dir, f[0], f[1]); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Remove the group name, the processes in it must be terminated.
+func (v *cgroup) Remove(name string) (err error) {
+	for _, dir := range v.dirs(name) {
+		if r := os.Remove(dir); r != nil && !os.IsNotExist(r) {
+			err = r
+		}
+	}
+	return
+}
+
+// The resource usage of group name.
+func (v *cgroup) Usage(name string) (u *CgroupUsage, err error) {
+	u = &CgroupUsage{}
+	dirs := v.dirs(name)
+
+	if v.v2 {
+		if u.Memory, err = readCgroupInt(dirs[""], "memory.current"); err != nil {
+			return
+		}
+		var f *os.File
+		if f, err = os.Open(path.Join(dirs[""], "cpu.stat")); err != nil {
+			return
+		}
+		defer f.Close()
+
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			if vs := strings.Fields(s.Text()); len(vs) == 2 && vs[0] == "usage_usec" {
+				u.Cpu, err = strconv.ParseInt(vs[1], 10, 64)
+				return
+			}
+		}
+		return
+	}
+
+	if u.Memory, err = readCgroupInt(dirs["memory"], "memory.usage_in_bytes"); err != nil {
+		return
+	}
+	// the cpuacct is co-mounted with cpu by most distros, in ns.
+	if u.Cpu, err = readCgroupInt(dirs["cpu"], "cpuacct.usage"); err != nil {
+		return
+	}
+	u.Cpu /= 1000
+	return
+}
+
+func writeCgroup(dir, file, value string) (err error) {
+	if err = ioutil.WriteFile(path.Join(dir, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("write cgroup %v=%v failed, err is %v", path.Join(dir, file), value, err)
+	}
+	return
+}
+
+func readCgroupInt(dir, file string) (int64, error) {
+	b, err := ioutil.ReadFile(path.Join(dir, file))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
@@ -28,13 +28,13 @@ SOFTWARE.
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	oj "github.com/ossrs/go-oryx-lib/json"
 	ol "github.com/ossrs/go-oryx-lib/logger"
 	"github.com/ossrs/go-oryx/kernel"
+	"io"
 	"os"
 	"os/exec"
+	"strings"
 )
 
 // The service provider.
@@ -44,6 +44,12 @@ func (v ServiceProvider) IsSrs() bool {
 	return v == "srs"
 }
 
+// The named sub-range of ports, [start,stop].
+type PortRangeConfig struct {
+	Start int `json:"start"`
+	Stop  int `json:"stop"`
+}
+
 // The config object for shell module.
 type ShellConfig struct {
 	kernel.Config
@@ -75,13 +81,82 @@ type ShellConfig struct {
 		Binary   string          `json:"binary"`
 		Config   string          `json:"config"`
 		WorkDir  string          `json:"work_dir"`
-		Ports    struct {
+		// The number of worker instances, each with its own ports, 0 for 1 instance.
+		Instances int `json:"instances"`
+		Ports     struct {
 			Start int `json:"start"`
 			Stop  int `json:"stop"`
+			// The ports in [start,stop] never used by worker.
+			Exclude []int `json:"exclude"`
+			// Whether disable the listen probe before alloc port.
+			DisableProbe bool `json:"disable_probe"`
+			// The quarantine in ms for busy port, 0 to use default.
+			Quarantine kernel.Duration `json:"quarantine"`
+			// The named sub-ranges in [start,stop] for the ports of worker, rtmp, http or api,
+			// for example, the rtmp ports opened by firewall.
+			Ranges map[string]*PortRangeConfig `json:"ranges"`
 		} `json:"ports"`
-		Service interface{} `json:"service"`
+		// The restart policy for crashed worker.
+		Restart struct {
+			// The backoff in ms to restart worker, double for each crash, 0 to use default.
+			Backoff kernel.Duration `json:"backoff"`
+			// The max backoff in ms, 0 to use default.
+			MaxBackoff kernel.Duration `json:"max_backoff"`
+			// The max crashes in window, the worker failed when exceed it, 0 to restart forever.
+			Budget int `json:"budget"`
+			// The window in ms to count crashes, 0 to use default.
+			Window kernel.Duration `json:"window"`
+		} `json:"restart"`
+		// The upgrade policy to replace the active worker.
+		Upgrade struct {
+			// The drain in ms for the old worker to serve the exists streams, 0 to use default.
+			Drain kernel.Duration `json:"drain"`
+			// The timeout in ms for the old worker to quit when SIGTERM, then SIGKILL it, 0 to use default.
+			StopTimeout kernel.Duration `json:"stop_timeout"`
+		} `json:"upgrade"`
+		// The readiness gate, the lbs switch to worker when api ready.
+		Readiness struct {
+			// The path of worker api to check, empty to use default.
+			Path string `json:"path"`
+			// The timeout in ms for each request, 0 to use default.
+			Timeout kernel.Duration `json:"timeout"`
+			// The interval in ms to retry, 0 to use default.
+			Interval kernel.Duration `json:"interval"`
+			// The deadline in ms for worker to be ready, 0 to use default.
+			Deadline kernel.Duration `json:"deadline"`
+		} `json:"readiness"`
+		// The liveness probe, the unhealthy worker is removed from lbs and restarted.
+		Liveness struct {
+			// Whether disable the liveness probe.
+			Disabled bool `json:"disabled"`
+			// The path of worker api to probe, empty to use the readiness path.
+			Path string `json:"path"`
+			// The timeout in ms for each request, 0 to use default.
+			Timeout kernel.Duration `json:"timeout"`
+			// The interval in ms to probe, 0 to use default.
+			Interval kernel.Duration `json:"interval"`
+			// The consecutive failures to mark worker unhealthy, 0 to use default.
+			Failures int `json:"failures"`
+		} `json:"liveness"`
+		// The reconcile loop, keep the workers to the desired state of config, start the missing
+		// instances, stop the extra ones and replace the ones with stale binary, config or template.
+		Reconcile struct {
+			// Whether disable the loop, the reload still reconcile the workers.
+			Disabled bool `json:"disabled"`
+			// The interval in ms to reconcile, 0 to use default.
+			Interval kernel.Duration `json:"interval"`
+		} `json:"reconcile"`
+		// The cgroup to limit the cpu and memory of each worker.
+		Cgroup CgroupConfig `json:"cgroup"`
+		// The output of worker, capture the stdout and stderr.
+		Output OutputConfig `json:"output"`
+		// The command template to start worker.
+		Template WorkerTemplate `json:"template"`
+		Service  interface{}    `json:"service"`
 	} `json:"worker"`
 	Api string `json:"api"`
+	// The pid file to prevent to start twice, empty to disable.
+	Pid string `json:"pid"`
 }
 
 func (v *ShellConfig) String() string {
@@ -99,10 +174,15 @@ func (v *ShellConfig) String() string {
 			r.Enabled, r.Binary, r.Config, r.Api, r.ProxyTo, r.Backend)
 	}
 	if r := &v.Worker; true {
-		worker = fmt.Sprintf("worker(%v,provider=%v,binary=%v,config=%v,dir=%v,ports=[%v,%v],service=%v)",
-			r.Enabled, r.Provider, r.Binary, r.Config, r.WorkDir, r.Ports.Start, r.Ports.Stop, r.Service)
+		worker = fmt.Sprintf("worker(%v,provider=%v,binary=%v,config=%v,dir=%v,instances=%v,ports=[%v,%v],exclude=%v,probe=%v,quarantine=%v,restart=(%v,%v,%v,%v),upgrade=(%v,%v),readiness=(%v,%v,%v,%v),%v,%v,template=(%v),service=%v)",
+			r.Enabled, r.Provider, r.Binary, r.Config, r.WorkDir, r.Instances, r.Ports.Start, r.Ports.Stop,
+			r.Ports.Exclude, !r.Ports.DisableProbe, r.Ports.Quarantine,
+			r.Restart.Backoff, r.Restart.MaxBackoff, r.Restart.Budget, r.Restart.Window,
+			r.Upgrade.Drain, r.Upgrade.StopTimeout,
+			r.Readiness.Path, r.Readiness.Timeout, r.Readiness.Interval, r.Readiness.Deadline,
+			&r.Cgroup, &r.Output, &r.Template, r.Service)
 	}
-	return fmt.Sprintf("%v, api=%v, %v, %v, %v, %v", &v.Config, v.Api, rtmplb, httplb, apilb, worker)
+	return fmt.Sprintf("%v, api=%v, pid=%v, %v, %v, %v, %v", &v.Config, v.Api, v.Pid, rtmplb, httplb, apilb, worker)
 }
 
 // nil if not srs config.
@@ -124,17 +204,48 @@ func (v *ShellConfig) ApiProxyToBig() bool {
 	return v.Apilb.ProxyTo == "big"
 }
 
+// The number of worker instances to run, 0 when worker disabled.
+func (v *ShellConfig) WorkerInstances() int {
+	if r := &v.Worker; !r.Enabled {
+		return 0
+	} else if r.Instances > 0 {
+		return r.Instances
+	}
+	return 1
+}
+
 func (v *ShellConfig) Loads(c string) (err error) {
-	f := func(c string) (err error) {
-		var f *os.File
-		if f, err = os.Open(c); err != nil {
-			ol.E(nil, "Open config failed, err is", err)
+	return v.loads(c, true)
+}
+
+// Loads the config to reload, never change the logger.
+func (v *ShellConfig) Reloads(c string) (err error) {
+	return v.loads(c, false)
+}
+
+func (v *ShellConfig) loads(c string, openLogger bool) (err error) {
+	if err = v.decode(c); err != nil {
+		return
+	}
+
+	if openLogger {
+		if err = v.Config.OpenLogger(); err != nil {
+			ol.E(nil, "Open logger failed, err is", err)
 			return
 		}
-		defer f.Close()
+	}
+
+	if errs := v.Check(); len(errs) > 0 {
+		return errs[0]
+	}
+
+	return
+}
 
-		r := json.NewDecoder(oj.NewJsonPlusReader(f))
-		if err = r.Decode(v); err != nil {
+// Decode the config and the provider.
+func (v *ShellConfig) decode(c string) (err error) {
+	f := func(c string) (err error) {
+		if err = kernel.DecodeConfig(c, v); err != nil {
 			ol.E(nil, "Decode config failed, err is", err)
 			return
 		}
@@ -161,11 +272,46 @@ func (v *ShellConfig) Loads(c string) (err error) {
 		}
 	}
 
-	if err = v.Config.OpenLogger(); err != nil {
-		ol.E(nil, "Open logger failed, err is", err)
-		return
+	return
+}
+
+// Test the config c without listen or start processes, print the result to w.
+// @return the exit code, 0 when ok.
+func testConfig(c, format string, w io.Writer) int {
+	conf := &ShellConfig{}
+	if err := conf.decode(c); err != nil {
+		return kernel.ConfigTestFormat(w, c, format, []error{err})
+	}
+
+	var errs []error
+	if err := conf.Config.CheckLogger(); err != nil {
+		errs = append(errs, err)
 	}
+	errs = append(errs, conf.Check()...)
+	return kernel.ConfigTestFormat(w, c, format, errs)
+}
+
+// Check the config, return the first error of each part, the field is the part.
+func (v *ShellConfig) Check() (errs []error) {
+	checks := []struct {
+		field string
+		check func() error
+	}{
+		{"rtmplb", v.checkRtmplb}, {"httplb", v.checkHttplb}, {"apilb", v.checkApilb},
+		{"worker", v.checkWorker}, {"api", v.checkApi},
+	}
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			errs = append(errs, kernel.ConfigField(c.field, err))
+		}
+	}
+	if err := v.Config.CheckProfile(); err != nil {
+		errs = append(errs, err)
+	}
+	return
+}
 
+func (v *ShellConfig) checkRtmplb() (err error) {
 	if r := &v.Rtmplb; r.Enabled {
 		if len(r.Binary) == 0 {
 			return fmt.Errorf("Empty rtmplb binary")
@@ -186,6 +332,10 @@ func (v *ShellConfig) Loads(c string) (err error) {
 		}
 	}
 
+	return
+}
+
+func (v *ShellConfig) checkHttplb() (err error) {
 	if r := &v.Httplb; r.Enabled {
 		if len(r.Binary) == 0 {
 			return fmt.Errorf("Empty httplb binary")
@@ -206,6 +356,10 @@ func (v *ShellConfig) Loads(c string) (err error) {
 		}
 	}
 
+	return
+}
+
+func (v *ShellConfig) checkApilb() (err error) {
 	if r := &v.Apilb; r.Enabled {
 		if len(r.Binary) == 0 {
 			return fmt.Errorf("Empty apilb binary")
@@ -224,6 +378,10 @@ func (v *ShellConfig) Loads(c string) (err error) {
 		}
 	}
 
+	return
+}
+
+func (v *ShellConfig) checkWorker() (err error) {
 	if r := &v.Worker; r.Enabled {
 		if len(r.Binary) == 0 {
 			return fmt.Errorf("Empty worker binary")
@@ -249,12 +407,70 @@ func (v *ShellConfig) Loads(c string) (err error) {
 			return fmt.Errorf("Work dir=%v is not dir", r.WorkDir)
 		}
 
+		if r.Instances < 0 {
+			return fmt.Errorf("Worker instances=%v should not be negative", r.Instances)
+		}
+
 		if r.Ports.Start <= 0 || r.Ports.Stop <= 0 {
 			return fmt.Errorf("Ports zone [%v, %v] invalid", r.Ports.Start, r.Ports.Stop)
 		}
 		if r.Ports.Start >= r.Ports.Stop {
 			return fmt.Errorf("Ports zone start=%v should greater than stop=%v", r.Ports.Start, r.Ports.Stop)
 		}
+		for _, port := range r.Ports.Exclude {
+			if port < r.Ports.Start || port > r.Ports.Stop {
+				return fmt.Errorf("Exclude port=%v out of zone [%v, %v]", port, r.Ports.Start, r.Ports.Stop)
+			}
+		}
+		if r.Ports.Quarantine < 0 {
+			return fmt.Errorf("Ports quarantine=%v should not be negative", r.Ports.Quarantine)
+		}
+		if len(r.Ports.Ranges) > 0 {
+			pool := NewPortPool(r.Ports.Start, r.Ports.Stop)
+			for name, pr := range r.Ports.Ranges {
+				if name != "rtmp" && name != "http" && name != "api" {
+					return fmt.Errorf("Ports range %v should be rtmp, http or api", name)
+				}
+				if err := pool.ReserveRange(name, pr.Start, pr.Stop); err != nil {
+					return fmt.Errorf("Ports %v", err)
+				}
+			}
+		}
+		if c := &r.Restart; c.Backoff < 0 || c.MaxBackoff < 0 || c.Budget < 0 || c.Window < 0 {
+			return fmt.Errorf("Restart backoff=%v, max=%v, budget=%v, window=%v should not be negative",
+				c.Backoff, c.MaxBackoff, c.Budget, c.Window)
+		}
+		if c := &r.Upgrade; c.Drain < 0 || c.StopTimeout < 0 {
+			return fmt.Errorf("Upgrade drain=%v, stop timeout=%v should not be negative", c.Drain, c.StopTimeout)
+		}
+		if c := &r.Readiness; len(c.Path) > 0 && !strings.HasPrefix(c.Path, "/") {
+			return fmt.Errorf("Readiness path=%v should start with /", c.Path)
+		}
+		if c := &r.Readiness; c.Timeout < 0 || c.Interval < 0 || c.Deadline < 0 {
+			return fmt.Errorf("Readiness timeout=%v, interval=%v, deadline=%v should not be negative",
+				c.Timeout, c.Interval, c.Deadline)
+		}
+		if c := &r.Liveness; len(c.Path) > 0 && !strings.HasPrefix(c.Path, "/") {
+			return fmt.Errorf("Liveness path=%v should start with /", c.Path)
+		}
+		if c := &r.Liveness; c.Timeout < 0 || c.Interval < 0 || c.Failures < 0 {
+			return fmt.Errorf("Liveness timeout=%v, interval=%v, failures=%v should not be negative",
+				c.Timeout, c.Interval, c.Failures)
+		}
+		if c := &r.Reconcile; c.Interval < 0 {
+			return fmt.Errorf("Reconcile interval=%v should not be negative", c.Interval)
+		}
+		if err = r.Cgroup.Check(); err != nil {
+			return
+		}
+		if err = r.Output.Check(); err != nil {
+			return
+		}
+
+		if err = r.Template.Check(); err != nil {
+			ol.E(nil, "Check worker template failed, err is", err)
+			return
+		}
 
 		if s := v.SrsConfig(); s != nil {
 			if err = s.Check(); err != nil {
@@ -264,9 +480,16 @@ func (v *ShellConfig) Loads(c string) (err error) {
 		}
 	}
 
+	return
+}
+
+func (v *ShellConfig) checkApi() (err error) {
 	if len(v.Api) == 0 {
 		return fmt.Errorf("Empty api listen")
 	}
+	if err = kernel.CheckListen(v.Api); err != nil {
+		return fmt.Errorf("Api %v", err)
+	}
 
 	return
 }
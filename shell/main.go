@@ -30,17 +30,18 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	oh "github.com/ossrs/go-oryx-lib/http"
 	ol "github.com/ossrs/go-oryx-lib/logger"
 	oo "github.com/ossrs/go-oryx-lib/options"
 	"github.com/ossrs/go-oryx/kernel"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
-	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
@@ -51,15 +52,20 @@ import (
 var signature = fmt.Sprintf("SHELL/%v", kernel.Version())
 
 const (
-	// when active worker failed, restart it.
-	workerRestartInterval = time.Duration(5) * time.Second
 	// wait for process to start to check api.
 	processExecInterval = time.Duration(200) * time.Millisecond
 	// max retry to check process.
 	processRetryMax = 15
+	// the timeout for each request to lb api.
+	lbApiTimeout = time.Duration(3) * time.Second
+	// the retry and backoff to switch lbs.
+	lbSwitchRetries = 3
+	lbSwitchBackoff = processExecInterval
 	// api error.
 	Success         oh.SystemError = 0
 	apiUpgradeError oh.SystemError = 100 + iota
+	apiMethodError
+	apiReloadError
 )
 
 // check the api, retry when failed, error when exceed the max.
@@ -134,24 +140,83 @@ type ShellBoss struct {
 	apilb   *exec.Cmd
 	pool    *kernel.ProcessPool
 	ports   *PortPool
-	workers []*SrsWorker
 	closed  bool
+	closing chan bool
+	// the registry of workers, protected by lock.
+	workers []*SrsWorker
+	// the active worker of each instance, indexed by instance.
+	actives []*SrsWorker
+	lock    *sync.Mutex
+	// the policy to restart crashed worker.
+	restart *restartPolicy
+	// the policy to drain the old worker when upgrade.
+	upgrade *upgradePolicy
+	// the readiness gate before switch lbs to worker.
+	readiness *readinessPolicy
+	// the liveness probe for active workers.
+	liveness *livenessPolicy
+	// the loop to reconcile workers to config.
+	reconciler *reconcilePolicy
+	// the desired spec of worker in config, protected by lock.
+	spec string
+	// the cgroup to place workers in, nil when disabled.
+	cgroup *cgroup
+	// the last registration to lbs, protected by lock.
+	rtmplbReg, httplbReg, apilbReg LbRegistration
+	// the listeners of lbs held by shell, the lbs inherit them and respawn on them,
+	// protected by lock.
+	listeners map[string]*net.TCPListener
+	// the listen addrs of each lb, to close the held listeners when lb listens changed.
+	lbAddrs map[string][]string
+	// the generation of applied config and the last reloads, protected by lock.
+	generation int
+	reloads    []*ReloadRecord
 	// for upgrade lock.
-	activeWorker *SrsWorker
-	upgradeLock  *sync.Mutex
+	upgradeLock *sync.Mutex
 }
 
-func NewShellBoss(conf *ShellConfig) *ShellBoss {
-	v := &ShellBoss{
+func NewShellBoss(conf *ShellConfig) (v *ShellBoss, err error) {
+	v = &ShellBoss{
 		conf:        conf,
 		pool:        kernel.NewProcessPool(),
 		workers:     make([]*SrsWorker, 0),
+		lock:        &sync.Mutex{},
+		closing:     make(chan bool, 1),
+		restart:     NewRestartPolicy(conf),
+		upgrade:     NewUpgradePolicy(conf),
+		readiness:   NewReadinessPolicy(conf),
+		liveness:    NewLivenessPolicy(conf),
+		reconciler:  NewReconcilePolicy(conf),
+		spec:        workerSpec(conf),
 		upgradeLock: &sync.Mutex{},
+		generation:  1,
+		reloads:     make([]*ReloadRecord, 0),
+		listeners:   make(map[string]*net.TCPListener),
+		lbAddrs:     make(map[string][]string),
 	}
 
 	c := &v.conf.Worker.Ports
-	v.ports = NewPortPool(c.Start, c.Stop)
-	return v
+	if v.ports, err = NewPortPoolExcluding(c.Start, c.Stop, c.Exclude); err != nil {
+		return nil, err
+	}
+	// the shell only free the ports it allocated, so check it.
+	v.ports.Strict = true
+	v.ports.Probe = !c.DisableProbe
+	if c.Quarantine > 0 {
+		v.ports.Quarantine = time.Duration(c.Quarantine) * time.Millisecond
+	}
+	for name, r := range c.Ranges {
+		if err = v.ports.ReserveRange(name, r.Start, r.Stop); err != nil {
+			return nil, err
+		}
+	}
+
+	if c := &v.conf.Worker.Cgroup; c.Enabled {
+		if v.cgroup, err = NewCgroup(c); err != nil {
+			return nil, err
+		}
+	}
+	return
 }
 
 func (v *ShellBoss) Close() (err error) {
@@ -160,21 +225,55 @@ func (v *ShellBoss) Close() (err error) {
 	}
 	v.closed = true
 
-	for _, w := range v.workers {
+	// notify the restarting workers to quit.
+	select {
+	case v.closing <- true:
+	default:
+	}
+
+	v.lock.Lock()
+	workers := append([]*SrsWorker{}, v.workers...)
+	v.lock.Unlock()
+
+	for _, w := range workers {
 		w.Close()
 	}
 
-	return v.pool.Close()
+	err = v.pool.Close()
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for addr, l := range v.listeners {
+		l.Close()
+		delete(v.listeners, addr)
+	}
+	return
 }
 
 func (v *ShellBoss) Upgrade(ctx ol.Context) (err error) {
 	v.upgradeLock.Lock()
 	defer v.upgradeLock.Unlock()
 
-	if v.activeWorker == nil {
+	v.lock.Lock()
+	var actives []*SrsWorker
+	var states []SrsState
+	for _, active := range v.actives {
+		if active != nil {
+			actives, states = append(actives, active), append(states, active.state)
+		}
+	}
+	v.lock.Unlock()
+
+	if len(actives) == 0 {
 		ol.W(ctx, "update ignore for no active worker")
 		return
 	}
+	// the respawn will replace the active worker.
+	for i, active := range actives {
+		if states[i] != SrsStateActive {
+			return fmt.Errorf("upgrade active worker %v is %v", active.name, states[i])
+		}
+	}
 
 	var latest *SrsVersion
 	if true {
@@ -193,78 +292,54 @@ func (v *ShellBoss) Upgrade(ctx ol.Context) (err error) {
 		}
 	}
 
-	version := v.activeWorker.version
-	if latest.String() == version.String() {
-		ol.W(ctx, fmt.Sprintf("upgrade ignore version=%v, current version=%v",
-			latest.String(), version.String()))
-		return
-	}
-	ol.T(ctx, fmt.Sprintf("upgrade %v to %v, current signature=%v",
-		version.String(), latest.String(), version.Signature))
+	// replace the instances one by one, the others keep serving.
+	// @remark abort when any instance failed, the upgraded instances keep the latest
+	// 	version, user can upgrade again for the others.
+	for _, active := range actives {
+		version := active.version
+		if latest.String() == version.String() {
+			ol.W(ctx, fmt.Sprintf("upgrade ignore %v version=%v, current version=%v",
+				active.name, latest.String(), version.String()))
+			continue
+		}
+		ol.T(ctx, fmt.Sprintf("upgrade %v %v to %v, current signature=%v",
+			active.name, version.String(), latest.String(), version.Signature))
 
-	// start a new worker.
-	// @remark when worker failed, we ignore to close it, for the Cycle() will do this.
-	var worker *SrsWorker
-	if worker, err = v.execWorker(ctx); err != nil {
-		ol.E(ctx, "upgrade exec worker failed, err is", err)
-		return
-	}
+		// start a new worker, which switch the lbs to it when api ok.
+		var worker *SrsWorker
+		if worker, err = v.execWorker(ctx, nil, active.instance); err != nil {
+			ol.E(ctx, "upgrade exec worker failed, err is", err)
 
-	// upgrade ok, update the active worker and set others to deprecated.
-	worker.state = SrsStateActive
-	v.activeWorker = worker
+			// abort the upgrade, cleanup the new worker, user can upgrade again.
+			// @remark the lbs are rollback to the active one when switch failed.
+			if worker != nil {
+				worker.Close()
+			}
+			return
+		}
 
-	for _, w := range v.workers {
-		if worker == w || w.state != SrsStateActive {
-			continue
+		// upgrade ok, update the active worker and set the old one to deprecated.
+		v.lock.Lock()
+		v.setActive(worker)
+		if active.state == SrsStateActive {
+			active.state = SrsStateDeprecated
 		}
+		v.lock.Unlock()
 
-		w.state = SrsStateDeprecated
-		r0 := w.cmd.Process.Signal(syscall.SIGUSR2)
-		ol.T(ctx, fmt.Sprintf("upgrade notify %v, r0=%v ok", w, r0))
-	}
+		// drain the old worker, the Cycle() will cleanup it when terminated.
+		go v.drainWorker(ctx, active)
 
-	ol.T(ctx, fmt.Sprintf("upgrade ok, %v", worker))
+		ol.T(ctx, fmt.Sprintf("upgrade ok, %v, drain %v in %v", worker, active.name, v.upgrade.drain))
+	}
 	return
 }
 
 func (v *ShellBoss) ExecBuddies(ctx ol.Context) (err error) {
 	// fork processes.
-	if r := &v.conf.Rtmplb; r.Enabled {
-		args := []string{"-c", r.Config,
-			"-a", fmt.Sprintf("tcp://127.0.0.1:%v", r.Api), "-l", fmt.Sprintf("tcp://:%v", r.Rtmp),
-		}
-		if v.rtmplb, err = v.pool.Start(ctx, r.Binary, args...); err != nil {
-			ol.E(ctx, "exec rtmplb failed, err is", err)
-			return
-		}
-		p := v.rtmplb
-		ol.T(ctx, fmt.Sprintf("exec rtmplb ok, args=%v, pid=%v", p.Args, p.Process.Pid))
-	}
-
-	if r := &v.conf.Httplb; r.Enabled {
-		args := []string{"-c", r.Config,
-			"-a", fmt.Sprintf("tcp://127.0.0.1:%v", r.Api), "-l", fmt.Sprintf("tcp://:%v", r.Http),
-		}
-		if v.httplb, err = v.pool.Start(ctx, r.Binary, args...); err != nil {
-			ol.E(ctx, "exec httplb failed, err is", err)
+	for _, name := range []string{"rtmplb", "httplb", "apilb"} {
+		if _, err = v.execLb(ctx, name); err != nil {
 			return
 		}
-		p := v.httplb
-		ol.T(ctx, fmt.Sprintf("exec httplb ok, args=%v, pid=%v", p.Args, p.Process.Pid))
-	}
-
-	if r := &v.conf.Apilb; r.Enabled {
-		args := []string{"-c", r.Config,
-			"-api", fmt.Sprintf("tcp://127.0.0.1:%v", r.Api),
-			"-backend", fmt.Sprintf("tcp://:%v", r.Backend),
-		}
-		if v.apilb, err = v.pool.Start(ctx, r.Binary, args...); err != nil {
-			ol.E(ctx, "exec apilb failed, err is", err)
-			return
-		}
-		p := v.apilb
-		ol.T(ctx, fmt.Sprintf("exec apilb ok, args=%v, pid=%v", p.Args, p.Process.Pid))
 	}
 
 	// sleep for a while and check the api.
@@ -288,16 +363,21 @@ func (v *ShellBoss) ExecBuddies(ctx ol.Context) (err error) {
 	}
 	ol.T(ctx, "kernel process ok.")
 
-	// fork workers.
+	// fork workers, each instance with its own ports.
 	// @reamrk when worker failed, quit.
-	var worker *SrsWorker
-	if worker, err = v.execWorker(ctx); err != nil {
-		ol.E(ctx, "exec worker failed, err is", err)
-		return
+	for i := 0; i < v.conf.WorkerInstances(); i++ {
+		var worker *SrsWorker
+		if worker, err = v.execWorker(ctx, nil, i); err != nil {
+			ol.E(ctx, "exec worker failed, err is", err)
+			return
+		}
+		if worker != nil {
+			v.lock.Lock()
+			v.setActive(worker)
+			v.lock.Unlock()
+		}
+		ol.T(ctx, fmt.Sprintf("worker process ok, %v", worker))
 	}
-	v.activeWorker = worker
-	worker.state = SrsStateActive
-	ol.T(ctx, fmt.Sprintf("worker process ok, %v", worker))
 
 	ol.T(ctx, fmt.Sprintf("all buddies ok"))
 	return
@@ -324,71 +404,188 @@ func (v *ShellBoss) Cycle(ctx ol.Context) {
 			}
 		}
 
-		// when kernel object exited, close pool
+		// when kernel object exited, respawn it on the listeners held by shell, or close pool.
 		if cmd == v.rtmplb || cmd == v.httplb || cmd == v.apilb {
-			ol.E(ctx, fmt.Sprintf("kernel process=%v quit, shell quit.", cmd.Process.Pid))
-			v.pool.Close()
-			return
-		}
-
-		// remove workers
-		var worker *SrsWorker
-		for i, w := range v.workers {
-			if w.cmd == cmd {
-				worker = w
-				worker.Close()
-				v.workers = append(v.workers[:i], v.workers[i+1:]...)
-				break
+			if err = v.respawnLb(ctx, cmd); err != nil {
+				ol.E(ctx, fmt.Sprintf("kernel process=%v quit, shell quit, err is %v", cmd.Process.Pid, err))
+				v.pool.Close()
+				return
 			}
+			continue
 		}
 
-		// ignore the worker not in active.
-		if worker.state != SrsStateActive {
-			ol.T(ctx, fmt.Sprintf("ignore worker terminated, %v", worker))
-			continue
+		// the supervisor restart or cleanup the worker.
+		if worker := v.findWorker(cmd); worker != nil {
+			v.onWorkerTerminated(ctx, worker, err)
+		} else {
+			ol.W(ctx, fmt.Sprintf("ignore unknown process %v terminated", cmd.Process.Pid))
 		}
-		ol.W(ctx, fmt.Sprintf("restart worker %v", worker))
+	}
 
-		// restart worker when terminated.
-		for !v.closed {
-			if err = v.restartWorker(ctx); err != nil {
-				interval := workerRestartInterval
-				ol.W(ctx, fmt.Sprintf("ignore and retry %v, err is %v", interval, err))
-				time.Sleep(interval)
-			} else {
-				break
-			}
+	return
+}
+
+// Start the lb of name when enabled, which inherits the listeners held by shell.
+func (v *ShellBoss) execLb(ctx ol.Context, name string) (cmd *exec.Cmd, err error) {
+	// the listens of lb maybe changed by reload.
+	v.lock.Lock()
+	conf := v.conf
+	v.lock.Unlock()
+
+	var binary string
+	var args, addrs []string
+	if r := &conf.Rtmplb; name == "rtmplb" && r.Enabled {
+		binary, addrs = r.Binary, []string{fmt.Sprintf("tcp://127.0.0.1:%v", r.Api), fmt.Sprintf("tcp://:%v", r.Rtmp)}
+		args = []string{"-c", r.Config, "-a", addrs[0], "-l", addrs[1]}
+	} else if r := &conf.Httplb; name == "httplb" && r.Enabled {
+		binary, addrs = r.Binary, []string{fmt.Sprintf("tcp://127.0.0.1:%v", r.Api), fmt.Sprintf("tcp://:%v", r.Http)}
+		args = []string{"-c", r.Config, "-a", addrs[0], "-l", addrs[1]}
+	} else if r := &conf.Apilb; name == "apilb" && r.Enabled {
+		binary, addrs = r.Binary, []string{fmt.Sprintf("tcp://127.0.0.1:%v", r.Api), fmt.Sprintf("tcp://:%v", r.Backend)}
+		args = []string{"-c", r.Config, "-api", addrs[0], "-backend", addrs[1]}
+	} else {
+		return
+	}
+
+	c := exec.Command(binary, args...)
+	for _, addr := range addrs {
+		v.inheritLbListener(ctx, c, addr)
+	}
+	// the child has its own copy of fds.
+	defer func() {
+		for _, f := range c.ExtraFiles {
+			f.Close()
 		}
+	}()
+
+	if _, err = v.pool.StartCmd(ctx, c); err != nil {
+		ol.E(ctx, fmt.Sprintf("exec %v failed, err is %v", name, err))
+		return
+	}
+	cmd = c
+
+	v.lock.Lock()
+	switch name {
+	case "rtmplb":
+		v.rtmplb = cmd
+	case "httplb":
+		v.httplb = cmd
+	case "apilb":
+		v.apilb = cmd
 	}
 
+	// close the held listeners of previous listens, which are changed by reload.
+	for _, addr := range v.lbAddrs[name] {
+		if l, ok := v.listeners[addr]; ok && !hasAddr(addrs, addr) {
+			l.Close()
+			delete(v.listeners, addr)
+		}
+	}
+	v.lbAddrs[name] = addrs
+	v.lock.Unlock()
+	ol.T(ctx, fmt.Sprintf("exec %v ok, args=%v, pid=%v", name, cmd.Args, cmd.Process.Pid))
 	return
 }
 
-func (v *ShellBoss) restartWorker(ctx ol.Context) (err error) {
-	v.upgradeLock.Lock()
-	defer v.upgradeLock.Unlock()
+func hasAddr(addrs []string, addr string) bool {
+	for _, v := range addrs {
+		if v == addr {
+			return true
+		}
+	}
+	return false
+}
 
-	var worker *SrsWorker
+// Whether the lb inherits the listeners held by shell, which can be respawned.
+func lbHolding(cmd *exec.Cmd) bool {
+	return cmd != nil && len(cmd.ExtraFiles) > 0
+}
 
-	v.activeWorker = nil
+// Pass the listener of addr held by shell to the lb, listen it when not held.
+// @remark the lb listens itself when failed, for example, on windows.
+func (v *ShellBoss) inheritLbListener(ctx ol.Context, cmd *exec.Cmd, addr string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	l, ok := v.listeners[addr]
+	if !ok {
+		var r0 error
+		var sl net.Listener
+		if sl, r0 = kernel.SdListen(addr); r0 != nil {
+			ol.W(ctx, fmt.Sprintf("ignore hold %v, err is %v", addr, r0))
+			return
+		}
+		if l, ok = sl.(*net.TCPListener); !ok {
+			sl.Close()
+			return
+		}
+	}
 
-	if worker, err = v.execWorker(ctx); err != nil {
-		// when failed, we must cleanup the worker,
-		// because we will retry when failed, and the Cycle()
-		// is not reap process when worker is ok.
-		worker.Close()
+	// never hold the listener which the lb can not inherit, or the lb fails to listen.
+	if r0 := kernel.InheritListener(cmd, addr, l); r0 != nil {
+		ol.W(ctx, fmt.Sprintf("ignore inherit %v, err is %v", addr, r0))
+		delete(v.listeners, addr)
+		l.Close()
+		return
+	}
+	v.listeners[addr] = l
+}
+
+// Respawn the terminated lb on the listeners held by shell, so the lb can be upgraded
+// by replacing the binary and stopping it, the connections are queued util it's ready.
+func (v *ShellBoss) respawnLb(ctx ol.Context, prev *exec.Cmd) (err error) {
+	if v.closed {
+		return fmt.Errorf("shell closed")
+	}
+	if !lbHolding(prev) {
+		return fmt.Errorf("no listener held")
+	}
 
-		ol.E(ctx, "restart worker failed, err is", err)
+	// the api of lb maybe changed by reload.
+	v.lock.Lock()
+	conf := v.conf
+	v.lock.Unlock()
+
+	var lb *lbTarget
+	var api int
+	switch prev {
+	case v.rtmplb:
+		api = conf.Rtmplb.Api
+		lb = &lbTarget{name: "rtmplb", api: api, key: "rtmp", reg: &v.rtmplbReg}
+	case v.httplb:
+		api = conf.Httplb.Api
+		lb = &lbTarget{name: "httplb", api: api, key: "http", reg: &v.httplbReg}
+	default:
+		api = conf.Apilb.Api
+		lb = &lbTarget{name: "apilb", api: api, key: "port", reg: &v.apilbReg}
+	}
+
+	var cmd *exec.Cmd
+	if cmd, err = v.execLb(ctx, lb.name); err != nil {
 		return
 	}
-	worker.state = SrsStateActive
-	v.activeWorker = worker
-	ol.T(ctx, fmt.Sprintf("fork worker ok, %v", worker))
 
+	url := fmt.Sprintf("http://127.0.0.1:%v/api/v1/version", api)
+	if err = checkApi(cmd, url, processRetryMax, processExecInterval); err != nil {
+		return fmt.Errorf("check %v api=%v failed, err is %v", lb.name, url, err)
+	}
+
+	// restore the workers of lb, ignore when never registered.
+	v.lock.Lock()
+	ports, pids := lb.reg.Ports, lb.reg.Pids
+	v.lock.Unlock()
+	if len(ports) > 0 {
+		if err = v.notifyProxy(ctx, lb, ports, pids); err != nil {
+			return
+		}
+	}
+
+	ol.T(ctx, fmt.Sprintf("respawn %v ok, pid=%v, prev=%v, ports=%v", lb.name, cmd.Process.Pid, prev.Process.Pid, ports))
 	return
 }
 
-func (v *ShellBoss) execWorker(ctx ol.Context) (worker *SrsWorker, err error) {
+// Start a new worker for instance, or replace the previous one when prev not nil.
+func (v *ShellBoss) execWorker(ctx ol.Context, prev *SrsWorker, instance int) (worker *SrsWorker, err error) {
 	r := &v.conf.Worker
 	if !r.Enabled {
 		return
@@ -399,6 +596,16 @@ func (v *ShellBoss) execWorker(ctx ol.Context) (worker *SrsWorker, err error) {
 	}
 
 	worker = NewSrsWorker(ctx, v, v.conf.SrsConfig(), v.ports)
+	// the first instance keep the name srs for compatibility.
+	if worker.instance = instance; instance > 0 {
+		worker.name = fmt.Sprintf("srs.%v", instance)
+	}
+	if prev != nil {
+		worker.name, worker.restarts, worker.crashes = prev.name, prev.restarts+1, prev.crashes
+	}
+	v.lock.Lock()
+	worker.spec = v.spec
+	v.lock.Unlock()
 	if err = worker.Exec(); err != nil {
 		ol.E(ctx, "start srs worker failed, err is", err)
 		return
@@ -408,11 +615,13 @@ func (v *ShellBoss) execWorker(ctx ol.Context) (worker *SrsWorker, err error) {
 	// when worker exec ok, the process must exists,
 	// we append the worker to queue to cleanup worker when
 	// process terminated.
-	v.workers = append(v.workers, worker)
-	ol.T(ctx, fmt.Sprintf("exec worker ok, pid=%v, total=%v", worker.pid, len(v.workers)))
+	total := v.addWorker(worker)
+	ol.T(ctx, fmt.Sprintf("exec worker ok, pid=%v, total=%v", worker.pid, total))
 
+	// the lbs never switch to the worker not ready, kill it and free ports.
 	if err = v.checkWorkerApi(ctx, worker); err != nil {
 		ol.E(ctx, "check worker api failed, err is", err)
+		worker.Close()
 		return
 	}
 	ol.T(ctx, "check srs worker api ok")
@@ -426,14 +635,44 @@ func (v *ShellBoss) execWorker(ctx ol.Context) (worker *SrsWorker, err error) {
 	return
 }
 
+// The active worker of instance, nil if not active.
+// @remark user must hold the lock.
+func (v *ShellBoss) active(instance int) *SrsWorker {
+	if instance < len(v.actives) && v.actives[instance] != nil && v.actives[instance].state == SrsStateActive {
+		return v.actives[instance]
+	}
+	return nil
+}
+
+// Set the worker to the active one of its instance.
+// @remark user must hold the lock.
+func (v *ShellBoss) setActive(worker *SrsWorker) {
+	for len(v.actives) <= worker.instance {
+		v.actives = append(v.actives, nil)
+	}
+
+	worker.state = SrsStateActive
+	v.actives[worker.instance] = worker
+}
+
 func (v *ShellBoss) checkWorkerApi(ctx ol.Context, worker *SrsWorker) (err error) {
-	api := fmt.Sprintf("http://127.0.0.1:%v/api/v1/versions", worker.api)
-	if err = checkApi(worker.cmd, api, processRetryMax, processExecInterval); err != nil {
-		ol.E(ctx, fmt.Sprintf("srs failed, api=%v, max=%v, interval=%v, err is %v",
-			api, processRetryMax, processExecInterval, err))
+	// the worker maybe closed by cycle when process terminated.
+	worker.lock.Lock()
+	cmd, port := worker.cmd, worker.api
+	worker.lock.Unlock()
+	if cmd == nil {
+		return fmt.Errorf("worker %v closed", worker.pid)
+	}
+
+	r := v.readiness
+	if err = r.wait(port, worker.terminated); err != nil {
+		ol.E(ctx, fmt.Sprintf("srs not ready, path=%v, timeout=%v, interval=%v, deadline=%v, err is %v",
+			r.path, r.timeout, r.interval, r.deadline, err))
 		return
 	}
 
+	api := fmt.Sprintf("http://127.0.0.1:%v/api/v1/versions", port)
+
 	// update current version
 	if _, body, err := oh.ApiRequest(api); err != nil {
 		ol.E(ctx, "request srs version failed, err is", err)
@@ -456,40 +695,171 @@ func (v *ShellBoss) checkWorkerApi(ctx ol.Context, worker *SrsWorker) (err error
 	return
 }
 
+// The lb to switch to the worker.
+type lbTarget struct {
+	name string
+	// the api port of lb.
+	api int
+	// the key of proxy api, for example, rtmp.
+	key string
+	// the ports and pids of workers to switch to.
+	ports []int
+	pids  []int
+	// the registration of lb, protected by shell lock.
+	reg *LbRegistration
+}
+
+// Switch all lbs to the worker and the other active instances, retry with backoff when failed.
+// @remark the lbs switch in two-phase, rollback the switched ones when any failed.
 func (v *ShellBoss) updateProxyApi(ctx ol.Context, worker *SrsWorker) (err error) {
-	// notify rtmp and http proxy to update the active backend.
-	url := fmt.Sprintf("http://127.0.0.1:%v/api/v1/proxy?rtmp=%v", v.conf.Rtmplb.Api, worker.rtmp)
-	if _, _, err := oh.ApiRequest(url); err != nil {
-		ol.E(ctx, "notify rtmp proxy failed, err is", err)
-		return err
+	// the worker replace the active one of its instance, ignore the dead instances.
+	var workers []*SrsWorker
+	v.lock.Lock()
+	for i := 0; i < len(v.actives) || i <= worker.instance; i++ {
+		if i == worker.instance {
+			workers = append(workers, worker)
+		} else if w := v.active(i); w != nil && !w.unhealthy {
+			workers = append(workers, v.actives[i])
+		}
 	}
-	ol.T(ctx, "notify rtmp proxy ok, url is", url)
+	v.lock.Unlock()
 
-	url = fmt.Sprintf("http://127.0.0.1:%v/api/v1/proxy?http=%v", v.conf.Httplb.Api, worker.http)
-	if _, _, err := oh.ApiRequest(url); err != nil {
-		ol.E(ctx, "notify http proxy failed, err is", err)
-		return err
+	rtmplb := &lbTarget{name: "rtmplb", api: v.conf.Rtmplb.Api, key: "rtmp", reg: &v.rtmplbReg}
+	httplb := &lbTarget{name: "httplb", api: v.conf.Httplb.Api, key: "http", reg: &v.httplbReg}
+	for _, w := range workers {
+		rtmplb.ports, rtmplb.pids = append(rtmplb.ports, w.rtmp), append(rtmplb.pids, w.pid)
+		httplb.ports, httplb.pids = append(httplb.ports, w.http), append(httplb.pids, w.pid)
 	}
-	ol.T(ctx, "notify http proxy ok, url is", url)
 
-	backend := worker.api
+	// the apilb only proxy to one backend, use the first instance.
+	backend := workers[0].api
 	if v.conf.ApiProxyToBig() {
-		backend = worker.big
+		backend = workers[0].big
 	}
-	url = fmt.Sprintf("http://127.0.0.1:%v/api/v1/proxy?port=%v", v.conf.Apilb.Api, backend)
-	if _, _, err := oh.ApiRequest(url); err != nil {
-		ol.E(ctx, "notify api proxy failed, err is", err)
-		return err
+	apilb := &lbTarget{name: "apilb", api: v.conf.Apilb.Api, key: "port",
+		ports: []int{backend}, pids: []int{workers[0].pid}, reg: &v.apilbReg,
+	}
+	lbs := []*lbTarget{rtmplb, httplb, apilb}
+
+	delay := lbSwitchBackoff
+	for i := 1; ; i++ {
+		if err = v.switchLbs(ctx, lbs); err == nil {
+			ol.T(ctx, fmt.Sprintf("switch lbs ok, %v", worker))
+			return
+		}
+
+		if i >= lbSwitchRetries {
+			ol.E(ctx, fmt.Sprintf("switch lbs failed, retry=%v, err is %v", i, err))
+			return
+		}
+
+		ol.W(ctx, fmt.Sprintf("switch lbs failed, retry=%v after %v, err is %v", i, delay, err))
+		select {
+		case <-time.After(delay):
+		case c := <-v.closing:
+			v.closing <- c
+			return
+		}
+		delay *= 2
+	}
+}
+
+// Switch lbs to the workers, rollback the switched lbs to previous ports when any failed.
+func (v *ShellBoss) switchLbs(ctx ol.Context, lbs []*lbTarget) (err error) {
+	v.lock.Lock()
+	prevs := make([]LbRegistration, len(lbs))
+	for i, lb := range lbs {
+		prevs[i] = *lb.reg
+	}
+	v.lock.Unlock()
+
+	for i, lb := range lbs {
+		if err = v.notifyProxy(ctx, lb, lb.ports, lb.pids); err == nil {
+			continue
+		}
+
+		for j := i - 1; j >= 0; j-- {
+			// ignore the lb never registered.
+			if prev := &prevs[j]; len(prev.Ports) > 0 {
+				if err := v.notifyProxy(ctx, lbs[j], prev.Ports, prev.Pids); err != nil {
+					ol.E(ctx, fmt.Sprintf("rollback %v to %v failed, err is %v", lbs[j].name, prev.Ports, err))
+				}
+			}
+		}
+		return fmt.Errorf("switch %v to %v failed, err is %v", lb.name, lb.ports, err)
 	}
-	ol.T(ctx, "notify api proxy ok, url is", url)
 
 	return
 }
 
+// Request the lb api to proxy to ports of workers, and record the registration.
+func (v *ShellBoss) notifyProxy(ctx ol.Context, lb *lbTarget, ports, pids []int) (err error) {
+	// the ports seperated by comma, for example, rtmp=19350,19351
+	var values []string
+	for _, port := range ports {
+		values = append(values, strconv.Itoa(port))
+	}
+	url := fmt.Sprintf("http://127.0.0.1:%v/api/v1/proxy?%v=%v", lb.api, lb.key, strings.Join(values, ","))
+
+	starttime := time.Now()
+	code, body, err := lbApiRequest(url)
+	ol.T(ctx, fmt.Sprintf("notify %v, url=%v, code=%v, body=%v, elapsed=%v, err=%v",
+		lb.name, url, code, strings.TrimSpace(string(body)), time.Now().Sub(starttime), err))
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// the lb keep the previous port when failed.
+	r := lb.reg
+	r.Ok, r.Error, r.Update = err == nil, "", time.Now()
+	if err != nil {
+		r.Error = err.Error()
+	} else {
+		r.Ports, r.Pids = ports, pids
+	}
+	return
+}
+
+// Request the api of lb with timeout.
+func lbApiRequest(url string) (code int, body []byte, err error) {
+	client := &http.Client{Timeout: lbApiTimeout}
+
+	var res *http.Response
+	if res, err = client.Get(url); err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	if body, err = ioutil.ReadAll(res.Body); err != nil {
+		return
+	}
+
+	s := struct {
+		Code int `json:"code"`
+	}{}
+	if err = json.Unmarshal(body, &s); err != nil {
+		return
+	}
+
+	if code = s.Code; code != 0 {
+		return code, body, fmt.Errorf("api error, code=%v", code)
+	}
+	return
+}
+
 func main() {
 	var err error
 
+	// test the config and quit.
+	var test bool
+	flag.BoolVar(&test, "t", false, "Test the config and quit.")
+	var format string
+	flag.StringVar(&format, "f", "text", "The format to print the config test, text or json.")
+
 	confFile := oo.ParseArgv("../conf/shell.json", kernel.Version(), signature)
+	if test {
+		os.Exit(testConfig(confFile, format, os.Stdout))
+	}
 	fmt.Println("SHELL is the process forker, config is", confFile)
 
 	conf := &ShellConfig{}
@@ -502,7 +872,21 @@ func main() {
 	ctx := &kernel.Context{}
 	ol.T(ctx, fmt.Sprintf("Config ok, %v", conf))
 
-	shell := NewShellBoss(conf)
+	// refuse to start when the shell is running.
+	if conf.Pid != "" {
+		pidFile := kernel.NewPidFile(conf.Pid)
+		if err = pidFile.Acquire(); err != nil {
+			ol.E(ctx, "Acquire pid file failed, err is", err)
+			return
+		}
+		defer pidFile.Close()
+	}
+
+	var shell *ShellBoss
+	if shell, err = NewShellBoss(conf); err != nil {
+		ol.E(ctx, "Create shell failed, err is", err)
+		return
+	}
 
 	if err = shell.ExecBuddies(ctx); err != nil {
 		ol.E(ctx, "Shell exec buddies failed, err is", err)
@@ -512,8 +896,8 @@ func main() {
 
 	var apiListener net.Listener
 	addrs := strings.Split(conf.Api, "://")
-	apiNetwork, apiAddr := addrs[0], addrs[1]
-	if apiListener, err = net.Listen(apiNetwork, apiAddr); err != nil {
+	apiAddr := addrs[1]
+	if apiListener, err = kernel.SdListen(conf.Api); err != nil {
 		ol.E(ctx, "http listen failed, err is", err)
 		return
 	}
@@ -544,10 +928,50 @@ func main() {
 			oh.WriteVersion(w, r, kernel.Version())
 		})
 
+		ol.T(ctx, fmt.Sprintf("Api: handle http://%v/api/v1/processes", apiAddr))
+		handler.HandleFunc("/api/v1/processes", func(w http.ResponseWriter, r *http.Request) {
+			oh.WriteData(&kernel.Context{}, w, r, shell.Processes())
+		})
+
+		ol.T(ctx, fmt.Sprintf("Api: handle http://%v/api/v1/ports", apiAddr))
+		handler.HandleFunc("/api/v1/ports", func(w http.ResponseWriter, r *http.Request) {
+			oh.WriteData(&kernel.Context{}, w, r, shell.PortsUsage())
+		})
+
+		ol.T(ctx, fmt.Sprintf("Api: handle http://%v/api/v1/reload", apiAddr))
+		handler.HandleFunc("/api/v1/reload", func(w http.ResponseWriter, r *http.Request) {
+			ctx := &kernel.Context{}
+			if r.Method != "POST" {
+				msg := fmt.Sprintf("reload requires POST, actual is %v", r.Method)
+				oh.WriteCplxError(ctx, w, r, apiMethodError, msg)
+				return
+			}
+
+			if err := shell.Reload(ctx, confFile); err != nil {
+				msg := fmt.Sprintf("reload failed, err is %v", err)
+				oh.WriteCplxError(ctx, w, r, apiReloadError, msg)
+				return
+			}
+
+			ol.T(ctx, "Api: reload ok.")
+			oh.WriteData(ctx, w, r, nil)
+		})
+
+		ol.T(ctx, fmt.Sprintf("Api: handle http://%v/api/v1/reloads", apiAddr))
+		handler.HandleFunc("/api/v1/reloads", func(w http.ResponseWriter, r *http.Request) {
+			oh.WriteData(&kernel.Context{}, w, r, shell.ReloadHistory())
+		})
+
 		ol.T(ctx, fmt.Sprintf("Api: handle http://%v/api/v1/upgrade", apiAddr))
 		handler.HandleFunc("/api/v1/upgrade", func(w http.ResponseWriter, r *http.Request) {
 			ctx := &kernel.Context{}
-			if err = shell.Upgrade(ctx); err != nil {
+			if r.Method != "POST" {
+				msg := fmt.Sprintf("upgrade requires POST, actual is %v", r.Method)
+				oh.WriteCplxError(ctx, w, r, apiMethodError, msg)
+				return
+			}
+
+			if err := shell.Upgrade(ctx); err != nil {
 				msg := fmt.Sprintf("upgrade failed, err is %v", err)
 				oh.WriteCplxError(ctx, w, r, apiUpgradeError, msg)
 				return
@@ -557,6 +981,8 @@ func main() {
 			oh.WriteData(ctx, w, r, nil)
 		})
 
+		kernel.HandleProfile(ctx, handler, &conf.Profile)
+
 		server := &http.Server{Addr: apiAddr, Handler: handler}
 		if err = server.Serve(apiListener); err != nil {
 			ol.E(ctx, "Api: http serve failed, err is", err)
@@ -577,26 +1003,56 @@ func main() {
 		shell.Close()
 	})
 
+	// probe the workers, restart the unhealthy one.
+	go func() {
+		ctx := &kernel.Context{}
+		ol.T(ctx, "Liveness: watch ready")
+		defer ol.T(ctx, "Liveness: watch ok.")
+
+		shell.watchLiveness(ctx)
+	}()
+
+	// reconcile the workers to the desired state of config.
+	go func() {
+		ctx := &kernel.Context{}
+		ol.T(ctx, "Reconcile: watch ready")
+		defer ol.T(ctx, "Reconcile: watch ok.")
+
+		shell.watchReconcile(ctx)
+	}()
+
+	// log the utilization of ports.
+	go func() {
+		ctx := &kernel.Context{}
+		ol.T(ctx, "Ports: watch ready")
+		defer ol.T(ctx, "Ports: watch ok.")
+
+		shell.watchPorts(ctx)
+	}()
+
 	// process singals
 	go func() {
 		ctx := &kernel.Context{}
 		ol.T(ctx, "Signal: ready")
 		defer ol.T(ctx, "Signal: signal ok.")
 
-		c := make(chan os.Signal)
-		signal.Notify(c, syscall.SIGUSR2)
-		for _ = range c {
-			// when upgrade failed, we serve as current workers.
-			if err = shell.Upgrade(ctx); err != nil {
-				ol.W(ctx, "Signal: upgrade failed, err is", err)
-			} else {
-				ol.T(ctx, "Signal: upgrade ok.")
-			}
+		c := make(chan os.Signal, 1)
+		if !controlSignals.notify(c) {
+			ol.W(ctx, "Signal: not supported, use api to reload and upgrade")
+			return
+		}
+		for s := range c {
+			controlSignals.serve(ctx, shell, confFile, s)
 		}
 
 	}()
 
+	// notify systemd when buddies and api ok, the shell is restarted when wedged.
+	kernel.SdNotifyReady(ctx, wg)
+
 	// wait for quit.
 	wg.Wait()
+
+	kernel.SdNotifyStopping(ctx)
 	return
 }
@@ -0,0 +1,200 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ The output of worker, capture the stdout and stderr to logger or file.
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"github.com/ossrs/go-oryx/kernel"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The output of worker, the lines of stdout and stderr prefixed with worker.
+type OutputConfig struct {
+	// The tank of output, "logger" to forward to shell logger,
+	// "file" to write to the work dir of worker, "none" to drop it, empty to use default.
+	Tank string `json:"tank"`
+	// The file under the work dir of worker for file tank, empty to use default.
+	File string `json:"file"`
+	// The rotation of file for file tank.
+	Rotate kernel.LogRotate `json:"rotate"`
+}
+
+const (
+	defaultOutputTank = "logger"
+	defaultOutputFile = "output.log"
+)
+
+func (v *OutputConfig) String() string {
+	return fmt.Sprintf("output(tank=%v,file=%v,rotate=(%v))", v.tank(), v.file(), &v.Rotate)
+}
+
+func (v *OutputConfig) Check() error {
+	if t := v.tank(); t != "logger" && t != "file" && t != "none" {
+		return fmt.Errorf("Output tank=%v should be logger, file or none", v.Tank)
+	}
+	if f := v.File; len(f) > 0 && (path.IsAbs(f) || strings.Contains(f, "..")) {
+		return fmt.Errorf("Output file=%v should be relative to work dir", f)
+	}
+	if c := &v.Rotate; c.Size < 0 || c.Interval < 0 || c.Keep < 0 {
+		return fmt.Errorf("Output rotate %v should not be negative", c)
+	}
+	return nil
+}
+
+func (v *OutputConfig) tank() string {
+	if len(v.Tank) == 0 {
+		return defaultOutputTank
+	}
+	return v.Tank
+}
+
+func (v *OutputConfig) file() string {
+	if len(v.File) == 0 {
+		return defaultOutputFile
+	}
+	return v.File
+}
+
+// The output of a worker process, read the pipes util the worker and its children quit.
+// @remark use pipes of file, so the wait of worker never blocks on the output.
+type workerOutput struct {
+	ctx    ol.Context
+	conf   OutputConfig
+	prefix string
+	// the file for file tank, nil for logger tank.
+	w io.WriteCloser
+	// the pipes of stdout and stderr, the writers for worker.
+	stdout, stderr [2]*os.File
+}
+
+// Create the output for worker in dir, nil when the tank is none.
+func NewWorkerOutput(ctx ol.Context, c *OutputConfig, dir string) (v *workerOutput, err error) {
+	if c.tank() == "none" {
+		return nil, nil
+	}
+
+	v = &workerOutput{ctx: ctx, conf: *c}
+	if c.tank() == "file" {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		if v.w, err = kernel.NewRotateWriter(path.Join(dir, c.file()), c.Rotate); err != nil {
+			return nil, err
+		}
+	}
+
+	if v.stdout[0], v.stdout[1], err = os.Pipe(); err != nil {
+		v.Close()
+		return nil, err
+	}
+	if v.stderr[0], v.stderr[1], err = os.Pipe(); err != nil {
+		v.Close()
+		return nil, err
+	}
+	return
+}
+
+// Attach the output to cmd, must start it after cmd started.
+func (v *workerOutput) Attach(cmd *exec.Cmd) {
+	cmd.Stdout, cmd.Stderr = v.stdout[1], v.stderr[1]
+}
+
+// Start to read the output of worker, the prefix identify the worker in lines.
+// @remark the output closes itself when the worker and its children quit.
+func (v *workerOutput) Start(prefix string) {
+	v.prefix = prefix
+
+	// the worker own the writers now.
+	v.stdout[1].Close()
+	v.stderr[1].Close()
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go v.read(wg, "stdout", v.stdout[0])
+	go v.read(wg, "stderr", v.stderr[0])
+
+	go func() {
+		wg.Wait()
+		if v.w != nil {
+			v.w.Close()
+		}
+	}()
+}
+
+// Close the output when worker not started.
+func (v *workerOutput) Close() error {
+	for _, f := range []*os.File{v.stdout[0], v.stdout[1], v.stderr[0], v.stderr[1]} {
+		if f != nil {
+			f.Close()
+		}
+	}
+	if v.w != nil {
+		return v.w.Close()
+	}
+	return nil
+}
+
+func (v *workerOutput) read(wg *sync.WaitGroup, stream string, r *os.File) {
+	defer wg.Done()
+	defer r.Close()
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); len(line) > 0 {
+			v.emit(stream, line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (v *workerOutput) emit(stream, line string) {
+	if v.w == nil {
+		if stream == "stderr" {
+			ol.W(v.ctx, v.prefix, stream, line)
+		} else {
+			ol.T(v.ctx, v.prefix, stream, line)
+		}
+		return
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05.000")
+	if _, err := fmt.Fprintf(v.w, "[%v][%v][%v] %v\n", now, v.prefix, stream, line); err != nil {
+		ol.W(v.ctx, v.prefix, "write output failed, err is", err)
+	}
+}
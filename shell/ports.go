@@ -30,22 +30,87 @@ package main
 import (
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 )
 
+// The default duration to quarantine the busy port.
+const defaultPortQuarantine = time.Duration(30) * time.Second
+
+// The error when there are enough free ports, but no contiguous block.
+var ErrPortsFragmented = fmt.Errorf("no contiguous ports, pool is fragmented")
+
 // PortPool The port pool manage available ports.
+// @remark The pool is safe for concurrent use.
 type PortPool struct {
+	// Whether check the freed port, when strict, Free returns error for port
+	// out of range or not allocated, and never changes the pool.
+	Strict bool
+	// Whether probe the port by listen before alloc it, the port which is used by
+	// other process is skipped and quarantined, recheck it after Quarantine.
+	Probe      bool
+	Quarantine time.Duration
+	// The range of ports, [start,stop].
+	start, stop int
 	// Alloc new port from ports. Alloc new port from the head of the list.
 	// Release to ports when free port.
-	// If check failed,  put the port to the tail of the list
+	// If check failed, quarantine the port and skip it.
 	ports []int
 	// The ports in use. fill used when alloc
 	used []int
+	// The reserved ports, never alloc them.
+	excluded []int
+	// The busy ports which is quarantined util the time.
+	quarantined map[int]time.Time
+	// The owner of allocated ports, for example, the worker.
+	owners map[int]string
+	// The max allocated ports.
+	highWater int
+	// The named sub-ranges, only alloc by AllocFrom, for example, rtmp.
+	ranges map[string]*portRange
+	lock   *sync.Mutex
+}
+
+// The named sub-range of pool, [start,stop].
+type portRange struct {
+	start, stop int
+	// The max allocated ports in range.
+	highWater int
+}
+
+func (v *portRange) contains(port int) bool {
+	return port >= v.start && port <= v.stop
+}
+
+// PortStats The utilization of pool,
+// where total is the sum of allocated, free, excluded and quarantined.
+type PortStats struct {
+	Total       int `json:"total"`
+	Allocated   int `json:"allocated"`
+	Free        int `json:"free"`
+	Excluded    int `json:"excluded"`
+	Quarantined int `json:"quarantined"`
+	HighWater   int `json:"high_water"`
+	// The stats of named sub-ranges, which are also counted in pool.
+	Ranges map[string]*PortStats `json:"ranges,omitempty"`
+}
+
+func (v *PortStats) String() string {
+	return fmt.Sprintf("total=%v,allocated=%v,free=%v,excluded=%v,quarantined=%v,high=%v",
+		v.Total, v.Allocated, v.Free, v.Excluded, v.Quarantined, v.HighWater)
 }
 
 // NewPortPool alloc port in [start,stop]
 func NewPortPool(start, stop int) *PortPool {
-	v := &PortPool{}
+	v := &PortPool{
+		start: start, stop: stop, lock: &sync.Mutex{},
+		Probe: true, Quarantine: defaultPortQuarantine,
+		quarantined: make(map[int]time.Time),
+		owners:      make(map[int]string),
+		ranges:      make(map[string]*portRange),
+	}
 	v.ports = make([]int, stop-start+1)
 	for i := start; i <= stop; i++ {
 		v.ports[i-start] = i
@@ -53,26 +118,150 @@ func NewPortPool(start, stop int) *PortPool {
 	return v
 }
 
-// allocOnePort alloc a port from the port pool
-func (v *PortPool) allocOnePort() (int, error) {
+// NewPortPoolExcluding alloc port in [start,stop] except the excluded ports.
+func NewPortPoolExcluding(start, stop int, excluded []int) (*PortPool, error) {
+	v := NewPortPool(start, stop)
+	for _, port := range excluded {
+		if err := v.Reserve(port); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// Reserve exclude the port from pool, which never be allocated.
+// @remark Error when port out of range or already allocated.
+func (v *PortPool) Reserve(port int) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if port < v.start || port > v.stop {
+		return fmt.Errorf("reserve port %v out of range [%v,%v]", port, v.start, v.stop)
+	}
+	if hasPort(v.used, port) {
+		return fmt.Errorf("reserve port %v already allocated", port)
+	}
+	if hasPort(v.excluded, port) {
+		return nil
+	}
+
+	for i, p := range v.ports {
+		if p == port {
+			v.ports = append(v.ports[:i], v.ports[i+1:]...)
+			break
+		}
+	}
+	v.excluded = append(v.excluded, port)
+	return nil
+}
+
+// ReserveRange reserve the named sub-range [start,stop] of pool, which is only
+// allocated by AllocFrom, for example, the rtmp ports for firewall rules.
+// @remark Error when out of range, conflict with other range, or any port allocated.
+func (v *PortPool) ReserveRange(name string, start, stop int) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if len(name) == 0 {
+		return fmt.Errorf("empty range name")
+	}
+	if start > stop || start < v.start || stop > v.stop {
+		return fmt.Errorf("range %v [%v,%v] out of pool [%v,%v]", name, start, stop, v.start, v.stop)
+	}
+	if _, ok := v.ranges[name]; ok {
+		return fmt.Errorf("range %v already reserved", name)
+	}
+	for n, r := range v.ranges {
+		if start <= r.stop && stop >= r.start {
+			return fmt.Errorf("range %v [%v,%v] conflicts with %v [%v,%v]", name, start, stop, n, r.start, r.stop)
+		}
+	}
+	for _, port := range v.used {
+		if port >= start && port <= stop {
+			return fmt.Errorf("range %v [%v,%v] port %v already allocated", name, start, stop, port)
+		}
+	}
+
+	v.ranges[name] = &portRange{start: start, stop: stop}
+	return nil
+}
+
+// The name of range the port in, empty if not in any range.
+func (v *PortPool) rangeOf(port int) string {
+	for name, r := range v.ranges {
+		if r.contains(port) {
+			return name
+		}
+	}
+	return ""
+}
+
+// allocOnePort alloc a port from the port pool, or the named range when name not empty.
+func (v *PortPool) allocOnePort(name string) (int, error) {
 	if len(v.ports) <= 0 {
 		return 0, fmt.Errorf("empty port pool")
 	}
 
+	now := time.Now()
+	var busy, total int
 	for i, p := range v.ports {
-		if checkPort(p) {
-			// delete i-index element
-			v.ports = append(v.ports[:i], v.ports[i+1:]...)
-			v.used = append(v.used, p)
-			return p, nil
+		if v.rangeOf(p) != name {
+			continue
+		}
+		total++
+
+		if t, ok := v.quarantined[p]; ok {
+			if now.Before(t) {
+				busy++
+				continue
+			}
+			delete(v.quarantined, p)
+		}
+
+		if v.Probe && !checkPort(p) {
+			v.quarantined[p] = now.Add(v.Quarantine)
+			busy++
+			continue
 		}
+
+		// delete i-index element
+		v.ports = append(v.ports[:i], v.ports[i+1:]...)
+		v.used = append(v.used, p)
+		v.updateHighWater()
+		return p, nil
 	}
 
-	return 0, fmt.Errorf("No available port")
+	if len(name) > 0 {
+		return 0, fmt.Errorf("No available port in range %v, %v of %v ports busy", name, busy, total)
+	}
+	return 0, fmt.Errorf("No available port, %v of %v ports busy", busy, total)
+}
+
+// Update the high water of pool and ranges.
+func (v *PortPool) updateHighWater() {
+	if len(v.used) > v.highWater {
+		v.highWater = len(v.used)
+	}
+
+	for _, r := range v.ranges {
+		var n int
+		for _, p := range v.used {
+			if r.contains(p) {
+				n++
+			}
+		}
+		if n > r.highWater {
+			r.highWater = n
+		}
+	}
 }
 
 // Alloc alloc nbPort ports from the port pool
+// @remark When failed, the allocated ports are returned to pool.
 func (v *PortPool) Alloc(nbPort int) ([]int, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
 	if nbPort <= 0 {
 		return nil, fmt.Errorf("invalid ports %v", nbPort)
 	}
@@ -81,10 +270,34 @@ func (v *PortPool) Alloc(nbPort int) ([]int, error) {
 		return nil, fmt.Errorf("no %v port available, left %v", nbPort, len(v.ports))
 	}
 
+	return v.alloc("", nbPort)
+}
+
+// AllocFrom alloc nbPort ports from the named range.
+// @remark When failed, the allocated ports are returned to pool.
+func (v *PortPool) AllocFrom(name string, nbPort int) ([]int, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if nbPort <= 0 {
+		return nil, fmt.Errorf("invalid ports %v", nbPort)
+	}
+	if _, ok := v.ranges[name]; !ok {
+		return nil, fmt.Errorf("no range %v", name)
+	}
+
+	return v.alloc(name, nbPort)
+}
+
+// @remark user must hold the lock.
+func (v *PortPool) alloc(name string, nbPort int) ([]int, error) {
 	ports := []int{}
 	for i := 0; i < nbPort; i++ {
-		p, err := v.allocOnePort()
+		p, err := v.allocOnePort(name)
 		if err != nil {
+			for _, p := range ports {
+				v.freeOnePort(p)
+			}
 			return nil, err
 		} else {
 			ports = append(ports, p)
@@ -93,10 +306,116 @@ func (v *PortPool) Alloc(nbPort int) ([]int, error) {
 	return ports, nil
 }
 
+// AllocContiguous alloc nbPort consecutive ports, the lowest available block.
+// @remark Return ErrPortsFragmented when enough free ports but no contiguous block.
+func (v *PortPool) AllocContiguous(nbPort int) ([]int, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if nbPort <= 0 {
+		return nil, fmt.Errorf("invalid ports %v", nbPort)
+	}
+
+	if len(v.ports) < nbPort {
+		return nil, fmt.Errorf("no %v port available, left %v", nbPort, len(v.ports))
+	}
+
+	// the candidates, not quarantined, not in named ranges, and sorted.
+	now := time.Now()
+	var candidates []int
+	for _, p := range v.ports {
+		if v.rangeOf(p) != "" {
+			continue
+		}
+		if t, ok := v.quarantined[p]; ok {
+			if now.Before(t) {
+				continue
+			}
+			delete(v.quarantined, p)
+		}
+		candidates = append(candidates, p)
+	}
+	sort.Ints(candidates)
+
+	// find the lowest run, restart after the busy port.
+	var run []int
+	var busy int
+	for _, p := range candidates {
+		if len(run) > 0 && run[len(run)-1] != p-1 {
+			run = nil
+		}
+
+		if v.Probe && !checkPort(p) {
+			v.quarantined[p] = now.Add(v.Quarantine)
+			busy++
+			run = nil
+			continue
+		}
+
+		if run = append(run, p); len(run) == nbPort {
+			break
+		}
+	}
+
+	if len(run) < nbPort {
+		if len(candidates)-busy >= nbPort {
+			return nil, ErrPortsFragmented
+		}
+		busy = len(v.ports) - len(candidates) + busy
+		return nil, fmt.Errorf("no %v port available, %v of %v ports busy", nbPort, busy, len(v.ports))
+	}
+
+	for _, p := range run {
+		for i, port := range v.ports {
+			if port == p {
+				v.ports = append(v.ports[:i], v.ports[i+1:]...)
+				break
+			}
+		}
+		v.used = append(v.used, p)
+	}
+	v.updateHighWater()
+	return run, nil
+}
+
 // Free free port from the port pool
-func (v *PortPool) Free(port int) {
+// @remark Only return error in strict mode, when port out of range or not in use.
+func (v *PortPool) Free(port int) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// the allocated port maybe out of range or excluded after resize.
+	if hasPort(v.used, port) {
+		v.freeOnePort(port)
+		return nil
+	}
+
+	if hasPort(v.excluded, port) {
+		if v.Strict {
+			return fmt.Errorf("port %v is reserved", port)
+		}
+		return nil
+	}
+
+	if v.Strict {
+		if port < v.start || port > v.stop {
+			return fmt.Errorf("port %v out of range [%v,%v]", port, v.start, v.stop)
+		}
+		return fmt.Errorf("port %v not allocated", port)
+	}
+
+	v.freeOnePort(port)
+	return nil
+}
+
+// freeOnePort free the port to pool, drop it when out of range or excluded.
+func (v *PortPool) freeOnePort(port int) {
+	delete(v.owners, port)
+
 	// Free used ports to the head of the ports list for better port reused.
-	v.ports = append([]int{port}, v.ports...)
+	if port >= v.start && port <= v.stop && !hasPort(v.excluded, port) {
+		v.ports = append([]int{port}, v.ports...)
+	}
 	for i, p := range v.used {
 		if port == p {
 			// delete i-index element
@@ -108,7 +427,170 @@ func (v *PortPool) Free(port int) {
 
 // GetPortsInUse get a list of port in use
 func (v *PortPool) GetPortsInUse() []int {
-	return v.used
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return append([]int{}, v.used...)
+}
+
+// Allocated the number of ports in use.
+func (v *PortPool) Allocated() int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return len(v.used)
+}
+
+// Available the number of ports can be allocated.
+func (v *PortPool) Available() int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return len(v.ports)
+}
+
+// Resize change the range and excluded ports of pool.
+// @remark The allocated ports are never invalidated, but the ports out of
+// range or excluded are dropped when freed, so shrink takes effect as ports are freed.
+func (v *PortPool) Resize(start, stop int, excluded []int) error {
+	if start <= 0 || start >= stop {
+		return fmt.Errorf("invalid ports range [%v,%v]", start, stop)
+	}
+	for _, port := range excluded {
+		if port < start || port > stop {
+			return fmt.Errorf("exclude port %v out of range [%v,%v]", port, start, stop)
+		}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for name, r := range v.ranges {
+		if r.start < start || r.stop > stop {
+			return fmt.Errorf("range %v [%v,%v] out of [%v,%v]", name, r.start, r.stop, start, stop)
+		}
+	}
+
+	// keep the order of available ports in range.
+	var ports []int
+	for _, p := range v.ports {
+		if p >= start && p <= stop && !hasPort(excluded, p) {
+			ports = append(ports, p)
+		}
+	}
+
+	// append the new ports, which is out of previous range or excluded before.
+	for p := start; p <= stop; p++ {
+		if p >= v.start && p <= v.stop && !hasPort(v.excluded, p) {
+			continue
+		}
+		if hasPort(excluded, p) || hasPort(v.used, p) {
+			continue
+		}
+		ports = append(ports, p)
+	}
+
+	v.start, v.stop = start, stop
+	v.excluded, v.ports = append([]int{}, excluded...), ports
+	return nil
+}
+
+// Own set the owner of allocated ports, for example, the worker.
+// @remark Error when port not allocated.
+func (v *PortPool) Own(owner string, ports ...int) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for _, port := range ports {
+		if !hasPort(v.used, port) {
+			return fmt.Errorf("own port %v not allocated", port)
+		}
+	}
+	for _, port := range ports {
+		v.owners[port] = owner
+	}
+	return nil
+}
+
+// Owners get the owner of ports in use, empty string if not owned.
+func (v *PortPool) Owners() map[int]string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	owners := make(map[int]string)
+	for _, port := range v.used {
+		owners[port] = v.owners[port]
+	}
+	return owners
+}
+
+// Stats get the utilization of pool.
+func (v *PortPool) Stats() *PortStats {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	var quarantined int
+	for _, p := range v.ports {
+		if t, ok := v.quarantined[p]; ok && now.Before(t) {
+			quarantined++
+		}
+	}
+
+	s := &PortStats{
+		Total:       v.stop - v.start + 1,
+		Allocated:   len(v.used),
+		Free:        len(v.ports) - quarantined,
+		Excluded:    len(v.excluded),
+		Quarantined: quarantined,
+		HighWater:   v.highWater,
+	}
+	for name, r := range v.ranges {
+		if s.Ranges == nil {
+			s.Ranges = make(map[string]*PortStats)
+		}
+		s.Ranges[name] = v.rangeStats(r, now)
+	}
+	return s
+}
+
+// The stats of named range.
+// @remark user must hold the lock.
+func (v *PortPool) rangeStats(r *portRange, now time.Time) *PortStats {
+	in := func(ports []int) (n int) {
+		for _, p := range ports {
+			if r.contains(p) {
+				n++
+			}
+		}
+		return
+	}
+
+	var quarantined int
+	for _, p := range v.ports {
+		if t, ok := v.quarantined[p]; ok && now.Before(t) && r.contains(p) {
+			quarantined++
+		}
+	}
+
+	return &PortStats{
+		Total:       r.stop - r.start + 1,
+		Allocated:   in(v.used),
+		Free:        in(v.ports) - quarantined,
+		Excluded:    in(v.excluded),
+		Quarantined: quarantined,
+		HighWater:   r.highWater,
+	}
+}
+
+// hasPort whether port in ports.
+func hasPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
 }
 
 // checkPort check if a port is available
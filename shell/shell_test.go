@@ -25,7 +25,18 @@ SOFTWARE.
 package main
 
 import (
+	"bytes"
+	"fmt"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"github.com/ossrs/go-oryx/kernel"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestPortPool_Alloc(t *testing.T) {
@@ -81,6 +92,470 @@ func TestPortPool_Alloc2(t *testing.T) {
 	}
 }
 
+func TestPortPool_Strict(t *testing.T) {
+	p := NewPortPool(6001, 6010)
+	p.Strict = true
+
+	if err := p.Free(6001); err == nil {
+		t.Error("should error for port not allocated")
+	}
+	if err := p.Free(11); err == nil {
+		t.Error("should error for port out of range")
+	}
+	if p.Allocated() != 0 || p.Available() != 10 {
+		t.Errorf("invalid allocated=%v, available=%v", p.Allocated(), p.Available())
+	}
+
+	if ps, err := p.Alloc(2); err != nil || len(ps) != 2 {
+		t.Errorf("alloc failed, ports=%v, err is %v", ps, err)
+	} else if p.Allocated() != 2 || p.Available() != 8 {
+		t.Errorf("invalid allocated=%v, available=%v", p.Allocated(), p.Available())
+	} else if err = p.Free(ps[0]); err != nil {
+		t.Errorf("free %v failed, err is %v", ps[0], err)
+	} else if err = p.Free(ps[0]); err == nil {
+		t.Errorf("should error for double free %v", ps[0])
+	} else if p.Allocated() != 1 || p.Available() != 9 {
+		t.Errorf("invalid allocated=%v, available=%v", p.Allocated(), p.Available())
+	}
+}
+
+func TestPortPool_Concurrent(t *testing.T) {
+	p := NewPortPool(16001, 16100)
+	p.Strict = true
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				ps, err := p.Alloc(3)
+				if err != nil {
+					t.Errorf("alloc failed, err is %v", err)
+					return
+				}
+				for _, port := range ps {
+					if err = p.Free(port); err != nil {
+						t.Errorf("free %v failed, err is %v", port, err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if p.Allocated() != 0 || p.Available() != 100 || len(p.GetPortsInUse()) != 0 {
+		t.Errorf("invalid allocated=%v, available=%v", p.Allocated(), p.Available())
+	}
+}
+
+func TestPortPool_Probe(t *testing.T) {
+	l, err := net.Listen("tcp", ":16202")
+	if err != nil {
+		t.Skip("listen failed, err is", err)
+	}
+	defer l.Close()
+
+	p := NewPortPool(16201, 16203)
+	p.Quarantine = time.Duration(100) * time.Millisecond
+
+	if ps, err := p.Alloc(2); err != nil || len(ps) != 2 || ps[0] != 16201 || ps[1] != 16203 {
+		t.Errorf("alloc failed, ports=%v, err is %v", ps, err)
+	} else if ps, err = p.Alloc(1); err == nil || !strings.Contains(err.Error(), "busy") {
+		t.Errorf("should exhausted, ports=%v, err is %v", ps, err)
+	}
+
+	// the port is quarantined, never alloc it even released.
+	l.Close()
+	if ps, err := p.Alloc(1); err == nil {
+		t.Errorf("should quarantined, ports=%v", ps)
+	}
+
+	time.Sleep(p.Quarantine)
+	if ps, err := p.Alloc(1); err != nil || len(ps) != 1 || ps[0] != 16202 {
+		t.Errorf("alloc failed, ports=%v, err is %v", ps, err)
+	}
+}
+
+func TestPortPool_ProbeExhausted(t *testing.T) {
+	var ls []net.Listener
+	defer func() {
+		for _, l := range ls {
+			l.Close()
+		}
+	}()
+	for _, port := range []string{":16301", ":16302"} {
+		l, err := net.Listen("tcp", port)
+		if err != nil {
+			t.Skip("listen failed, err is", err)
+		}
+		ls = append(ls, l)
+	}
+
+	p := NewPortPool(16301, 16303)
+	if ps, err := p.Alloc(2); err == nil {
+		t.Errorf("should exhausted, ports=%v", ps)
+	} else if p.Allocated() != 0 || p.Available() != 3 {
+		t.Errorf("should rollback, allocated=%v, available=%v", p.Allocated(), p.Available())
+	}
+
+	p = NewPortPool(16301, 16303)
+	p.Probe = false
+	if ps, err := p.Alloc(3); err != nil || len(ps) != 3 {
+		t.Errorf("alloc failed, ports=%v, err is %v", ps, err)
+	}
+}
+
+func TestPortPool_Exclude(t *testing.T) {
+	if _, err := NewPortPoolExcluding(16401, 16410, []int{16400}); err == nil {
+		t.Error("should error for exclude out of range")
+	}
+
+	p, err := NewPortPoolExcluding(16401, 16410, []int{16402, 16405, 16410})
+	if err != nil {
+		t.Fatalf("create pool failed, err is %v", err)
+	}
+	p.Strict = true
+
+	if p.Available() != 7 {
+		t.Errorf("invalid available=%v", p.Available())
+	}
+	if ps, err := p.Alloc(8); err == nil {
+		t.Errorf("should error, ports=%v", ps)
+	}
+
+	ps, err := p.Alloc(7)
+	if err != nil || len(ps) != 7 {
+		t.Fatalf("alloc failed, ports=%v, err is %v", ps, err)
+	}
+	for _, port := range ps {
+		if port == 16402 || port == 16405 || port == 16410 {
+			t.Errorf("alloc excluded port %v, ports=%v", port, ps)
+		}
+	}
+	if ps, err := p.Alloc(1); err == nil {
+		t.Errorf("should error, ports=%v", ps)
+	}
+
+	if err = p.Free(16405); err == nil {
+		t.Error("should error for free reserved port")
+	}
+	if err = p.Reserve(ps[0]); err == nil {
+		t.Errorf("should error for reserve allocated port %v", ps[0])
+	}
+	if err = p.Free(ps[0]); err != nil {
+		t.Errorf("free failed, err is %v", err)
+	} else if err = p.Reserve(ps[0]); err != nil {
+		t.Errorf("reserve failed, err is %v", err)
+	} else if p.Available() != 0 || p.Allocated() != 6 {
+		t.Errorf("invalid allocated=%v, available=%v", p.Allocated(), p.Available())
+	}
+}
+
+func TestPortPool_AllocContiguous(t *testing.T) {
+	p, err := NewPortPoolExcluding(16501, 16510, []int{16503})
+	if err != nil {
+		t.Fatalf("create pool failed, err is %v", err)
+	}
+	p.Strict = true
+
+	if _, err := p.AllocContiguous(0); err == nil {
+		t.Error("should error")
+	}
+
+	// 16503 is excluded, so the first block is 16504-16506.
+	if ps, err := p.AllocContiguous(3); err != nil || len(ps) != 3 || ps[0] != 16504 || ps[2] != 16506 {
+		t.Errorf("alloc failed, ports=%v, err is %v", ps, err)
+	}
+	if ps, err := p.AllocContiguous(2); err != nil || len(ps) != 2 || ps[0] != 16501 || ps[1] != 16502 {
+		t.Errorf("alloc failed, ports=%v, err is %v", ps, err)
+	}
+
+	// make fragments, free 16502 and 16505, left 16502,16505,16507-16510.
+	p.Free(16502)
+	p.Free(16505)
+	if ps, err := p.AllocContiguous(5); err != ErrPortsFragmented {
+		t.Errorf("should fragmented, ports=%v, err is %v", ps, err)
+	}
+	if ps, err := p.AllocContiguous(4); err != nil || len(ps) != 4 || ps[0] != 16507 || ps[3] != 16510 {
+		t.Errorf("alloc failed, ports=%v, err is %v", ps, err)
+	}
+	if ps, err := p.AllocContiguous(2); err != ErrPortsFragmented {
+		t.Errorf("should fragmented, ports=%v, err is %v", ps, err)
+	} else if p.Allocated() != 7 || p.Available() != 2 {
+		t.Errorf("invalid allocated=%v, available=%v", p.Allocated(), p.Available())
+	}
+	if ps, err := p.AllocContiguous(3); err == nil || err == ErrPortsFragmented {
+		t.Errorf("should exhausted, ports=%v, err is %v", ps, err)
+	}
+
+	// free any port in the block as usual.
+	if err = p.Free(16508); err != nil {
+		t.Errorf("free failed, err is %v", err)
+	} else if ps, err := p.Alloc(3); err != nil || len(ps) != 3 {
+		t.Errorf("alloc failed, ports=%v, err is %v", ps, err)
+	}
+}
+
+func TestPortPool_Stats(t *testing.T) {
+	l, err := net.Listen("tcp", ":16602")
+	if err != nil {
+		t.Fatal("listen failed, err is", err)
+	}
+	defer l.Close()
+
+	p, err := NewPortPoolExcluding(16601, 16610, []int{16610})
+	if err != nil {
+		t.Fatal("create pool failed, err is", err)
+	}
+
+	ports, err := p.Alloc(3)
+	if err != nil {
+		t.Fatal("alloc failed, err is", err)
+	}
+
+	if s := p.Stats(); s.Total != 10 || s.Allocated != 3 || s.Free != 5 || s.Excluded != 1 || s.Quarantined != 1 || s.HighWater != 3 {
+		t.Errorf("invalid stats %v", s)
+	}
+
+	if err = p.Own("srs/100", ports[:2]...); err != nil {
+		t.Error("own failed, err is", err)
+	}
+	if err = p.Own("srs/100", 16609); err == nil {
+		t.Error("should fail for not allocated")
+	}
+	if owners := p.Owners(); len(owners) != 3 || owners[ports[0]] != "srs/100" || owners[ports[2]] != "" {
+		t.Errorf("invalid owners %v", owners)
+	}
+
+	if err = p.Free(ports[0]); err != nil {
+		t.Error("free failed, err is", err)
+	}
+	if owners := p.Owners(); len(owners) != 2 {
+		t.Errorf("invalid owners %v", owners)
+	}
+	if s := p.Stats(); s.Allocated != 2 || s.Free != 6 || s.HighWater != 3 {
+		t.Errorf("invalid stats %v", s)
+	}
+
+	// the owner is reset when alloc again.
+	if ports, err = p.Alloc(1); err != nil {
+		t.Error("alloc failed, err is", err)
+	} else if owners := p.Owners(); owners[ports[0]] != "" {
+		t.Errorf("invalid owners %v", owners)
+	}
+}
+
+func TestPortPool_Resize(t *testing.T) {
+	p := NewPortPool(16701, 16710)
+	p.Strict, p.Probe = true, false
+
+	if ps, err := p.Alloc(4); err != nil || ps[0] != 16701 || ps[3] != 16704 {
+		t.Errorf("alloc failed, ports=%v, err is %v", ps, err)
+	}
+
+	// grow, the new ports are available.
+	if err := p.Resize(16701, 16715, nil); err != nil {
+		t.Error("resize failed, err is", err)
+	} else if p.Allocated() != 4 || p.Available() != 11 {
+		t.Errorf("invalid allocated=%v, available=%v", p.Allocated(), p.Available())
+	} else if ps, err := p.Alloc(7); err != nil || ps[0] != 16705 || ps[6] != 16711 {
+		t.Errorf("alloc failed, ports=%v, err is %v", ps, err)
+	} else {
+		for _, port := range ps {
+			p.Free(port)
+		}
+	}
+
+	// invalid range, the pool is not changed.
+	if err := p.Resize(16710, 16701, nil); err == nil {
+		t.Error("should fail for invalid range")
+	} else if err := p.Resize(16701, 16710, []int{16711}); err == nil {
+		t.Error("should fail for exclude out of range")
+	} else if p.Allocated() != 4 || p.Available() != 11 {
+		t.Errorf("invalid allocated=%v, available=%v", p.Allocated(), p.Available())
+	}
+
+	// shrink, the allocated ports are still in use.
+	if err := p.Resize(16703, 16708, []int{16706}); err != nil {
+		t.Error("resize failed, err is", err)
+	} else if p.Allocated() != 4 || p.Available() != 3 {
+		t.Errorf("invalid allocated=%v, available=%v", p.Allocated(), p.Available())
+	}
+
+	// the port out of range is dropped when freed.
+	if err := p.Free(16701); err != nil {
+		t.Error("free failed, err is", err)
+	} else if p.Allocated() != 3 || p.Available() != 3 {
+		t.Errorf("invalid allocated=%v, available=%v", p.Allocated(), p.Available())
+	} else if err = p.Free(16701); err == nil {
+		t.Error("should fail for out of range")
+	}
+
+	// the port in range is returned.
+	if err := p.Free(16703); err != nil {
+		t.Error("free failed, err is", err)
+	} else if p.Allocated() != 2 || p.Available() != 4 {
+		t.Errorf("invalid allocated=%v, available=%v", p.Allocated(), p.Available())
+	}
+
+	// the excluded port is available when not excluded.
+	if err := p.Resize(16703, 16708, nil); err != nil {
+		t.Error("resize failed, err is", err)
+	} else if p.Available() != 5 {
+		t.Errorf("invalid available=%v", p.Available())
+	}
+}
+
+func TestPortPool_Ranges(t *testing.T) {
+	p := NewPortPool(16801, 16820)
+	p.Strict, p.Probe = true, false
+
+	if err := p.ReserveRange("rtmp", 16811, 16815); err != nil {
+		t.Error("reserve failed, err is", err)
+	}
+	if err := p.ReserveRange("http", 16815, 16816); err == nil {
+		t.Error("should fail for conflict with rtmp")
+	}
+	if err := p.ReserveRange("api", 16819, 16821); err == nil {
+		t.Error("should fail for out of pool")
+	}
+	if err := p.ReserveRange("api", 16816, 16817); err != nil {
+		t.Error("reserve failed, err is", err)
+	}
+
+	// the general alloc never use the ports in ranges.
+	if ps, err := p.AllocContiguous(10); err != nil || ps[0] != 16801 || ps[9] != 16810 {
+		t.Errorf("alloc failed, ports=%v, err is %v", ps, err)
+	}
+	if ps, err := p.Alloc(3); err != nil || ps[0] != 16818 || ps[2] != 16820 {
+		t.Errorf("alloc failed, ports=%v, err is %v", ps, err)
+	}
+
+	if ps, err := p.AllocFrom("rtmp", 2); err != nil || ps[0] != 16811 || ps[1] != 16812 {
+		t.Errorf("alloc failed, ports=%v, err is %v", ps, err)
+	}
+	if _, err := p.AllocFrom("api", 3); err == nil {
+		t.Error("should fail for range exhausted")
+	}
+	if _, err := p.AllocFrom("dns", 1); err == nil {
+		t.Error("should fail for no range")
+	}
+	if err := p.ReserveRange("dns", 16801, 16802); err == nil {
+		t.Error("should fail for ports allocated")
+	}
+
+	s := p.Stats()
+	if r := s.Ranges["rtmp"]; r == nil || r.Total != 5 || r.Allocated != 2 || r.Free != 3 || r.HighWater != 2 {
+		t.Errorf("invalid rtmp stats %v", r)
+	}
+	if r := s.Ranges["api"]; r == nil || r.Allocated != 0 || r.Free != 2 {
+		t.Errorf("invalid api stats %v", r)
+	}
+	if s.Allocated != 15 {
+		t.Errorf("invalid stats %v", s)
+	}
+
+	if err := p.Resize(16801, 16815, nil); err == nil {
+		t.Error("should fail for api range out of pool")
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	vars := map[string]string{"rtmpPort": "1935", "apiPort": "1985", "name": "srs"}
+
+	for s, r := range map[string]string{
+		"":                         "",
+		"-c":                       "-c",
+		"{rtmpPort}":               "1935",
+		"port{rtmpPort}":           "port1935",
+		"{rtmpPort}ok":             "1935ok",
+		"{apiPort}{rtmpPort}":      "19851935",
+		"{apiPort}:{apiPort}":      "1985:1985",
+		"{name}-{rtmpPort}-{name}": "srs-1935-srs",
+		"{ rtmpPort}":              "{ rtmpPort}",
+		"{rtmp-port}":              "{rtmp-port}",
+		"{{apiPort}}":              "{1985}",
+	} {
+		if v, err := renderTemplate(s, vars); err != nil {
+			t.Errorf("render %v failed, err is %v", s, err)
+		} else if v != r {
+			t.Errorf("render %v invalid, expect %v, actual %v", s, r, v)
+		}
+	}
+
+	for _, s := range []string{"{httpPort}", "{RtmpPort}", "ok{unknown}", "{rtmpPort}{foo}"} {
+		if _, err := renderTemplate(s, vars); err == nil {
+			t.Errorf("render %v should fail", s)
+		}
+	}
+}
+
+func TestWorkerTemplate_Check(t *testing.T) {
+	if err := (&WorkerTemplate{}).Check(); err != nil {
+		t.Error("check failed, err is", err)
+	}
+
+	v := &WorkerTemplate{
+		Args: []string{"-c", "{config}", "-n", "{name}"},
+		Env:  []string{"PORTS={rtmpPort},{httpPort},{apiPort}"},
+		Dir:  "{workDir}",
+	}
+	if err := v.Check(); err != nil {
+		t.Error("check failed, err is", err)
+	}
+
+	if err := (&WorkerTemplate{Args: []string{"{rtmp}"}}).Check(); err == nil {
+		t.Error("should fail for args")
+	} else if err := (&WorkerTemplate{Env: []string{"A={port}"}}).Check(); err == nil {
+		t.Error("should fail for env")
+	} else if err := (&WorkerTemplate{Dir: "{cwd}"}).Check(); err == nil {
+		t.Error("should fail for dir")
+	} else if err := (&WorkerTemplate{Binary: "./objs/not-exists"}).Check(); err == nil {
+		t.Error("should fail for binary")
+	}
+}
+
+func TestWorkerTemplate_Command(t *testing.T) {
+	vars := map[string]string{
+		"rtmpPort": "1935", "httpPort": "8080", "apiPort": "1985",
+		"workDir": "/tmp/srs", "name": "srs", "config": "/tmp/srs/srs.conf",
+	}
+
+	if cmd, err := (&WorkerTemplate{}).Command("/usr/bin/srs", vars); err != nil {
+		t.Error("command failed, err is", err)
+	} else if cmd.Path != "/usr/bin/srs" || strings.Join(cmd.Args, " ") != "/usr/bin/srs -c /tmp/srs/srs.conf" {
+		t.Errorf("invalid path=%v, args=%v", cmd.Path, cmd.Args)
+	} else if cmd.Env != nil || cmd.Dir != "" {
+		t.Errorf("invalid env=%v, dir=%v", cmd.Env, cmd.Dir)
+	}
+
+	v := &WorkerTemplate{
+		Binary: "/usr/local/bin/srs",
+		Args:   []string{"-c", "{config}", "-p", "{rtmpPort}:{httpPort}"},
+		Env:    []string{"SRS_NAME={name}", "SRS_API={apiPort}"},
+		Dir:    "{workDir}",
+	}
+	if cmd, err := v.Command("/usr/bin/srs", vars); err != nil {
+		t.Error("command failed, err is", err)
+	} else if cmd.Path != "/usr/local/bin/srs" {
+		t.Errorf("invalid path=%v", cmd.Path)
+	} else if strings.Join(cmd.Args[1:], " ") != "-c /tmp/srs/srs.conf -p 1935:8080" {
+		t.Errorf("invalid args=%v", cmd.Args)
+	} else if env := cmd.Env[len(cmd.Env)-2:]; env[0] != "SRS_NAME=srs" || env[1] != "SRS_API=1985" {
+		t.Errorf("invalid env=%v", env)
+	} else if len(cmd.Env) != len(os.Environ())+2 {
+		t.Errorf("should inherit env, env=%v", cmd.Env)
+	} else if cmd.Dir != "/tmp/srs" {
+		t.Errorf("invalid dir=%v", cmd.Dir)
+	}
+
+	delete(vars, "name")
+	if _, err := v.Command("/usr/bin/srs", vars); err == nil {
+		t.Error("should fail for no name")
+	}
+}
+
 func TestRetrieveVersion(t *testing.T) {
 	var err error
 	var ver *SrsVersion
@@ -148,3 +623,154 @@ func TestSrsVersion_String(t *testing.T) {
 		t.Errorf("invalid")
 	}
 }
+
+// The fake signal, for all platforms.
+type fakeSignal string
+
+func (v fakeSignal) String() string {
+	return string(v)
+}
+
+func (v fakeSignal) Signal() {
+}
+
+// The fake shell to handle signals.
+type fakeSignalHandler struct {
+	reloads  []string
+	upgrades int
+	err      error
+}
+
+func (v *fakeSignalHandler) Reload(ctx ol.Context, c string) error {
+	v.reloads = append(v.reloads, c)
+	return v.err
+}
+
+func (v *fakeSignalHandler) Upgrade(ctx ol.Context) error {
+	v.upgrades++
+	return v.err
+}
+
+func TestShellSignals(t *testing.T) {
+	ctx := &kernel.Context{}
+
+	// the fallback for platform without signals.
+	s := &shellSignals{}
+	if s.notify(make(chan os.Signal, 1)) {
+		t.Error("should not notify")
+	}
+	h := &fakeSignalHandler{}
+	if err := s.serve(ctx, h, "shell.json", fakeSignal("usr2")); err == nil || h.upgrades != 0 || len(h.reloads) != 0 {
+		t.Errorf("should ignore, err is %v, %v", err, h)
+	}
+
+	s = &shellSignals{upgrade: fakeSignal("usr2"), reload: fakeSignal("hup")}
+	if err := s.serve(ctx, h, "shell.json", fakeSignal("hup")); err != nil || len(h.reloads) != 1 || h.reloads[0] != "shell.json" {
+		t.Errorf("reload failed, err is %v, %v", err, h)
+	}
+	if err := s.serve(ctx, h, "shell.json", fakeSignal("usr2")); err != nil || h.upgrades != 1 {
+		t.Errorf("upgrade failed, err is %v, %v", err, h)
+	}
+	if err := s.serve(ctx, h, "shell.json", fakeSignal("term")); err == nil || h.upgrades != 1 || len(h.reloads) != 1 {
+		t.Errorf("should ignore, err is %v, %v", err, h)
+	}
+
+	// the error of handler.
+	h.err = fmt.Errorf("mock error")
+	if err := s.serve(ctx, h, "shell.json", fakeSignal("usr2")); err != h.err {
+		t.Errorf("should fail, err is %v", err)
+	}
+}
+
+func TestTestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := path.Join(dir, "shell.json")
+	test := func(conf string) (int, string) {
+		if err := ioutil.WriteFile(c, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		code := testConfig(c, "text", &b)
+		return code, b.String()
+	}
+
+	if code, out := test(`{"logger": {"tank": "console"}, "api": "tcp://127.0.0.1:2040"}`); code != 0 {
+		t.Errorf("invalid code=%v, output=%v", code, out)
+	}
+
+	// all errors are reported.
+	code, out := test(`{"logger": {"tank": "none"}, "rtmplb": {"enabled": true}, "apilb": {"enabled": true}, "api": "tcp://2040"}`)
+	if code != 1 {
+		t.Errorf("invalid code=%v, output=%v", code, out)
+	}
+	for _, msg := range []string{"Invalid logger tank", "Empty rtmplb binary", "Empty apilb binary", "tcp://2040 invalid"} {
+		if !strings.Contains(out, msg) {
+			t.Errorf("no %v in output=%v", msg, out)
+		}
+	}
+
+	if code, out := test(`{"worker": {"enabled": true, "provider": "none"}}`); code != 1 || !strings.Contains(out, "must be srs") {
+		t.Errorf("invalid code=%v, output=%v", code, out)
+	}
+}
+
+func TestCgroup(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	c := &CgroupConfig{Enabled: true, Root: root, Cpu: 150, Memory: 512}
+	if _, err = NewCgroup(c); err == nil {
+		t.Error("should fail without cgroup")
+	}
+
+	// the v2 with unified hierarchy.
+	if err = ioutil.WriteFile(path.Join(root, "cgroup.controllers"), []byte("cpu memory"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cg, err := NewCgroup(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cg.Add("srs-100", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := path.Join(root, defaultCgroupGroup, "srs-100")
+	for file, value := range map[string]string{"cpu.max": "150000 100000", "memory.max": "536870912", "cgroup.procs": "100"} {
+		if b, err := ioutil.ReadFile(path.Join(dir, file)); err != nil || string(b) != value {
+			t.Errorf("invalid %v=%v, err is %v", file, string(b), err)
+		}
+	}
+
+	ioutil.WriteFile(path.Join(dir, "memory.current"), []byte("1024\n"), 0644)
+	ioutil.WriteFile(path.Join(dir, "cpu.stat"), []byte("usage_usec 2000\nuser_usec 1000\n"), 0644)
+	if u, err := cg.Usage("srs-100"); err != nil || u.Cpu != 2000 || u.Memory != 1024 {
+		t.Errorf("invalid usage %v, err is %v", u, err)
+	}
+
+	// the v1 with hierarchy for each controller.
+	os.Remove(path.Join(root, "cgroup.controllers"))
+	os.Mkdir(path.Join(root, "memory"), 0755)
+	if cg, err = NewCgroup(c); err != nil || cg.v2 {
+		t.Fatal("should be v1, err is", err)
+	}
+	if err = cg.Add("srs-101", 101); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(path.Join(root, "cpu", defaultCgroupGroup, "srs-101", "cpu.cfs_quota_us")); err != nil || string(b) != "150000" {
+		t.Errorf("invalid quota %v, err is %v", string(b), err)
+	}
+
+	// the dir with files never removed, but ok for cgroup fs.
+	if err = cg.Remove("srs-102"); err != nil {
+		t.Error("remove not exists failed, err is", err)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ The signals to control shell, some signals are not supported by all platforms.
+*/
+package main
+
+import (
+	"fmt"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"os"
+	"os/signal"
+)
+
+// The shell controlled by signals.
+type signalHandler interface {
+	// Reload the config file c.
+	Reload(ctx ol.Context, c string) error
+	// Upgrade the workers.
+	Upgrade(ctx ol.Context) error
+}
+
+// The signals to control shell, nil when not supported by platform,
+// user should use the api instead.
+type shellSignals struct {
+	// to upgrade the workers.
+	upgrade os.Signal
+	// to reload the config.
+	reload os.Signal
+}
+
+// Notify the supported signals to c.
+// @return false when no signal supported.
+func (v *shellSignals) notify(c chan os.Signal) bool {
+	var signals []os.Signal
+	for _, s := range []os.Signal{v.upgrade, v.reload} {
+		if s != nil {
+			signals = append(signals, s)
+		}
+	}
+
+	if len(signals) == 0 {
+		return false
+	}
+
+	signal.Notify(c, signals...)
+	return true
+}
+
+// Serve the signal s by h, for config file c.
+// @remark when reload or upgrade failed, we serve as current config and workers.
+func (v *shellSignals) serve(ctx ol.Context, h signalHandler, c string, s os.Signal) (err error) {
+	if s == nil {
+		return fmt.Errorf("signal not supported")
+	}
+
+	if s == v.reload {
+		if err = h.Reload(ctx, c); err != nil {
+			ol.W(ctx, "Signal: reload failed, err is", err)
+		} else {
+			ol.T(ctx, "Signal: reload ok.")
+		}
+		return
+	}
+
+	if s == v.upgrade {
+		if err = h.Upgrade(ctx); err != nil {
+			ol.W(ctx, "Signal: upgrade failed, err is", err)
+		} else {
+			ol.T(ctx, "Signal: upgrade ok.")
+		}
+		return
+	}
+
+	return fmt.Errorf("signal %v not supported", s)
+}
@@ -32,6 +32,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -102,6 +103,10 @@ const (
 	// for example, when new process change from init to active,
 	// the old processes should change to deprecated.
 	SrsStateDeprecated
+	// worker is terminated, wait for new process to replace it.
+	SrsStateStopped
+	// worker crashes too many times, never restart it.
+	SrsStateFailed
 )
 
 func (v SrsState) String() string {
@@ -112,11 +117,43 @@ func (v SrsState) String() string {
 		return "active"
 	case SrsStateDeprecated:
 		return "deprecated"
+	case SrsStateStopped:
+		return "stopped"
+	case SrsStateFailed:
+		return "failed"
 	default:
 		return "unknown"
 	}
 }
 
+// The phase of worker for api, starting/healthy/draining/stopped/failed.
+func (v SrsState) Phase() string {
+	switch v {
+	case SrsStateInit:
+		return "starting"
+	case SrsStateActive:
+		return "healthy"
+	case SrsStateDeprecated:
+		return "draining"
+	case SrsStateStopped:
+		return "stopped"
+	case SrsStateFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// How the worker is stopped.
+type SrsStop string
+
+const (
+	// worker quit when SIGTERM.
+	SrsStopClean SrsStop = "clean"
+	// worker killed when SIGTERM timeout or signal not supported.
+	SrsStopKilled SrsStop = "killed"
+)
+
 // The srs stream worker.
 type SrsWorker struct {
 	shell *ShellBoss
@@ -143,19 +180,52 @@ type SrsWorker struct {
 	version *SrsVersion
 	// the state of process.
 	state SrsState
+	// the name of worker, the new process to replace the dead one use the same name.
+	name string
+	// the index of instance, the new process to replace the dead one use the same instance.
+	instance int
+	// when the process started.
+	startTime time.Time
+	// the times the worker restarted, and the crashes in restart window.
+	restarts int
+	crashes  []time.Time
+	// the exit status of process.
+	lastExit string
+	// the consecutive failures of liveness probe, protected by shell lock.
+	failures int
+	// whether the liveness probe failed, the lbs ignore it, protected by shell lock.
+	unhealthy bool
+	// closed when process terminated.
+	terminated chan bool
+	// how the worker is stopped by shell.
+	stop SrsStop
+	// the spec of config when started, stale when config changed.
+	spec string
 }
 
 func NewSrsWorker(ctx ol.Context, shell *ShellBoss, conf *SrsServiceConfig, ports *PortPool) *SrsWorker {
 	v := &SrsWorker{
 		ctx: ctx, shell: shell, conf: conf,
 		pool: ports, lock: &sync.Mutex{},
-		state: SrsStateInit,
+		state: SrsStateInit, name: "srs",
+		terminated: make(chan bool),
 	}
 	return v
 }
 
 func (v *SrsWorker) String() string {
-	return fmt.Sprintf("srs worker, pid=%v, state=%v, version=%v", v.pid, v.state, v.version)
+	return fmt.Sprintf("srs worker %v, instance=%v, pid=%v, state=%v, version=%v, restarts=%v",
+		v.name, v.instance, v.pid, v.state, v.version, v.restarts)
+}
+
+// The cgroup of worker, under the parent group of shell.
+func (v *SrsWorker) cgroupName() string {
+	return fmt.Sprintf("%v-%v", v.name, v.pid)
+}
+
+// The owner of ports allocated by worker.
+func (v *SrsWorker) owner() string {
+	return fmt.Sprintf("%v/%v", v.name, v.pid)
 }
 
 func (v *SrsWorker) Close() error {
@@ -164,7 +234,9 @@ func (v *SrsWorker) Close() error {
 
 	// free the ports.
 	for _, p := range v.ports {
-		v.pool.Free(p)
+		if err := v.pool.Free(p); err != nil {
+			ol.W(v.ctx, "free port failed, err is", err)
+		}
 	}
 	v.ports = nil
 
@@ -209,7 +281,7 @@ func (v *SrsWorker) doExec() (err error) {
 	}
 
 	// create work dir and link binaries.
-	v.workDir = path.Join(r.WorkDir, fmt.Sprintf("srs/%v", time.Now().Format("2006-01-02-15:04:05.000")))
+	v.workDir = path.Join(r.WorkDir, fmt.Sprintf("%v/%v", v.name, time.Now().Format("2006-01-02-15:04:05.000")))
 	if wd := path.Join(v.workDir, "objs/nginx/html"); true {
 		if err = os.MkdirAll(wd, 0755); err != nil {
 			ol.E(ctx, "create srs dir", wd, "failed, err is", err)
@@ -259,20 +331,46 @@ func (v *SrsWorker) doExec() (err error) {
 		}
 		return
 	}
-	bins := []string{r.Binary, s.BigBinary, s.BitchBinary, s.FfmpegBinary, s.DnsBinary}
+	bins := []string{r.Binary, r.Template.Binary, s.BigBinary, s.BitchBinary, s.FfmpegBinary, s.DnsBinary}
 	if err = slinks(v.workDir, bins...); err != nil {
 		ol.E(ctx, "symlink failed, err is", err)
 		return
 	}
 
-	// alloc all ports, althrough maybe not use it.
-	if ports, err := v.pool.Alloc(8); err != nil {
+	// alloc the rtmp, http and api port from the named ranges when configured.
+	fields := []*int{&v.rtmp, &v.http, &v.api, &v.big, &v.bitch, &v.dns}
+	var slots []*int
+	for i, name := range []string{"rtmp", "http", "api"} {
+		if _, ok := r.Ports.Ranges[name]; !ok {
+			slots = append(slots, fields[i])
+			continue
+		}
+		ps, err := v.pool.AllocFrom(name, 1)
+		if err != nil {
+			ol.E(ctx, "alloc", name, "port failed, err is", err)
+			return err
+		}
+		v.ports = append(v.ports, ps...)
+		*fields[i] = ps[0]
+	}
+	slots = append(slots, fields[3:]...)
+
+	// alloc all other ports, althrough maybe not use it.
+	// @remark prefer contiguous ports, fallback to any ports when fragmented.
+	n := 8 - (len(fields) - len(slots))
+	ps, err := v.pool.AllocContiguous(n)
+	if err == ErrPortsFragmented {
+		ol.W(ctx, "alloc contiguous ports failed, fallback, err is", err)
+		ps, err = v.pool.Alloc(n)
+	}
+	if err != nil {
 		ol.E(ctx, "alloc ports failed, err is", err)
 		return err
 	} else {
-		v.ports = append(v.ports, ports...)
-		v.rtmp, v.http, v.api = ports[0], ports[1], ports[2]
-		v.big, v.bitch, v.dns = ports[3], ports[4], ports[5]
+		v.ports = append(v.ports, ps...)
+		for i, port := range slots {
+			*port = ps[i]
+		}
 	}
 
 	// build all port.
@@ -321,20 +419,72 @@ func (v *SrsWorker) doExec() (err error) {
 		v.rtmp, v.http, v.api, v.big, v.bitch, v.dns)
 	ol.T(ctx, fmt.Sprintf("srs ports(%v), cwd=%v, config=%v", ports, v.workDir, v.config))
 
+	// render the command template with the allocated ports.
+	// @remark use absolute path for the dir of worker maybe changed.
+	vars := map[string]string{
+		"rtmpPort": strconv.Itoa(v.rtmp), "httpPort": strconv.Itoa(v.http), "apiPort": strconv.Itoa(v.api),
+		"name": v.name,
+	}
+	if vars["workDir"], err = filepath.Abs(v.workDir); err != nil {
+		ol.E(ctx, "abs work dir failed, err is", err)
+		return
+	}
+	if vars["config"], err = filepath.Abs(v.config); err != nil {
+		ol.E(ctx, "abs config failed, err is", err)
+		return
+	}
+
+	var cmd *exec.Cmd
+	if cmd, err = r.Template.Command(r.Binary, vars); err != nil {
+		ol.E(ctx, "render template failed, err is", err)
+		return
+	}
+
 	// test the config with srs.
-	if b, err := exec.Command(r.Binary, "-t", "-c", v.config).CombinedOutput(); err != nil {
+	test := exec.Command(cmd.Path, "-t", "-c", vars["config"])
+	test.Env, test.Dir = cmd.Env, cmd.Dir
+	if b, err := test.CombinedOutput(); err != nil {
 		ol.E(ctx, fmt.Sprintf("test config failed, err is %v, raw log is:\n%v", err, string(b)))
 		return err
 	}
 
+	// capture the stdout and stderr of worker.
+	var output *workerOutput
+	if output, err = NewWorkerOutput(ctx, &r.Output, v.workDir); err != nil {
+		ol.E(ctx, "open output failed, err is", err)
+		return
+	}
+	if output != nil {
+		output.Attach(cmd)
+	}
+
 	// start srs process.
-	var cmd *exec.Cmd
-	if cmd, err = v.shell.pool.Start(ctx, r.Binary, "-c", v.config); err != nil {
+	if cmd, err = v.shell.pool.StartCmd(ctx, cmd); err != nil {
 		ol.E(ctx, "exec worker failed, err is", err)
+		if output != nil {
+			output.Close()
+		}
 		return
 	}
 	v.cmd = cmd
 	v.pid = cmd.Process.Pid
+	if output != nil {
+		output.Start(fmt.Sprintf("worker(%v,pid=%v,rtmp=%v)", v.name, v.pid, v.rtmp))
+	}
+	v.startTime = time.Now()
+	if err := v.pool.Own(v.owner(), v.ports...); err != nil {
+		ol.W(ctx, "own ports failed, err is", err)
+	}
+
+	// limit the worker by cgroup, kill it when failed.
+	// @remark the worker runs without limits before placed in cgroup.
+	if c := v.shell.cgroup; c != nil {
+		if err = c.Add(v.cgroupName(), v.pid); err != nil {
+			ol.E(ctx, "add worker to cgroup failed, err is", err)
+			return
+		}
+		ol.T(ctx, fmt.Sprintf("worker in cgroup %v/%v", c, v.cgroupName()))
+	}
 	ol.T(ctx, fmt.Sprintf("exec worker ok, args=%v, pid=%v", cmd.Args, v.pid))
 
 	return
@@ -0,0 +1,1162 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ The supervisor for shell, restart the crashed worker.
+*/
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"reflect"
+	"sort"
+	"syscall"
+	"time"
+)
+
+const (
+	// the default backoff to restart the crashed worker.
+	defaultRestartBackoff = time.Duration(1) * time.Second
+	// the default max backoff to restart worker.
+	defaultRestartMaxBackoff = time.Duration(30) * time.Second
+	// the default window to count the crashes.
+	defaultRestartWindow = time.Duration(60) * time.Second
+	// the default drain for the old worker when upgrade.
+	defaultUpgradeDrain = time.Duration(30) * time.Second
+	// the default timeout for worker to quit when SIGTERM.
+	defaultStopTimeout = time.Duration(10) * time.Second
+	// the default api path to check whether worker is ready.
+	defaultReadinessPath = "/api/v1/versions"
+	// the default timeout for each readiness request.
+	defaultReadinessTimeout = time.Duration(1) * time.Second
+	// the default deadline for worker to be ready.
+	defaultReadinessDeadline = processRetryMax * processExecInterval
+	// the default interval to probe the liveness of worker.
+	defaultLivenessInterval = time.Duration(5) * time.Second
+	// the default consecutive failures to mark worker unhealthy.
+	defaultLivenessFailures = 3
+	// the default interval to reconcile workers to config.
+	defaultReconcileInterval = time.Duration(10) * time.Second
+	// the interval to check the utilization of ports.
+	portsWatchInterval = time.Duration(10) * time.Second
+)
+
+// The thresholds in percent to log the utilization of ports.
+var portsThresholds = []int{80, 95}
+
+// The restart policy for crashed worker, exponential backoff and budget.
+type restartPolicy struct {
+	// the backoff for the first crash, double for each crash.
+	backoff time.Duration
+	// the backoff never exceed it.
+	maxBackoff time.Duration
+	// the max crashes in window, 0 to restart forever.
+	budget int
+	// the window to count crashes.
+	window time.Duration
+}
+
+func NewRestartPolicy(conf *ShellConfig) *restartPolicy {
+	r := &conf.Worker.Restart
+	v := &restartPolicy{
+		backoff:    defaultRestartBackoff,
+		maxBackoff: defaultRestartMaxBackoff,
+		budget:     r.Budget,
+		window:     defaultRestartWindow,
+	}
+	if r.Backoff > 0 {
+		v.backoff = time.Duration(r.Backoff) * time.Millisecond
+	}
+	if r.MaxBackoff > 0 {
+		v.maxBackoff = time.Duration(r.MaxBackoff) * time.Millisecond
+	}
+	if r.Window > 0 {
+		v.window = time.Duration(r.Window) * time.Millisecond
+	}
+	return v
+}
+
+// The crashes in window, remove the expired.
+func (v *restartPolicy) crashes(crashes []time.Time, now time.Time) []time.Time {
+	var r []time.Time
+	for _, t := range crashes {
+		if now.Sub(t) < v.window {
+			r = append(r, t)
+		}
+	}
+	return r
+}
+
+// The backoff for the nth crash in window, start from 1.
+func (v *restartPolicy) delay(n int) time.Duration {
+	d := v.backoff
+	for i := 1; i < n && d < v.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > v.maxBackoff {
+		d = v.maxBackoff
+	}
+	return d
+}
+
+// Whether the crashes exceed the budget.
+func (v *restartPolicy) exceed(n int) bool {
+	return v.budget > 0 && n > v.budget
+}
+
+// The upgrade policy, drain the old worker then stop it.
+type upgradePolicy struct {
+	// the drain for the old worker to serve the exists streams.
+	drain time.Duration
+	// the timeout for worker to quit when SIGTERM, then SIGKILL it.
+	stopTimeout time.Duration
+}
+
+func NewUpgradePolicy(conf *ShellConfig) *upgradePolicy {
+	r := &conf.Worker.Upgrade
+	v := &upgradePolicy{
+		drain:       defaultUpgradeDrain,
+		stopTimeout: defaultStopTimeout,
+	}
+	if r.Drain > 0 {
+		v.drain = time.Duration(r.Drain) * time.Millisecond
+	}
+	if r.StopTimeout > 0 {
+		v.stopTimeout = time.Duration(r.StopTimeout) * time.Millisecond
+	}
+	return v
+}
+
+// The readiness gate, the worker is ready when api response ok.
+type readinessPolicy struct {
+	// the path of api to check.
+	path string
+	// the timeout for each request.
+	timeout time.Duration
+	// the interval to retry.
+	interval time.Duration
+	// the deadline for worker to be ready.
+	deadline time.Duration
+}
+
+func NewReadinessPolicy(conf *ShellConfig) *readinessPolicy {
+	r := &conf.Worker.Readiness
+	v := &readinessPolicy{
+		path:     defaultReadinessPath,
+		timeout:  defaultReadinessTimeout,
+		interval: processExecInterval,
+		deadline: defaultReadinessDeadline,
+	}
+	if len(r.Path) > 0 {
+		v.path = r.Path
+	}
+	if r.Timeout > 0 {
+		v.timeout = time.Duration(r.Timeout) * time.Millisecond
+	}
+	if r.Interval > 0 {
+		v.interval = time.Duration(r.Interval) * time.Millisecond
+	}
+	if r.Deadline > 0 {
+		v.deadline = time.Duration(r.Deadline) * time.Millisecond
+	}
+	return v
+}
+
+// Wait for the api of worker ready, error when deadline or process terminated.
+func (v *readinessPolicy) wait(port int, terminated chan bool) (err error) {
+	url := fmt.Sprintf("http://127.0.0.1:%v%v", port, v.path)
+	client := &http.Client{Timeout: v.timeout}
+	deadline := time.After(v.deadline)
+
+	for {
+		var res *http.Response
+		if res, err = client.Get(url); err == nil {
+			res.Body.Close()
+			if res.StatusCode >= 200 && res.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("api %v status %v", url, res.StatusCode)
+		}
+
+		select {
+		case <-terminated:
+			return fmt.Errorf("process terminated, err is %v", err)
+		case <-deadline:
+			return fmt.Errorf("not ready in %v, err is %v", v.deadline, err)
+		case <-time.After(v.interval):
+		}
+	}
+}
+
+// The liveness probe, the worker is unhealthy when consecutive failures.
+type livenessPolicy struct {
+	// whether disable the probe.
+	disabled bool
+	// the path of api to probe.
+	path string
+	// the timeout for each request.
+	timeout time.Duration
+	// the interval to probe.
+	interval time.Duration
+	// the consecutive failures to mark worker unhealthy.
+	failures int
+}
+
+func NewLivenessPolicy(conf *ShellConfig) *livenessPolicy {
+	r := &conf.Worker.Liveness
+	v := &livenessPolicy{
+		disabled: r.Disabled,
+		path:     defaultReadinessPath,
+		timeout:  defaultReadinessTimeout,
+		interval: defaultLivenessInterval,
+		failures: defaultLivenessFailures,
+	}
+	if len(r.Path) > 0 {
+		v.path = r.Path
+	} else if p := conf.Worker.Readiness.Path; len(p) > 0 {
+		v.path = p
+	}
+	if r.Timeout > 0 {
+		v.timeout = time.Duration(r.Timeout) * time.Millisecond
+	}
+	if r.Interval > 0 {
+		v.interval = time.Duration(r.Interval) * time.Millisecond
+	}
+	if r.Failures > 0 {
+		v.failures = r.Failures
+	}
+	return v
+}
+
+// The reconcile loop to keep workers to the desired state of config.
+type reconcilePolicy struct {
+	// whether disable the loop.
+	disabled bool
+	// the interval to reconcile.
+	interval time.Duration
+}
+
+func NewReconcilePolicy(conf *ShellConfig) *reconcilePolicy {
+	r := &conf.Worker.Reconcile
+	v := &reconcilePolicy{disabled: r.Disabled, interval: defaultReconcileInterval}
+	if r.Interval > 0 {
+		v.interval = time.Duration(r.Interval) * time.Millisecond
+	}
+	return v
+}
+
+// The spec of worker in config, the binary, config file and template,
+// the worker started by a different spec is stale and should be replaced.
+func workerSpec(conf *ShellConfig) string {
+	r := &conf.Worker
+	h := md5.New()
+	fmt.Fprintf(h, "binary=%v,config=%v,work_dir=%v,%v\n", r.Binary, r.Config, r.WorkDir, &r.Template)
+	// the proxy ports of worker are the listens of lbs.
+	fmt.Fprintf(h, "http_proxy=%v,big_proxy=%v\n", conf.Httplb.Http, conf.Apilb.Backend)
+	if b, err := json.Marshal(r.Service); err == nil {
+		h.Write(b)
+	}
+	// the content of config file, the worker config is generated from it.
+	if b, err := ioutil.ReadFile(r.Config); err == nil {
+		h.Write(b)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Probe the api of worker once.
+func (v *livenessPolicy) probe(port int) (err error) {
+	url := fmt.Sprintf("http://127.0.0.1:%v%v", port, v.path)
+	client := &http.Client{Timeout: v.timeout}
+
+	var res *http.Response
+	if res, err = client.Get(url); err != nil {
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("api %v status %v", url, res.StatusCode)
+	}
+	return
+}
+
+// Add worker to registry.
+func (v *ShellBoss) addWorker(worker *SrsWorker) int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.workers = append(v.workers, worker)
+	return len(v.workers)
+}
+
+// Remove worker from registry.
+func (v *ShellBoss) removeWorker(worker *SrsWorker) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for i, w := range v.workers {
+		if w == worker {
+			v.workers = append(v.workers[:i], v.workers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Find the worker by process, nil if not found.
+// @remark use pid because the cmd of worker is reset when closed.
+func (v *ShellBoss) findWorker(cmd *exec.Cmd) *SrsWorker {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for _, w := range v.workers {
+		if w.pid == cmd.Process.Pid {
+			return w
+		}
+	}
+	return nil
+}
+
+// When worker terminated, restart it if active, or cleanup it.
+// @param err the error of process wait, nil when exit ok.
+func (v *ShellBoss) onWorkerTerminated(ctx ol.Context, worker *SrsWorker, err error) {
+	v.lock.Lock()
+	state := worker.state
+	close(worker.terminated)
+	worker.lastExit = "exit status 0"
+	if err != nil {
+		worker.lastExit = err.Error()
+	}
+	if state == SrsStateActive {
+		worker.state = SrsStateStopped
+	}
+	v.lock.Unlock()
+
+	if v.cgroup != nil {
+		if err := v.cgroup.Remove(worker.cgroupName()); err != nil {
+			ol.W(ctx, "remove cgroup failed, err is", err)
+		}
+	}
+
+	// ignore the worker not in active.
+	if state != SrsStateActive {
+		worker.Close()
+		v.removeWorker(worker)
+		ol.T(ctx, fmt.Sprintf("ignore worker terminated, %v", worker))
+		return
+	}
+
+	// keep the ports of dead worker util the new one is ok.
+	ol.W(ctx, fmt.Sprintf("restart worker %v, exit=%v", worker, worker.lastExit))
+	go v.respawn(ctx, worker)
+}
+
+// Restart the dead worker with backoff, until ok or exceed the budget.
+func (v *ShellBoss) respawn(ctx ol.Context, dead *SrsWorker) {
+	for {
+		now := time.Now()
+
+		// the policy and instances maybe changed by reload.
+		v.lock.Lock()
+		policy, enabled := v.restart, dead.instance < v.conf.WorkerInstances()
+		crashes := append(policy.crashes(dead.crashes, now), now)
+		dead.crashes = crashes
+		v.lock.Unlock()
+
+		// the worker is disabled by reload.
+		if !enabled {
+			dead.Close()
+			v.removeWorker(dead)
+			ol.T(ctx, fmt.Sprintf("ignore restart disabled worker %v", dead.name))
+			return
+		}
+
+		if policy.exceed(len(crashes)) {
+			v.lock.Lock()
+			dead.state = SrsStateFailed
+			v.lock.Unlock()
+
+			dead.Close()
+			ol.E(ctx, fmt.Sprintf("alert: worker %v crashes %v in %v, exceed budget %v, give up",
+				dead.name, len(crashes), policy.window, policy.budget))
+			return
+		}
+
+		delay := policy.delay(len(crashes))
+		ol.T(ctx, fmt.Sprintf("restart worker %v after %v, crashes=%v", dead.name, delay, len(crashes)))
+		select {
+		case <-time.After(delay):
+		case c := <-v.closing:
+			v.closing <- c
+			return
+		}
+
+		worker, err := v.restartWorker(ctx, dead)
+		if err != nil {
+			ol.W(ctx, fmt.Sprintf("restart worker %v failed, err is %v", dead.name, err))
+			continue
+		}
+
+		// the new worker is ok, free the ports of dead one.
+		dead.Close()
+		v.removeWorker(dead)
+		ol.T(ctx, fmt.Sprintf("restart worker ok, %v", worker))
+		return
+	}
+}
+
+// Start a new worker to replace the dead one.
+func (v *ShellBoss) restartWorker(ctx ol.Context, dead *SrsWorker) (worker *SrsWorker, err error) {
+	v.upgradeLock.Lock()
+	defer v.upgradeLock.Unlock()
+
+	// the instance maybe removed by reload.
+	if dead.instance >= v.conf.WorkerInstances() {
+		return nil, fmt.Errorf("worker %v disabled", dead.name)
+	}
+
+	if worker, err = v.execWorker(ctx, dead, dead.instance); err != nil {
+		// when failed, we must cleanup the worker, because we will retry,
+		// and the Cycle() will ignore the worker not active.
+		if worker != nil {
+			worker.Close()
+		}
+		return
+	}
+	if worker == nil {
+		return nil, fmt.Errorf("worker %v disabled", dead.name)
+	}
+
+	v.lock.Lock()
+	v.setActive(worker)
+	v.lock.Unlock()
+
+	return
+}
+
+// Drain the deprecated worker, then stop it and free its ports.
+func (v *ShellBoss) drainWorker(ctx ol.Context, worker *SrsWorker) {
+	// notify worker to gracefully quit.
+	// @remark the worker is stopped when drain timeout if signal not supported.
+	worker.lock.Lock()
+	if worker.cmd != nil && drainSignal != nil {
+		r0 := worker.cmd.Process.Signal(drainSignal)
+		ol.T(ctx, fmt.Sprintf("drain notify %v, r0=%v", worker, r0))
+	}
+	worker.lock.Unlock()
+
+	select {
+	case <-worker.terminated:
+		return
+	case <-time.After(v.upgrade.drain):
+	case c := <-v.closing:
+		v.closing <- c
+		return
+	}
+
+	ol.T(ctx, fmt.Sprintf("drain %v timeout %v, stop it", worker, v.upgrade.drain))
+	v.stopWorker(ctx, worker)
+}
+
+// Stop the worker by SIGTERM, then SIGKILL when timeout, and wait for it terminated.
+// @remark the Cycle() will cleanup the worker and free its ports when terminated.
+// @remark kill the worker when signal not supported.
+func (v *ShellBoss) stopWorker(ctx ol.Context, worker *SrsWorker) {
+	// ignore the closed worker.
+	worker.lock.Lock()
+	cmd := worker.cmd
+	worker.lock.Unlock()
+	if cmd == nil {
+		return
+	}
+
+	stop := SrsStopClean
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		ol.W(ctx, fmt.Sprintf("stop %v signal failed, kill it, err is %v", worker, err))
+		stop = SrsStopKilled
+	} else {
+		select {
+		case <-worker.terminated:
+		case <-time.After(v.upgrade.stopTimeout):
+			ol.W(ctx, fmt.Sprintf("stop %v timeout %v, kill it", worker, v.upgrade.stopTimeout))
+			stop = SrsStopKilled
+		}
+	}
+
+	if stop == SrsStopKilled {
+		worker.Close()
+	}
+
+	// wait for the process terminated.
+	select {
+	case <-worker.terminated:
+	case c := <-v.closing:
+		v.closing <- c
+		return
+	}
+
+	v.lock.Lock()
+	worker.stop = stop
+	exit := worker.lastExit
+	v.lock.Unlock()
+
+	ol.T(ctx, fmt.Sprintf("stop %v %v, exit=%v", worker, stop, exit))
+}
+
+// The outcome of a reload scope.
+const (
+	ReloadApplied = "applied"
+	ReloadIgnored = "ignored"
+	ReloadFailed  = "failed"
+)
+
+// the max reloads kept in history.
+const reloadHistoryMax = 16
+
+// The record of a reload, for api.
+type ReloadRecord struct {
+	// the generation of config after reload, only increase when config applied.
+	Generation int       `json:"generation"`
+	Time       time.Time `json:"time"`
+	Ok         bool      `json:"ok"`
+	Error      string    `json:"error,omitempty"`
+	// the outcome of each changed scope, for example, ports, logger or workers.
+	Scopes map[string]string `json:"scopes"`
+}
+
+// The reload history of shell, for api.
+type ReloadHistory struct {
+	Generation int             `json:"generation"`
+	Reloads    []*ReloadRecord `json:"reloads"`
+}
+
+// the history of reloads, the last one is the latest.
+func (v *ShellBoss) ReloadHistory() *ReloadHistory {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	r := &ReloadHistory{Generation: v.generation, Reloads: make([]*ReloadRecord, 0, len(v.reloads))}
+	for _, rec := range v.reloads {
+		c := *rec
+		c.Scopes = make(map[string]string)
+		for k, s := range rec.Scopes {
+			c.Scopes[k] = s
+		}
+		r.Reloads = append(r.Reloads, &c)
+	}
+	return r
+}
+
+// record the reload, increase the generation when config applied.
+func (v *ShellBoss) recordReload(rec *ReloadRecord, applied bool, err error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if applied {
+		v.generation++
+	}
+	rec.Generation = v.generation
+	rec.Ok = err == nil
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	v.reloads = append(v.reloads, rec)
+	if len(v.reloads) > reloadHistoryMax {
+		v.reloads = v.reloads[len(v.reloads)-reloadHistoryMax:]
+	}
+}
+
+// Reload the config, reject the invalid config and keep the previous one.
+// @remark the listens of lbs are applied by respawn the lbs holding the listeners,
+// while the others of lbs and api are not reloadable, restart shell to apply them.
+// @remark each reload is recorded in history, see ReloadHistory.
+func (v *ShellBoss) Reload(ctx ol.Context, c string) (err error) {
+	rec := &ReloadRecord{Time: time.Now(), Scopes: make(map[string]string)}
+	var applied bool
+	defer func() {
+		v.recordReload(rec, applied, err)
+	}()
+
+	conf := &ShellConfig{}
+	if err = conf.Reloads(c); err != nil {
+		ol.E(ctx, "reload config failed, err is", err)
+		rec.Scopes["config"] = ReloadFailed
+		return
+	}
+
+	// never exec worker when reload.
+	v.upgradeLock.Lock()
+	defer v.upgradeLock.Unlock()
+
+	r := &conf.Worker.Ports
+	v.lock.Lock()
+	pp := v.conf.Worker.Ports
+	v.lock.Unlock()
+	if err = v.ports.Resize(r.Start, r.Stop, r.Exclude); err != nil {
+		ol.E(ctx, "reload ports failed, err is", err)
+		rec.Scopes["ports"] = ReloadFailed
+		return
+	}
+	if pp.Start != r.Start || pp.Stop != r.Stop || !reflect.DeepEqual(pp.Exclude, r.Exclude) {
+		rec.Scopes["ports"] = ReloadApplied
+	}
+
+	v.lock.Lock()
+	prev := v.conf
+	if !reflect.DeepEqual(prev.Worker.Ports.Ranges, r.Ranges) {
+		ol.W(ctx, "reload ignore ports ranges, restart shell to apply")
+		rec.Scopes["ranges"] = ReloadIgnored
+	}
+	r.Ranges = prev.Worker.Ports.Ranges
+	if prev.Worker.Cgroup != conf.Worker.Cgroup {
+		ol.W(ctx, "reload ignore cgroup, restart shell to apply")
+		rec.Scopes["cgroup"] = ReloadIgnored
+	}
+	conf.Worker.Cgroup = prev.Worker.Cgroup
+
+	// apply the changed listens of lb, when only the listens changed and the lb holds the
+	// listeners, which is respawned on the new listens by Cycle() after it quit.
+	var relistens []*exec.Cmd
+	rtmplb, httplb, apilb := prev.Rtmplb, prev.Httplb, prev.Apilb
+	if lb := rtmplb; lbHolding(v.rtmplb) {
+		if lb.Api, lb.Rtmp = conf.Rtmplb.Api, conf.Rtmplb.Rtmp; lb == conf.Rtmplb && lb != rtmplb {
+			relistens, rtmplb = append(relistens, v.rtmplb), lb
+		}
+	}
+	if lb := httplb; lbHolding(v.httplb) {
+		if lb.Api, lb.Http = conf.Httplb.Api, conf.Httplb.Http; lb == conf.Httplb && lb != httplb {
+			relistens, httplb = append(relistens, v.httplb), lb
+		}
+	}
+	if lb := apilb; lbHolding(v.apilb) {
+		if lb.Api, lb.Backend = conf.Apilb.Api, conf.Apilb.Backend; lb == conf.Apilb && lb != apilb {
+			relistens, apilb = append(relistens, v.apilb), lb
+		}
+	}
+	if len(relistens) > 0 {
+		rec.Scopes["listens"] = ReloadApplied
+	}
+
+	if rtmplb != conf.Rtmplb || httplb != conf.Httplb || apilb != conf.Apilb || prev.Api != conf.Api || prev.Pid != conf.Pid || prev.Profile != conf.Profile {
+		ol.W(ctx, "reload ignore lbs, api, profile and pid, restart shell to apply")
+		rec.Scopes["lbs"] = ReloadIgnored
+	}
+	conf.RunAs, conf.Rtmplb, conf.Httplb, conf.Apilb, conf.Api = prev.RunAs, rtmplb, httplb, apilb, prev.Api
+	conf.Pid, conf.Profile = prev.Pid, prev.Profile
+
+	// reopen the logger when changed, the console is stdout which never reopen.
+	if conf.Logger != prev.Logger {
+		if conf.Logger.Tank == "console" {
+			ol.W(ctx, "reload ignore logger to console, restart shell to apply")
+			rec.Scopes["logger"] = ReloadIgnored
+			conf.Logger = prev.Logger
+		} else if err := conf.Config.OpenLogger(); err != nil {
+			ol.W(ctx, "reload ignore logger, open failed, err is", err)
+			rec.Scopes["logger"] = ReloadFailed
+			conf.Logger = prev.Logger
+		} else {
+			ol.T(ctx, fmt.Sprintf("reload logger ok, %v", &conf.Config))
+			rec.Scopes["logger"] = ReloadApplied
+		}
+	}
+
+	if prev.Worker.Output != conf.Worker.Output {
+		rec.Scopes["output"] = ReloadApplied
+	}
+	if prev.Worker.Restart != conf.Worker.Restart || prev.Worker.Upgrade != conf.Worker.Upgrade ||
+		prev.Worker.Readiness != conf.Worker.Readiness || prev.Worker.Liveness != conf.Worker.Liveness ||
+		prev.Worker.Reconcile != conf.Worker.Reconcile {
+		rec.Scopes["policies"] = ReloadApplied
+	}
+
+	// the worker config uses the listens of lbs, so compute the spec after lbs applied.
+	v.conf, v.spec, applied = conf, workerSpec(conf), true
+	v.restart, v.upgrade, v.readiness = NewRestartPolicy(conf), NewUpgradePolicy(conf), NewReadinessPolicy(conf)
+	v.liveness, v.reconciler = NewLivenessPolicy(conf), NewReconcilePolicy(conf)
+	v.lock.Unlock()
+	ol.T(ctx, fmt.Sprintf("reload config ok, %v", conf))
+
+	for _, cmd := range relistens {
+		if r0 := cmd.Process.Signal(syscall.SIGTERM); r0 != nil {
+			ol.W(ctx, fmt.Sprintf("reload ignore quit lb pid=%v, err is %v", cmd.Process.Pid, r0))
+		}
+	}
+
+	var changed bool
+	if changed, err = v.reconcile(ctx); err != nil {
+		ol.E(ctx, "reload reconcile workers failed, err is", err)
+		rec.Scopes["workers"] = ReloadFailed
+		return
+	}
+	if changed {
+		rec.Scopes["workers"] = ReloadApplied
+	}
+
+	return
+}
+
+// Reconcile the workers to the desired state of config, stop the instances exceed the config,
+// start the missing ones, and replace the ones started by stale spec one by one like upgrade.
+// @return changed whether any worker is started or stopped.
+// @remark user must hold the upgrade lock.
+func (v *ShellBoss) reconcile(ctx ol.Context) (changed bool, err error) {
+	v.lock.Lock()
+	// remove the instances exceed the config, the respawn ignore the dead ones.
+	instances := v.conf.WorkerInstances()
+	var removed []*SrsWorker
+	for i := instances; i < len(v.actives); i++ {
+		if active := v.actives[i]; active != nil && active.state == SrsStateActive {
+			active.state = SrsStateDeprecated
+			removed = append(removed, active)
+		}
+	}
+	if len(v.actives) > instances {
+		v.actives = v.actives[:instances]
+	}
+
+	// the failed worker never restart, start a new one when spec changed,
+	// while the stale active worker is replaced after the new one is ready.
+	var starts, stales []int
+	for i := 0; i < instances; i++ {
+		if i >= len(v.actives) || v.actives[i] == nil {
+			starts = append(starts, i)
+		} else if w := v.actives[i]; w.spec == v.spec {
+			continue
+		} else if w.state == SrsStateFailed {
+			starts = append(starts, i)
+		} else if w.state == SrsStateActive {
+			stales = append(stales, i)
+		}
+	}
+
+	var active *SrsWorker
+	for _, w := range v.actives {
+		if w != nil && w.state == SrsStateActive {
+			active = w
+			break
+		}
+	}
+	v.lock.Unlock()
+
+	changed = len(removed) > 0 || len(starts) > 0 || len(stales) > 0
+
+	// switch the lbs to the left instances before drain the removed ones.
+	if len(removed) > 0 && active != nil {
+		if err = v.updateProxyApi(ctx, active); err != nil {
+			ol.E(ctx, "reconcile update proxy api failed, err is", err)
+			return
+		}
+	}
+
+	// drain and stop the removed instances.
+	for _, w := range removed {
+		go v.drainWorker(ctx, w)
+		ol.T(ctx, fmt.Sprintf("reconcile drain worker %v", w))
+	}
+
+	// start the new instances, and replace the failed ones.
+	for _, i := range starts {
+		var worker *SrsWorker
+		if worker, err = v.execWorker(ctx, nil, i); err != nil {
+			ol.E(ctx, "reconcile exec worker failed, err is", err)
+			if worker != nil {
+				worker.Close()
+			}
+			return
+		}
+		if worker == nil {
+			continue
+		}
+
+		var failed *SrsWorker
+		v.lock.Lock()
+		if i < len(v.actives) && v.actives[i] != nil && v.actives[i].state == SrsStateFailed {
+			failed = v.actives[i]
+		}
+		v.setActive(worker)
+		v.lock.Unlock()
+
+		// the failed worker is kept for api, remove it when replaced.
+		if failed != nil {
+			v.removeWorker(failed)
+		}
+		ol.T(ctx, fmt.Sprintf("reconcile start worker %v", worker))
+	}
+
+	// replace the stale instances one by one, the others keep serving.
+	for _, i := range stales {
+		v.lock.Lock()
+		prev := v.active(i)
+		v.lock.Unlock()
+
+		// the crashed worker is restarted by respawn with the latest config.
+		if prev == nil || prev.state != SrsStateActive {
+			continue
+		}
+
+		var worker *SrsWorker
+		if worker, err = v.execWorker(ctx, nil, i); err != nil {
+			ol.E(ctx, "reconcile exec worker failed, err is", err)
+			if worker != nil {
+				worker.Close()
+			}
+			return
+		}
+		if worker == nil {
+			continue
+		}
+
+		v.lock.Lock()
+		v.setActive(worker)
+		if prev.state == SrsStateActive {
+			prev.state = SrsStateDeprecated
+		}
+		v.lock.Unlock()
+
+		go v.drainWorker(ctx, prev)
+		ol.T(ctx, fmt.Sprintf("reconcile replace stale %v by %v", prev, worker))
+	}
+
+	return
+}
+
+// Reconcile the workers to config periodically, util shell closed.
+func (v *ShellBoss) watchReconcile(ctx ol.Context) {
+	for {
+		v.lock.Lock()
+		policy := v.reconciler
+		v.lock.Unlock()
+
+		select {
+		case <-time.After(policy.interval):
+		case c := <-v.closing:
+			v.closing <- c
+			return
+		}
+
+		if policy.disabled {
+			continue
+		}
+
+		v.upgradeLock.Lock()
+		if _, err := v.reconcile(ctx); err != nil {
+			ol.W(ctx, "reconcile workers failed, err is", err)
+		}
+		v.upgradeLock.Unlock()
+	}
+}
+
+// The registration of shell to lb, the ports last pushed to lb.
+type LbRegistration struct {
+	Ports  []int     `json:"ports"`
+	Pids   []int     `json:"pids"`
+	Ok     bool      `json:"ok"`
+	Error  string    `json:"error,omitempty"`
+	Update time.Time `json:"update"`
+}
+
+// The managed process, for api.
+type ProcessInfo struct {
+	Name     string `json:"name"`
+	Instance int    `json:"instance"`
+	Template string `json:"template"`
+	Pid      int    `json:"pid"`
+	State    string `json:"state"`
+	Ports    struct {
+		Rtmp int `json:"rtmp"`
+		Http int `json:"http"`
+		Api  int `json:"api"`
+	} `json:"ports"`
+	StartTime time.Time `json:"start_time"`
+	Restarts  int       `json:"restarts"`
+	LastExit  string    `json:"last_exit"`
+	// the consecutive failures of liveness probe.
+	Failures int `json:"failures"`
+	// how the worker is stopped, clean or killed.
+	Stop string `json:"stop,omitempty"`
+	// whether the worker started by stale config, replaced by reconcile.
+	Stale bool `json:"stale,omitempty"`
+	// the resource usage in cgroup, nil when cgroup disabled.
+	Resources *CgroupUsage `json:"resources,omitempty"`
+}
+
+// The processes managed by shell, for api.
+type ShellProcesses struct {
+	Processes []*ProcessInfo `json:"processes"`
+	Lbs       struct {
+		Rtmplb LbRegistration `json:"rtmplb"`
+		Httplb LbRegistration `json:"httplb"`
+		Apilb  LbRegistration `json:"apilb"`
+		// whether all lbs proxy to the same workers.
+		Consistent bool `json:"consistent"`
+	} `json:"lbs"`
+}
+
+// The snapshot of processes in registry.
+func (v *ShellBoss) Processes() *ShellProcesses {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	r := &ShellProcesses{Processes: make([]*ProcessInfo, 0, len(v.workers))}
+	r.Lbs.Rtmplb, r.Lbs.Httplb, r.Lbs.Apilb = v.rtmplbReg, v.httplbReg, v.apilbReg
+	// the apilb only proxy to the first worker.
+	pids := v.rtmplbReg.Pids
+	r.Lbs.Consistent = len(pids) > 0 && equalInts(pids, v.httplbReg.Pids) &&
+		len(v.apilbReg.Pids) == 1 && v.apilbReg.Pids[0] == pids[0]
+
+	for _, w := range v.workers {
+		p := &ProcessInfo{
+			Name: w.name, Instance: w.instance, Template: v.conf.Worker.Config,
+			Pid: w.pid, State: w.state.Phase(), Failures: w.failures,
+			StartTime: w.startTime, Restarts: w.restarts, LastExit: w.lastExit,
+			Stop: string(w.stop), Stale: w.spec != v.spec,
+		}
+
+		if w.unhealthy && w.state == SrsStateActive {
+			p.State = "unhealthy"
+		}
+
+		// the cgroup is removed when worker terminated.
+		if v.cgroup != nil && w.pid > 0 {
+			if u, err := v.cgroup.Usage(w.cgroupName()); err == nil {
+				p.Resources = u
+			}
+		}
+
+		// the ports is freed when worker closed.
+		w.lock.Lock()
+		if len(w.ports) > 0 {
+			p.Ports.Rtmp, p.Ports.Http, p.Ports.Api = w.rtmp, w.http, w.api
+		}
+		w.lock.Unlock()
+
+		r.Processes = append(r.Processes, p)
+	}
+	return r
+}
+
+// Whether the ints are the same.
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// The port in use and its owner, orphaned when owner is not alive.
+type PortOwner struct {
+	Port     int    `json:"port"`
+	Owner    string `json:"owner"`
+	Orphaned bool   `json:"orphaned"`
+}
+
+// The ports of shell, for api.
+type ShellPorts struct {
+	Stats *PortStats   `json:"stats"`
+	Ports []*PortOwner `json:"ports"`
+}
+
+// The utilization of ports and the owners.
+// @remark the port without owner is allocating, not orphaned.
+func (v *ShellBoss) PortsUsage() *ShellPorts {
+	alive := make(map[string]bool)
+	func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		for _, w := range v.workers {
+			w.lock.Lock()
+			if len(w.ports) > 0 {
+				alive[w.owner()] = true
+			}
+			w.lock.Unlock()
+		}
+	}()
+
+	r := &ShellPorts{Stats: v.ports.Stats(), Ports: make([]*PortOwner, 0)}
+	for port, owner := range v.ports.Owners() {
+		r.Ports = append(r.Ports, &PortOwner{
+			Port: port, Owner: owner, Orphaned: owner != "" && !alive[owner],
+		})
+	}
+	sort.Slice(r.Ports, func(i, j int) bool {
+		return r.Ports[i].Port < r.Ports[j].Port
+	})
+	return r
+}
+
+// Check the utilization of ports util closed.
+func (v *ShellBoss) watchPorts(ctx ol.Context) {
+	var level int
+	for {
+		level = v.checkPorts(ctx, level)
+
+		select {
+		case <-time.After(portsWatchInterval):
+		case c := <-v.closing:
+			v.closing <- c
+			return
+		}
+	}
+}
+
+// Log when the utilization of ports cross the thresholds.
+// @return the new level, the number of thresholds exceeded.
+func (v *ShellBoss) checkPorts(ctx ol.Context, level int) int {
+	s := v.ports.Stats()
+	usable := s.Total - s.Excluded
+	if usable <= 0 {
+		return level
+	}
+
+	percent := s.Allocated * 100 / usable
+	var n int
+	for _, t := range portsThresholds {
+		if percent >= t {
+			n++
+		}
+	}
+
+	if n > level {
+		ol.W(ctx, fmt.Sprintf("ports utilization %v%% exceed %v%%, %v", percent, portsThresholds[n-1], s))
+	} else if n < level {
+		ol.T(ctx, fmt.Sprintf("ports utilization %v%% under %v%%, %v", percent, portsThresholds[level-1], s))
+	}
+	return n
+}
+
+// Probe the active workers util closed.
+func (v *ShellBoss) watchLiveness(ctx ol.Context) {
+	for {
+		v.lock.Lock()
+		policy := v.liveness
+		v.lock.Unlock()
+
+		if !policy.disabled {
+			v.checkLiveness(ctx, policy)
+		}
+
+		select {
+		case <-time.After(policy.interval):
+		case c := <-v.closing:
+			v.closing <- c
+			return
+		}
+	}
+}
+
+// Probe each active worker, failover the unhealthy ones.
+func (v *ShellBoss) checkLiveness(ctx ol.Context, policy *livenessPolicy) {
+	var workers []*SrsWorker
+	v.lock.Lock()
+	for i := range v.actives {
+		if w := v.active(i); w != nil && !w.unhealthy {
+			workers = append(workers, w)
+		}
+	}
+	v.lock.Unlock()
+
+	for _, w := range workers {
+		// the worker maybe closed when process terminated.
+		w.lock.Lock()
+		cmd, port := w.cmd, w.api
+		w.lock.Unlock()
+		if cmd == nil {
+			continue
+		}
+
+		err := policy.probe(port)
+
+		v.lock.Lock()
+		if err == nil {
+			w.failures = 0
+		} else {
+			w.failures++
+		}
+		failures := w.failures
+		unhealthy := failures >= policy.failures && w.state == SrsStateActive
+		w.unhealthy = unhealthy
+		v.lock.Unlock()
+
+		if unhealthy {
+			ol.E(ctx, fmt.Sprintf("alert: worker %v unhealthy, failures=%v, err is %v", w, failures, err))
+			v.failover(ctx, w)
+		} else if err != nil {
+			ol.W(ctx, fmt.Sprintf("probe worker %v failed, failures=%v, err is %v", w.name, failures, err))
+		}
+	}
+}
+
+// Switch the lbs to the other healthy workers, then kill the unhealthy one,
+// the supervisor restart it as crashed.
+func (v *ShellBoss) failover(ctx ol.Context, dead *SrsWorker) {
+	// never switch lbs when upgrade or restart.
+	v.upgradeLock.Lock()
+	var healthy *SrsWorker
+	v.lock.Lock()
+	for i := range v.actives {
+		if w := v.active(i); w != nil && !w.unhealthy {
+			healthy = w
+			break
+		}
+	}
+	v.lock.Unlock()
+
+	if healthy != nil {
+		if err := v.updateProxyApi(ctx, healthy); err != nil {
+			ol.E(ctx, fmt.Sprintf("failover %v update proxy api failed, err is %v", dead.name, err))
+		}
+	}
+	v.upgradeLock.Unlock()
+
+	// the state is updated by terminated under shell lock.
+	v.lock.Lock()
+	pid, state := dead.pid, dead.state
+	v.lock.Unlock()
+
+	// the process state is set by wait before terminated, ignore the terminated one.
+	select {
+	case <-dead.terminated:
+		return
+	default:
+	}
+
+	dead.lock.Lock()
+	if dead.cmd != nil {
+		r0 := dead.cmd.Process.Kill()
+		ol.T(ctx, fmt.Sprintf("failover kill %v, pid=%v, state=%v, r0=%v", dead.name, pid, state, r0))
+	}
+	dead.lock.Unlock()
+}
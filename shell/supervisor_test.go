@@ -0,0 +1,1461 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx/kernel"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// When set, the test binary is a fake srs, serve api at the port of config.
+const fakeSrsEnv = "SHELL_TEST_FAKE_SRS"
+
+// When the file exists, the fake srs crash when start.
+const fakeSrsCrashEnv = "SHELL_TEST_FAKE_SRS_CRASH"
+
+// The version of fake srs binary, the api always return 3.0.1
+const fakeSrsVersionEnv = "SHELL_TEST_FAKE_SRS_VERSION"
+
+// The delay in ms for fake srs to serve api.
+const fakeSrsDelayEnv = "SHELL_TEST_FAKE_SRS_DELAY"
+
+// When set, the fake srs ignore SIGTERM.
+const fakeSrsTrapEnv = "SHELL_TEST_FAKE_SRS_TRAP"
+
+// When set, the test binary with -a is a fake lb, serve api at -a and accept at -l.
+const fakeLbEnv = "SHELL_TEST_FAKE_LB"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeLbEnv) == "1" && len(os.Args) > 3 && os.Args[3] == "-a" {
+		os.Exit(fakeLb(os.Args[1:]))
+	}
+	if os.Getenv(fakeSrsEnv) == "1" {
+		os.Exit(fakeSrs(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// The fake srs, args is "-c conf" or "-t -c conf".
+func fakeSrs(args []string) int {
+	var conf string
+	for i, arg := range args {
+		if arg == "-t" {
+			return 0
+		}
+		if arg == "-v" {
+			fmt.Fprintln(os.Stderr, os.Getenv(fakeSrsVersionEnv))
+			return 0
+		}
+		if arg == "-c" && i+1 < len(args) {
+			conf = args[i+1]
+		}
+	}
+
+	if f := os.Getenv(fakeSrsCrashEnv); f != "" {
+		if _, err := os.Stat(f); err == nil {
+			return 1
+		}
+	}
+
+	// drain util SIGTERM.
+	if drainSignal != nil {
+		signal.Ignore(drainSignal)
+	}
+	if os.Getenv(fakeSrsTrapEnv) == "1" {
+		signal.Ignore(syscall.SIGTERM)
+	}
+
+	var api string
+	if f, err := os.Open(conf); err != nil {
+		return 2
+	} else {
+		defer f.Close()
+		for s := bufio.NewScanner(f); s.Scan(); {
+			if vs := strings.Fields(s.Text()); len(vs) == 2 && vs[0] == "http_api" {
+				api = strings.TrimSuffix(vs[1], ";")
+			}
+		}
+	}
+
+	fmt.Println("fake srs start, conf is", conf)
+	fmt.Fprintln(os.Stderr, "fake srs api at", api)
+
+	if delay, _ := strconv.Atoi(os.Getenv(fakeSrsDelayEnv)); delay > 0 {
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+	}
+
+	// the api is unavailable when hang.
+	var hang bool
+	var lock sync.Mutex
+	http.HandleFunc("/api/v1/versions", func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if hang {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, `{"code":0,"data":{"major":3,"minor":0,"revision":1,"signature":"fake"}}`)
+	})
+	http.HandleFunc("/hang", func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		hang = true
+	})
+	http.HandleFunc("/exit", func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(r.URL.Query().Get("code"))
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			os.Exit(code)
+		}()
+	})
+	if err := http.ListenAndServe("127.0.0.1:"+api, nil); err != nil {
+		return 3
+	}
+	return 0
+}
+
+// The fake lb, args is "-c conf -a api -l listen", response the pid and whether
+// the listener is inherited for each connection.
+func fakeLb(args []string) int {
+	var api, listen string
+	for i := 0; i+1 < len(args); i += 2 {
+		if args[i] == "-a" {
+			api = args[i+1]
+		} else if args[i] == "-l" {
+			listen = args[i+1]
+		}
+	}
+
+	l, err := kernel.SdListen(listen)
+	if err != nil {
+		return 2
+	}
+	go func() {
+		inherited := os.Getenv(kernel.ListenFdsEnv) != ""
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(c, "%v %v", os.Getpid(), inherited)
+			c.Close()
+		}
+	}()
+
+	al, err := kernel.SdListen(api)
+	if err != nil {
+		return 3
+	}
+	http.HandleFunc("/api/v1/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"code":0}`)
+	})
+	http.HandleFunc("/exit", func(w http.ResponseWriter, r *http.Request) {
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			os.Exit(0)
+		}()
+	})
+	http.Serve(al, nil)
+	return 0
+}
+
+// The stub api for rtmplb, httplb and apilb, record the proxy requests.
+type stubLbApi struct {
+	server  *httptest.Server
+	port    int
+	lock    sync.Mutex
+	queries []url.Values
+	// the proxy request with this key fail, for times or forever when negative.
+	fail  string
+	times int
+}
+
+func newStubLbApi() *stubLbApi {
+	v := &stubLbApi{}
+	v.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/proxy" {
+			v.lock.Lock()
+			defer v.lock.Unlock()
+
+			if q := r.URL.Query(); q.Get(v.fail) != "" && v.times != 0 {
+				v.times--
+				fmt.Fprintf(w, `{"code":1}`)
+				return
+			} else {
+				v.queries = append(v.queries, q)
+			}
+		}
+		fmt.Fprintf(w, `{"code":0}`)
+	}))
+	u, _ := url.Parse(v.server.URL)
+	_, port, _ := splitHostPort(u.Host)
+	v.port = port
+	return v
+}
+
+func splitHostPort(hostport string) (string, int, error) {
+	i := strings.LastIndex(hostport, ":")
+	port, err := strconv.Atoi(hostport[i+1:])
+	return hostport[:i], port, err
+}
+
+// The last proxy port for key, for example, rtmp.
+func (v *stubLbApi) last(key string) string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for i := len(v.queries) - 1; i >= 0; i-- {
+		if p := v.queries[i].Get(key); p != "" {
+			return p
+		}
+	}
+	return ""
+}
+
+func (v *stubLbApi) failOn(key string, times int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.fail, v.times = key, times
+}
+
+func (v *stubLbApi) Close() {
+	v.server.Close()
+}
+
+// Create shell with fake srs worker in dir.
+func newTestShell(t *testing.T, dir string, lb *stubLbApi) *ShellBoss {
+	template := path.Join(dir, "srs.conf")
+	if err := ioutil.WriteFile(template, []byte("listen ${rtmp};\nhttp_api ${api};\nhttp_server ${http};\n"), 0644); err != nil {
+		t.Fatal("write template failed, err is", err)
+	}
+
+	conf := &ShellConfig{}
+	conf.Rtmplb.Api, conf.Httplb.Api, conf.Apilb.Api = lb.port, lb.port, lb.port
+
+	r := &conf.Worker
+	r.Enabled, r.Provider, r.Binary, r.Config = true, "srs", os.Args[0], template
+	r.WorkDir = path.Join(dir, "workers")
+	r.Ports.Start, r.Ports.Stop = 17001, 17100
+	r.Restart.Backoff, r.Restart.MaxBackoff = 10, 40
+	r.Template.Dir, r.Template.Env = "{workDir}", []string{"SRS_NAME={name}"}
+
+	s := NewSrsServiceConfig()
+	s.Variables.RtmpPort, s.Variables.ApiPort, s.Variables.HttpPort = "${rtmp}", "${api}", "${http}"
+	s.Variables.WorkDir = "${cwd}"
+	r.Service = s
+
+	os.Setenv(fakeSrsEnv, "1")
+	os.Setenv(fakeSrsCrashEnv, path.Join(dir, "crash"))
+	os.Setenv(fakeSrsVersionEnv, "3.0.1")
+	os.Setenv(fakeSrsDelayEnv, "0")
+	os.Setenv(fakeSrsTrapEnv, "0")
+
+	shell, err := NewShellBoss(conf)
+	if err != nil {
+		t.Fatal("create shell failed, err is", err)
+	}
+	return shell
+}
+
+// Wait util cond is true, fail when timeout.
+func waitFor(t *testing.T, msg string, cond func() bool) {
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("timeout for", msg)
+}
+
+func TestShellBoss_RestartWorker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	defer shell.Close()
+
+	if err = shell.ExecBuddies(ctx); err != nil {
+		t.Fatal("exec buddies failed, err is", err)
+	}
+	go shell.Cycle(ctx)
+
+	dead := shell.actives[0]
+	if lb.last("rtmp") != strconv.Itoa(dead.rtmp) {
+		t.Errorf("invalid rtmp=%v, worker=%v", lb.last("rtmp"), dead.rtmp)
+	}
+	http.Get(fmt.Sprintf("http://127.0.0.1:%v/exit?code=1", dead.api))
+
+	var worker *SrsWorker
+	waitFor(t, "restart worker", func() bool {
+		shell.lock.Lock()
+		defer shell.lock.Unlock()
+		worker = shell.actives[0]
+		return worker != dead && len(shell.workers) == 1
+	})
+
+	if worker.state != SrsStateActive || worker.restarts != 1 || worker.name != dead.name {
+		t.Errorf("invalid worker %v", worker)
+	}
+	if !strings.Contains(dead.lastExit, "exit status 1") {
+		t.Errorf("invalid exit %v", dead.lastExit)
+	}
+	if lb.last("rtmp") != strconv.Itoa(worker.rtmp) || lb.last("http") != strconv.Itoa(worker.http) {
+		t.Errorf("invalid rtmp=%v, http=%v, worker %v", lb.last("rtmp"), lb.last("http"), worker)
+	}
+	// the ports of dead worker is freed.
+	if n := shell.ports.Allocated(); n != 8 {
+		t.Errorf("invalid allocated=%v", n)
+	}
+}
+
+func TestShellBoss_Instances(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	shell.conf.Worker.Instances = 2
+	defer shell.Close()
+
+	if err = shell.ExecBuddies(ctx); err != nil {
+		t.Fatal("exec buddies failed, err is", err)
+	}
+	go shell.Cycle(ctx)
+
+	// the lbs proxy to all instances, the apilb to the first one.
+	w0, dead := shell.actives[0], shell.actives[1]
+	if r := fmt.Sprintf("%v,%v", w0.rtmp, dead.rtmp); lb.last("rtmp") != r {
+		t.Errorf("invalid rtmp=%v, expect %v", lb.last("rtmp"), r)
+	}
+	if lb.last("port") != strconv.Itoa(w0.api) || shell.ports.Allocated() != 16 {
+		t.Errorf("invalid api=%v, allocated=%v", lb.last("port"), shell.ports.Allocated())
+	}
+	if ps := shell.Processes().Processes; len(ps) != 2 || ps[0].Instance != 0 || ps[1].Instance != 1 || ps[1].Name != "srs.1" {
+		t.Errorf("invalid processes %v", ps)
+	}
+
+	// restart the second instance, the first one is not disturbed.
+	http.Get(fmt.Sprintf("http://127.0.0.1:%v/exit?code=1", dead.api))
+
+	var worker *SrsWorker
+	waitFor(t, "restart instance", func() bool {
+		shell.lock.Lock()
+		defer shell.lock.Unlock()
+		worker = shell.actives[1]
+		return worker != dead && len(shell.workers) == 2
+	})
+
+	if worker.instance != 1 || worker.name != dead.name || worker.restarts != 1 {
+		t.Errorf("invalid worker %v", worker)
+	}
+	if shell.actives[0] != w0 || w0.state != SrsStateActive || w0.restarts != 0 {
+		t.Errorf("invalid first instance %v", w0)
+	}
+	if r := fmt.Sprintf("%v,%v", w0.rtmp, worker.rtmp); lb.last("rtmp") != r {
+		t.Errorf("invalid rtmp=%v, expect %v", lb.last("rtmp"), r)
+	}
+	if r := fmt.Sprintf("%v,%v", w0.http, worker.http); lb.last("http") != r {
+		t.Errorf("invalid http=%v, expect %v", lb.last("http"), r)
+	}
+	if r := shell.Processes().Lbs; !r.Consistent || !equalInts(r.Rtmplb.Pids, []int{w0.pid, worker.pid}) {
+		t.Errorf("invalid lbs %v", r)
+	}
+	if lb.last("port") != strconv.Itoa(w0.api) || shell.ports.Allocated() != 16 {
+		t.Errorf("invalid api=%v, allocated=%v", lb.last("port"), shell.ports.Allocated())
+	}
+}
+
+func TestShellBoss_Liveness(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	shell.conf.Worker.Instances = 2
+	shell.conf.Worker.Liveness.Interval, shell.conf.Worker.Liveness.Failures = 50, 2
+	shell.liveness = NewLivenessPolicy(shell.conf)
+	defer shell.Close()
+
+	if err = shell.ExecBuddies(ctx); err != nil {
+		t.Fatal("exec buddies failed, err is", err)
+	}
+	go shell.Cycle(ctx)
+	go shell.watchLiveness(ctx)
+
+	// the healthy workers never failover.
+	w0, dead := shell.actives[0], shell.actives[1]
+	time.Sleep(200 * time.Millisecond)
+	shell.lock.Lock()
+	if shell.actives[1] != dead || dead.failures != 0 {
+		t.Errorf("invalid worker %v, failures=%v", dead, dead.failures)
+	}
+	shell.lock.Unlock()
+
+	// the lbs switch to the healthy one, and the unhealthy one is restarted.
+	http.Get(fmt.Sprintf("http://127.0.0.1:%v/hang", dead.api))
+	waitFor(t, "failover", func() bool {
+		return lb.last("rtmp") == strconv.Itoa(w0.rtmp)
+	})
+
+	var worker *SrsWorker
+	waitFor(t, "restart unhealthy", func() bool {
+		shell.lock.Lock()
+		defer shell.lock.Unlock()
+		worker = shell.actives[1]
+		return worker != dead && len(shell.workers) == 2
+	})
+
+	shell.lock.Lock()
+	defer shell.lock.Unlock()
+	if !dead.unhealthy || worker.unhealthy || worker.restarts != 1 || worker.name != dead.name {
+		t.Errorf("invalid worker %v, dead %v", worker, dead)
+	}
+	if r := fmt.Sprintf("%v,%v", w0.rtmp, worker.rtmp); lb.last("rtmp") != r {
+		t.Errorf("invalid rtmp=%v, expect %v", lb.last("rtmp"), r)
+	}
+	if shell.actives[0] != w0 || w0.unhealthy {
+		t.Errorf("invalid first instance %v", w0)
+	}
+}
+
+func TestShellBoss_CrashLoop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	shell.restart.budget = 2
+	defer shell.Close()
+
+	if err = shell.ExecBuddies(ctx); err != nil {
+		t.Fatal("exec buddies failed, err is", err)
+	}
+	go shell.Cycle(ctx)
+
+	// all new workers crash when start.
+	if err = ioutil.WriteFile(path.Join(dir, "crash"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dead := shell.actives[0]
+	http.Get(fmt.Sprintf("http://127.0.0.1:%v/exit?code=1", dead.api))
+
+	waitFor(t, "worker failed", func() bool {
+		shell.lock.Lock()
+		defer shell.lock.Unlock()
+		return dead.state == SrsStateFailed
+	})
+
+	if n := len(dead.crashes); n != 3 {
+		t.Errorf("invalid crashes=%v", n)
+	}
+	waitFor(t, "ports freed", func() bool {
+		return shell.ports.Allocated() == 0
+	})
+}
+
+func TestShellBoss_Processes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	shell.restart.budget = 1
+	defer shell.Close()
+
+	if err = shell.ExecBuddies(ctx); err != nil {
+		t.Fatal("exec buddies failed, err is", err)
+	}
+	go shell.Cycle(ctx)
+
+	// the json for api.
+	processes := func() (r struct {
+		Processes []map[string]interface{} `json:"processes"`
+		Lbs       map[string]interface{}   `json:"lbs"`
+	}) {
+		if b, err := json.Marshal(shell.Processes()); err != nil {
+			t.Fatal("marshal failed, err is", err)
+		} else if err = json.Unmarshal(b, &r); err != nil {
+			t.Fatal("unmarshal failed, err is", err)
+		}
+		return
+	}
+
+	worker := shell.actives[0]
+	ps := processes()
+	if len(ps.Processes) != 1 {
+		t.Fatalf("invalid processes %v", ps.Processes)
+	}
+	p := ps.Processes[0]
+	for _, k := range []string{"name", "instance", "template", "pid", "state", "ports", "start_time", "restarts", "last_exit"} {
+		if _, ok := p[k]; !ok {
+			t.Errorf("no field %v in %v", k, p)
+		}
+	}
+	if p["state"] != "healthy" || p["pid"] != float64(worker.pid) || p["name"] != "srs" {
+		t.Errorf("invalid process %v", p)
+	}
+	if ports, ok := p["ports"].(map[string]interface{}); !ok || ports["rtmp"] != float64(worker.rtmp) {
+		t.Errorf("invalid ports %v", p["ports"])
+	}
+	for k, port := range map[string]int{"rtmplb": worker.rtmp, "httplb": worker.http, "apilb": worker.api} {
+		r, ok := ps.Lbs[k].(map[string]interface{})
+		if !ok || r["ok"] != true {
+			t.Errorf("invalid %v %v", k, ps.Lbs[k])
+		} else if ports, ok := r["ports"].([]interface{}); !ok || len(ports) != 1 || ports[0] != float64(port) {
+			t.Errorf("invalid %v ports %v", k, r["ports"])
+		}
+	}
+	if ps.Lbs["consistent"] != true {
+		t.Errorf("invalid lbs %v", ps.Lbs)
+	}
+
+	// crash and exceed the budget, the worker failed.
+	if err = ioutil.WriteFile(path.Join(dir, "crash"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	http.Get(fmt.Sprintf("http://127.0.0.1:%v/exit?code=1", worker.api))
+
+	waitFor(t, "worker failed", func() bool {
+		ps = processes()
+		return len(ps.Processes) == 1 && ps.Processes[0]["state"] == "failed"
+	})
+	if p = ps.Processes[0]; !strings.Contains(p["last_exit"].(string), "exit status 1") {
+		t.Errorf("invalid exit %v", p)
+	}
+}
+
+func TestShellBoss_Upgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	shell.upgrade.drain = 50 * time.Millisecond
+	defer shell.Close()
+
+	if err = shell.ExecBuddies(ctx); err != nil {
+		t.Fatal("exec buddies failed, err is", err)
+	}
+	go shell.Cycle(ctx)
+
+	// ignore when version not changed.
+	old := shell.actives[0]
+	if err = shell.Upgrade(ctx); err != nil || shell.actives[0] != old {
+		t.Fatal("upgrade failed, err is", err)
+	}
+
+	os.Setenv(fakeSrsVersionEnv, "3.0.2")
+	if err = shell.Upgrade(ctx); err != nil {
+		t.Fatal("upgrade failed, err is", err)
+	}
+
+	worker := shell.actives[0]
+	if worker == old || worker.state != SrsStateActive {
+		t.Errorf("invalid worker %v", worker)
+	}
+	if lb.last("rtmp") != strconv.Itoa(worker.rtmp) || lb.last("http") != strconv.Itoa(worker.http) {
+		t.Errorf("invalid rtmp=%v, http=%v, worker %v", lb.last("rtmp"), lb.last("http"), worker)
+	}
+
+	// the old worker is stopped after drain, and its ports are freed.
+	waitFor(t, "old worker stopped", func() bool {
+		return len(shell.Processes().Processes) == 1 && shell.ports.Allocated() == 8
+	})
+	if !strings.Contains(old.lastExit, "terminated") {
+		t.Errorf("invalid exit %v", old.lastExit)
+	}
+}
+
+func TestShellBoss_UpgradeRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	shell.upgrade.drain = 50 * time.Millisecond
+	defer shell.Close()
+
+	if err = shell.ExecBuddies(ctx); err != nil {
+		t.Fatal("exec buddies failed, err is", err)
+	}
+	go shell.Cycle(ctx)
+
+	os.Setenv(fakeSrsVersionEnv, "3.0.2")
+	old := shell.actives[0]
+
+	// the rollback should keep the old worker active.
+	check := func(msg string) {
+		if shell.actives[0] != old || old.state != SrsStateActive {
+			t.Errorf("%v: invalid active %v", msg, shell.actives[0])
+		}
+		if lb.last("rtmp") != strconv.Itoa(old.rtmp) {
+			t.Errorf("%v: invalid rtmp=%v, old %v", msg, lb.last("rtmp"), old.rtmp)
+		}
+		waitFor(t, msg+" cleanup", func() bool {
+			return len(shell.Processes().Processes) == 1 && shell.ports.Allocated() == 8
+		})
+	}
+
+	// the new worker fail for api.
+	crash := path.Join(dir, "crash")
+	if err = ioutil.WriteFile(crash, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = shell.Upgrade(ctx); err == nil {
+		t.Error("should fail for new worker crash")
+	}
+	check("crash")
+
+	// the rtmplb switched, but httplb failed.
+	if err = os.Remove(crash); err != nil {
+		t.Fatal(err)
+	}
+	lb.failOn("http", -1)
+	if err = shell.Upgrade(ctx); err == nil {
+		t.Error("should fail for httplb")
+	}
+	check("httplb")
+
+	// upgrade again is ok.
+	lb.failOn("", 0)
+	if err = shell.Upgrade(ctx); err != nil {
+		t.Error("upgrade failed, err is", err)
+	}
+	if worker := shell.actives[0]; worker == old || lb.last("rtmp") != strconv.Itoa(worker.rtmp) {
+		t.Errorf("invalid worker %v", worker)
+	}
+}
+
+func TestShellBoss_ReadinessDelay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	shell.readiness.interval = 20 * time.Millisecond
+	defer shell.Close()
+
+	// switch lbs to worker util api ready.
+	os.Setenv(fakeSrsDelayEnv, "300")
+	starttime := time.Now()
+	if err = shell.ExecBuddies(ctx); err != nil {
+		t.Fatal("exec buddies failed, err is", err)
+	}
+
+	if d := time.Now().Sub(starttime); d < 300*time.Millisecond {
+		t.Errorf("invalid ready in %v", d)
+	}
+	if worker := shell.actives[0]; lb.last("rtmp") != strconv.Itoa(worker.rtmp) {
+		t.Errorf("invalid rtmp=%v, worker %v", lb.last("rtmp"), worker)
+	}
+}
+
+func TestShellBoss_ReadinessNever(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	shell.readiness.interval = 20 * time.Millisecond
+	shell.readiness.deadline = 200 * time.Millisecond
+	shell.restart.budget = 2
+	defer shell.Close()
+
+	// never switch lbs to worker not ready.
+	os.Setenv(fakeSrsDelayEnv, "3600000")
+	if err = shell.ExecBuddies(ctx); err == nil {
+		t.Fatal("should fail for not ready")
+	}
+	if r := lb.last("rtmp"); r != "" {
+		t.Errorf("invalid rtmp=%v", r)
+	}
+	if n := shell.ports.Allocated(); n != 0 {
+		t.Errorf("invalid allocated=%v", n)
+	}
+
+	os.Setenv(fakeSrsDelayEnv, "0")
+	if err = shell.ExecBuddies(ctx); err != nil {
+		t.Fatal("exec buddies failed, err is", err)
+	}
+	go shell.Cycle(ctx)
+
+	// the restarted worker never ready, retry util exceed budget.
+	old := shell.actives[0]
+	os.Setenv(fakeSrsDelayEnv, "3600000")
+	http.Get(fmt.Sprintf("http://127.0.0.1:%v/exit?code=1", old.api))
+
+	waitFor(t, "worker failed", func() bool {
+		shell.lock.Lock()
+		defer shell.lock.Unlock()
+		return old.state == SrsStateFailed
+	})
+	if r := lb.last("rtmp"); r != strconv.Itoa(old.rtmp) {
+		t.Errorf("invalid rtmp=%v, old=%v", r, old.rtmp)
+	}
+	waitFor(t, "ports freed", func() bool {
+		return shell.ports.Allocated() == 0
+	})
+}
+
+func TestShellBoss_SwitchLbs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	defer shell.Close()
+
+	w1 := &SrsWorker{pid: 101, rtmp: 19351, http: 18081, api: 19851}
+	w2 := &SrsWorker{pid: 102, rtmp: 19352, http: 18082, api: 19852}
+
+	// the lbs should proxy to worker.
+	check := func(msg string, w *SrsWorker, consistent bool) {
+		if lb.last("rtmp") != strconv.Itoa(w.rtmp) || lb.last("http") != strconv.Itoa(w.http) || lb.last("port") != strconv.Itoa(w.api) {
+			t.Errorf("%v: invalid rtmp=%v, http=%v, api=%v, worker=%v", msg, lb.last("rtmp"), lb.last("http"), lb.last("port"), w.pid)
+		}
+		if r := shell.Processes().Lbs; !equalInts(r.Rtmplb.Pids, []int{w.pid}) || r.Consistent != consistent {
+			t.Errorf("%v: invalid lbs %v", msg, r)
+		}
+	}
+
+	// the first switch, the httplb failed, no previous port to rollback.
+	lb.failOn("http", -1)
+	if err = shell.updateProxyApi(ctx, w1); err == nil {
+		t.Error("should fail for httplb")
+	}
+	if r := shell.Processes().Lbs; r.Consistent || !equalInts(r.Rtmplb.Pids, []int{w1.pid}) || r.Httplb.Ok {
+		t.Errorf("should be inconsistent, lbs %v", r)
+	}
+
+	// resolved.
+	lb.failOn("", 0)
+	if err = shell.updateProxyApi(ctx, w1); err != nil {
+		t.Error("switch failed, err is", err)
+	}
+	check("ok", w1, true)
+
+	// the first lb failed, nothing switched.
+	lb.failOn("rtmp", -1)
+	if err = shell.updateProxyApi(ctx, w2); err == nil {
+		t.Error("should fail for rtmplb")
+	}
+	check("rtmplb", w1, true)
+	if r := shell.Processes().Lbs.Rtmplb; r.Ok || r.Error == "" {
+		t.Errorf("invalid rtmplb %v", r)
+	}
+
+	// the second lb failed, rollback the first one.
+	lb.failOn("http", -1)
+	if err = shell.updateProxyApi(ctx, w2); err == nil {
+		t.Error("should fail for httplb")
+	}
+	check("httplb", w1, true)
+
+	// the last lb failed once, rollback and retry ok.
+	lb.failOn("port", 1)
+	if err = shell.updateProxyApi(ctx, w2); err != nil {
+		t.Error("switch failed, err is", err)
+	}
+	check("retry", w2, true)
+}
+
+func TestShellBoss_PortsUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	defer shell.Close()
+
+	if err = shell.ExecBuddies(ctx); err != nil {
+		t.Fatal("exec buddies failed, err is", err)
+	}
+	go shell.Cycle(ctx)
+
+	// all ports owned by worker.
+	check := func(msg string, worker *SrsWorker) {
+		r := shell.PortsUsage()
+		if r.Stats.Allocated != 8 || len(r.Ports) != 8 {
+			t.Errorf("%v: invalid ports %v", msg, r.Stats)
+		}
+		for _, p := range r.Ports {
+			if p.Owner != fmt.Sprintf("srs/%v", worker.pid) || p.Orphaned {
+				t.Errorf("%v: invalid port %v", msg, *p)
+			}
+		}
+	}
+
+	dead := shell.actives[0]
+	check("start", dead)
+
+	// the ports of dead worker freed after restart.
+	http.Get(fmt.Sprintf("http://127.0.0.1:%v/exit?code=1", dead.api))
+	waitFor(t, "restart worker", func() bool {
+		shell.lock.Lock()
+		defer shell.lock.Unlock()
+		return shell.actives[0] != dead && len(shell.workers) == 1
+	})
+	check("restart", shell.actives[0])
+
+	// the dead worker keep its ports util new one ok.
+	if r := shell.PortsUsage(); r.Stats.HighWater != 16 {
+		t.Errorf("invalid stats %v", r.Stats)
+	}
+
+	// the ports of worker not alive is orphaned.
+	ports, err := shell.ports.Alloc(2)
+	if err != nil {
+		t.Fatal("alloc failed, err is", err)
+	}
+	shell.ports.Own(dead.owner(), ports...)
+
+	var orphaned []int
+	for _, p := range shell.PortsUsage().Ports {
+		if p.Orphaned {
+			orphaned = append(orphaned, p.Port)
+		}
+	}
+	if len(orphaned) != 2 || orphaned[0] != ports[0] && orphaned[0] != ports[1] {
+		t.Errorf("invalid orphaned %v, expect %v", orphaned, ports)
+	}
+}
+
+func TestShellBoss_CheckPorts(t *testing.T) {
+	shell, err := NewShellBoss(&ShellConfig{})
+	if err != nil {
+		t.Fatal("create shell failed, err is", err)
+	}
+	shell.ports = NewPortPool(17201, 17220)
+	shell.ports.Probe = false
+
+	ctx := &kernel.Context{}
+	for _, c := range []struct {
+		alloc, level int
+	}{{10, 0}, {6, 1}, {2, 1}, {1, 2}, {1, 2}} {
+		if _, err = shell.ports.Alloc(c.alloc); err != nil {
+			t.Fatal("alloc failed, err is", err)
+		}
+		if level := shell.checkPorts(ctx, 0); level != c.level {
+			t.Errorf("invalid level %v for %v", level, shell.ports.Stats())
+		}
+	}
+
+	shell.ports.Free(17201)
+	shell.ports.Free(17202)
+	if level := shell.checkPorts(ctx, 2); level != 1 {
+		t.Errorf("invalid level %v", level)
+	}
+}
+
+func TestShellBoss_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	shell.conf.Worker.Enabled = false
+	defer shell.Close()
+
+	if err = shell.ExecBuddies(ctx); err != nil {
+		t.Fatal("exec buddies failed, err is", err)
+	}
+	go shell.Cycle(ctx)
+
+	// write the config to reload.
+	c := path.Join(dir, "shell.json")
+	reload := func(enabled bool, start, stop int) error {
+		conf := fmt.Sprintf(`{
+			"logger": {"tank": "console"},
+			"worker": {
+				"enabled": %v, "provider": "srs",
+				"binary": "%v", "config": "%v", "work_dir": "%v",
+				"ports": {"start": %v, "stop": %v},
+				"upgrade": {"drain": 50},
+				"template": {"env": ["SRS_NAME={name}"]},
+				"service": {
+					"variables": {"rtmp_port": "${rtmp}", "api_port": "${api}", "http_port": "${http}", "work_dir": "${cwd}"}
+				}
+			},
+			"api": "tcp://127.0.0.1:2040"
+		}`, enabled, os.Args[0], path.Join(dir, "srs.conf"), path.Join(dir, "workers"), start, stop)
+		if err := ioutil.WriteFile(c, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return shell.Reload(ctx, c)
+	}
+
+	// reject the invalid config.
+	if err = reload(true, 17100, 17001); err == nil {
+		t.Error("should fail for invalid ports")
+	}
+	if shell.conf.Worker.Enabled || len(shell.Processes().Processes) != 0 || shell.ports.Stats().Total != 100 {
+		t.Errorf("should not change, %v", shell.conf)
+	}
+
+	// start the new service, and grow the ports.
+	if err = reload(true, 17001, 17150); err != nil {
+		t.Fatal("reload failed, err is", err)
+	}
+	if ps := shell.Processes().Processes; len(ps) != 1 || ps[0].State != "healthy" {
+		t.Errorf("invalid processes %v", ps)
+	} else if worker := shell.actives[0]; lb.last("rtmp") != strconv.Itoa(worker.rtmp) {
+		t.Errorf("invalid rtmp=%v, worker %v", lb.last("rtmp"), worker)
+	}
+	if s := shell.ports.Stats(); s.Total != 150 || s.Allocated != 8 {
+		t.Errorf("invalid ports %v", s)
+	}
+	if shell.conf.Rtmplb.Api != lb.port {
+		t.Errorf("should keep lbs, %v", shell.conf)
+	}
+
+	// drain and stop the removed service.
+	if err = reload(false, 17001, 17150); err != nil {
+		t.Fatal("reload failed, err is", err)
+	}
+	waitFor(t, "worker stopped", func() bool {
+		return len(shell.Processes().Processes) == 0 && shell.ports.Allocated() == 0
+	})
+
+	// the history of reloads, the generation only increase when applied.
+	h := shell.ReloadHistory()
+	if h.Generation != 3 || len(h.Reloads) != 3 {
+		t.Fatalf("invalid history %+v", h)
+	}
+	if r := h.Reloads[0]; r.Ok || r.Generation != 1 || r.Error == "" || r.Scopes["config"] != ReloadFailed {
+		t.Errorf("invalid reload %+v", r)
+	}
+	if r := h.Reloads[1]; !r.Ok || r.Generation != 2 || r.Scopes["ports"] != ReloadApplied || r.Scopes["workers"] != ReloadApplied {
+		t.Errorf("invalid reload %+v", r)
+	}
+	if r := h.Reloads[2]; !r.Ok || r.Generation != 3 || r.Scopes["ports"] != "" || r.Scopes["workers"] != ReloadApplied {
+		t.Errorf("invalid reload %+v", r)
+	}
+}
+
+func TestShellBoss_Reconcile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	shell.upgrade.drain = 50 * time.Millisecond
+	defer shell.Close()
+
+	if err = shell.ExecBuddies(ctx); err != nil {
+		t.Fatal("exec buddies failed, err is", err)
+	}
+	go shell.Cycle(ctx)
+
+	// nothing to do when workers match the config.
+	shell.upgradeLock.Lock()
+	changed, err := shell.reconcile(ctx)
+	shell.upgradeLock.Unlock()
+	if err != nil || changed {
+		t.Fatalf("should not change, changed=%v, err is %v", changed, err)
+	}
+	old := shell.actives[0]
+
+	// the worker is stale when the config template changed.
+	c := shell.conf.Worker.Config
+	if err = ioutil.WriteFile(c, []byte("listen ${rtmp};\nhttp_api ${api};\nhttp_server ${http};\n# v2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	shell.lock.Lock()
+	shell.spec = workerSpec(shell.conf)
+	shell.reconciler = &reconcilePolicy{interval: 20 * time.Millisecond}
+	shell.lock.Unlock()
+	if ps := shell.Processes().Processes; len(ps) != 1 || !ps[0].Stale {
+		t.Errorf("invalid processes %v", ps)
+	}
+
+	// the loop replace the stale worker.
+	go shell.watchReconcile(ctx)
+	waitFor(t, "stale replaced", func() bool {
+		ps := shell.Processes().Processes
+		return len(ps) == 1 && ps[0].State == "healthy" && !ps[0].Stale && ps[0].Pid != old.pid
+	})
+	shell.lock.Lock()
+	worker := shell.actives[0]
+	shell.lock.Unlock()
+	if lb.last("rtmp") != strconv.Itoa(worker.rtmp) {
+		t.Errorf("invalid rtmp=%v, worker %v", lb.last("rtmp"), worker)
+	}
+
+	// scale to the instances in config.
+	shell.lock.Lock()
+	shell.conf.Worker.Instances = 2
+	shell.lock.Unlock()
+	waitFor(t, "scaled", func() bool {
+		ps := shell.Processes().Processes
+		return len(ps) == 2 && ps[0].State == "healthy" && ps[1].State == "healthy"
+	})
+
+	// stop the loop before close.
+	shell.lock.Lock()
+	shell.reconciler = &reconcilePolicy{disabled: true, interval: 20 * time.Millisecond}
+	shell.lock.Unlock()
+	shell.upgradeLock.Lock()
+	shell.upgradeLock.Unlock()
+}
+
+func TestShellBoss_Output(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	shell.conf.Worker.Output.Tank = "file"
+	defer shell.Close()
+
+	if err = shell.ExecBuddies(ctx); err != nil {
+		t.Fatal("exec buddies failed, err is", err)
+	}
+	go shell.Cycle(ctx)
+
+	// the lines of worker prefixed with name and port.
+	worker := shell.actives[0]
+	prefix := fmt.Sprintf("[worker(%v,pid=%v,rtmp=%v)]", worker.name, worker.pid, worker.rtmp)
+	f := path.Join(worker.workDir, defaultOutputFile)
+	waitFor(t, "worker output", func() bool {
+		b, _ := ioutil.ReadFile(f)
+		s := string(b)
+		return strings.Contains(s, prefix+"[stdout] fake srs start") && strings.Contains(s, prefix+"[stderr] fake srs api at")
+	})
+}
+
+func TestShellBoss_StopWorker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	shell.upgrade.stopTimeout = 300 * time.Millisecond
+	defer shell.Close()
+
+	if err = shell.ExecBuddies(ctx); err != nil {
+		t.Fatal("exec buddies failed, err is", err)
+	}
+	go shell.Cycle(ctx)
+
+	// the worker quit when SIGTERM.
+	worker := shell.actives[0]
+	shell.lock.Lock()
+	worker.state = SrsStateDeprecated
+	shell.lock.Unlock()
+
+	starttime := time.Now()
+	shell.stopWorker(ctx, worker)
+	if d := time.Now().Sub(starttime); d >= shell.upgrade.stopTimeout {
+		t.Errorf("invalid stop in %v", d)
+	}
+	if worker.stop != SrsStopClean || !strings.Contains(worker.lastExit, "terminated") {
+		t.Errorf("invalid stop=%v, exit=%v", worker.stop, worker.lastExit)
+	}
+	waitFor(t, "ports freed", func() bool {
+		return shell.ports.Allocated() == 0
+	})
+}
+
+func TestShellBoss_StopWorkerKill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	shell.upgrade.stopTimeout = 300 * time.Millisecond
+	defer shell.Close()
+
+	// the worker refuse to quit when SIGTERM.
+	os.Setenv(fakeSrsTrapEnv, "1")
+	if err = shell.ExecBuddies(ctx); err != nil {
+		t.Fatal("exec buddies failed, err is", err)
+	}
+	go shell.Cycle(ctx)
+
+	worker := shell.actives[0]
+	shell.lock.Lock()
+	worker.state = SrsStateDeprecated
+	shell.lock.Unlock()
+
+	starttime := time.Now()
+	shell.stopWorker(ctx, worker)
+	if d := time.Now().Sub(starttime); d < shell.upgrade.stopTimeout {
+		t.Errorf("invalid kill in %v", d)
+	}
+	if worker.stop != SrsStopKilled || !strings.Contains(worker.lastExit, "killed") {
+		t.Errorf("invalid stop=%v, exit=%v", worker.stop, worker.lastExit)
+	}
+	if n := shell.ports.Allocated(); n != 0 {
+		t.Errorf("invalid allocated=%v", n)
+	}
+
+	// the killed worker is cleanup by cycle.
+	waitFor(t, "worker removed", func() bool {
+		return len(shell.Processes().Processes) == 0
+	})
+}
+
+func TestRestartPolicy(t *testing.T) {
+	conf := &ShellConfig{}
+	conf.Worker.Restart.Backoff, conf.Worker.Restart.MaxBackoff = 100, 500
+	conf.Worker.Restart.Budget = 3
+
+	p := NewRestartPolicy(conf)
+	for i, d := range []int{100, 200, 400, 500, 500} {
+		if v := p.delay(i + 1); v != time.Duration(d)*time.Millisecond {
+			t.Errorf("invalid delay=%v for %v", v, i+1)
+		}
+	}
+
+	if p.exceed(3) || !p.exceed(4) {
+		t.Error("invalid budget")
+	}
+
+	now := time.Now()
+	crashes := []time.Time{now.Add(-2 * p.window), now.Add(-1 * time.Second), now}
+	if v := p.crashes(crashes, now); len(v) != 2 {
+		t.Errorf("invalid crashes=%v", v)
+	}
+}
+
+// Get a free port to listen at.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// Request the fake lb listen at port, return the pid and whether inherited.
+func fakeLbRequest(port int) string {
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", port))
+	if err != nil {
+		return ""
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	b, _ := ioutil.ReadAll(c)
+	return string(b)
+}
+
+func TestShellBoss_RespawnLb(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	defer shell.Close()
+
+	r := &shell.conf.Rtmplb
+	r.Enabled, r.Binary, r.Api, r.Rtmp = true, os.Args[0], freePort(t), freePort(t)
+	os.Setenv(fakeLbEnv, "1")
+	defer os.Unsetenv(fakeLbEnv)
+
+	if err = shell.ExecBuddies(ctx); err != nil {
+		t.Fatal("exec buddies failed, err is", err)
+	}
+	go shell.Cycle(ctx)
+
+	prev := fakeLbRequest(r.Rtmp)
+	if !strings.HasSuffix(prev, " true") {
+		t.Fatalf("invalid lb %v", prev)
+	}
+	shell.lock.Lock()
+	reg := shell.rtmplbReg
+	shell.lock.Unlock()
+
+	// the lb quit, the shell respawn it on the same listener.
+	http.Get(fmt.Sprintf("http://127.0.0.1:%v/exit", r.Api))
+
+	var pid string
+	waitFor(t, "respawn lb", func() bool {
+		pid = fakeLbRequest(r.Rtmp)
+		return pid != "" && pid != prev
+	})
+	if !strings.HasSuffix(pid, " true") {
+		t.Errorf("invalid lb %v", pid)
+	}
+
+	// the workers are restored to the respawned lb.
+	waitFor(t, "restore lb", func() bool {
+		shell.lock.Lock()
+		defer shell.lock.Unlock()
+		r := &shell.rtmplbReg
+		return r.Ok && r.Update.After(reg.Update) && fmt.Sprint(r.Ports) == fmt.Sprint(reg.Ports)
+	})
+}
+
+func TestShellBoss_ExecLbFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	defer shell.Close()
+
+	// the lb binary is missing, for example, a bad upgrade.
+	r := &shell.conf.Rtmplb
+	r.Enabled, r.Binary, r.Api, r.Rtmp = true, path.Join(dir, "rtmplb"), freePort(t), freePort(t)
+	if cmd, err := shell.execLb(ctx, "rtmplb"); err == nil || cmd != nil {
+		t.Errorf("should fail, cmd=%v", cmd)
+	}
+	if err = shell.ExecBuddies(ctx); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestShellBoss_PortRanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	defer shell.Close()
+
+	// the rtmp and http ports from ranges, never alloc them from the general pool.
+	r := &shell.conf.Worker.Ports
+	r.Ranges = map[string]*PortRangeConfig{"rtmp": {Start: 17091, Stop: 17095}, "http": {Start: 17096, Stop: 17100}}
+	for name, pr := range r.Ranges {
+		if err = shell.ports.ReserveRange(name, pr.Start, pr.Stop); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = shell.ExecBuddies(ctx); err != nil {
+		t.Fatal("exec buddies failed, err is", err)
+	}
+	go shell.Cycle(ctx)
+
+	worker := shell.actives[0]
+	if worker.rtmp < 17091 || worker.rtmp > 17095 || worker.http < 17096 || worker.http > 17100 {
+		t.Errorf("invalid worker %v", worker)
+	}
+	if n := shell.ports.Allocated(); n != 8 || len(worker.ports) != 8 {
+		t.Errorf("invalid allocated=%v, ports=%v", n, worker.ports)
+	}
+}
+
+func TestShellBoss_ReloadListens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lb := newStubLbApi()
+	defer lb.Close()
+
+	ctx := &kernel.Context{}
+	shell := newTestShell(t, dir, lb)
+	shell.conf.Worker.Enabled, shell.conf.Api = false, "tcp://127.0.0.1:2040"
+	defer shell.Close()
+
+	r := &shell.conf.Rtmplb
+	r.Enabled, r.Binary, r.Config, r.Api, r.Rtmp = true, os.Args[0], shell.conf.Worker.Config, freePort(t), freePort(t)
+	os.Setenv(fakeLbEnv, "1")
+	defer os.Unsetenv(fakeLbEnv)
+
+	if err = shell.ExecBuddies(ctx); err != nil {
+		t.Fatal("exec buddies failed, err is", err)
+	}
+	go shell.Cycle(ctx)
+
+	prev, api, rtmp := fakeLbRequest(r.Rtmp), r.Api, r.Rtmp
+	if !strings.HasSuffix(prev, " true") {
+		t.Fatalf("invalid lb %v", prev)
+	}
+
+	// change the listens of rtmplb, which is respawned on the new listens.
+	nApi, nRtmp := freePort(t), freePort(t)
+	c := path.Join(dir, "shell.json")
+	conf := fmt.Sprintf(`{
+		"logger": {"tank": "console"},
+		"rtmplb": {"enabled": true, "binary": "%v", "config": "%v", "api": %v, "rtmp": %v},
+		"httplb": {"api": %v}, "apilb": {"api": %v},
+		"worker": {"enabled": false, "ports": {"start": 17001, "stop": 17100}},
+		"api": "tcp://127.0.0.1:2040"
+	}`, os.Args[0], r.Config, nApi, nRtmp, lb.port, lb.port)
+	if err = ioutil.WriteFile(c, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = shell.Reload(ctx, c); err != nil {
+		t.Fatal("reload failed, err is", err)
+	}
+
+	h := shell.ReloadHistory()
+	if r := h.Reloads[0]; !r.Ok || r.Scopes["listens"] != ReloadApplied || r.Scopes["lbs"] != "" {
+		t.Errorf("invalid reload %+v", r)
+	}
+
+	var pid string
+	waitFor(t, "respawn lb", func() bool {
+		pid = fakeLbRequest(nRtmp)
+		return pid != "" && pid != prev
+	})
+	if !strings.HasSuffix(pid, " true") {
+		t.Errorf("invalid lb %v", pid)
+	}
+
+	// the previous listens are closed.
+	waitFor(t, "close listens", func() bool {
+		return fakeLbRequest(rtmp) == "" && fakeLbRequest(api) == ""
+	})
+}
@@ -0,0 +1,132 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+ The command template for worker, render the variables when start it.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+)
+
+// The variables of template, for example, {rtmpPort}.
+var templateVariable = regexp.MustCompile(`\{([a-zA-Z]+)\}`)
+
+// The variables supported by template.
+var templateVariables = []string{"rtmpPort", "httpPort", "apiPort", "workDir", "name", "config"}
+
+// The command template of worker, the binary, args, env and dir,
+// where the variables are replaced when start worker.
+type WorkerTemplate struct {
+	// The binary of worker, use the binary of worker when empty.
+	Binary string `json:"binary"`
+	// The args, default to "-c {config}".
+	Args []string `json:"args"`
+	// The env to append to shell env, for example, "SRS_NAME={name}".
+	Env []string `json:"env"`
+	// The dir to start worker, use the cwd of shell when empty.
+	Dir string `json:"dir"`
+}
+
+func (v *WorkerTemplate) String() string {
+	return fmt.Sprintf("binary=%v,args=%v,env=%v,dir=%v", v.Binary, v.Args, v.Env, v.Dir)
+}
+
+// The args of worker, the default when not specified.
+func (v *WorkerTemplate) args() []string {
+	if len(v.Args) == 0 {
+		return []string{"-c", "{config}"}
+	}
+	return v.Args
+}
+
+// Check the template, all variables must be known.
+func (v *WorkerTemplate) Check() (err error) {
+	vars := make(map[string]string)
+	for _, k := range templateVariables {
+		vars[k] = ""
+	}
+
+	for _, s := range append(append(v.args(), v.Env...), v.Dir) {
+		if _, err = renderTemplate(s, vars); err != nil {
+			return
+		}
+	}
+
+	if len(v.Binary) > 0 {
+		if _, err = exec.LookPath(v.Binary); err != nil {
+			return fmt.Errorf("Invalid template binary=%v, err is %v", v.Binary, err)
+		}
+	}
+	return
+}
+
+// Build the command to start worker, binary used when template binary is empty.
+func (v *WorkerTemplate) Command(binary string, vars map[string]string) (cmd *exec.Cmd, err error) {
+	if len(v.Binary) > 0 {
+		binary = v.Binary
+	}
+
+	var args []string
+	for _, s := range v.args() {
+		if s, err = renderTemplate(s, vars); err != nil {
+			return
+		}
+		args = append(args, s)
+	}
+	cmd = exec.Command(binary, args...)
+
+	if len(v.Env) > 0 {
+		cmd.Env = os.Environ()
+		for _, s := range v.Env {
+			if s, err = renderTemplate(s, vars); err != nil {
+				return
+			}
+			cmd.Env = append(cmd.Env, s)
+		}
+	}
+
+	if cmd.Dir, err = renderTemplate(v.Dir, vars); err != nil {
+		return
+	}
+	return
+}
+
+// Replace the variables in s, error when variable is unknown.
+func renderTemplate(s string, vars map[string]string) (r string, err error) {
+	r = templateVariable.ReplaceAllStringFunc(s, func(m string) string {
+		if value, ok := vars[m[1:len(m)-1]]; ok {
+			return value
+		}
+		if err == nil {
+			err = fmt.Errorf("Unknown variable %v in %v", m, s)
+		}
+		return m
+	})
+	return
+}